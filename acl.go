@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// repoACLFile lists a repository's admins inside the repository
+const repoACLFile = "git-acl.json"
+
+// RepoACL holds who may change a repository's restricted settings
+type RepoACL struct {
+	// Admins are identities as returned by lockOwner. Without any, those of the groups the
+	// repository is in apply, and without those every tailnet user is an admin.
+	Admins []string `json:"admins,omitempty"`
+}
+
+// loadRepoACL loads the access list of a repository, a missing file means no restrictions
+func loadRepoACL(repoPath string) (*RepoACL, error) {
+	acl := &RepoACL{}
+	data, err := os.ReadFile(filepath.Join(repoPath, repoACLFile))
+	if os.IsNotExist(err) {
+		return acl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, acl); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// saveRepoACL saves the access list of a repository
+func saveRepoACL(repoPath string, acl *RepoACL) error {
+	data, err := json.MarshalIndent(acl, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(repoPath, repoACLFile), data, 0644)
+}
+
+// parseRepoAdmins parses a comma or whitespace separated list of admins
+func parseRepoAdmins(s string) []string {
+	var admins []string
+	for _, admin := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if !slices.Contains(admins, admin) {
+			admins = append(admins, admin)
+		}
+	}
+	return admins
+}
+
+// isRepoAdmin reports whether a request may change a repository's restricted settings.
+// It requires tailnet access, and being listed if the repository has admins, or else the
+// groups it's in.
+func (s *Server) isRepoAdmin(r *http.Request, repoPath string) bool {
+	return s.isRepoAdminIn(r, repoPath, repoPath)
+}
+
+// isRepoAdminIn is isRepoAdmin for a repository in the groups of groupsPath, where a deleted
+// repository was before it went to the trash
+func (s *Server) isRepoAdminIn(r *http.Request, repoPath, groupsPath string) bool {
+	if !s.isTailnetRequest(r) {
+		return false
+	}
+	acl, err := loadRepoACL(repoPath)
+	if err != nil {
+		return false
+	}
+	admins := acl.Admins
+	if len(admins) == 0 {
+		admins = inheritedAdmins(s.reposPath, groupsPath)
+	}
+	return len(admins) == 0 || slices.Contains(admins, lockOwner(r))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// writeJSON writes a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+// handleAPICommitSearch returns commit search results as JSON
+func (s *Server) handleAPICommitSearch(w http.ResponseWriter, r *http.Request) {
+	q, err := s.commitQueryFromRequest(r)
+	if err != nil {
+		log.Printf("Error listing repos: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Error listing repositories"})
+		return
+	}
+
+	if q.Text == "" && q.Author == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "q or author is required"})
+		return
+	}
+
+	results := s.commits.Search(q)
+	if results == nil {
+		results = []CommitSearchResult{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"commits": results,
+		"count":   len(results),
+	})
+}
@@ -0,0 +1,997 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// backupCheckInterval is how often the backup schedule and config are checked
+	backupCheckInterval = time.Minute
+
+	// defaultBackupRetention is how many snapshots are kept when the config doesn't say
+	defaultBackupRetention = 7
+
+	// defaultBackupVerify is when snapshots are verified when the config doesn't say
+	defaultBackupVerify = "weekly"
+
+	// backupSnapshotPrefix is where snapshots are stored in the bucket, one directory each:
+	// snapshots/{id}/repos/{repo}/files/{file}, snapshots/{id}/server/{file} and
+	// snapshots/{id}/manifest.json, written last
+	backupSnapshotPrefix = "snapshots/"
+
+	// backupBundlePrefix is where git bundles are stored in the bucket, shared by the snapshots
+	// whose chains include them: bundles/{repo}/{snapshot id}.bundle
+	backupBundlePrefix = "bundles/"
+
+	// backupChainLength is how many bundles a chain grows to before a full bundle starts a
+	// new one, so restores don't have to apply too many
+	backupChainLength = 10
+
+	// backupLFSPrefix is where LFS objects are stored in the bucket, once for all snapshots:
+	// lfs/{repo}/{oid[0:2]}/{oid[2:4]}/{oid}
+	backupLFSPrefix = "lfs/"
+
+	// backupStatusFile keeps the last backup, restore and verifications in the data
+	// directory across restarts
+	backupStatusFile = "backup-status.json"
+
+	// backupIDFormat names snapshots by their start time, so they sort by age
+	backupIDFormat = "20060102T150405Z"
+)
+
+// ErrBackupRunning is returned when a backup, restore or verification is already in progress
+var ErrBackupRunning = errors.New("a backup, restore or verification is already running")
+
+// backupRepoFiles are the files of a repository saved next to its bundle, which only holds
+// refs and objects
+var backupRepoFiles = []string{
+	"HEAD", "config", "description", "git-daemon-export-ok", "git-pages.json", "git-mirror.json",
+	repoLFSConfigFile, repoACLFile, lfsLocksFile, repoTemplateFile, repoArchivedFile,
+}
+
+// backupServerFiles are the config files of the data directory saved with every snapshot.
+// The master key isn't, it has to be kept apart from the secrets it encrypts.
+var backupServerFiles = []string{"lfs-config.json", "backup-config.json", repoRedirectsFile}
+
+// backupGroupsPrefix starts the names of group settings among a snapshot's server files
+const backupGroupsPrefix = "groups/"
+
+// BackupConfig holds the S3-compatible bucket server backups are uploaded to
+type BackupConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Endpoint  string `json:"endpoint"`
+	Bucket    string `json:"bucket"`
+	Region    string `json:"region"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Schedule  string `json:"schedule"`            // See ParseSchedule
+	Retention int    `json:"retention,omitempty"` // Snapshots kept, defaultBackupRetention if 0
+	Verify    string `json:"verify,omitempty"`    // Schedule of snapshot verification, defaultBackupVerify if empty
+
+	// Encrypt turns on encryption of what's uploaded with the first of EncryptionKey, comma
+	// separated base64 AES-256 keys. The keys decrypt older snapshots even when it's off.
+	Encrypt       bool   `json:"encrypt,omitempty"`
+	EncryptionKey string `json:"encryption_key,omitempty"`
+
+	// AllowPlaintext reads snapshots made before encryption was turned on. Their manifests
+	// aren't authenticated, so it's off by default while encryption is on.
+	AllowPlaintext bool `json:"allow_plaintext,omitempty"`
+}
+
+// verifySchedule returns the schedule snapshots are verified on
+func (c *BackupConfig) verifySchedule() string {
+	if c.Verify == "" {
+		return defaultBackupVerify
+	}
+	return c.Verify
+}
+
+// BackupManifest lists the contents of a snapshot, a snapshot without one is incomplete
+type BackupManifest struct {
+	ID       string       `json:"id"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	Repos    []BackupRepo `json:"repos"`
+	Files    []string     `json:"files"`         // Server config files
+	Key      string       `json:"key,omitempty"` // ID of the encryption key, empty if not encrypted
+}
+
+// BackupRepo is a repository in a snapshot. Its objects are in a chain of bundles, a full one
+// followed by incremental ones holding what changed since the previous, applied in order.
+type BackupRepo struct {
+	Name       string            `json:"name"`
+	Refs       map[string]string `json:"refs"`              // Ref name -> object ID
+	Bundles    []string          `json:"bundles,omitempty"` // Keys of the chain, empty for repositories without refs
+	Bundle     string            `json:"bundle,omitempty"`  // Full bundle of snapshots made before chains
+	Size       int64             `json:"size"`              // Uploaded for this snapshot
+	Files      []string          `json:"files"`
+	LFSObjects []string          `json:"lfs_objects,omitempty"` // OIDs, stored under backupLFSPrefix
+}
+
+// BackupRun describes a backup, finished or in progress
+type BackupRun struct {
+	ID            string    `json:"id"`
+	Trigger       string    `json:"trigger"` // "schedule" or "manual"
+	Started       time.Time `json:"started"`
+	Finished      time.Time `json:"finished"`
+	Repos         int       `json:"repos"`
+	Unchanged     int       `json:"unchanged"`        // Repositories without new objects, no bundle was uploaded
+	Bytes         int64     `json:"bytes"`            // Uploaded, including new LFS objects
+	Pruned        int       `json:"pruned"`           // Old snapshots deleted by retention
+	PrunedLFS     int       `json:"pruned_lfs"`       // LFS objects no snapshot refers to anymore
+	PrunedBundles int       `json:"pruned_bundles"`   // Bundles no snapshot's chain includes anymore
+	Errors        []string  `json:"errors,omitempty"` // Repositories that failed, the snapshot has the others
+	Error         string    `json:"error,omitempty"`  // Why the whole backup failed
+}
+
+// Failed reports whether anything in the backup went wrong
+func (b *BackupRun) Failed() bool {
+	return b.Error != "" || len(b.Errors) > 0
+}
+
+// Duration returns how long the backup took
+func (b *BackupRun) Duration() time.Duration {
+	return b.Finished.Sub(b.Started).Round(100 * time.Millisecond)
+}
+
+// BackupSnapshot is a snapshot found in the backup bucket
+type BackupSnapshot struct {
+	ID       string    `json:"id"`
+	Started  time.Time `json:"started"`
+	Complete bool      `json:"complete"`
+	Bytes    int64     `json:"bytes"` // Uploaded by the snapshot, LFS objects aside
+	Repos    []string  `json:"repos"` // From the manifest
+}
+
+// BackupStatus is what the backups are doing and have done
+type BackupStatus struct {
+	Last       *BackupRun                     `json:"last"`
+	Current    *BackupRun                     `json:"current"`  // Backup in progress
+	Activity   string                         `json:"activity"` // "backup", "restore" or "verify" while running
+	Next       time.Time                      `json:"next"`
+	NextVerify time.Time                      `json:"next_verify"`
+	Restore    *RestoreReport                 `json:"restore"`
+	Verified   map[string]*BackupVerification `json:"verified"` // Snapshot ID -> last verification
+	Snapshots  []BackupSnapshot               `json:"snapshots"`
+	Listed     time.Time                      `json:"listed"`
+}
+
+// backupStatus is what backupStatusFile holds
+type backupStatus struct {
+	Last     *BackupRun                     `json:"last,omitempty"`
+	Restore  *RestoreReport                 `json:"restore,omitempty"`
+	Verified map[string]*BackupVerification `json:"verified,omitempty"`
+}
+
+// scheduledJob tracks when a job on a schedule runs next
+type scheduledJob struct {
+	spec string
+	next time.Time
+}
+
+// due reports whether the job is due at now. When its schedule changed, the next run is
+// worked out from now instead and an invalid schedule is returned as an error once.
+func (j *scheduledJob) due(spec string, now time.Time) (bool, error) {
+	changed := spec != j.spec
+	j.spec = spec
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		j.next = time.Time{}
+		if changed {
+			return false, err
+		}
+		return false, nil
+	}
+	if changed || j.next.IsZero() {
+		j.next = schedule.Next(now)
+		return false, nil
+	}
+	if now.Before(j.next) {
+		return false, nil
+	}
+	j.next = schedule.Next(now)
+	return true, nil
+}
+
+// Backups uploads snapshots of every repository to the backup bucket on schedule, restores
+// them and verifies they can be restored
+type Backups struct {
+	reposPath string
+	runMu     sync.Mutex // Held while backing up, restoring or verifying
+
+	mu        sync.Mutex
+	activity  string
+	last      *BackupRun
+	current   *BackupRun
+	restore   *RestoreReport
+	verified  map[string]*BackupVerification
+	snapshots []BackupSnapshot
+	listed    time.Time
+	backupJob scheduledJob
+	verifyJob scheduledJob
+}
+
+// NewBackups creates the backups of the repositories in reposPath, with the saved status
+func NewBackups(reposPath string) *Backups {
+	b := &Backups{reposPath: reposPath, verified: make(map[string]*BackupVerification)}
+	if data, err := os.ReadFile(b.statusPath()); err == nil {
+		var status backupStatus
+		if json.Unmarshal(data, &status) == nil {
+			b.last, b.restore = status.Last, status.Restore
+			for id, verification := range status.Verified {
+				b.verified[id] = verification
+			}
+		}
+	}
+	return b
+}
+
+// loadBackupConfig loads the backup configuration from file, with its secrets decrypted
+func loadBackupConfig(configPath string) (*BackupConfig, error) {
+	cfg, err := loadCachedConfig[BackupConfig](storageConfigs, configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.decryptSecrets(); err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
+	return cfg, nil
+}
+
+// decryptSecrets decrypts the keys of the config in place
+func (cfg *BackupConfig) decryptSecrets() error {
+	return decryptSecrets(&cfg.AccessKey, &cfg.SecretKey, &cfg.EncryptionKey)
+}
+
+// openBackupStorage opens the backup bucket, through the same interface as LFS storage,
+// encrypting what's stored in it if the config has a key
+func openBackupStorage(ctx context.Context, cfg *BackupConfig) (LFSStorage, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("backup bucket is required")
+	}
+	client, err := storageConfigs.S3Client(ctx, s3ClientConfig{
+		Endpoint:  cfg.Endpoint,
+		Region:    cfg.Region,
+		AccessKey: cfg.AccessKey,
+		SecretKey: cfg.SecretKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	storage := &S3LFSStorage{client: client, bucket: cfg.Bucket}
+	if cfg.EncryptionKey == "" && !cfg.Encrypt {
+		return storage, nil
+	}
+	cipher, err := newBackupCipher(cfg.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStorage{LFSStorage: storage, cipher: cipher, encrypt: cfg.Encrypt, plaintext: !cfg.Encrypt || cfg.AllowPlaintext}, nil
+}
+
+// config loads the backup config
+func (b *Backups) config() (*BackupConfig, error) {
+	return loadBackupConfig(filepath.Join(filepath.Dir(b.reposPath), "backup-config.json"))
+}
+
+// storage opens the backup bucket of the saved config
+func (b *Backups) storage(ctx context.Context) (LFSStorage, error) {
+	cfg, err := b.config()
+	if err != nil {
+		return nil, err
+	}
+	return openBackupStorage(ctx, cfg)
+}
+
+// statusPath is where the status is saved
+func (b *Backups) statusPath() string {
+	return filepath.Join(filepath.Dir(b.reposPath), backupStatusFile)
+}
+
+// saveStatus saves the last backup, restore and verifications
+func (b *Backups) saveStatus() {
+	b.mu.Lock()
+	data, err := json.MarshalIndent(backupStatus{Last: b.last, Restore: b.restore, Verified: b.verified}, "", "  ")
+	b.mu.Unlock()
+	if err == nil {
+		err = os.WriteFile(b.statusPath(), data, 0644)
+	}
+	if err != nil {
+		log.Printf("Backup: saving status: %v", err)
+	}
+}
+
+// Run backs up and verifies snapshots whenever the configured schedules are due, it never
+// returns. Changes to the config are picked up within interval.
+func (b *Backups) Run(interval time.Duration) {
+	for {
+		b.tick(time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// tick starts the jobs that are due, and works out when they run next
+func (b *Backups) tick(now time.Time) {
+	cfg, err := b.config()
+	if err != nil || !cfg.Enabled {
+		b.mu.Lock()
+		b.backupJob, b.verifyJob = scheduledJob{}, scheduledJob{}
+		b.mu.Unlock()
+		return
+	}
+
+	b.mu.Lock()
+	backupDue, backupErr := b.backupJob.due(cfg.Schedule, now)
+	verifyDue, verifyErr := b.verifyJob.due(cfg.verifySchedule(), now)
+	listed := b.listed
+	b.mu.Unlock()
+	for _, err := range []error{backupErr, verifyErr} {
+		if err != nil {
+			log.Printf("Backup: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	if listed.IsZero() {
+		if err := b.RefreshSnapshots(ctx); err != nil {
+			log.Printf("Backup: listing snapshots: %v", err)
+		}
+	}
+	if backupDue {
+		if _, err := b.Backup(ctx, "schedule"); err != nil {
+			log.Printf("Backup failed: %v", err)
+		}
+	}
+	if verifyDue {
+		if err := b.VerifyAll(ctx); err != nil {
+			log.Printf("Backup verification failed: %v", err)
+		}
+	}
+}
+
+// Status returns what the backups are doing and have done
+func (b *Backups) Status() BackupStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BackupStatus{
+		Last:       b.last,
+		Activity:   b.activity,
+		Next:       b.backupJob.next,
+		NextVerify: b.verifyJob.next,
+		Restore:    b.restore,
+		Verified:   make(map[string]*BackupVerification, len(b.verified)),
+		Snapshots:  b.snapshots,
+		Listed:     b.listed,
+	}
+	if b.current != nil {
+		run := *b.current
+		status.Current = &run
+	}
+	for id, verification := range b.verified {
+		status.Verified[id] = verification
+	}
+	return status
+}
+
+// Running reports whether a backup, restore or verification is in progress
+func (b *Backups) Running() bool {
+	if b.runMu.TryLock() {
+		b.runMu.Unlock()
+		return false
+	}
+	return true
+}
+
+// start claims the backups for an activity, it fails if another is in progress
+func (b *Backups) start(activity string) error {
+	if !b.runMu.TryLock() {
+		return ErrBackupRunning
+	}
+	b.mu.Lock()
+	b.activity = activity
+	b.mu.Unlock()
+	return nil
+}
+
+// finish releases the backups after an activity
+func (b *Backups) finish() {
+	b.mu.Lock()
+	b.activity = ""
+	b.mu.Unlock()
+	b.runMu.Unlock()
+}
+
+// Backup uploads a snapshot of every repository and the server configs, then deletes
+// snapshots beyond the retention. A repository failing doesn't stop the others.
+func (b *Backups) Backup(ctx context.Context, trigger string) (*BackupRun, error) {
+	if err := b.start("backup"); err != nil {
+		return nil, err
+	}
+	defer b.finish()
+
+	started := time.Now()
+	run := &BackupRun{ID: started.UTC().Format(backupIDFormat), Trigger: trigger, Started: started}
+	b.mu.Lock()
+	b.current = run
+	b.mu.Unlock()
+
+	err := b.backup(ctx, run)
+
+	b.mu.Lock()
+	if err != nil {
+		run.Error = err.Error()
+	}
+	run.Finished = time.Now()
+	b.current, b.last = nil, run
+	b.mu.Unlock()
+	b.saveStatus()
+	if err := b.RefreshSnapshots(ctx); err != nil {
+		log.Printf("Backup: listing snapshots: %v", err)
+	}
+
+	if err == nil {
+		log.Printf("Backup %s: %d repositories (%d unchanged), %d bytes, %d errors, %d old snapshots, %d bundles and %d LFS objects deleted",
+			run.ID, run.Repos, run.Unchanged, run.Bytes, len(run.Errors), run.Pruned, run.PrunedBundles, run.PrunedLFS)
+	}
+	return run, err
+}
+
+// backup fills in a backup run
+func (b *Backups) backup(ctx context.Context, run *BackupRun) error {
+	cfg, err := b.config()
+	if err != nil {
+		return err
+	}
+	storage, err := openBackupStorage(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	repos, err := ListRepos(b.reposPath, true)
+	if err != nil {
+		return err
+	}
+
+	// Chains continue from the last complete snapshot, unless it was encrypted with another key
+	snapshot := backupSnapshotPrefix + run.ID + "/"
+	manifest := &BackupManifest{ID: run.ID, Started: run.Started, Repos: []BackupRepo{}, Files: []string{}, Key: backupKeyID(storage)}
+	previous := make(map[string]*BackupRepo)
+	if last, err := lastBackupManifest(ctx, storage); errors.Is(err, errBackupNotEncrypted) {
+		log.Printf("Backup: the last snapshot isn't encrypted, starting new chains")
+	} else if err != nil {
+		return fmt.Errorf("reading the last snapshot: %w", err)
+	} else if last != nil && last.Key == manifest.Key {
+		for i := range last.Repos {
+			previous[last.Repos[i].Name] = &last.Repos[i]
+		}
+	}
+
+	for _, repo := range repos {
+		prev := previous[repo.Name]
+		backupRepo, lfsBytes, err := b.backupRepo(ctx, storage, run.ID, repo.Name, prev)
+		if err != nil {
+			log.Printf("Backup: %s: %v", repo.Name, err)
+			b.update(func() { run.Errors = append(run.Errors, repo.Name+": "+err.Error()) })
+			continue
+		}
+		manifest.Repos = append(manifest.Repos, *backupRepo)
+		b.update(func() {
+			run.Repos++
+			if prev != nil && slices.Equal(prev.Bundles, backupRepo.Bundles) {
+				run.Unchanged++
+			}
+			run.Bytes += backupRepo.Size + lfsBytes
+		})
+	}
+
+	// Group settings are saved with the server's, under their path in the repos directory
+	dataDir := filepath.Dir(b.reposPath)
+	files := make(map[string]string)
+	for _, name := range backupServerFiles {
+		files[name] = filepath.Join(dataDir, name)
+	}
+	for _, path := range groupConfigPaths(b.reposPath) {
+		if rel, err := filepath.Rel(b.reposPath, path); err == nil {
+			files[backupGroupsPrefix+filepath.ToSlash(rel)] = path
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		size, err := putBackupFile(ctx, storage, snapshot+"server/"+name, files[name])
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		manifest.Files = append(manifest.Files, name)
+		b.update(func() { run.Bytes += size })
+	}
+
+	// The manifest marks the snapshot complete, so it goes last
+	manifest.Finished = time.Now()
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := storage.Put(ctx, snapshot+"manifest.json", bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("manifest: %w", err)
+	}
+
+	retention := cfg.Retention
+	if retention <= 0 {
+		retention = defaultBackupRetention
+	}
+	pruned, err := pruneBackups(ctx, storage, retention, run.ID)
+	b.update(func() { run.Pruned = pruned })
+	if err != nil {
+		return fmt.Errorf("deleting old snapshots: %w", err)
+	}
+
+	// Then the bundles and LFS objects only the deleted snapshots referred to
+	manifests, err := loadBackupManifests(ctx, storage)
+	if err != nil {
+		return err
+	}
+	bundles, lfsObjects := make(map[string]bool), make(map[string]bool)
+	for _, m := range manifests {
+		for _, repo := range m.Repos {
+			for _, key := range repo.Bundles {
+				bundles[key] = true
+			}
+			for _, oid := range repo.LFSObjects {
+				lfsObjects[backupLFSPrefix+lfsObjectKey(repo.Name, oid)] = true
+			}
+		}
+	}
+	prunedBundles, err := pruneBackupShared(ctx, storage, backupBundlePrefix, bundles)
+	b.update(func() { run.PrunedBundles = prunedBundles })
+	if err != nil {
+		return fmt.Errorf("deleting old bundles: %w", err)
+	}
+	prunedLFS, err := pruneBackupShared(ctx, storage, backupLFSPrefix, lfsObjects)
+	b.update(func() { run.PrunedLFS = prunedLFS })
+	if err != nil {
+		return fmt.Errorf("deleting old LFS objects: %w", err)
+	}
+	return nil
+}
+
+// update changes the run in progress, which Status reads concurrently
+func (b *Backups) update(fn func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fn()
+}
+
+// backupRepoPrefix is where a repository is stored in a snapshot
+func backupRepoPrefix(id, repoName string) string {
+	return backupSnapshotPrefix + id + "/repos/" + repoName + "/"
+}
+
+// backupRepo uploads what changed in a repository since prev, its state in the last snapshot
+// or nil: a bundle of the new objects, its config files and the LFS objects not in the bucket
+// yet. It returns the bytes of LFS objects uploaded.
+func (b *Backups) backupRepo(ctx context.Context, storage LFSStorage, id, repoName string, prev *BackupRepo) (*BackupRepo, int64, error) {
+	repoPath := filepath.Join(b.reposPath, repoName+".git")
+	prefix := backupRepoPrefix(id, repoName)
+	backup := &BackupRepo{Name: repoName, Files: []string{}}
+
+	refs, err := listRefs(ctx, repoPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("listing refs: %w", err)
+	}
+	backup.Refs = refs
+
+	// Chains from before refs were recorded can't be continued
+	var chain []string
+	if prev != nil && prev.Refs != nil && len(prev.Bundles) < backupChainLength {
+		chain = prev.Bundles
+	}
+	switch {
+	case len(refs) == 0:
+		// Repositories without refs only have their files
+	case chain != nil && maps.Equal(prev.Refs, refs):
+		backup.Bundles = chain
+	default:
+		// The previous tips are in the chain already, unless the chain starts over
+		var tips []string
+		if chain != nil {
+			tips = slices.Collect(maps.Values(prev.Refs))
+		}
+		key := backupBundlePrefix + repoName + "/" + id + ".bundle"
+		size, err := uploadBundle(ctx, storage, repoPath, key, tips)
+		if err != nil {
+			return nil, 0, err
+		}
+		backup.Bundles = slices.Clone(chain)
+		// Nothing new when refs were only deleted or moved to known commits
+		if size > 0 {
+			backup.Bundles = append(backup.Bundles, key)
+			backup.Size += size
+		}
+	}
+
+	for _, name := range backupRepoFiles {
+		size, err := putBackupFile(ctx, storage, prefix+"files/"+name, filepath.Join(repoPath, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", name, err)
+		}
+		backup.Files = append(backup.Files, name)
+		backup.Size += size
+	}
+
+	// LFS objects never change, each is uploaded once and shared by the snapshots
+	lfs, _, err := openRepoLFSStorage(ctx, b.reposPath, repoName)
+	if errors.Is(err, ErrLFSNotConfigured) {
+		return backup, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("LFS storage: %w", err)
+	}
+	objects, err := listLFSObjects(ctx, lfs, repoName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("listing LFS objects: %w", err)
+	}
+	var lfsBytes int64
+	for _, obj := range objects {
+		key := backupLFSPrefix + obj.Key
+		if !backupObjectCurrent(ctx, storage, key, obj.Size) {
+			if err := copyLFSObject(ctx, lfs, obj.Key, storage, key, obj.Size); err != nil {
+				return nil, 0, fmt.Errorf("LFS object %s: %w", filepath.Base(obj.Key), err)
+			}
+			lfsBytes += obj.Size
+		}
+		backup.LFSObjects = append(backup.LFSObjects, filepath.Base(obj.Key))
+	}
+	return backup, lfsBytes, nil
+}
+
+// listRefs returns the refs of a repository and the objects they point to
+func listRefs(ctx context.Context, repoPath string) (map[string]string, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "for-each-ref", "--format=%(objectname) %(refname)").Output()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if oid, name, ok := strings.Cut(line, " "); ok {
+			refs[name] = oid
+		}
+	}
+	return refs, nil
+}
+
+// uploadBundle uploads a bundle of every ref of a repository, leaving out the objects
+// reachable from tips, and returns its size. It returns 0 without uploading anything if the
+// bundle would be empty.
+func uploadBundle(ctx context.Context, storage LFSStorage, repoPath, key string, tips []string) (int64, error) {
+	// Tips can be gone from the repository after a force push and gc
+	var exclude strings.Builder
+	if len(tips) > 0 {
+		cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "cat-file", "--batch-check=%(objectname)")
+		cmd.Stdin = strings.NewReader(strings.Join(tips, "\n") + "\n")
+		out, err := cmd.Output()
+		if err != nil {
+			return 0, fmt.Errorf("git cat-file: %w", err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			if !strings.HasSuffix(line, " missing") {
+				exclude.WriteString("^" + line + "\n")
+			}
+		}
+	}
+
+	bundle, err := os.CreateTemp("", "gitraf-backup-*.bundle")
+	if err != nil {
+		return 0, err
+	}
+	bundle.Close()
+	defer os.Remove(bundle.Name())
+
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "bundle", "create", "--quiet", bundle.Name(), "--all", "--stdin")
+	cmd.Stdin = strings.NewReader(exclude.String())
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if strings.Contains(string(out), "Refusing to create empty bundle") {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("git bundle: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	size, err := putBackupFile(ctx, storage, key, bundle.Name())
+	if err != nil {
+		return 0, fmt.Errorf("uploading bundle: %w", err)
+	}
+	return size, nil
+}
+
+// backupObjectCurrent reports whether an object of size bytes is in the backup bucket the way
+// it would be uploaded now
+func backupObjectCurrent(ctx context.Context, storage LFSStorage, key string, size int64) bool {
+	if encrypted, ok := storage.(*encryptedStorage); ok {
+		return encrypted.storedAsPut(ctx, key, size)
+	}
+	stored, err := storage.Size(ctx, key)
+	return err == nil && stored == size
+}
+
+// backupKeyID returns the ID of the key a backup storage encrypts with, or "" if it doesn't
+func backupKeyID(storage LFSStorage) string {
+	if encrypted, ok := storage.(*encryptedStorage); ok && encrypted.encrypt {
+		return encrypted.cipher.KeyID()
+	}
+	return ""
+}
+
+// putBackupFile uploads a file and returns its size, the error wraps os.ErrNotExist if
+// there's no such file
+func putBackupFile(ctx context.Context, storage LFSStorage, key, filePath string) (int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), storage.Put(ctx, key, f, info.Size())
+}
+
+// listBackupObjects returns the objects of every snapshot in the bucket by snapshot ID
+func listBackupObjects(ctx context.Context, storage LFSStorage) (map[string][]LFSStoredObject, error) {
+	objects := make(map[string][]LFSStoredObject)
+	err := storage.List(ctx, backupSnapshotPrefix, func(obj LFSStoredObject) error {
+		id, _, ok := strings.Cut(strings.TrimPrefix(obj.Key, backupSnapshotPrefix), "/")
+		if ok {
+			objects[id] = append(objects[id], obj)
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// backupComplete reports whether a snapshot's objects include its manifest
+func backupComplete(id string, objects []LFSStoredObject) bool {
+	return slices.ContainsFunc(objects, func(obj LFSStoredObject) bool {
+		return obj.Key == backupSnapshotPrefix+id+"/manifest.json"
+	})
+}
+
+// listBackupSnapshots returns the snapshots in the bucket, newest first
+func listBackupSnapshots(ctx context.Context, storage LFSStorage) ([]BackupSnapshot, error) {
+	objects, err := listBackupObjects(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bundles are named after the snapshot that uploaded them
+	bundleBytes := make(map[string]int64)
+	err = storage.List(ctx, backupBundlePrefix, func(obj LFSStoredObject) error {
+		bundleBytes[strings.TrimSuffix(path.Base(obj.Key), ".bundle")] += obj.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]BackupSnapshot, 0, len(objects))
+	for id, objs := range objects {
+		snapshot := BackupSnapshot{ID: id, Complete: backupComplete(id, objs), Repos: []string{}}
+		snapshot.Started, _ = time.Parse(backupIDFormat, id)
+		snapshot.Bytes = bundleBytes[id]
+		for _, obj := range objs {
+			snapshot.Bytes += obj.Size
+		}
+		if snapshot.Complete {
+			manifest, err := loadBackupManifest(ctx, storage, id)
+			if err != nil {
+				return nil, fmt.Errorf("snapshot %s: %w", id, err)
+			}
+			for _, repo := range manifest.Repos {
+				snapshot.Repos = append(snapshot.Repos, repo.Name)
+			}
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID > snapshots[j].ID })
+	return snapshots, nil
+}
+
+// loadBackupManifest reads the manifest of a snapshot. One that names an encryption key has to
+// be encrypted, or anyone able to write to the bucket could replace it.
+func loadBackupManifest(ctx context.Context, storage LFSStorage, id string) (*BackupManifest, error) {
+	key := backupSnapshotPrefix + id + "/manifest.json"
+	var body io.ReadCloser
+	var err error
+	encrypted := false
+	if s, ok := storage.(*encryptedStorage); ok {
+		body, encrypted, err = s.open(ctx, key)
+	} else {
+		body, err = storage.Get(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	manifest := &BackupManifest{}
+	if err := json.NewDecoder(body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	if manifest.Key != "" && !encrypted {
+		return nil, fmt.Errorf("manifest names encryption key %s: %w", manifest.Key, errBackupNotEncrypted)
+	}
+	for i, repo := range manifest.Repos {
+		if repo.Bundle != "" && len(repo.Bundles) == 0 {
+			manifest.Repos[i].Bundles = []string{repo.Bundle}
+		}
+	}
+	return manifest, nil
+}
+
+// loadBackupManifests reads the manifests of every complete snapshot, newest first
+func loadBackupManifests(ctx context.Context, storage LFSStorage) ([]*BackupManifest, error) {
+	objects, err := listBackupObjects(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []*BackupManifest
+	for id, objs := range objects {
+		if !backupComplete(id, objs) {
+			continue
+		}
+		manifest, err := loadBackupManifest(ctx, storage, id)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", id, err)
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].ID > manifests[j].ID })
+	return manifests, nil
+}
+
+// lastBackupManifest reads the manifest of the newest complete snapshot, or returns nil if
+// there's none
+func lastBackupManifest(ctx context.Context, storage LFSStorage) (*BackupManifest, error) {
+	objects, err := listBackupObjects(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	last := ""
+	for id, objs := range objects {
+		if id > last && backupComplete(id, objs) {
+			last = id
+		}
+	}
+	if last == "" {
+		return nil, nil
+	}
+	return loadBackupManifest(ctx, storage, last)
+}
+
+// RefreshSnapshots lists the snapshots in the bucket again
+func (b *Backups) RefreshSnapshots(ctx context.Context) error {
+	storage, err := b.storage(ctx)
+	if err != nil {
+		return err
+	}
+	snapshots, err := listBackupSnapshots(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.snapshots, b.listed = snapshots, time.Now()
+	// Verifications of deleted snapshots don't matter anymore
+	for id := range b.verified {
+		if !slices.ContainsFunc(snapshots, func(s BackupSnapshot) bool { return s.ID == id }) {
+			delete(b.verified, id)
+		}
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+// pruneBackups deletes complete snapshots beyond the newest keep, and incomplete ones left
+// by failed backups, and returns how many it deleted. The snapshot with ID current is kept.
+func pruneBackups(ctx context.Context, storage LFSStorage, keep int, current string) (int, error) {
+	objects, err := listBackupObjects(ctx, storage)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := make([]string, 0, len(objects))
+	for id := range objects {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+	pruned, kept := 0, 0
+	for _, id := range ids {
+		if id == current {
+			kept++
+			continue
+		}
+		if backupComplete(id, objects[id]) && kept < keep {
+			kept++
+			continue
+		}
+		for _, obj := range objects[id] {
+			if err := storage.Delete(ctx, obj.Key); err != nil {
+				return pruned, fmt.Errorf("%s: %w", obj.Key, err)
+			}
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// pruneBackupShared deletes the objects under prefix, shared by snapshots, that none of them
+// refers to anymore, and returns how many it deleted
+func pruneBackupShared(ctx context.Context, storage LFSStorage, prefix string, referenced map[string]bool) (int, error) {
+	var unreferenced []string
+	err := storage.List(ctx, prefix, func(obj LFSStoredObject) error {
+		if !referenced[obj.Key] {
+			unreferenced = append(unreferenced, obj.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range unreferenced {
+		if err := storage.Delete(ctx, key); err != nil {
+			return i, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return len(unreferenced), nil
+}
+
+// handleBackupRunPost starts a backup in the background (tailnet only)
+func (s *Server) handleBackupRunPost(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied - Tailnet required", http.StatusForbidden)
+		return
+	}
+
+	cfg, err := s.backups.config()
+	if err != nil || !cfg.Enabled {
+		http.Error(w, "Backups are not enabled", http.StatusBadRequest)
+		return
+	}
+	if s.backups.Running() {
+		http.Error(w, ErrBackupRunning.Error(), http.StatusConflict)
+		return
+	}
+
+	go func() {
+		if _, err := s.backups.Backup(context.Background(), "manual"); err != nil {
+			log.Printf("Backup failed: %v", err)
+		}
+	}()
+
+	// Redirect back to referrer
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		referer = "/admin/settings"
+	}
+	http.Redirect(w, r, referer, http.StatusFound)
+}
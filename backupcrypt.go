@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// backupCryptMagic starts every encrypted backup object. It's followed by the ID of the key,
+	// 4 bytes, and a random 12 byte nonce, then the plaintext in chunks of backupCryptChunk
+	// bytes, each sealed with AES-256-GCM. The last chunk is shorter, possibly empty, and
+	// sealed as the last so a truncated object doesn't decrypt.
+	backupCryptMagic = "GRAFBAK1"
+
+	backupCryptHeader = len(backupCryptMagic) + 4 + 12
+	backupCryptChunk  = 64 * 1024
+	backupCryptTag    = 16
+)
+
+// backupCipher encrypts backup objects with the first of its keys and decrypts them with any
+type backupCipher struct {
+	keys [][]byte
+}
+
+// newBackupCipher parses comma separated base64 keys of 32 bytes
+func newBackupCipher(encoded string) (*backupCipher, error) {
+	c := &backupCipher{}
+	for _, field := range strings.Split(encoded, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(field)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("backup encryption key must be 32 bytes, base64 encoded")
+		}
+		c.keys = append(c.keys, key)
+	}
+	if len(c.keys) == 0 {
+		return nil, errors.New("no backup encryption key")
+	}
+	return c, nil
+}
+
+// KeyID returns the ID of the key objects are encrypted with
+func (c *backupCipher) KeyID() string {
+	return masterKeyID(c.keys[0])
+}
+
+// key returns the key with an ID, or nil
+func (c *backupCipher) key(id []byte) []byte {
+	for _, key := range c.keys {
+		if masterKeyID(key) == hex.EncodeToString(id) {
+			return key
+		}
+	}
+	return nil
+}
+
+// encryptedSize returns the size of an object of size bytes once encrypted
+func encryptedSize(size int64) int64 {
+	return int64(backupCryptHeader) + size + backupCryptTag*(size/backupCryptChunk+1)
+}
+
+// decryptedSize returns the size of an encrypted object of size bytes once decrypted
+func decryptedSize(size int64) (int64, error) {
+	n := size - int64(backupCryptHeader)
+	if n < backupCryptTag {
+		return 0, errors.New("encrypted object is truncated")
+	}
+	return n - backupCryptTag*(n/(backupCryptChunk+backupCryptTag)+1), nil
+}
+
+// chunkNonce returns the nonce of chunk i, the object's nonce with i in its last 8 bytes
+func chunkNonce(nonce []byte, i uint64) []byte {
+	n := bytes.Clone(nonce)
+	binary.BigEndian.PutUint64(n[4:], binary.BigEndian.Uint64(n[4:])^i)
+	return n
+}
+
+// chunkAD is the additional data of a chunk, telling the last one apart
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// cryptReader encrypts or decrypts a stream chunk by chunk
+type cryptReader struct {
+	src   io.Reader
+	gcm   cipher.AEAD
+	nonce []byte
+	seal  bool
+
+	chunk uint64
+	buf   []byte // Processed, not read yet
+	in    []byte
+	done  bool
+	err   error
+}
+
+// Encrypt returns a reader of the encryption of r
+func (c *backupCipher) Encrypt(r io.Reader) (io.Reader, error) {
+	gcm, err := newGCM(c.keys[0])
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, backupCryptHeader)
+	header = append(header, backupCryptMagic...)
+	id, _ := hex.DecodeString(c.KeyID())
+	header = append(header, id...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+
+	return &cryptReader{
+		src:   r,
+		gcm:   gcm,
+		nonce: nonce,
+		seal:  true,
+		buf:   header,
+		in:    make([]byte, backupCryptChunk),
+	}, nil
+}
+
+// Decrypt returns a reader of the decryption of r, which starts after the magic. Every chunk
+// is authenticated before it's returned.
+func (c *backupCipher) Decrypt(r io.Reader) (io.Reader, error) {
+	header := make([]byte, backupCryptHeader-len(backupCryptMagic))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New("encrypted object is truncated")
+	}
+	key := c.key(header[:4])
+	if key == nil {
+		return nil, fmt.Errorf("backup object was encrypted with an unknown key (%x)", header[:4])
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptReader{
+		src:   r,
+		gcm:   gcm,
+		nonce: header[4:],
+		in:    make([]byte, backupCryptChunk+backupCryptTag),
+	}, nil
+}
+
+// Read implements io.Reader
+func (r *cryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next processes the next chunk. A chunk shorter than a full one is the last.
+func (r *cryptReader) next() {
+	n, err := io.ReadFull(r.src, r.in)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		r.err = err
+		return
+	}
+	last := n < len(r.in)
+	nonce := chunkNonce(r.nonce, r.chunk)
+	r.chunk++
+
+	if r.seal {
+		r.buf = r.gcm.Seal(r.buf[:0:0], nonce, r.in[:n], chunkAD(last))
+	} else {
+		if last && n < backupCryptTag {
+			r.err = errors.New("encrypted object is truncated")
+			return
+		}
+		r.buf, err = r.gcm.Open(r.buf[:0:0], nonce, r.in[:n], chunkAD(last))
+		if err != nil {
+			r.err = errors.New("backup object failed to decrypt, it's corrupt or truncated")
+			return
+		}
+	}
+	r.done = last
+}
+
+// errBackupNotEncrypted means a backup object is stored without encryption where it has to be
+var errBackupNotEncrypted = errors.New("backup object isn't encrypted")
+
+// encryptedStorage encrypts the objects put into a storage and decrypts those it gets.
+// Objects stored without encryption are only returned as they are if plaintext is set, so a
+// bucket can hold both while encryption is turned on or off.
+type encryptedStorage struct {
+	LFSStorage
+	cipher    *backupCipher
+	encrypt   bool // Off, objects are only decrypted
+	plaintext bool // Objects stored without encryption are read too
+}
+
+// stat returns the stored size of an object and whether it's encrypted, from its magic
+func (s *encryptedStorage) stat(ctx context.Context, key string) (int64, bool, error) {
+	size, err := s.LFSStorage.Size(ctx, key)
+	if err != nil || size < int64(len(backupCryptMagic)) {
+		return size, false, err
+	}
+
+	var body io.ReadCloser
+	if ranged, ok := s.LFSStorage.(lfsRangeReader); ok {
+		body, err = ranged.GetRange(ctx, key, 0, int64(len(backupCryptMagic)))
+	} else {
+		body, err = s.LFSStorage.Get(ctx, key)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer body.Close()
+	magic := make([]byte, len(backupCryptMagic))
+	if _, err := io.ReadFull(body, magic); err != nil {
+		return 0, false, err
+	}
+	return size, string(magic) == backupCryptMagic, nil
+}
+
+// Size returns the size of a stored object once decrypted
+func (s *encryptedStorage) Size(ctx context.Context, key string) (int64, error) {
+	size, encrypted, err := s.stat(ctx, key)
+	switch {
+	case err != nil:
+		return 0, err
+	case encrypted:
+		return decryptedSize(size)
+	case !s.plaintext:
+		return 0, fmt.Errorf("%s: %w", key, errBackupNotEncrypted)
+	}
+	return size, nil
+}
+
+// storedAsPut reports whether an object of size bytes is stored the way Put would store it
+// now, encrypted or not
+func (s *encryptedStorage) storedAsPut(ctx context.Context, key string, size int64) bool {
+	stored, encrypted, err := s.stat(ctx, key)
+	if err != nil || encrypted != s.encrypt {
+		return false
+	}
+	if encrypted {
+		return stored == encryptedSize(size)
+	}
+	return stored == size
+}
+
+// Get downloads and decrypts an object
+func (s *encryptedStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, _, err := s.open(ctx, key)
+	return body, err
+}
+
+// open downloads an object, decrypting it if it's encrypted, and reports whether it was
+func (s *encryptedStorage) open(ctx context.Context, key string) (io.ReadCloser, bool, error) {
+	body, err := s.LFSStorage.Get(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	magic := make([]byte, len(backupCryptMagic))
+	n, err := io.ReadFull(body, magic)
+	if err != nil || string(magic) != backupCryptMagic {
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			body.Close()
+			return nil, false, err
+		}
+		if !s.plaintext {
+			body.Close()
+			return nil, false, fmt.Errorf("%s: %w", key, errBackupNotEncrypted)
+		}
+		return readCloser{io.MultiReader(bytes.NewReader(magic[:n]), body), body}, false, nil
+	}
+
+	r, err := s.cipher.Decrypt(body)
+	if err != nil {
+		body.Close()
+		return nil, false, fmt.Errorf("%s: %w", key, err)
+	}
+	return readCloser{r, body}, true, nil
+}
+
+// snapshotStorage returns the storage to read the objects of a snapshot from. Those of a
+// snapshot encrypted with a key have to be encrypted too, even when plaintext is allowed.
+func snapshotStorage(storage LFSStorage, manifest *BackupManifest) LFSStorage {
+	encrypted, ok := storage.(*encryptedStorage)
+	if !ok || manifest.Key == "" || !encrypted.plaintext {
+		return storage
+	}
+	strict := *encrypted
+	strict.plaintext = false
+	return &strict
+}
+
+// Put encrypts and uploads an object
+func (s *encryptedStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if !s.encrypt {
+		return s.LFSStorage.Put(ctx, key, r, size)
+	}
+	encrypted, err := s.cipher.Encrypt(r)
+	if err != nil {
+		return err
+	}
+	return s.LFSStorage.Put(ctx, key, encrypted, encryptedSize(size))
+}
+
+// readCloser reads from one reader and closes another
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
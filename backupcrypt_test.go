@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testBackupKey returns a base64 backup key of 32 bytes of b
+func testBackupKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+// backupEncrypt encrypts data with c
+func backupEncrypt(t *testing.T, c *backupCipher, data []byte) []byte {
+	t.Helper()
+	r, err := c.Encrypt(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
+
+// backupDecrypt decrypts an object encrypted by backupEncrypt with c
+func backupDecrypt(c *backupCipher, encrypted []byte) ([]byte, error) {
+	if !bytes.HasPrefix(encrypted, []byte(backupCryptMagic)) {
+		return nil, errors.New("no magic")
+	}
+	r, err := c.Decrypt(bytes.NewReader(encrypted[len(backupCryptMagic):]))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestBackupCipherRoundTrip(t *testing.T) {
+	c, err := newBackupCipher(testBackupKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, backupCryptChunk - 1, backupCryptChunk, backupCryptChunk + 1, 3*backupCryptChunk + 7} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		encrypted := backupEncrypt(t, c, data)
+		if int64(len(encrypted)) != encryptedSize(int64(size)) {
+			t.Errorf("%d bytes encrypt to %d, encryptedSize says %d", size, len(encrypted), encryptedSize(int64(size)))
+		}
+		if n, err := decryptedSize(int64(len(encrypted))); err != nil || n != int64(size) {
+			t.Errorf("decryptedSize of %d bytes = %d, %v, want %d", len(encrypted), n, err, size)
+		}
+		if size > 16 && bytes.Contains(encrypted, data[:16]) {
+			t.Errorf("%d bytes: the plaintext is in the encrypted object", size)
+		}
+		if again := backupEncrypt(t, c, data); bytes.Equal(again, encrypted) {
+			t.Errorf("%d bytes: two encryptions are equal, the nonce isn't random", size)
+		}
+		got, err := backupDecrypt(c, encrypted)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: decrypted %d bytes, %v", size, len(got), err)
+		}
+	}
+}
+
+func TestBackupCipherRejectsTruncation(t *testing.T) {
+	c, err := newBackupCipher(testBackupKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("backup"), backupCryptChunk/2)
+	encrypted := backupEncrypt(t, c, data)
+	fullChunk := backupCryptChunk + backupCryptTag
+
+	for name, damaged := range map[string][]byte{
+		"header only":         encrypted[:backupCryptHeader],
+		"short header":        encrypted[:backupCryptHeader-1],
+		"last chunk dropped":  encrypted[:backupCryptHeader+2*fullChunk],
+		"cut within a chunk":  encrypted[:backupCryptHeader+fullChunk+100],
+		"last byte dropped":   encrypted[:len(encrypted)-1],
+		"chunks swapped":      append(append(append([]byte(nil), encrypted[:backupCryptHeader]...), encrypted[backupCryptHeader+fullChunk:backupCryptHeader+2*fullChunk]...), encrypted[backupCryptHeader:backupCryptHeader+fullChunk]...),
+		"trailing bytes":      append(append([]byte(nil), encrypted...), 0),
+		"modified ciphertext": append(append(append([]byte(nil), encrypted[:backupCryptHeader+10]...), encrypted[backupCryptHeader+10]^1), encrypted[backupCryptHeader+11:]...),
+		"modified nonce":      append(append(append([]byte(nil), encrypted[:backupCryptHeader-1]...), encrypted[backupCryptHeader-1]^1), encrypted[backupCryptHeader:]...),
+	} {
+		if got, err := backupDecrypt(c, damaged); err == nil {
+			t.Errorf("%s: decrypted %d bytes", name, len(got))
+		}
+	}
+}
+
+func TestBackupCipherKeys(t *testing.T) {
+	oldKey, newKey := testBackupKey(1), testBackupKey(2)
+	old, err := newBackupCipher(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("encrypted before the key changed")
+	encrypted := backupEncrypt(t, old, data)
+
+	// Another key can't decrypt it, and says which key it needs
+	other, _ := newBackupCipher(newKey)
+	if _, err := backupDecrypt(other, encrypted); err == nil || !strings.Contains(err.Error(), old.KeyID()) {
+		t.Errorf("decrypting with the wrong key: %v, want an error naming key %s", err, old.KeyID())
+	}
+
+	// After a change of key the new one encrypts and the old one still decrypts
+	rotated, err := newBackupCipher(newKey + ", " + oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.KeyID() != other.KeyID() {
+		t.Errorf("KeyID = %s, want the first key's %s", rotated.KeyID(), other.KeyID())
+	}
+	if got, err := backupDecrypt(rotated, encrypted); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decrypting with the old key after a change: %q, %v", got, err)
+	}
+	if got, err := backupDecrypt(other, backupEncrypt(t, rotated, data)); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decrypting what the new key encrypted: %q, %v", got, err)
+	}
+
+	for _, keys := range []string{"", " , ", "c2hvcnQ=", "not base64", newKey + ",c2hvcnQ="} {
+		if _, err := newBackupCipher(keys); err == nil {
+			t.Errorf("newBackupCipher(%q) accepted the keys", keys)
+		}
+	}
+}
+
+// newTestEncryptedStorage returns an encrypted storage on a local directory, and the directory
+func newTestEncryptedStorage(t *testing.T, keys string, plaintext bool) (*encryptedStorage, *LocalLFSStorage) {
+	t.Helper()
+	cipher, err := newBackupCipher(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := &LocalLFSStorage{root: t.TempDir()}
+	return &encryptedStorage{LFSStorage: local, cipher: cipher, encrypt: true, plaintext: plaintext}, local
+}
+
+func TestEncryptedStorageSize(t *testing.T) {
+	ctx := context.Background()
+	storage, local := newTestEncryptedStorage(t, testBackupKey(1), true)
+	for _, size := range []int{0, 5, backupCryptChunk, backupCryptChunk + 1} {
+		data := bytes.Repeat([]byte("x"), size)
+		if err := storage.Put(ctx, "encrypted", bytes.NewReader(data), int64(size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := local.Put(ctx, "plain", bytes.NewReader(data), int64(size)); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"encrypted", "plain"} {
+			if got, err := storage.Size(ctx, key); err != nil || got != int64(size) {
+				t.Errorf("Size of %d bytes %s = %d, %v", size, key, got, err)
+			}
+		}
+		if !storage.storedAsPut(ctx, "encrypted", int64(size)) || storage.storedAsPut(ctx, "plain", int64(size)) {
+			t.Errorf("%d bytes: only the encrypted object is stored the way it's put", size)
+		}
+	}
+
+	storage.plaintext = false
+	if _, err := storage.Size(ctx, "plain"); !errors.Is(err, errBackupNotEncrypted) {
+		t.Errorf("Size of a plaintext object: %v, want errBackupNotEncrypted", err)
+	}
+	if _, err := storage.Get(ctx, "plain"); !errors.Is(err, errBackupNotEncrypted) {
+		t.Errorf("Get of a plaintext object: %v, want errBackupNotEncrypted", err)
+	}
+}
+
+func TestLoadBackupManifestRefusesPlaintext(t *testing.T) {
+	ctx := context.Background()
+	storage, local := newTestEncryptedStorage(t, testBackupKey(1), true)
+	const id = "20261018T030000Z"
+	putManifest := func(manifest *BackupManifest, encrypted bool) {
+		t.Helper()
+		data, _ := json.Marshal(manifest)
+		var dst LFSStorage = local
+		if encrypted {
+			dst = storage
+		}
+		if err := dst.Put(ctx, backupSnapshotPrefix+id+"/manifest.json", bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A plaintext manifest claiming a key was swapped in for an encrypted one
+	putManifest(&BackupManifest{ID: id, Key: storage.cipher.KeyID()}, false)
+	if _, err := loadBackupManifest(ctx, storage, id); !errors.Is(err, errBackupNotEncrypted) {
+		t.Errorf("plaintext manifest naming a key: %v, want errBackupNotEncrypted", err)
+	}
+
+	// Snapshots from before encryption are only read when allowed
+	putManifest(&BackupManifest{ID: id}, false)
+	if _, err := loadBackupManifest(ctx, storage, id); err != nil {
+		t.Errorf("plaintext manifest with plaintext allowed: %v", err)
+	}
+	strict := *storage
+	strict.plaintext = false
+	if _, err := loadBackupManifest(ctx, &strict, id); !errors.Is(err, errBackupNotEncrypted) {
+		t.Errorf("plaintext manifest with plaintext refused: %v, want errBackupNotEncrypted", err)
+	}
+
+	// Everything of an encrypted snapshot has to be encrypted
+	putManifest(&BackupManifest{ID: id, Key: storage.cipher.KeyID()}, true)
+	manifest, err := loadBackupManifest(ctx, storage, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Put(ctx, "bundles/repo/1.bundle", strings.NewReader("swapped"), 7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snapshotStorage(storage, manifest).Get(ctx, "bundles/repo/1.bundle"); !errors.Is(err, errBackupNotEncrypted) {
+		t.Errorf("plaintext bundle of an encrypted snapshot: %v, want errBackupNotEncrypted", err)
+	}
+	body, err := snapshotStorage(storage, &BackupManifest{ID: id}).Get(ctx, "bundles/repo/1.bundle")
+	if err != nil {
+		t.Fatalf("plaintext bundle of a plaintext snapshot: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "swapped" {
+		t.Errorf("plaintext bundle = %q", data)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// staleBranchAge is how long a branch can go without commits before it is marked stale
+const staleBranchAge = 90 * 24 * time.Hour
+
+// BranchInfo represents a branch with its status relative to the default branch
+type BranchInfo struct {
+	Name       string
+	IsDefault  bool
+	IsMerged   bool // Tip is reachable from the default branch
+	IsStale    bool // No commits for staleBranchAge
+	Ahead      int  // Commits on this branch that are not on the default branch
+	Behind     int  // Commits on the default branch that are not on this branch
+	LastCommit Commit
+}
+
+// GetBranchInfos returns all branches with last commit and ahead/behind counts
+// relative to the default branch. The default branch is listed first.
+func GetBranchInfos(reposPath, repoName string) ([]BranchInfo, error) {
+	repoPath := filepath.Join(reposPath, repoName+".git")
+	r, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultBranch, _ := GetDefaultBranch(repoPath)
+
+	iter, err := r.Branches()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var refs []*plumbing.Reference
+	var defaultHash plumbing.Hash
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		refs = append(refs, ref)
+		if ref.Name().Short() == defaultBranch {
+			defaultHash = ref.Hash()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var branches []BranchInfo
+	for _, ref := range refs {
+		commit, err := r.CommitObject(ref.Hash())
+		if err != nil {
+			continue
+		}
+
+		info := BranchInfo{
+			Name:      ref.Name().Short(),
+			IsDefault: ref.Name().Short() == defaultBranch,
+			IsStale:   time.Since(commit.Committer.When) > staleBranchAge,
+			LastCommit: Commit{
+				Hash:      commit.Hash.String(),
+				ShortHash: commit.Hash.String()[:8],
+				Message:   strings.TrimSpace(commit.Message),
+				Author:    commit.Author.Name,
+				Email:     commit.Author.Email,
+				Date:      commit.Author.When,
+			},
+		}
+
+		if !info.IsDefault && !defaultHash.IsZero() {
+			key := resultKey{repoPath: repoPath, kind: "ahead-behind", commit: commit.Hash, path: defaultHash.String()}
+			counts, err := cachedResult(repoCache, key, func() ([2]int, error) {
+				return countAheadBehind(r, commit.Hash, defaultHash)
+			})
+			if err == nil {
+				info.Ahead, info.Behind = counts[0], counts[1]
+				info.IsMerged = info.Ahead == 0
+			}
+		}
+
+		branches = append(branches, info)
+	}
+
+	// Default branch first, then most recently updated
+	sort.Slice(branches, func(i, j int) bool {
+		if branches[i].IsDefault != branches[j].IsDefault {
+			return branches[i].IsDefault
+		}
+		return branches[i].LastCommit.Date.After(branches[j].LastCommit.Date)
+	})
+
+	return branches, nil
+}
+
+// commitQueue orders commits newest first, by committer date
+type commitQueue []*object.Commit
+
+func (q commitQueue) Len() int           { return len(q) }
+func (q commitQueue) Less(i, j int) bool { return q[i].Committer.When.After(q[j].Committer.When) }
+func (q commitQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x any)        { *q = append(*q, x.(*object.Commit)) }
+func (q *commitQueue) Pop() any {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// countAheadBehind counts the commits only on branch and only on base. Both histories are
+// walked together, newest first, and the walk stops once only shared history is left.
+// Commits walked from one side before turning out to be on both, which happens when commit
+// dates are equal or skewed, are walked again to pass that on to their parents.
+func countAheadBehind(r *git.Repository, branch, base plumbing.Hash) ([2]int, error) {
+	const (
+		onBranch = 1 << iota
+		onBase
+		shared = onBranch | onBase
+	)
+	flags := map[plumbing.Hash]int{branch: onBranch}
+	flags[base] |= onBase
+
+	queue := &commitQueue{}
+	queued := make(map[plumbing.Hash]bool)
+	walked := make(map[plumbing.Hash]bool)
+	pending := 0 // Queued commits not known to be on both sides
+	rewalks := 0 // Queued commits walked before
+	for hash := range flags {
+		c, err := r.CommitObject(hash)
+		if err != nil {
+			return [2]int{}, err
+		}
+		heap.Push(queue, c)
+		queued[hash] = true
+		if flags[hash] != shared {
+			pending++
+		}
+	}
+
+	for pending > 0 || rewalks > 0 {
+		c := heap.Pop(queue).(*object.Commit)
+		delete(queued, c.Hash)
+		f := flags[c.Hash]
+		if f != shared {
+			pending--
+		}
+		if walked[c.Hash] {
+			rewalks--
+		}
+		walked[c.Hash] = true
+
+		for _, parent := range c.ParentHashes {
+			old := flags[parent]
+			if old|f == old {
+				continue
+			}
+			flags[parent] = old | f
+			if queued[parent] {
+				if old|f == shared {
+					pending--
+				}
+				continue
+			}
+			p, err := r.CommitObject(parent)
+			if err != nil {
+				return [2]int{}, err
+			}
+			heap.Push(queue, p)
+			queued[parent] = true
+			if old|f != shared {
+				pending++
+			}
+			if walked[parent] {
+				rewalks++
+			}
+		}
+	}
+
+	var counts [2]int
+	for _, f := range flags {
+		switch f {
+		case onBranch:
+			counts[0]++
+		case onBase:
+			counts[1]++
+		}
+	}
+	return counts, nil
+}
+
+// CreateBranch creates a new branch pointing at the commit the given ref resolves to
+func CreateBranch(reposPath, repoName, name, from string) error {
+	repoPath := filepath.Join(reposPath, repoName+".git")
+	defer repoCache.Invalidate(repoPath)
+
+	r, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return err
+	}
+
+	refName := plumbing.NewBranchReferenceName(name)
+	if err := refName.Validate(); err != nil {
+		return fmt.Errorf("invalid branch name: %s", name)
+	}
+
+	if _, err := r.Reference(refName, false); err == nil {
+		return fmt.Errorf("branch already exists: %s", name)
+	}
+
+	hash, err := resolveRef(r, from)
+	if err != nil {
+		return err
+	}
+
+	return r.Storer.SetReference(plumbing.NewHashReference(refName, hash))
+}
+
+// DeleteBranch removes a branch. Only branches fully merged into the default
+// branch can be deleted, and the default branch itself is never deleted.
+func DeleteBranch(reposPath, repoName, name string) error {
+	repoPath := filepath.Join(reposPath, repoName+".git")
+	defer repoCache.Invalidate(repoPath)
+
+	r, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return err
+	}
+
+	refName := plumbing.NewBranchReferenceName(name)
+	ref, err := r.Reference(refName, false)
+	if err != nil {
+		return fmt.Errorf("branch not found: %s", name)
+	}
+
+	head, err := r.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return err
+	}
+	if head.Target() == refName {
+		return fmt.Errorf("cannot delete the default branch")
+	}
+
+	defaultRef, err := r.Reference(head.Target(), true)
+	if err != nil {
+		return err
+	}
+	counts, err := countAheadBehind(r, ref.Hash(), defaultRef.Hash())
+	if err != nil {
+		return err
+	}
+	if counts[0] > 0 {
+		return fmt.Errorf("branch is not merged into %s", head.Target().Short())
+	}
+
+	return r.Storer.RemoveReference(refName)
+}
+
+// SetDefaultBranch points HEAD at the given branch
+func SetDefaultBranch(repoPath, branch string) error {
+	defer repoCache.Invalidate(repoPath)
+
+	r, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return err
+	}
+
+	refName := plumbing.NewBranchReferenceName(branch)
+	if _, err := r.Reference(refName, false); err != nil {
+		return fmt.Errorf("branch not found: %s", branch)
+	}
+
+	return r.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, refName))
+}
+
+// handleBranches shows the branch management page
+func (s *Server) handleBranches(w http.ResponseWriter, r *http.Request) {
+	repoName := repoParam(r)
+
+	if !RepoExists(s.reposPath, repoName) {
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+
+	// Check access
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	if !IsPublicRepo(s.reposPath, repoPath) && !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	branches, err := GetBranchInfos(s.reposPath, repoName)
+	if err != nil {
+		log.Printf("Error getting branches: %v", err)
+		http.Error(w, "Error reading branches", http.StatusInternalServerError)
+		return
+	}
+
+	defaultBranch, err := GetDefaultBranch(repoPath)
+	if err != nil {
+		defaultBranch = "main"
+	}
+
+	var branchNames []string
+	for _, b := range branches {
+		branchNames = append(branchNames, b.Name)
+	}
+
+	data := map[string]interface{}{
+		"Title":         "Branches - " + repoName,
+		"RepoName":      repoName,
+		"Ref":           defaultBranch,
+		"DefaultBranch": defaultBranch,
+		"BranchInfos":   branches,
+		"Branches":      branchNames,
+		"IsTailnet":     s.isTailnetRequest(r),
+		"IsPublic":      IsPublicRepo(s.reposPath, repoPath),
+		"PublicURL":     s.publicURL,
+		"TailnetURL":    s.tailnetURL,
+		"MirrorURL":     pullMirrorURL(repoPath),
+	}
+
+	s.renderTemplate(w, "branches.html", data)
+}
+
+// branchRepo checks that the repository of a branch change exists and its branches may be
+// changed, writing an error response and returning "" otherwise
+func (s *Server) branchRepo(w http.ResponseWriter, r *http.Request) string {
+	if !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied - Tailnet required", http.StatusForbidden)
+		return ""
+	}
+
+	repoName := repoParam(r)
+	if !RepoExists(s.reposPath, repoName) {
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return ""
+	}
+
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	if pullMirrorURL(repoPath) != "" {
+		http.Error(w, errPullMirror.Error(), http.StatusConflict)
+		return ""
+	}
+	if IsArchivedRepo(repoPath) {
+		http.Error(w, errArchived.Error(), http.StatusConflict)
+		return ""
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return ""
+	}
+	return repoName
+}
+
+// handleBranchCreate creates a new branch from a ref (tailnet only)
+func (s *Server) handleBranchCreate(w http.ResponseWriter, r *http.Request) {
+	repoName := s.branchRepo(w, r)
+	if repoName == "" {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	from := strings.TrimSpace(r.FormValue("from"))
+	if name == "" || from == "" {
+		http.Error(w, "Branch name and source ref are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := CreateBranch(s.reposPath, repoName, name, from); err != nil {
+		log.Printf("Error creating branch: %v", err)
+		http.Error(w, "Failed to create branch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Created branch %s in %s from %s", name, repoName, from)
+	http.Redirect(w, r, "/"+repoName+"/branches", http.StatusFound)
+}
+
+// handleBranchDelete deletes a merged branch (tailnet only)
+func (s *Server) handleBranchDelete(w http.ResponseWriter, r *http.Request) {
+	repoName := s.branchRepo(w, r)
+	if repoName == "" {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if err := DeleteBranch(s.reposPath, repoName, name); err != nil {
+		log.Printf("Error deleting branch: %v", err)
+		http.Error(w, "Failed to delete branch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Deleted branch %s in %s", name, repoName)
+	http.Redirect(w, r, "/"+repoName+"/branches", http.StatusFound)
+}
+
+// handleBranchDefault changes the default branch (HEAD) of a repository (tailnet only)
+func (s *Server) handleBranchDefault(w http.ResponseWriter, r *http.Request) {
+	repoName := s.branchRepo(w, r)
+	if repoName == "" {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	if err := SetDefaultBranch(repoPath, name); err != nil {
+		log.Printf("Error setting default branch: %v", err)
+		http.Error(w, "Failed to set default branch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Default branch of %s set to %s", repoName, name)
+	http.Redirect(w, r, "/"+repoName+"/branches", http.StatusFound)
+}
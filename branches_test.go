@@ -0,0 +1,40 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestDeleteBranch(t *testing.T) {
+	reposPath, commits := newRevisionTestRepo(t)
+	r, err := git.PlainOpen(filepath.Join(reposPath, "repo.git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, commit := range map[string]string{"old": "c2", "unmerged": "a1"} {
+		ref := plumbing.NewHashReference(plumbing.NewBranchReferenceName(name), commits[commit])
+		if err := r.Storer.SetReference(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"main", "unmerged", "nope"} {
+		if err := DeleteBranch(reposPath, "repo", name); err == nil {
+			t.Errorf("deleted branch %s", name)
+		}
+	}
+	for _, name := range []string{"feature/x", "old"} {
+		if err := DeleteBranch(reposPath, "repo", name); err != nil {
+			t.Errorf("deleting merged branch %s: %v", name, err)
+		}
+		if _, err := r.Reference(plumbing.NewBranchReferenceName(name), false); err == nil {
+			t.Errorf("branch %s is still there", name)
+		}
+	}
+	if _, err := r.Reference(plumbing.NewBranchReferenceName("unmerged"), false); err != nil {
+		t.Errorf("unmerged branch is gone: %v", err)
+	}
+}
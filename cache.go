@@ -0,0 +1,368 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// maxCachedResults limits the number of memoised per-commit results
+const maxCachedResults = 4096
+
+// repoCache is shared by the git helpers so they don't re-open repositories on every call
+var repoCache = NewRepoCache()
+
+// cachedRepo holds an opened repository and the data derived from its refs
+type cachedRepo struct {
+	// go-git repositories are not safe for concurrent use, so access is serialised
+	mu      sync.Mutex
+	repo    *git.Repository
+	summary *Repo
+}
+
+// resultKey identifies a memoised result. Results are keyed by commit hash, so
+// they never go stale and don't need to be invalidated when refs move.
+type resultKey struct {
+	repoPath string
+	kind     string
+	commit   plumbing.Hash
+	path     string
+}
+
+// cacheCounter counts the hits and misses of one kind of cached data
+type cacheCounter struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// CacheStats reports the effectiveness of one kind of cached data
+type CacheStats struct {
+	Kind    string  `json:"kind"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// HitPercent returns the hit rate as a whole percentage
+func (s CacheStats) HitPercent() int {
+	return int(s.HitRate*100 + 0.5)
+}
+
+// RepoCache keeps opened repositories and memoises per-commit results
+type RepoCache struct {
+	mu      sync.Mutex
+	repos   map[string]*cachedRepo
+	results map[resultKey]interface{}
+	order   []resultKey // Insertion order, oldest results are evicted first
+
+	counters      sync.Map // Kind -> *cacheCounter
+	invalidations atomic.Int64
+
+	listenersMu sync.Mutex
+	listeners   []func(repoPath string)
+}
+
+// NewRepoCache creates an empty repository cache
+func NewRepoCache() *RepoCache {
+	return &RepoCache{
+		repos:   make(map[string]*cachedRepo),
+		results: make(map[resultKey]interface{}),
+	}
+}
+
+// withCachedRepo calls fn with the cached repository at repoPath, opening it if needed
+func withCachedRepo[T any](repoPath string, fn func(r *git.Repository) (T, error)) (T, error) {
+	var result T
+	err := repoCache.withEntry(repoPath, func(entry *cachedRepo) error {
+		var err error
+		result, err = fn(entry.repo)
+		return err
+	})
+	return result, err
+}
+
+// withEntry calls fn with the locked cache entry of a repository, opening it if needed
+func (c *RepoCache) withEntry(repoPath string, fn func(entry *cachedRepo) error) error {
+	entry := c.entry(repoPath)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.repo == nil {
+		c.counter("repo").misses.Add(1)
+		r, err := git.PlainOpen(repoPath)
+		if err != nil {
+			return err
+		}
+		entry.repo = r
+	} else {
+		c.counter("repo").hits.Add(1)
+	}
+
+	return fn(entry)
+}
+
+// entry returns the cache entry of a repository, creating it if needed
+func (c *RepoCache) entry(repoPath string) *cachedRepo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.repos[repoPath]
+	if !ok {
+		entry = &cachedRepo{}
+		c.repos[repoPath] = entry
+	}
+	return entry
+}
+
+// Invalidate drops the opened repository and everything derived from its refs.
+// Per-commit results are kept since they can't change.
+func (c *RepoCache) Invalidate(repoPath string) {
+	c.mu.Lock()
+	delete(c.repos, repoPath)
+	c.mu.Unlock()
+	c.invalidations.Add(1)
+
+	c.listenersMu.Lock()
+	listeners := c.listeners
+	c.listenersMu.Unlock()
+	for _, fn := range listeners {
+		fn(repoPath)
+	}
+}
+
+// OnInvalidate registers fn to be called with the path of every repository whose refs changed
+func (c *RepoCache) OnInvalidate(fn func(repoPath string)) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	c.listeners = append(c.listeners, fn)
+}
+
+// Stats returns hit and miss counts per kind of cached data
+func (c *RepoCache) Stats() []CacheStats {
+	var stats []CacheStats
+	c.counters.Range(func(key, value interface{}) bool {
+		counter := value.(*cacheCounter)
+		s := CacheStats{
+			Kind:   key.(string),
+			Hits:   counter.hits.Load(),
+			Misses: counter.misses.Load(),
+		}
+		if total := s.Hits + s.Misses; total > 0 {
+			s.HitRate = float64(s.Hits) / float64(total)
+		}
+		stats = append(stats, s)
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Kind < stats[j].Kind
+	})
+	return stats
+}
+
+// counter returns the hit/miss counter of a kind of cached data
+func (c *RepoCache) counter(kind string) *cacheCounter {
+	counter, _ := c.counters.LoadOrStore(kind, &cacheCounter{})
+	return counter.(*cacheCounter)
+}
+
+// cachedResult returns the memoised result for key, computing and storing it on a miss
+func cachedResult[T any](c *RepoCache, key resultKey, compute func() (T, error)) (T, error) {
+	c.mu.Lock()
+	v, ok := c.results[key]
+	c.mu.Unlock()
+	if ok {
+		c.counter(key.kind).hits.Add(1)
+		return v.(T), nil
+	}
+
+	c.counter(key.kind).misses.Add(1)
+	result, err := compute()
+	if err != nil {
+		return result, err
+	}
+
+	c.mu.Lock()
+	if _, exists := c.results[key]; !exists {
+		c.results[key] = result
+		c.order = append(c.order, key)
+		for len(c.order) > maxCachedResults {
+			delete(c.results, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+	c.mu.Unlock()
+
+	return result, nil
+}
+
+// repoSummary returns the cached index page summary of a repository
+func (c *RepoCache) repoSummary(repoPath string, compute func(r *git.Repository) Repo) (Repo, error) {
+	var summary Repo
+	err := c.withEntry(repoPath, func(entry *cachedRepo) error {
+		if entry.summary != nil {
+			c.counter("summary").hits.Add(1)
+			summary = *entry.summary
+			return nil
+		}
+		c.counter("summary").misses.Add(1)
+		summary = compute(entry.repo)
+		entry.summary = &summary
+		return nil
+	})
+	return summary, err
+}
+
+// Watch invalidates repositories when their refs change on disk, it never returns
+func (c *RepoCache) Watch(reposPath string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Repository cache: file watching unavailable, relying on hook notifications: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(reposPath); err != nil {
+		log.Printf("Repository cache: failed to watch %s: %v", reposPath, err)
+		return
+	}
+	watchRepos(watcher, reposPath)
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			c.handleEvent(watcher, reposPath, event)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Repository cache: watch error: %v", err)
+		}
+	}
+}
+
+// handleEvent invalidates the repository a file system event belongs to if it touched its refs
+func (c *RepoCache) handleEvent(watcher *fsnotify.Watcher, reposPath string, event fsnotify.Event) {
+	rel, err := filepath.Rel(reposPath, event.Name)
+	if err != nil || strings.HasSuffix(rel, ".lock") {
+		return
+	}
+	// Repositories can be in groups, the first segment ending in .git is the repository
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	i := slices.IndexFunc(segments, func(segment string) bool { return strings.HasSuffix(segment, ".git") })
+	if i < 0 {
+		// A group was created, possibly moved here with repositories in it
+		if event.Has(fsnotify.Create) {
+			if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+				watchRepos(watcher, event.Name)
+				for _, repoPath := range repoPaths(event.Name) {
+					c.Invalidate(repoPath)
+				}
+			}
+		}
+		return
+	}
+	repoPath := filepath.Join(reposPath, filepath.FromSlash(strings.Join(segments[:i+1], "/")))
+	rest := strings.Join(segments[i+1:], "/")
+
+	// A repository was created or removed
+	if rest == "" {
+		if event.Has(fsnotify.Create) {
+			watchRepoRefs(watcher, repoPath)
+		}
+		c.Invalidate(repoPath)
+		return
+	}
+
+	inRefs := rest == "refs" || strings.HasPrefix(rest, "refs/")
+	if !inRefs && rest != "HEAD" && rest != "packed-refs" {
+		return
+	}
+	if inRefs && event.Has(fsnotify.Create) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			watchTree(watcher, event.Name)
+		}
+	}
+	c.Invalidate(repoPath)
+}
+
+// watchRepos watches the groups under dir and the refs of the repositories in them
+func watchRepos(watcher *fsnotify.Watcher, dir string) {
+	walkRepos(dir, func(path string, isRepo bool) {
+		if isRepo {
+			watchRepoRefs(watcher, path)
+		} else if err := watcher.Add(path); err != nil {
+			log.Printf("Repository cache: failed to watch %s: %v", path, err)
+		}
+	})
+}
+
+// watchRepoRefs watches a repository's HEAD, packed-refs and refs directory
+func watchRepoRefs(watcher *fsnotify.Watcher, repoPath string) {
+	if err := watcher.Add(repoPath); err != nil {
+		log.Printf("Repository cache: failed to watch %s: %v", repoPath, err)
+		return
+	}
+	watchTree(watcher, filepath.Join(repoPath, "refs"))
+}
+
+// watchTree watches a directory and all of its subdirectories
+func watchTree(watcher *fsnotify.Watcher, root string) {
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if err := watcher.Add(path); err != nil {
+				log.Printf("Repository cache: failed to watch %s: %v", path, err)
+			}
+		}
+		return nil
+	})
+}
+
+// handleRefsChanged lets git hooks report ref updates, for file systems without change notifications
+func (s *Server) handleRefsChanged(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) && !isLoopbackRequest(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "Access denied"})
+		return
+	}
+
+	repoName := repoParam(r)
+	if !RepoExists(s.reposPath, repoName) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Repository not found"})
+		return
+	}
+
+	repoCache.Invalidate(filepath.Join(s.reposPath, repoName+".git"))
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleAPICacheStats returns repository cache hit metrics (tailnet only)
+func (s *Server) handleAPICacheStats(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "Access denied - Tailnet required"})
+		return
+	}
+
+	stats := repoCache.Stats()
+	if stats == nil {
+		stats = []CacheStats{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"stats":         stats,
+		"invalidations": repoCache.invalidations.Load(),
+	})
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/gob"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// maxCommitResults limits the number of commits returned by a commit search
+const maxCommitResults = 100
+
+// commitRepoIndex holds the metadata of every commit reachable from a repository's refs
+type commitRepoIndex struct {
+	Repo    string
+	Tips    map[string]string // Ref name -> commit hash at the time of indexing
+	Commits []Commit
+}
+
+// CommitQuery describes a commit metadata search
+type CommitQuery struct {
+	Text   string // Matched against the message and the hash prefix
+	Author string // Matched against the author name and email
+	Repos  []string
+	Limit  int
+}
+
+// CommitSearchResult is a commit found by a commit search
+type CommitSearchResult struct {
+	Repo      string    `json:"repo"`
+	Hash      string    `json:"hash"`
+	ShortHash string    `json:"short_hash"`
+	Author    string    `json:"author"`
+	Email     string    `json:"email"`
+	Date      time.Time `json:"date"`
+	Message   string    `json:"message"`
+}
+
+// CommitIndex maintains an on-disk index of commit metadata across all repositories
+type CommitIndex struct {
+	reposPath string
+	dir       string
+
+	mu    sync.RWMutex
+	repos map[string]*commitRepoIndex
+}
+
+// NewCommitIndex creates a commit index stored in dir and loads existing index files
+func NewCommitIndex(reposPath, dir string) (*CommitIndex, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	ci := &CommitIndex{
+		reposPath: reposPath,
+		dir:       dir,
+		repos:     make(map[string]*commitRepoIndex),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".idx") {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var idx commitRepoIndex
+		err = gob.NewDecoder(f).Decode(&idx)
+		f.Close()
+		if err != nil {
+			log.Printf("Commit index: ignoring %s: %v", entry.Name(), err)
+			continue
+		}
+		ci.repos[idx.Repo] = &idx
+	}
+
+	return ci, nil
+}
+
+// Run updates the index periodically, it never returns
+func (ci *CommitIndex) Run(interval time.Duration) {
+	for {
+		if err := ci.Update(); err != nil {
+			log.Printf("Commit index update failed: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Update indexes new commits in every repository
+func (ci *CommitIndex) Update() error {
+	repos, err := ListRepos(ci.reposPath, true)
+	if err != nil {
+		return err
+	}
+
+	present := make(map[string]bool)
+	for _, repo := range repos {
+		present[repo.Name] = true
+		if err := ci.UpdateRepo(repo.Name); err != nil {
+			log.Printf("Commit index: failed to index %s: %v", repo.Name, err)
+		}
+	}
+
+	// Drop indexes of repositories that no longer exist
+	ci.mu.Lock()
+	for name := range ci.repos {
+		if !present[name] {
+			delete(ci.repos, name)
+			os.Remove(ci.indexPath(name))
+		}
+	}
+	ci.mu.Unlock()
+
+	return nil
+}
+
+// UpdateRepo indexes the commits added since the last indexed tips. When a ref was
+// deleted or rewound (force push) the repository is re-indexed from scratch, so
+// commits that are no longer reachable disappear from the results.
+func (ci *CommitIndex) UpdateRepo(repoName string) error {
+	r, err := git.PlainOpen(filepath.Join(ci.reposPath, repoName+".git"))
+	if err != nil {
+		return err
+	}
+
+	tips, err := refTips(r)
+	if err != nil {
+		return err
+	}
+
+	ci.mu.RLock()
+	previous := ci.repos[repoName]
+	ci.mu.RUnlock()
+
+	idx := &commitRepoIndex{Repo: repoName, Tips: tips}
+	known := make(map[plumbing.Hash]bool)
+	if previous != nil && canIndexIncrementally(r, previous.Tips, tips) {
+		if sameTips(previous.Tips, tips) {
+			return nil
+		}
+		idx.Commits = append(idx.Commits, previous.Commits...)
+		for _, c := range previous.Commits {
+			known[plumbing.NewHash(c.Hash)] = true
+		}
+	}
+
+	added := 0
+	for _, tip := range tips {
+		commit, err := peelToCommit(r, plumbing.NewHash(tip))
+		if err != nil || known[commit.Hash] {
+			continue
+		}
+		iter := object.NewCommitPreorderIter(commit, known, nil)
+		err = iter.ForEach(func(c *object.Commit) error {
+			known[c.Hash] = true
+			idx.Commits = append(idx.Commits, Commit{
+				Hash:      c.Hash.String(),
+				ShortHash: c.Hash.String()[:8],
+				Message:   strings.TrimSpace(c.Message),
+				Author:    c.Author.Name,
+				Email:     c.Author.Email,
+				Date:      c.Author.When,
+			})
+			added++
+			return nil
+		})
+		iter.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := ci.save(idx); err != nil {
+		return err
+	}
+
+	ci.mu.Lock()
+	ci.repos[repoName] = idx
+	ci.mu.Unlock()
+
+	if added > 0 {
+		log.Printf("Commit index: indexed %d new commits in %s", added, repoName)
+	}
+	return nil
+}
+
+// Search returns commits matching the query, newest first
+func (ci *CommitIndex) Search(q CommitQuery) []CommitSearchResult {
+	text := strings.ToLower(strings.TrimSpace(q.Text))
+	author := strings.ToLower(strings.TrimSpace(q.Author))
+	limit := q.Limit
+	if limit <= 0 || limit > maxCommitResults {
+		limit = maxCommitResults
+	}
+
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	var results []CommitSearchResult
+	for _, name := range q.Repos {
+		idx, ok := ci.repos[name]
+		if !ok {
+			continue
+		}
+		for _, c := range idx.Commits {
+			if text != "" && !strings.HasPrefix(c.Hash, text) && !strings.Contains(strings.ToLower(c.Message), text) {
+				continue
+			}
+			if author != "" && !strings.Contains(strings.ToLower(c.Author), author) && !strings.Contains(strings.ToLower(c.Email), author) {
+				continue
+			}
+			results = append(results, CommitSearchResult{
+				Repo:      name,
+				Hash:      c.Hash,
+				ShortHash: c.ShortHash,
+				Author:    c.Author,
+				Email:     c.Email,
+				Date:      c.Date,
+				Message:   c.Message,
+			})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Date.After(results[j].Date)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// save writes a repository's commit index to disk atomically
+func (ci *CommitIndex) save(idx *commitRepoIndex) error {
+	path := ci.indexPath(idx.Repo)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(idx); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// indexPath returns the index file of a repository, the slashes of groups escaped
+func (ci *CommitIndex) indexPath(repoName string) string {
+	return filepath.Join(ci.dir, url.PathEscape(repoName)+".idx")
+}
+
+// refTips returns the hashes of all branches and tags
+func refTips(r *git.Repository) (map[string]string, error) {
+	refs, err := r.References()
+	if err != nil {
+		return nil, err
+	}
+	defer refs.Close()
+
+	tips := make(map[string]string)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && (ref.Name().IsBranch() || ref.Name().IsTag()) {
+			tips[ref.Name().String()] = ref.Hash().String()
+		}
+		return nil
+	})
+	return tips, err
+}
+
+// sameTips reports whether two sets of ref tips are identical
+func sameTips(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, hash := range a {
+		if b[name] != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// canIndexIncrementally reports whether every previously indexed ref still exists
+// and only moved forward, so previously indexed commits are still reachable
+func canIndexIncrementally(r *git.Repository, previous, current map[string]string) bool {
+	for name, oldHash := range previous {
+		newHash, ok := current[name]
+		if !ok {
+			return false
+		}
+		if newHash == oldHash {
+			continue
+		}
+		oldCommit, err := peelToCommit(r, plumbing.NewHash(oldHash))
+		if err != nil {
+			return false
+		}
+		newCommit, err := peelToCommit(r, plumbing.NewHash(newHash))
+		if err != nil {
+			return false
+		}
+		if ok, err := oldCommit.IsAncestor(newCommit); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// commitQueryFromRequest builds a commit query from URL parameters, limited to visible repositories
+func (s *Server) commitQueryFromRequest(r *http.Request) (CommitQuery, error) {
+	repos, err := ListRepos(s.reposPath, s.isTailnetRequest(r))
+	if err != nil {
+		return CommitQuery{}, err
+	}
+
+	q := CommitQuery{
+		Text:   r.URL.Query().Get("q"),
+		Author: r.URL.Query().Get("author"),
+	}
+	q.Limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
+
+	only := r.URL.Query().Get("repo")
+	for _, repo := range repos {
+		if only == "" || only == repo.Name {
+			q.Repos = append(q.Repos, repo.Name)
+		}
+	}
+	return q, nil
+}
+
+// handleCommitSearch searches commit messages and authors across visible repositories
+func (s *Server) handleCommitSearch(w http.ResponseWriter, r *http.Request) {
+	q, err := s.commitQueryFromRequest(r)
+	if err != nil {
+		log.Printf("Error listing repos: %v", err)
+		http.Error(w, "Error listing repositories", http.StatusInternalServerError)
+		return
+	}
+
+	var results []CommitSearchResult
+	if q.Text != "" || q.Author != "" {
+		results = s.commits.Search(q)
+	}
+
+	data := map[string]interface{}{
+		"Title":      "Commit Search",
+		"Query":      q.Text,
+		"Author":     q.Author,
+		"Repo":       r.URL.Query().Get("repo"),
+		"Searched":   q.Text != "" || q.Author != "",
+		"Results":    results,
+		"Truncated":  len(results) >= maxCommitResults,
+		"IsTailnet":  s.isTailnetRequest(r),
+		"PublicURL":  s.publicURL,
+		"TailnetURL": s.tailnetURL,
+	}
+
+	s.renderTemplate(w, "commit-search.html", data)
+}
@@ -24,6 +24,10 @@ type Repo struct {
 	Description string
 	IsPublic    bool
 	LastCommit  time.Time
+	MirrorURL   string // Upstream of a pull mirror, empty otherwise
+	IsTemplate  bool
+	IsArchived  bool
+	Topics      []string
 }
 
 // TreeEntry represents a file or directory in a git tree
@@ -103,38 +107,23 @@ type DiffStats struct {
 
 // ListRepos returns a list of repositories in the given path
 func ListRepos(reposPath string, showPrivate bool) ([]Repo, error) {
-	entries, err := os.ReadDir(reposPath)
-	if err != nil {
-		return nil, err
-	}
-
 	var repos []Repo
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-
-		name := entry.Name()
-		// Only consider directories ending with .git
-		if !strings.HasSuffix(name, ".git") {
-			continue
+	err := walkRepos(reposPath, func(repoPath string, isRepo bool) {
+		if !isRepo {
+			return
 		}
 
-		repoPath := filepath.Join(reposPath, name)
-		isPublic := IsPublicRepo(repoPath)
+		isPublic := IsPublicRepo(reposPath, repoPath)
 
 		// Skip private repos if not showing private
 		if !showPrivate && !isPublic {
-			continue
-		}
-
-		repo := Repo{
-			Name:     strings.TrimSuffix(name, ".git"),
-			IsPublic: isPublic,
+			return
 		}
 
-		// Try to get last commit time and use commit message as description
-		if r, err := git.PlainOpen(repoPath); err == nil {
+		// The summary only changes when refs move, so it is cached until then
+		repo, _ := repoCache.repoSummary(repoPath, func(r *git.Repository) Repo {
+			var repo Repo
+			// Try to get last commit time and use commit message as fallback description
 			if head, err := r.Head(); err == nil {
 				if commit, err := r.CommitObject(head.Hash()); err == nil {
 					repo.LastCommit = commit.Author.When
@@ -146,9 +135,22 @@ func ListRepos(reposPath string, showPrivate bool) ([]Repo, error) {
 					repo.Description = msg
 				}
 			}
+			return repo
+		})
+		repo.Name = repoNameOf(reposPath, repoPath)
+		repo.IsPublic = isPublic
+		repo.MirrorURL = pullMirrorURL(repoPath)
+		repo.IsTemplate = IsTemplateRepo(repoPath)
+		repo.IsArchived = IsArchivedRepo(repoPath)
+		repo.Topics = ReadRepoTopics(repoPath)
+		if description := ReadDescription(repoPath); description != "" {
+			repo.Description = description
 		}
 
 		repos = append(repos, repo)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Sort by last commit time, most recent first
@@ -159,8 +161,27 @@ func ListRepos(reposPath string, showPrivate bool) ([]Repo, error) {
 	return repos, nil
 }
 
-// IsPublicRepo checks if a repository has git-daemon-export-ok file
-func IsPublicRepo(repoPath string) bool {
+// ReadDescription returns the description of a repository from its description file, or ""
+// if it has none or still git's default
+func ReadDescription(repoPath string) string {
+	data, err := os.ReadFile(filepath.Join(repoPath, "description"))
+	if err != nil {
+		return ""
+	}
+	description := strings.TrimSpace(string(data))
+	if strings.HasPrefix(description, "Unnamed repository") {
+		return ""
+	}
+	return description
+}
+
+// IsPublicRepo checks if a repository is exported and isn't in a private group of reposPath
+func IsPublicRepo(reposPath, repoPath string) bool {
+	return isExportedRepo(repoPath) && !inPrivateGroup(reposPath, repoPath)
+}
+
+// isExportedRepo checks if a repository has git-daemon-export-ok file, its own visibility
+func isExportedRepo(repoPath string) bool {
 	exportOkPath := filepath.Join(repoPath, "git-daemon-export-ok")
 	_, err := os.Stat(exportOkPath)
 	return err == nil
@@ -168,33 +189,42 @@ func IsPublicRepo(repoPath string) bool {
 
 // GetDefaultBranch returns the default branch (HEAD target) for a repository
 func GetDefaultBranch(repoPath string) (string, error) {
-	r, err := git.PlainOpen(repoPath)
-	if err != nil {
-		return "", err
-	}
-
-	head, err := r.Head()
-	if err != nil {
-		return "", err
-	}
+	return withCachedRepo(repoPath, func(r *git.Repository) (string, error) {
+		head, err := r.Head()
+		if err != nil {
+			return "", err
+		}
+		return head.Name().Short(), nil
+	})
+}
 
-	return head.Name().Short(), nil
+// resolveCommit resolves a revision to a commit hash using the cached repository
+func resolveCommit(repoPath, ref string) (plumbing.Hash, error) {
+	return withCachedRepo(repoPath, func(r *git.Repository) (plumbing.Hash, error) {
+		return resolveRef(r, ref)
+	})
 }
 
-// GetTree returns the tree entries for a given path in a repository
+// GetTree returns the tree entries for a given path in a repository. The result is
+// shared with the cache and must not be modified.
 func GetTree(reposPath, repoName, ref, path string) ([]TreeEntry, error) {
 	repoPath := filepath.Join(reposPath, repoName+".git")
-	r, err := git.PlainOpen(repoPath)
+	hash, err := resolveCommit(repoPath, ref)
 	if err != nil {
 		return nil, err
 	}
 
-	// Resolve the reference
-	hash, err := resolveRef(r, ref)
-	if err != nil {
-		return nil, err
-	}
+	path = strings.Trim(path, "/")
+	key := resultKey{repoPath: repoPath, kind: "tree", commit: hash, path: path}
+	return cachedResult(repoCache, key, func() ([]TreeEntry, error) {
+		return withCachedRepo(repoPath, func(r *git.Repository) ([]TreeEntry, error) {
+			return readTree(r, hash, path)
+		})
+	})
+}
 
+// readTree reads the entries of a directory at the given commit
+func readTree(r *git.Repository, hash plumbing.Hash, path string) ([]TreeEntry, error) {
 	commit, err := r.CommitObject(hash)
 	if err != nil {
 		return nil, err
@@ -206,8 +236,7 @@ func GetTree(reposPath, repoName, ref, path string) ([]TreeEntry, error) {
 	}
 
 	// Navigate to the requested path
-	if path != "" && path != "/" {
-		path = strings.Trim(path, "/")
+	if path != "" {
 		tree, err = tree.Tree(path)
 		if err != nil {
 			return nil, err
@@ -254,153 +283,108 @@ func GetTree(reposPath, repoName, ref, path string) ([]TreeEntry, error) {
 // GetBlob returns the content of a file in a repository
 func GetBlob(reposPath, repoName, ref, path string) ([]byte, error) {
 	repoPath := filepath.Join(reposPath, repoName+".git")
-	r, err := git.PlainOpen(repoPath)
-	if err != nil {
-		return nil, err
-	}
-
-	// Resolve the reference
-	hash, err := resolveRef(r, ref)
-	if err != nil {
-		return nil, err
-	}
+	return withCachedRepo(repoPath, func(r *git.Repository) ([]byte, error) {
+		// Resolve the reference
+		hash, err := resolveRef(r, ref)
+		if err != nil {
+			return nil, err
+		}
 
-	commit, err := r.CommitObject(hash)
-	if err != nil {
-		return nil, err
-	}
+		commit, err := r.CommitObject(hash)
+		if err != nil {
+			return nil, err
+		}
 
-	tree, err := commit.Tree()
-	if err != nil {
-		return nil, err
-	}
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, err
+		}
 
-	path = strings.Trim(path, "/")
-	file, err := tree.File(path)
-	if err != nil {
-		return nil, err
-	}
+		path = strings.Trim(path, "/")
+		file, err := tree.File(path)
+		if err != nil {
+			return nil, err
+		}
 
-	reader, err := file.Reader()
-	if err != nil {
-		return nil, err
-	}
-	defer reader.Close()
+		reader, err := file.Reader()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
 
-	return io.ReadAll(reader)
+		return io.ReadAll(reader)
+	})
 }
 
 // GetCommits returns the commit history for a repository
 func GetCommits(reposPath, repoName, ref string, limit int) ([]Commit, error) {
 	repoPath := filepath.Join(reposPath, repoName+".git")
-	r, err := git.PlainOpen(repoPath)
-	if err != nil {
-		return nil, err
-	}
+	return withCachedRepo(repoPath, func(r *git.Repository) ([]Commit, error) {
+		// Resolve the reference
+		hash, err := resolveRef(r, ref)
+		if err != nil {
+			return nil, err
+		}
 
-	// Resolve the reference
-	hash, err := resolveRef(r, ref)
-	if err != nil {
-		return nil, err
-	}
+		// Get commit iterator
+		iter, err := r.Log(&git.LogOptions{
+			From:  hash,
+			Order: git.LogOrderCommitterTime,
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer iter.Close()
 
-	// Get commit iterator
-	iter, err := r.Log(&git.LogOptions{
-		From:  hash,
-		Order: git.LogOrderCommitterTime,
-	})
-	if err != nil {
-		return nil, err
-	}
-	defer iter.Close()
-
-	var commits []Commit
-	count := 0
-	err = iter.ForEach(func(c *object.Commit) error {
-		if limit > 0 && count >= limit {
-			return io.EOF
-		}
-
-		commits = append(commits, Commit{
-			Hash:      c.Hash.String(),
-			ShortHash: c.Hash.String()[:8],
-			Message:   strings.TrimSpace(c.Message),
-			Author:    c.Author.Name,
-			Email:     c.Author.Email,
-			Date:      c.Author.When,
+		var commits []Commit
+		count := 0
+		err = iter.ForEach(func(c *object.Commit) error {
+			if limit > 0 && count >= limit {
+				return io.EOF
+			}
+
+			commits = append(commits, Commit{
+				Hash:      c.Hash.String(),
+				ShortHash: c.Hash.String()[:8],
+				Message:   strings.TrimSpace(c.Message),
+				Author:    c.Author.Name,
+				Email:     c.Author.Email,
+				Date:      c.Author.When,
+			})
+			count++
+			return nil
 		})
-		count++
-		return nil
-	})
 
-	if err != nil && err != io.EOF {
-		return nil, err
-	}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
 
-	return commits, nil
+		return commits, nil
+	})
 }
 
 // GetBranches returns the list of branches for a repository
 func GetBranches(reposPath, repoName string) ([]string, error) {
 	repoPath := filepath.Join(reposPath, repoName+".git")
-	r, err := git.PlainOpen(repoPath)
-	if err != nil {
-		return nil, err
-	}
-
-	iter, err := r.Branches()
-	if err != nil {
-		return nil, err
-	}
-	defer iter.Close()
-
-	var branches []string
-	err = iter.ForEach(func(ref *plumbing.Reference) error {
-		branches = append(branches, ref.Name().Short())
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	sort.Strings(branches)
-	return branches, nil
-}
-
-// resolveRef resolves a branch name, tag, or commit hash to a commit hash
-func resolveRef(r *git.Repository, ref string) (plumbing.Hash, error) {
-	// First try as a branch
-	branchRef, err := r.Reference(plumbing.NewBranchReferenceName(ref), true)
-	if err == nil {
-		return branchRef.Hash(), nil
-	}
-
-	// Try as a tag
-	tagRef, err := r.Reference(plumbing.NewTagReferenceName(ref), true)
-	if err == nil {
-		return tagRef.Hash(), nil
-	}
-
-	// Try as HEAD
-	if ref == "HEAD" || ref == "" {
-		head, err := r.Head()
-		if err == nil {
-			return head.Hash(), nil
+	return withCachedRepo(repoPath, func(r *git.Repository) ([]string, error) {
+		iter, err := r.Branches()
+		if err != nil {
+			return nil, err
 		}
-	}
+		defer iter.Close()
 
-	// Try as a commit hash
-	hash := plumbing.NewHash(ref)
-	if _, err := r.CommitObject(hash); err == nil {
-		return hash, nil
-	}
+		var branches []string
+		err = iter.ForEach(func(ref *plumbing.Reference) error {
+			branches = append(branches, ref.Name().Short())
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
 
-	// Default to HEAD
-	head, err := r.Head()
-	if err != nil {
-		return plumbing.ZeroHash, err
-	}
-	return head.Hash(), nil
+		sort.Strings(branches)
+		return branches, nil
+	})
 }
 
 // RepoExists checks if a repository exists
@@ -412,33 +396,43 @@ func RepoExists(reposPath, repoName string) bool {
 
 // IsEmptyRepo checks if a repository has no commits
 func IsEmptyRepo(repoPath string) bool {
-	r, err := git.PlainOpen(repoPath)
-	if err != nil {
-		return true
-	}
+	empty, err := withCachedRepo(repoPath, func(r *git.Repository) (bool, error) {
+		// First try HEAD
+		if _, err := r.Head(); err == nil {
+			return false, nil
+		}
 
-	// First try HEAD
-	_, err = r.Head()
-	if err == nil {
-		return false
-	}
+		// HEAD might point to non-existent branch, check if any branches exist
+		refs, err := r.References()
+		if err != nil {
+			return true, nil
+		}
 
-	// HEAD might point to non-existent branch, check if any branches exist
-	refs, err := r.References()
-	if err != nil {
-		return true
-	}
+		hasCommits := false
+		refs.ForEach(func(ref *plumbing.Reference) error {
+			if ref.Name().IsBranch() {
+				hasCommits = true
+				return io.EOF // Stop iteration
+			}
+			return nil
+		})
 
-	hasCommits := false
-	refs.ForEach(func(ref *plumbing.Reference) error {
-		if ref.Name().IsBranch() {
-			hasCommits = true
-			return io.EOF // Stop iteration
-		}
-		return nil
+		return !hasCommits, nil
 	})
+	return err != nil || empty
+}
 
-	return !hasCommits
+// validRepoName reports whether a repository name only has alphanumerics, dashes, underscores and dots
+func validRepoName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
 }
 
 // CreateBareRepo creates a new bare git repository
@@ -450,155 +444,157 @@ func CreateBareRepo(repoPath string) error {
 // GetCommitDetails returns detailed information about a specific commit
 func GetCommitDetails(reposPath, repoName, hash string) (*Commit, error) {
 	repoPath := filepath.Join(reposPath, repoName+".git")
-	r, err := git.PlainOpen(repoPath)
-	if err != nil {
-		return nil, err
-	}
-
-	commitHash := plumbing.NewHash(hash)
-	commit, err := r.CommitObject(commitHash)
-	if err != nil {
-		return nil, err
-	}
-
-	return &Commit{
-		Hash:      commit.Hash.String(),
-		ShortHash: commit.Hash.String()[:8],
-		Message:   strings.TrimSpace(commit.Message),
-		Author:    commit.Author.Name,
-		Email:     commit.Author.Email,
-		Date:      commit.Author.When,
-	}, nil
-}
-
-// GetCommitDiff returns the diff for a specific commit
-func GetCommitDiff(reposPath, repoName, hash string) (*CommitDiff, error) {
-	repoPath := filepath.Join(reposPath, repoName+".git")
-	r, err := git.PlainOpen(repoPath)
-	if err != nil {
-		return nil, err
-	}
+	return withCachedRepo(repoPath, func(r *git.Repository) (*Commit, error) {
+		commitHash, err := resolveRef(r, hash)
+		if err != nil {
+			return nil, err
+		}
 
-	commitHash := plumbing.NewHash(hash)
-	commit, err := r.CommitObject(commitHash)
-	if err != nil {
-		return nil, err
-	}
+		commit, err := r.CommitObject(commitHash)
+		if err != nil {
+			return nil, err
+		}
 
-	result := &CommitDiff{
-		Commit: Commit{
+		return &Commit{
 			Hash:      commit.Hash.String(),
 			ShortHash: commit.Hash.String()[:8],
 			Message:   strings.TrimSpace(commit.Message),
 			Author:    commit.Author.Name,
 			Email:     commit.Author.Email,
 			Date:      commit.Author.When,
-		},
-	}
+		}, nil
+	})
+}
 
-	// Get parent commit for diff
-	var parentTree *object.Tree
-	if commit.NumParents() > 0 {
-		parent, err := commit.Parent(0)
-		if err == nil {
-			result.ParentHash = parent.Hash.String()[:8]
-			parentTree, _ = parent.Tree()
+// GetCommitDiff returns the diff for a specific commit
+func GetCommitDiff(reposPath, repoName, hash string) (*CommitDiff, error) {
+	repoPath := filepath.Join(reposPath, repoName+".git")
+	return withCachedRepo(repoPath, func(r *git.Repository) (*CommitDiff, error) {
+		commitHash, err := resolveRef(r, hash)
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	// Get current commit's tree
-	currentTree, err := commit.Tree()
-	if err != nil {
-		return result, nil // Return commit info without diff
-	}
+		commit, err := r.CommitObject(commitHash)
+		if err != nil {
+			return nil, err
+		}
 
-	// Calculate diff between parent and current
-	var changes object.Changes
-	if parentTree != nil {
-		changes, err = parentTree.Diff(currentTree)
-	} else {
-		// First commit - show all files as added
-		changes, err = object.DiffTree(nil, currentTree)
-	}
-	if err != nil {
-		return result, nil
-	}
+		result := &CommitDiff{
+			Commit: Commit{
+				Hash:      commit.Hash.String(),
+				ShortHash: commit.Hash.String()[:8],
+				Message:   strings.TrimSpace(commit.Message),
+				Author:    commit.Author.Name,
+				Email:     commit.Author.Email,
+				Date:      commit.Author.When,
+			},
+		}
 
-	// Process each changed file
-	for _, change := range changes {
-		fileDiff := FileDiff{}
+		// Get parent commit for diff
+		var parentTree *object.Tree
+		if commit.NumParents() > 0 {
+			parent, err := commit.Parent(0)
+			if err == nil {
+				result.ParentHash = parent.Hash.String()[:8]
+				parentTree, _ = parent.Tree()
+			}
+		}
 
-		// Determine file status and names
-		action, err := change.Action()
+		// Get current commit's tree
+		currentTree, err := commit.Tree()
 		if err != nil {
-			continue
+			return result, nil // Return commit info without diff
 		}
 
-		switch action {
-		case 1: // Insert
-			fileDiff.Status = "added"
-			fileDiff.Name = change.To.Name
-		case 2: // Delete
-			fileDiff.Status = "deleted"
-			fileDiff.Name = change.From.Name
-		case 3: // Modify
-			if change.From.Name != change.To.Name {
-				fileDiff.Status = "renamed"
-				fileDiff.OldName = change.From.Name
-				fileDiff.Name = change.To.Name
-			} else {
-				fileDiff.Status = "modified"
-				fileDiff.Name = change.To.Name
-			}
+		// Calculate diff between parent and current
+		var changes object.Changes
+		if parentTree != nil {
+			changes, err = parentTree.Diff(currentTree)
+		} else {
+			// First commit - show all files as added
+			changes, err = object.DiffTree(nil, currentTree)
+		}
+		if err != nil {
+			return result, nil
 		}
 
-		// Get file patch for diff lines
-		patch, err := change.Patch()
-		if err == nil && patch != nil {
-			for _, fp := range patch.FilePatches() {
-				if fp.IsBinary() {
-					fileDiff.IsBinary = true
-					continue
-				}
+		// Process each changed file
+		for _, change := range changes {
+			fileDiff := FileDiff{}
 
-				for _, chunk := range fp.Chunks() {
-					diffChunk := DiffChunk{}
-					lines := strings.Split(chunk.Content(), "\n")
+			// Determine file status and names
+			action, err := change.Action()
+			if err != nil {
+				continue
+			}
 
-					for _, line := range lines {
-						if line == "" {
-							continue
-						}
-						diffLine := DiffLine{Content: line}
-
-						switch chunk.Type() {
-						case 0: // Equal
-							diffLine.Type = "context"
-						case 1: // Add
-							diffLine.Type = "add"
-							fileDiff.Additions++
-							result.Stats.Additions++
-						case 2: // Delete
-							diffLine.Type = "delete"
-							fileDiff.Deletions++
-							result.Stats.Deletions++
-						}
+			switch action {
+			case 1: // Insert
+				fileDiff.Status = "added"
+				fileDiff.Name = change.To.Name
+			case 2: // Delete
+				fileDiff.Status = "deleted"
+				fileDiff.Name = change.From.Name
+			case 3: // Modify
+				if change.From.Name != change.To.Name {
+					fileDiff.Status = "renamed"
+					fileDiff.OldName = change.From.Name
+					fileDiff.Name = change.To.Name
+				} else {
+					fileDiff.Status = "modified"
+					fileDiff.Name = change.To.Name
+				}
+			}
 
-						diffChunk.Lines = append(diffChunk.Lines, diffLine)
+			// Get file patch for diff lines
+			patch, err := change.Patch()
+			if err == nil && patch != nil {
+				for _, fp := range patch.FilePatches() {
+					if fp.IsBinary() {
+						fileDiff.IsBinary = true
+						continue
 					}
 
-					if len(diffChunk.Lines) > 0 {
-						fileDiff.Chunks = append(fileDiff.Chunks, diffChunk)
+					for _, chunk := range fp.Chunks() {
+						diffChunk := DiffChunk{}
+						lines := strings.Split(chunk.Content(), "\n")
+
+						for _, line := range lines {
+							if line == "" {
+								continue
+							}
+							diffLine := DiffLine{Content: line}
+
+							switch chunk.Type() {
+							case 0: // Equal
+								diffLine.Type = "context"
+							case 1: // Add
+								diffLine.Type = "add"
+								fileDiff.Additions++
+								result.Stats.Additions++
+							case 2: // Delete
+								diffLine.Type = "delete"
+								fileDiff.Deletions++
+								result.Stats.Deletions++
+							}
+
+							diffChunk.Lines = append(diffChunk.Lines, diffLine)
+						}
+
+						if len(diffChunk.Lines) > 0 {
+							fileDiff.Chunks = append(fileDiff.Chunks, diffChunk)
+						}
 					}
 				}
 			}
-		}
 
-		result.Files = append(result.Files, fileDiff)
-		result.Stats.FilesChanged++
-	}
+			result.Files = append(result.Files, fileDiff)
+			result.Stats.FilesChanged++
+		}
 
-	return result, nil
+		return result, nil
+	})
 }
 
 // ParseGitmodules reads and parses .gitmodules from a tree at given ref
@@ -665,31 +661,33 @@ func formatWebURL(host, path, hash string) string {
 // GetSubmoduleInfo returns detailed information about a specific submodule
 func GetSubmoduleInfo(reposPath, repoName, ref, submodulePath string) (*SubmoduleInfo, error) {
 	repoPath := filepath.Join(reposPath, repoName+".git")
-	r, err := git.PlainOpen(repoPath)
-	if err != nil {
-		return nil, err
-	}
+	submodulePath = strings.Trim(submodulePath, "/")
 
-	hash, err := resolveRef(r, ref)
-	if err != nil {
-		return nil, err
-	}
+	entry, err := withCachedRepo(repoPath, func(r *git.Repository) (*object.TreeEntry, error) {
+		hash, err := resolveRef(r, ref)
+		if err != nil {
+			return nil, err
+		}
 
-	commit, err := r.CommitObject(hash)
-	if err != nil {
-		return nil, err
-	}
+		commit, err := r.CommitObject(hash)
+		if err != nil {
+			return nil, err
+		}
 
-	tree, err := commit.Tree()
-	if err != nil {
-		return nil, err
-	}
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, err
+		}
 
-	// Find the submodule entry in the tree
-	submodulePath = strings.Trim(submodulePath, "/")
-	entry, err := tree.FindEntry(submodulePath)
+		// Find the submodule entry in the tree
+		entry, err := tree.FindEntry(submodulePath)
+		if err != nil {
+			return nil, fmt.Errorf("submodule not found: %s", submodulePath)
+		}
+		return entry, nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("submodule not found: %s", submodulePath)
+		return nil, err
 	}
 
 	if entry.Mode != filemode.Submodule {
@@ -721,8 +719,24 @@ func GetSubmoduleInfo(reposPath, repoName, ref, submodulePath string) (*Submodul
 	return info, nil
 }
 
-// GetSubmodulesForPath returns submodule info for entries at a given path
+// GetSubmodulesForPath returns submodule info for entries at a given path.
+// The result is shared with the cache and must not be modified.
 func GetSubmodulesForPath(reposPath, repoName, ref, path string) (map[string]*SubmoduleInfo, error) {
+	repoPath := filepath.Join(reposPath, repoName+".git")
+	hash, err := resolveCommit(repoPath, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	path = strings.Trim(path, "/")
+	key := resultKey{repoPath: repoPath, kind: "submodules", commit: hash, path: path}
+	return cachedResult(repoCache, key, func() (map[string]*SubmoduleInfo, error) {
+		return readSubmodules(reposPath, repoName, hash.String(), path)
+	})
+}
+
+// readSubmodules builds the submodule info for entries at a given path
+func readSubmodules(reposPath, repoName, ref, path string) (map[string]*SubmoduleInfo, error) {
 	entries, err := GetTree(reposPath, repoName, ref, path)
 	if err != nil {
 		return nil, err
@@ -738,8 +752,8 @@ func GetSubmodulesForPath(reposPath, repoName, ref, path string) (map[string]*Su
 		}
 
 		fullPath := entry.Name
-		if path != "" && path != "/" {
-			fullPath = filepath.Join(strings.Trim(path, "/"), entry.Name)
+		if path != "" {
+			fullPath = filepath.Join(path, entry.Name)
 		}
 
 		info := &SubmoduleInfo{
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// groupConfigFile holds the settings of a group inside its directory
+const groupConfigFile = "gitraf-group.json"
+
+// GroupConfig holds the settings of a group, which the repositories and groups in it inherit
+type GroupConfig struct {
+	Description string `json:"description,omitempty"`
+	// Private hides the group and everything in it from outside the tailnet, whatever the
+	// visibility of its repositories
+	Private bool `json:"private,omitempty"`
+	// Admins are the admins of the repositories in the group that don't list their own
+	Admins []string `json:"admins,omitempty"`
+}
+
+// Group is a directory of repositories and other groups
+type Group struct {
+	Name        string
+	Description string
+	IsPublic    bool
+	Repos       int // Repositories in it and its subgroups that are listed
+}
+
+// loadGroupConfig loads the settings of the group at groupPath, a missing file means defaults
+func loadGroupConfig(groupPath string) (*GroupConfig, error) {
+	cfg := &GroupConfig{}
+	data, err := os.ReadFile(filepath.Join(groupPath, groupConfigFile))
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// saveGroupConfig saves the settings of the group at groupPath
+func saveGroupConfig(groupPath string, cfg *GroupConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(groupPath, groupConfigFile), data, 0644)
+}
+
+// parentGroupConfigs returns the settings of the groups a repository or group at path is in,
+// innermost first. Only group directories have settings files, so it looks at every
+// directory between path and reposPath.
+func parentGroupConfigs(reposPath, path string) []*GroupConfig {
+	var configs []*GroupConfig
+	root := filepath.Clean(reposPath) + string(filepath.Separator)
+	for dir := filepath.Dir(path); strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, groupConfigFile)); err != nil {
+			continue
+		}
+		cfg, err := loadGroupConfig(dir)
+		if err != nil {
+			log.Printf("Error reading group settings in %s: %v", dir, err)
+			continue
+		}
+		configs = append(configs, cfg)
+	}
+	return configs
+}
+
+// inPrivateGroup reports whether a repository or group at path is in a private group
+func inPrivateGroup(reposPath, path string) bool {
+	return slices.ContainsFunc(parentGroupConfigs(reposPath, path), func(cfg *GroupConfig) bool { return cfg.Private })
+}
+
+// inheritedAdmins returns the admins of the innermost group above path that lists any
+func inheritedAdmins(reposPath, path string) []string {
+	for _, cfg := range parentGroupConfigs(reposPath, path) {
+		if len(cfg.Admins) > 0 {
+			return cfg.Admins
+		}
+	}
+	return nil
+}
+
+// validRepoPath reports whether a repository or group name, with the groups it's in, only has
+// valid names separated by slashes
+func validRepoPath(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if !validRepoName(segment) || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// repoParam returns the repository named in a request's URL, with its groups. Their slashes
+// are escaped by routeNamespaces to fit in one segment.
+func repoParam(r *http.Request) string {
+	name, err := url.PathUnescape(chi.URLParam(r, "repo"))
+	if err != nil || !validRepoPath(name) {
+		return ""
+	}
+	return name
+}
+
+// GroupExists checks if a group, a directory of repositories, exists
+func GroupExists(reposPath, name string) bool {
+	if !validRepoPath(name) || strings.HasSuffix(name, ".git") {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(reposPath, name))
+	return err == nil && info.IsDir()
+}
+
+// checkNewRepoName returns why a repository can't be created or moved under a name, with the
+// HTTP status to answer with, or 0 if it can. A repository can't be a group at the same time.
+func checkNewRepoName(reposPath, name string) (int, string) {
+	segments := strings.Split(name, "/")
+	switch {
+	case !validRepoPath(name):
+		return http.StatusBadRequest, "Invalid repository name - only alphanumeric, dash, underscore, and dot allowed, with slashes after groups"
+	case slices.Contains(reservedRepoNames, segments[0]) || slices.Contains(segments, "-"):
+		return http.StatusBadRequest, fmt.Sprintf("%s is used by gitraf-server itself, choose another name", name)
+	case RepoExists(reposPath, name):
+		return http.StatusConflict, "Repository already exists"
+	case GroupExists(reposPath, name):
+		return http.StatusConflict, "A group with that name already exists"
+	}
+	for i := 1; i < len(segments); i++ {
+		group := strings.Join(segments[:i], "/")
+		if strings.HasSuffix(group, ".git") {
+			return http.StatusBadRequest, "Group names can't end in .git"
+		}
+		if RepoExists(reposPath, group) {
+			return http.StatusConflict, fmt.Sprintf("%s is a repository, it can't be a group as well", group)
+		}
+	}
+	return 0, ""
+}
+
+// createRepoGroups creates the groups a repository goes in, which inherit the settings of the
+// groups they're in
+func createRepoGroups(reposPath, repoName string) error {
+	return os.MkdirAll(filepath.Dir(filepath.Join(reposPath, repoName+".git")), 0755)
+}
+
+// walkRepos calls fn with the path of every group and repository under reposPath. Hidden
+// directories are skipped, and repositories aren't descended into.
+func walkRepos(reposPath string, fn func(path string, isRepo bool)) error {
+	return filepath.WalkDir(reposPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == reposPath {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() || path == reposPath {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if strings.HasSuffix(d.Name(), ".git") {
+			fn(path, true)
+			return filepath.SkipDir
+		}
+		fn(path, false)
+		return nil
+	})
+}
+
+// repoPaths returns the paths of every repository under reposPath
+func repoPaths(reposPath string) []string {
+	var paths []string
+	walkRepos(reposPath, func(path string, isRepo bool) {
+		if isRepo {
+			paths = append(paths, path)
+		}
+	})
+	return paths
+}
+
+// groupConfigPaths returns the settings files of every group under reposPath
+func groupConfigPaths(reposPath string) []string {
+	var paths []string
+	walkRepos(reposPath, func(path string, isRepo bool) {
+		if _, err := os.Stat(filepath.Join(path, groupConfigFile)); !isRepo && err == nil {
+			paths = append(paths, filepath.Join(path, groupConfigFile))
+		}
+	})
+	return paths
+}
+
+// repoNameOf returns the name of the repository at repoPath, with its groups
+func repoNameOf(reposPath, repoPath string) string {
+	rel, err := filepath.Rel(reposPath, repoPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(filepath.ToSlash(rel), ".git")
+}
+
+// ListGroups returns every group under reposPath, private ones only if showPrivate
+func ListGroups(reposPath string, showPrivate bool) ([]Group, error) {
+	var groups []Group
+	err := walkRepos(reposPath, func(path string, isRepo bool) {
+		if isRepo {
+			return
+		}
+		cfg, err := loadGroupConfig(path)
+		if err != nil {
+			log.Printf("Error reading group settings in %s: %v", path, err)
+			cfg = &GroupConfig{}
+		}
+		isPublic := !cfg.Private && !inPrivateGroup(reposPath, path)
+		if !showPrivate && !isPublic {
+			return
+		}
+		groups = append(groups, Group{
+			Name:        repoNameOf(reposPath, path),
+			Description: cfg.Description,
+			IsPublic:    isPublic,
+		})
+	})
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, err
+}
+
+// countGroupRepos sets how many of the repos are in each group, the groups without any are
+// dropped unless keepEmpty
+func countGroupRepos(groups []Group, repos []Repo, keepEmpty bool) []Group {
+	var counted []Group
+	for _, group := range groups {
+		for _, repo := range repos {
+			if strings.HasPrefix(repo.Name, group.Name+"/") {
+				group.Repos++
+			}
+		}
+		if group.Repos > 0 || keepEmpty {
+			counted = append(counted, group)
+		}
+	}
+	return counted
+}
+
+// topLevelGroups returns the groups that aren't in another group
+func topLevelGroups(groups []Group) []Group {
+	var top []Group
+	for _, group := range groups {
+		if !strings.Contains(group.Name, "/") {
+			top = append(top, group)
+		}
+	}
+	return top
+}
+
+// groupCrumbs returns the groups a repository or group is in, outermost first, for breadcrumbs
+func groupCrumbs(name string) []map[string]string {
+	var crumbs []map[string]string
+	segments := strings.Split(name, "/")
+	for i := 1; i < len(segments); i++ {
+		crumbs = append(crumbs, map[string]string{
+			"Name": segments[i-1],
+			"Path": strings.Join(segments[:i], "/"),
+		})
+	}
+	return crumbs
+}
+
+// baseName returns the name of a repository or group without the groups it's in
+func baseName(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// pagesHost returns the subdomain a repository's pages are served on, the repository first:
+// team/service is service.team
+func pagesHost(repoName string) string {
+	segments := strings.Split(repoName, "/")
+	slices.Reverse(segments)
+	return strings.Join(segments, ".")
+}
+
+// repoPathStart returns the URL path segment repository names start at, -1 for paths of the
+// server's own pages
+func repoPathStart(segments []string) int {
+	if segments[0] == "api" && len(segments) > 3 && segments[1] == "repos" {
+		return 2
+	}
+	if slices.Contains(reservedRepoNames, segments[0]) {
+		return -1
+	}
+	return 0
+}
+
+// splitRepoPath finds the repository URL path segments start with: the fewest segments naming
+// one, the last possibly ending in .git. It returns its name, how many segments it takes,
+// zero if none, and whether the last one ends in .git.
+func splitRepoPath(segments []string, exists func(name string) bool) (string, int, bool) {
+	for n := 1; n <= len(segments); n++ {
+		last, hasSuffix := strings.CutSuffix(segments[n-1], ".git")
+		if !validRepoName(last) || last == "." || last == ".." {
+			return "", 0, false
+		}
+		name := strings.Join(append(slices.Clone(segments[:n-1]), last), "/")
+		if exists(name) {
+			return name, n, hasSuffix
+		}
+		if hasSuffix {
+			return "", 0, false
+		}
+	}
+	return "", 0, false
+}
+
+// routeNamespaces routes URLs of repositories in groups, /team/service/tree/main, to the
+// repository routes, which take the name in one segment with its slashes escaped. Group
+// pages, /team and /team/-/settings, go to the group routes.
+func (s *Server) routeNamespaces(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		start := repoPathStart(segments)
+		if start < 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rctx := chi.RouteContext(r.Context())
+		name, n, hasSuffix := splitRepoPath(segments[start:], func(name string) bool {
+			return RepoExists(s.reposPath, name)
+		})
+		if n > 1 {
+			escaped := url.PathEscape(name)
+			if hasSuffix {
+				escaped += ".git"
+			}
+			routed := append(slices.Clone(segments[:start]), escaped)
+			rctx.RoutePath = "/" + strings.Join(append(routed, segments[start+n:]...), "/")
+		} else if n == 0 && start == 0 {
+			group := strings.TrimSuffix(strings.Join(segments, "/"), "/")
+			suffix := ""
+			if before, ok := strings.CutSuffix(group, "/-/settings"); ok {
+				group, suffix = before, "/settings"
+			}
+			if GroupExists(s.reposPath, group) {
+				rctx.RoutePath = "/-/groups/" + url.PathEscape(group) + suffix
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// groupParam returns the group named in a request's URL
+func groupParam(r *http.Request) string {
+	name, err := url.PathUnescape(chi.URLParam(r, "group"))
+	if err != nil || !validRepoPath(name) {
+		return ""
+	}
+	return name
+}
+
+// isGroupAdmin reports whether a request may change a group's settings. It requires tailnet
+// access, and being listed if the group or one it's in has admins.
+func (s *Server) isGroupAdmin(r *http.Request, groupPath string) bool {
+	if !s.isTailnetRequest(r) {
+		return false
+	}
+	cfg, err := loadGroupConfig(groupPath)
+	if err != nil {
+		return false
+	}
+	admins := cfg.Admins
+	if len(admins) == 0 {
+		admins = inheritedAdmins(s.reposPath, groupPath)
+	}
+	return len(admins) == 0 || slices.Contains(admins, lockOwner(r))
+}
+
+// handleGroup lists the repositories and subgroups of a group
+func (s *Server) handleGroup(w http.ResponseWriter, r *http.Request) {
+	groupName := groupParam(r)
+	if !GroupExists(s.reposPath, groupName) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	showPrivate := s.isTailnetRequest(r)
+	groupPath := filepath.Join(s.reposPath, groupName)
+	cfg, err := loadGroupConfig(groupPath)
+	if err != nil {
+		log.Printf("Error reading settings of group %s: %v", groupName, err)
+		cfg = &GroupConfig{}
+	}
+	isPublic := !cfg.Private && !inPrivateGroup(s.reposPath, groupPath)
+	if !isPublic && !showPrivate {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	repos, err := ListRepos(s.reposPath, showPrivate)
+	if err != nil {
+		log.Printf("Error listing repos: %v", err)
+		http.Error(w, "Error listing repositories", http.StatusInternalServerError)
+		return
+	}
+	var inGroup []Repo
+	for _, repo := range repos {
+		if strings.HasPrefix(repo.Name, groupName+"/") {
+			inGroup = append(inGroup, repo)
+		}
+	}
+	archived := countArchivedRepos(inGroup)
+	inGroup = filterArchivedRepos(inGroup, showArchived(r))
+
+	// Only the groups directly in this one
+	groups, err := ListGroups(s.reposPath, showPrivate)
+	if err != nil {
+		log.Printf("Error listing groups: %v", err)
+	}
+	var subgroups []Group
+	for _, group := range countGroupRepos(groups, inGroup, showPrivate) {
+		if rest, ok := strings.CutPrefix(group.Name, groupName+"/"); ok && !strings.Contains(rest, "/") {
+			subgroups = append(subgroups, group)
+		}
+	}
+
+	data := map[string]interface{}{
+		"Title":         groupName,
+		"GroupName":     groupName,
+		"BaseName":      baseName(groupName),
+		"Crumbs":        groupCrumbs(groupName),
+		"Description":   cfg.Description,
+		"IsPublic":      isPublic,
+		"Repos":         inGroup,
+		"Groups":        subgroups,
+		"ShowArchived":  showArchived(r),
+		"ArchivedCount": archived,
+		"GroupAdmin":    s.isGroupAdmin(r, groupPath),
+		"IsTailnet":     showPrivate,
+		"PublicURL":     s.publicURL,
+		"TailnetURL":    s.tailnetURL,
+	}
+
+	s.renderTemplate(w, "group.html", data)
+}
+
+// handleGroupSettings shows the settings of a group (tailnet only)
+func (s *Server) handleGroupSettings(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied - Tailnet required", http.StatusForbidden)
+		return
+	}
+
+	groupName := groupParam(r)
+	if !GroupExists(s.reposPath, groupName) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	groupPath := filepath.Join(s.reposPath, groupName)
+	cfg, err := loadGroupConfig(groupPath)
+	if err != nil {
+		log.Printf("Error reading settings of group %s: %v", groupName, err)
+		http.Error(w, "Failed to read group settings", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":           groupName + " Settings",
+		"GroupName":       groupName,
+		"BaseName":        baseName(groupName),
+		"Crumbs":          groupCrumbs(groupName),
+		"Description":     cfg.Description,
+		"IsPrivate":       cfg.Private,
+		"InPrivateGroup":  inPrivateGroup(s.reposPath, groupPath),
+		"Admins":          strings.Join(cfg.Admins, ", "),
+		"InheritedAdmins": strings.Join(inheritedAdmins(s.reposPath, groupPath), ", "),
+		"GroupAdmin":      s.isGroupAdmin(r, groupPath),
+		"CurrentUser":     lockOwner(r),
+		"IsTailnet":       true,
+		"PublicURL":       s.publicURL,
+		"TailnetURL":      s.tailnetURL,
+	}
+
+	s.renderTemplate(w, "group-settings.html", data)
+}
+
+// handleGroupSettingsPost saves the settings of a group (group admins only)
+func (s *Server) handleGroupSettingsPost(w http.ResponseWriter, r *http.Request) {
+	groupName := groupParam(r)
+	if !GroupExists(s.reposPath, groupName) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	groupPath := filepath.Join(s.reposPath, groupName)
+	if !s.isGroupAdmin(r, groupPath) {
+		http.Error(w, "Access denied - group admin required", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	cfg := &GroupConfig{
+		Description: strings.TrimSpace(r.FormValue("description")),
+		Private:     r.FormValue("visibility") == "private",
+		Admins:      parseRepoAdmins(r.FormValue("admins")),
+	}
+	if err := saveGroupConfig(groupPath, cfg); err != nil {
+		log.Printf("Error saving settings of group %s: %v", groupName, err)
+		http.Error(w, "Failed to save group settings", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Settings of group %s changed by %s", groupName, lockOwner(r))
+	http.Redirect(w, r, "/"+groupName, http.StatusFound)
+}
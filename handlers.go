@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
@@ -10,7 +12,11 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/yuin/goldmark"
@@ -27,10 +33,17 @@ type Server struct {
 	pagesBaseURL string
 	templates    *template.Template
 	markdown     goldmark.Markdown
+	search       *SearchIndex
+	commits      *CommitIndex
+	lfsGC        *LFSGC
+	backups      *Backups
+	mirrors      *Mirrors
+	imports      *Imports
+	trash        *Trash
 }
 
 // NewServer creates a new Server instance
-func NewServer(reposPath, publicURL, tailnetURL, templatesPath, pagesBaseURL string) (*Server, error) {
+func NewServer(reposPath, publicURL, tailnetURL, templatesPath, pagesBaseURL string, trashRetention time.Duration) (*Server, error) {
 	// Parse all templates
 	tmpl, err := template.New("").Funcs(template.FuncMap{
 		"truncate": func(s string, n int) string {
@@ -54,7 +67,10 @@ func NewServer(reposPath, publicURL, tailnetURL, templatesPath, pagesBaseURL str
 				return fmt.Sprintf("%.1f KB", kb)
 			}
 			mb := kb / 1024
-			return fmt.Sprintf("%.1f MB", mb)
+			if mb < 1024 {
+				return fmt.Sprintf("%.1f MB", mb)
+			}
+			return fmt.Sprintf("%.1f GB", mb/1024)
 		},
 		"isText": func(name string) bool {
 			textExts := []string{
@@ -100,6 +116,9 @@ func NewServer(reposPath, publicURL, tailnetURL, templatesPath, pagesBaseURL str
 		"pathJoin": func(parts ...string) string {
 			return filepath.Join(parts...)
 		},
+		"formatQuota": formatQuota,
+		"groupCrumbs": groupCrumbs,
+		"baseName":    baseName,
 	}).ParseGlob(filepath.Join(templatesPath, "*.html"))
 	if err != nil {
 		return nil, err
@@ -122,6 +141,17 @@ func NewServer(reposPath, publicURL, tailnetURL, templatesPath, pagesBaseURL str
 		),
 	)
 
+	// Search indexes live next to the other server data
+	search, err := NewSearchIndex(reposPath, filepath.Join(filepath.Dir(reposPath), "search-index"))
+	if err != nil {
+		return nil, err
+	}
+
+	commits, err := NewCommitIndex(reposPath, filepath.Join(filepath.Dir(reposPath), "commit-index"))
+	if err != nil {
+		return nil, err
+	}
+
 	return &Server{
 		reposPath:    reposPath,
 		publicURL:    publicURL,
@@ -129,6 +159,13 @@ func NewServer(reposPath, publicURL, tailnetURL, templatesPath, pagesBaseURL str
 		pagesBaseURL: pagesBaseURL,
 		templates:    tmpl,
 		markdown:     md,
+		search:       search,
+		commits:      commits,
+		lfsGC:        NewLFSGC(reposPath),
+		backups:      NewBackups(reposPath),
+		mirrors:      NewMirrors(reposPath),
+		imports:      NewImports(reposPath),
+		trash:        NewTrash(reposPath, trashRetention),
 	}, nil
 }
 
@@ -142,6 +179,15 @@ func (s *Server) isTailnetRequest(r *http.Request) bool {
 	return IsTailnetIP(clientIP)
 }
 
+// isLoopbackRequest checks if the request comes from this host. Requests relayed by a local
+// proxy carry forwarding headers and aren't, the client they name could be anyone.
+func isLoopbackRequest(r *http.Request) bool {
+	if r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("X-Real-IP") != "" {
+		return false
+	}
+	return IsLoopbackIP(peerAddr(r))
+}
+
 // renderTemplate renders a template with the given data
 func (s *Server) renderTemplate(w http.ResponseWriter, name string, data interface{}) {
 	err := s.templates.ExecuteTemplate(w, name, data)
@@ -151,6 +197,51 @@ func (s *Server) renderTemplate(w http.ResponseWriter, name string, data interfa
 	}
 }
 
+// renderError renders the error page with the given status code
+func (s *Server) renderError(w http.ResponseWriter, r *http.Request, status int, repoName, message string) {
+	s.renderErrorPage(w, status, s.errorData(r, status, repoName, message))
+}
+
+// errorData returns the template data of an error page
+func (s *Server) errorData(r *http.Request, status int, repoName, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"Title":      http.StatusText(status),
+		"Status":     status,
+		"StatusText": http.StatusText(status),
+		"Message":    message,
+		"RepoName":   repoName,
+		"IsTailnet":  s.isTailnetRequest(r),
+		"PublicURL":  s.publicURL,
+		"TailnetURL": s.tailnetURL,
+	}
+}
+
+// renderErrorPage renders the error template with data, falling back to plain text
+func (s *Server) renderErrorPage(w http.ResponseWriter, status int, data map[string]interface{}) {
+	var buf bytes.Buffer
+	if err := s.templates.ExecuteTemplate(&buf, "error.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, data["Message"].(string), status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// renderRefNotFound renders a 404 page for a revision that could not be resolved. Ambiguous
+// short hashes list the commits they match.
+func (s *Server) renderRefNotFound(w http.ResponseWriter, r *http.Request, repoName string, err error) {
+	var ambiguous *AmbiguousRefError
+	if errors.As(err, &ambiguous) {
+		data := s.errorData(r, http.StatusNotFound, repoName, fmt.Sprintf("short hash %s is ambiguous, it matches:", ambiguous.Ref))
+		data["Candidates"] = ambiguous.Candidates
+		s.renderErrorPage(w, http.StatusNotFound, data)
+		return
+	}
+	s.renderError(w, r, http.StatusNotFound, repoName, err.Error())
+}
+
 // renderMarkdown converts markdown to HTML
 func (s *Server) renderMarkdown(source []byte) template.HTML {
 	var buf bytes.Buffer
@@ -178,6 +269,48 @@ func findReadme(entries []TreeEntry) string {
 	return ""
 }
 
+// renderedReadme is a README file rendered for display
+type renderedReadme struct {
+	Name string
+	HTML template.HTML
+}
+
+// renderReadme renders the README in a directory, memoised per commit
+func (s *Server) renderReadme(repoName, ref, path string, entries []TreeEntry) (renderedReadme, error) {
+	name := findReadme(entries)
+	if name == "" {
+		return renderedReadme{}, nil
+	}
+
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	hash, err := resolveCommit(repoPath, ref)
+	if err != nil {
+		return renderedReadme{}, err
+	}
+
+	readmePath := name
+	if path = strings.Trim(path, "/"); path != "" {
+		readmePath = filepath.Join(path, name)
+	}
+
+	key := resultKey{repoPath: repoPath, kind: "readme", commit: hash, path: readmePath}
+	return cachedResult(repoCache, key, func() (renderedReadme, error) {
+		content, err := GetBlob(s.reposPath, repoName, hash.String(), readmePath)
+		if err != nil {
+			return renderedReadme{}, err
+		}
+		readme := renderedReadme{Name: name}
+		// Check if it's a markdown file
+		if strings.HasSuffix(strings.ToLower(name), ".md") {
+			readme.HTML = s.renderMarkdown(content)
+		} else {
+			// For non-markdown README files, show as preformatted text
+			readme.HTML = template.HTML("<pre>" + template.HTMLEscapeString(string(content)) + "</pre>")
+		}
+		return readme, nil
+	})
+}
+
 // handleIndex shows the list of repositories
 func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	showPrivate := s.isTailnetRequest(r)
@@ -189,12 +322,30 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Archived repos are only listed when asked for
+	archived := countArchivedRepos(repos)
+	repos = filterArchivedRepos(repos, showArchived(r))
+
+	// Top-level groups with the repos listed in them, empty ones only for the tailnet
+	groups, err := ListGroups(s.reposPath, showPrivate)
+	if err != nil {
+		log.Printf("Error listing groups: %v", err)
+	}
+
+	// Filter by topic, the topics to pick from are those of every listed repo
+	topic := strings.ToLower(r.URL.Query().Get("topic"))
+
 	data := map[string]interface{}{
-		"Title":       "Repositories",
-		"Repos":       repos,
-		"IsTailnet":   showPrivate,
-		"PublicURL":   s.publicURL,
-		"TailnetURL":  s.tailnetURL,
+		"Title":         "Repositories",
+		"Repos":         filterReposByTopic(repos, topic),
+		"Groups":        countGroupRepos(topLevelGroups(groups), repos, showPrivate),
+		"Topic":         topic,
+		"Topics":        repoTopicCounts(repos),
+		"ShowArchived":  showArchived(r),
+		"ArchivedCount": archived,
+		"IsTailnet":     showPrivate,
+		"PublicURL":     s.publicURL,
+		"TailnetURL":    s.tailnetURL,
 	}
 
 	s.renderTemplate(w, "index.html", data)
@@ -202,7 +353,7 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 
 // handleRepo shows a repository's file tree
 func (s *Server) handleRepo(w http.ResponseWriter, r *http.Request) {
-	repoName := chi.URLParam(r, "repo")
+	repoName := repoParam(r)
 
 	if !RepoExists(s.reposPath, repoName) {
 		http.Error(w, "Repository not found", http.StatusNotFound)
@@ -211,11 +362,26 @@ func (s *Server) handleRepo(w http.ResponseWriter, r *http.Request) {
 
 	// Check access
 	repoPath := filepath.Join(s.reposPath, repoName+".git")
-	if !IsPublicRepo(repoPath) && !s.isTailnetRequest(r) {
+	if !IsPublicRepo(s.reposPath, repoPath) && !s.isTailnetRequest(r) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
 
+	// Show the progress of an import, or why it failed
+	if status := s.imports.Status(repoName); status != nil {
+		data := map[string]interface{}{
+			"Title":      repoName,
+			"RepoName":   repoName,
+			"Import":     status,
+			"IsTailnet":  s.isTailnetRequest(r),
+			"IsPublic":   IsPublicRepo(s.reposPath, repoPath),
+			"PublicURL":  s.publicURL,
+			"TailnetURL": s.tailnetURL,
+		}
+		s.renderTemplate(w, "repo.html", data)
+		return
+	}
+
 	// Check if repository is empty
 	if IsEmptyRepo(repoPath) {
 		data := map[string]interface{}{
@@ -223,9 +389,12 @@ func (s *Server) handleRepo(w http.ResponseWriter, r *http.Request) {
 			"RepoName":   repoName,
 			"IsEmpty":    true,
 			"IsTailnet":  s.isTailnetRequest(r),
-			"IsPublic":   IsPublicRepo(repoPath),
+			"IsPublic":   IsPublicRepo(s.reposPath, repoPath),
 			"PublicURL":  s.publicURL,
 			"TailnetURL": s.tailnetURL,
+			"MirrorURL":  pullMirrorURL(repoPath),
+			"IsTemplate": IsTemplateRepo(repoPath),
+			"IsArchived": IsArchivedRepo(repoPath),
 		}
 		s.renderTemplate(w, "repo.html", data)
 		return
@@ -243,9 +412,7 @@ func (s *Server) handleRepo(w http.ResponseWriter, r *http.Request) {
 
 // handleTree shows the file tree for a specific path
 func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
-	repoName := chi.URLParam(r, "repo")
-	ref := chi.URLParam(r, "ref")
-	path := chi.URLParam(r, "*")
+	repoName := repoParam(r)
 
 	if !RepoExists(s.reposPath, repoName) {
 		http.Error(w, "Repository not found", http.StatusNotFound)
@@ -254,11 +421,18 @@ func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
 
 	// Check access
 	repoPath := filepath.Join(s.reposPath, repoName+".git")
-	if !IsPublicRepo(repoPath) && !s.isTailnetRequest(r) {
+	if !IsPublicRepo(s.reposPath, repoPath) && !s.isTailnetRequest(r) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
 
+	// Split the revision from the path, branch names may contain slashes
+	ref, path, err := SplitRefPath(s.reposPath, repoName, chi.URLParam(r, "*"))
+	if err != nil {
+		s.renderRefNotFound(w, r, repoName, err)
+		return
+	}
+
 	entries, err := GetTree(s.reposPath, repoName, ref, path)
 	if err != nil {
 		log.Printf("Error getting tree: %v", err)
@@ -290,24 +464,7 @@ func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Look for README file in current directory
-	var readmeHTML template.HTML
-	var readmeName string
-	if readme := findReadme(entries); readme != "" {
-		readmeName = readme
-		readmePath := readme
-		if path != "" && path != "/" {
-			readmePath = filepath.Join(strings.Trim(path, "/"), readme)
-		}
-		if content, err := GetBlob(s.reposPath, repoName, ref, readmePath); err == nil {
-			// Check if it's a markdown file
-			if strings.HasSuffix(strings.ToLower(readme), ".md") {
-				readmeHTML = s.renderMarkdown(content)
-			} else {
-				// For non-markdown README files, show as preformatted text
-				readmeHTML = template.HTML("<pre>" + template.HTMLEscapeString(string(content)) + "</pre>")
-			}
-		}
-	}
+	readme, _ := s.renderReadme(repoName, ref, path, entries)
 
 	// Check if pages is enabled for this repo
 	pagesEnabled := false
@@ -324,7 +481,7 @@ func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if pagesEnabled && s.pagesBaseURL != "" {
-		pagesURL = "https://" + repoName + "." + s.pagesBaseURL
+		pagesURL = "https://" + pagesHost(repoName) + "." + s.pagesBaseURL
 	}
 
 	data := map[string]interface{}{
@@ -337,13 +494,17 @@ func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
 		"Branches":     branches,
 		"Breadcrumbs":  breadcrumbs,
 		"IsTailnet":    s.isTailnetRequest(r),
-		"IsPublic":     IsPublicRepo(repoPath),
+		"IsPublic":     IsPublicRepo(s.reposPath, repoPath),
 		"PublicURL":    s.publicURL,
 		"TailnetURL":   s.tailnetURL,
-		"ReadmeHTML":   readmeHTML,
-		"ReadmeName":   readmeName,
+		"ReadmeHTML":   readme.HTML,
+		"ReadmeName":   readme.Name,
 		"PagesEnabled": pagesEnabled,
 		"PagesURL":     pagesURL,
+		"MirrorURL":    pullMirrorURL(repoPath),
+		"IsTemplate":   IsTemplateRepo(repoPath),
+		"IsArchived":   IsArchivedRepo(repoPath),
+		"Topics":       ReadRepoTopics(repoPath),
 	}
 
 	s.renderTemplate(w, "repo.html", data)
@@ -351,9 +512,7 @@ func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
 
 // handleSubmodule shows details for a specific submodule
 func (s *Server) handleSubmodule(w http.ResponseWriter, r *http.Request) {
-	repoName := chi.URLParam(r, "repo")
-	ref := chi.URLParam(r, "ref")
-	path := chi.URLParam(r, "*")
+	repoName := repoParam(r)
 
 	if !RepoExists(s.reposPath, repoName) {
 		http.Error(w, "Repository not found", http.StatusNotFound)
@@ -362,11 +521,18 @@ func (s *Server) handleSubmodule(w http.ResponseWriter, r *http.Request) {
 
 	// Check access
 	repoPath := filepath.Join(s.reposPath, repoName+".git")
-	if !IsPublicRepo(repoPath) && !s.isTailnetRequest(r) {
+	if !IsPublicRepo(s.reposPath, repoPath) && !s.isTailnetRequest(r) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
 
+	// Split the revision from the path, branch names may contain slashes
+	ref, path, err := SplitRefPath(s.reposPath, repoName, chi.URLParam(r, "*"))
+	if err != nil {
+		s.renderRefNotFound(w, r, repoName, err)
+		return
+	}
+
 	info, err := GetSubmoduleInfo(s.reposPath, repoName, ref, path)
 	if err != nil {
 		log.Printf("Error getting submodule info: %v", err)
@@ -406,7 +572,7 @@ func (s *Server) handleSubmodule(w http.ResponseWriter, r *http.Request) {
 		"Branches":    branches,
 		"Breadcrumbs": breadcrumbs,
 		"IsTailnet":   s.isTailnetRequest(r),
-		"IsPublic":    IsPublicRepo(repoPath),
+		"IsPublic":    IsPublicRepo(s.reposPath, repoPath),
 		"PublicURL":   s.publicURL,
 		"TailnetURL":  s.tailnetURL,
 	}
@@ -416,9 +582,7 @@ func (s *Server) handleSubmodule(w http.ResponseWriter, r *http.Request) {
 
 // handleBlob shows the content of a file
 func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
-	repoName := chi.URLParam(r, "repo")
-	ref := chi.URLParam(r, "ref")
-	path := chi.URLParam(r, "*")
+	repoName := repoParam(r)
 
 	if !RepoExists(s.reposPath, repoName) {
 		http.Error(w, "Repository not found", http.StatusNotFound)
@@ -427,11 +591,18 @@ func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
 
 	// Check access
 	repoPath := filepath.Join(s.reposPath, repoName+".git")
-	if !IsPublicRepo(repoPath) && !s.isTailnetRequest(r) {
+	if !IsPublicRepo(s.reposPath, repoPath) && !s.isTailnetRequest(r) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
 
+	// Split the revision from the path, branch names may contain slashes
+	ref, path, err := SplitRefPath(s.reposPath, repoName, chi.URLParam(r, "*"))
+	if err != nil {
+		s.renderRefNotFound(w, r, repoName, err)
+		return
+	}
+
 	content, err := GetBlob(s.reposPath, repoName, ref, path)
 	if err != nil {
 		log.Printf("Error getting blob: %v", err)
@@ -478,7 +649,7 @@ func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
 		"Branches":    branches,
 		"Breadcrumbs": breadcrumbs,
 		"IsTailnet":   s.isTailnetRequest(r),
-		"IsPublic":    IsPublicRepo(repoPath),
+		"IsPublic":    IsPublicRepo(s.reposPath, repoPath),
 		"PublicURL":   s.publicURL,
 		"TailnetURL":  s.tailnetURL,
 	}
@@ -488,8 +659,8 @@ func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
 
 // handleCommits shows the commit history
 func (s *Server) handleCommits(w http.ResponseWriter, r *http.Request) {
-	repoName := chi.URLParam(r, "repo")
-	ref := chi.URLParam(r, "ref")
+	repoName := repoParam(r)
+	ref := strings.Trim(chi.URLParam(r, "*"), "/")
 
 	if !RepoExists(s.reposPath, repoName) {
 		http.Error(w, "Repository not found", http.StatusNotFound)
@@ -498,12 +669,16 @@ func (s *Server) handleCommits(w http.ResponseWriter, r *http.Request) {
 
 	// Check access
 	repoPath := filepath.Join(s.reposPath, repoName+".git")
-	if !IsPublicRepo(repoPath) && !s.isTailnetRequest(r) {
+	if !IsPublicRepo(s.reposPath, repoPath) && !s.isTailnetRequest(r) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
 
 	commits, err := GetCommits(s.reposPath, repoName, ref, 50)
+	if isRefError(err) {
+		s.renderRefNotFound(w, r, repoName, err)
+		return
+	}
 	if err != nil {
 		log.Printf("Error getting commits: %v", err)
 		http.Error(w, "Error reading commits", http.StatusInternalServerError)
@@ -520,7 +695,7 @@ func (s *Server) handleCommits(w http.ResponseWriter, r *http.Request) {
 		"Commits":    commits,
 		"Branches":   branches,
 		"IsTailnet":  s.isTailnetRequest(r),
-		"IsPublic":   IsPublicRepo(repoPath),
+		"IsPublic":   IsPublicRepo(s.reposPath, repoPath),
 		"PublicURL":  s.publicURL,
 		"TailnetURL": s.tailnetURL,
 	}
@@ -572,11 +747,28 @@ func (s *Server) handleNewRepo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var credentialNames []string
+	if credentials, err := loadMirrorCredentials(s.reposPath); err == nil {
+		for name := range credentials {
+			credentialNames = append(credentialNames, name)
+		}
+		sort.Strings(credentialNames)
+	}
+
 	data := map[string]interface{}{
-		"Title":      "New Repository",
-		"IsTailnet":  true,
-		"PublicURL":  s.publicURL,
-		"TailnetURL": s.tailnetURL,
+		"Title":             "New Repository",
+		"IsTailnet":         true,
+		"PublicURL":         s.publicURL,
+		"TailnetURL":        s.tailnetURL,
+		"MirrorCredentials": credentialNames,
+		"SSHKeyExists":      sshKeyExists(),
+		"Templates":         ListTemplateRepos(s.reposPath),
+		"Gitignores":        gitignoreTemplates,
+		"Licenses":          repoLicenses,
+	}
+	// Linked from a group's page to create a repository in it
+	if group := r.URL.Query().Get("group"); GroupExists(s.reposPath, group) {
+		data["Group"] = group
 	}
 
 	s.renderTemplate(w, "new-repo.html", data)
@@ -604,28 +796,68 @@ func (s *Server) handleNewRepoPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check for invalid characters
-	for _, c := range repoName {
-		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.') {
-			http.Error(w, "Invalid repository name - only alphanumeric, dash, underscore, and dot allowed", http.StatusBadRequest)
+	// Check for invalid characters and names taken by repositories or groups
+	if status, msg := checkNewRepoName(s.reposPath, repoName); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	// Creating in a group with admins takes being one of them
+	if admins := inheritedAdmins(s.reposPath, filepath.Join(s.reposPath, repoName+".git")); len(admins) > 0 && !slices.Contains(admins, lockOwner(r)) {
+		http.Error(w, "Access denied - admin of the destination group required", http.StatusForbidden)
+		return
+	}
+
+	// Read the remote to import from, if any
+	var source *ImportStatus
+	if r.FormValue("import_url") != "" {
+		credentials, err := loadMirrorCredentials(s.reposPath)
+		if err != nil {
+			log.Printf("Error loading mirror credentials: %v", err)
+			http.Error(w, "Failed to load mirror credentials", http.StatusInternalServerError)
 			return
 		}
+		if source, err = parseImportSource(r, credentials); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Read the topics
+	topics, err := parseRepoTopics(r.FormValue("topics"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Check if repo already exists
-	if RepoExists(s.reposPath, repoName) {
-		http.Error(w, "Repository already exists", http.StatusConflict)
+	// Read the initial commit, an imported repository gets its commits from the remote
+	initial, err := parseRepoInit(r, s.reposPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if initial != nil && source != nil {
+		http.Error(w, "An imported repository can't start from a template or with initial files", http.StatusBadRequest)
 		return
 	}
 
-	// Create the bare repository
+	// Create the bare repository, in its groups
 	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	if err := createRepoGroups(s.reposPath, repoName); err != nil {
+		log.Printf("Error creating groups of %s: %v", repoName, err)
+		http.Error(w, "Failed to create repository", http.StatusInternalServerError)
+		return
+	}
 	if err := CreateBareRepo(repoPath); err != nil {
 		log.Printf("Error creating repository: %v", err)
 		http.Error(w, "Failed to create repository", http.StatusInternalServerError)
 		return
 	}
 
+	// A repository renamed from this name isn't redirected to anymore
+	if err := removeRepoRedirect(s.reposPath, repoName); err != nil {
+		log.Printf("Error removing redirect of %s: %v", repoName, err)
+	}
+
 	// Set description
 	if description != "" {
 		descPath := filepath.Join(repoPath, "description")
@@ -638,10 +870,61 @@ func (s *Server) handleNewRepoPost(w http.ResponseWriter, r *http.Request) {
 		os.WriteFile(exportPath, []byte{}, 0644)
 	}
 
+	// Set topics
+	if len(topics) > 0 {
+		if err := setRepoTopics(repoPath, topics); err != nil {
+			log.Printf("Error setting topics for %s: %v", repoName, err)
+		}
+	}
+
+	// Write the initial commit
+	if initial != nil {
+		if err := initRepo(r.Context(), s.reposPath, repoName, description, initial); err != nil {
+			log.Printf("Error initializing repository %s: %v", repoName, err)
+			http.Error(w, "Repository created, but the initial commit failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Set up pages, serving the initial branch
+	if r.FormValue("pages_enabled") == "on" {
+		if err := writePagesConfig(repoPath, true, defaultInitialBranch, r.FormValue("pages_build_cmd"), r.FormValue("pages_output_dir")); err != nil {
+			log.Printf("Error writing pages config for %s: %v", repoName, err)
+		}
+	}
+
+	// Import in the background, the repo page shows the progress
+	if source != nil {
+		if err := s.imports.Start(repoName, source); err != nil {
+			log.Printf("Error starting import: %v", err)
+			http.Error(w, "Failed to start the import", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Redirect to the new repo
 	http.Redirect(w, r, "/"+repoName, http.StatusFound)
 }
 
+// writePagesConfig writes the pages config of a repository, serving main and the public
+// directory unless told otherwise
+func writePagesConfig(repoPath string, enabled bool, branch, buildCmd, outputDir string) error {
+	if branch == "" {
+		branch = "main"
+	}
+	if outputDir == "" {
+		outputDir = "public"
+	}
+	pagesConfig := map[string]interface{}{
+		"enabled":       enabled,
+		"branch":        branch,
+		"build_command": buildCmd,
+		"output_dir":    outputDir,
+	}
+	pagesData, _ := json.MarshalIndent(pagesConfig, "", "  ")
+	return os.WriteFile(filepath.Join(repoPath, "git-pages.json"), pagesData, 0644)
+}
+
 // handleRepoSettings shows repository settings (tailnet only)
 func (s *Server) handleRepoSettings(w http.ResponseWriter, r *http.Request) {
 	if !s.isTailnetRequest(r) {
@@ -649,7 +932,7 @@ func (s *Server) handleRepoSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	repoName := chi.URLParam(r, "repo")
+	repoName := repoParam(r)
 
 	if !RepoExists(s.reposPath, repoName) {
 		http.Error(w, "Repository not found", http.StatusNotFound)
@@ -659,14 +942,7 @@ func (s *Server) handleRepoSettings(w http.ResponseWriter, r *http.Request) {
 	repoPath := filepath.Join(s.reposPath, repoName+".git")
 
 	// Read current description
-	description := ""
-	if data, err := os.ReadFile(filepath.Join(repoPath, "description")); err == nil {
-		description = strings.TrimSpace(string(data))
-		// Ignore default git description
-		if strings.HasPrefix(description, "Unnamed repository") {
-			description = ""
-		}
-	}
+	description := ReadDescription(repoPath)
 
 	// Read pages config if exists
 	pagesEnabled := false
@@ -695,20 +971,17 @@ func (s *Server) handleRepoSettings(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Read mirror config if exists
-	mirrorEnabled := false
-	mirrorURL := ""
-	mirrorConfigPath := filepath.Join(repoPath, "git-mirror.json")
-	if data, err := os.ReadFile(mirrorConfigPath); err == nil {
-		var mirrorConfig map[string]interface{}
-		if json.Unmarshal(data, &mirrorConfig) == nil {
-			if enabled, ok := mirrorConfig["enabled"].(bool); ok {
-				mirrorEnabled = enabled
-			}
-			if url, ok := mirrorConfig["github_url"].(string); ok {
-				mirrorURL = url
-			}
+	// Read mirror config if exists, and the credentials mirrors can use
+	mirrorConfig, err := loadMirrorConfig(repoPath)
+	if err != nil {
+		mirrorConfig = &MirrorConfig{}
+	}
+	var mirrorCredentials []string
+	if creds, err := loadMirrorCredentials(s.reposPath); err == nil {
+		for name := range creds {
+			mirrorCredentials = append(mirrorCredentials, name)
 		}
+		sort.Strings(mirrorCredentials)
 	}
 
 	// Get branches for dropdown
@@ -727,8 +1000,6 @@ func (s *Server) handleRepoSettings(w http.ResponseWriter, r *http.Request) {
 	lfsEndpoint := ""
 	lfsBucket := ""
 	lfsRegion := "auto"
-	lfsAccessKey := ""
-	lfsSecretKey := ""
 	lfsConfigPath := filepath.Join(filepath.Dir(s.reposPath), "lfs-config.json")
 	if data, err := os.ReadFile(lfsConfigPath); err == nil {
 		var lfsConfig map[string]interface{}
@@ -743,12 +1014,6 @@ func (s *Server) handleRepoSettings(w http.ResponseWriter, r *http.Request) {
 			if v, ok := lfsConfig["region"].(string); ok {
 				lfsRegion = v
 			}
-			if v, ok := lfsConfig["access_key"].(string); ok {
-				lfsAccessKey = v
-			}
-			if v, ok := lfsConfig["secret_key"].(string); ok {
-				lfsSecretKey = v
-			}
 		}
 	}
 
@@ -757,42 +1022,66 @@ func (s *Server) handleRepoSettings(w http.ResponseWriter, r *http.Request) {
 	backupEndpoint := ""
 	backupBucket := ""
 	backupRegion := "auto"
-	backupAccessKey := ""
-	backupSecretKey := ""
 	backupSchedule := "daily"
-	backupConfigPath := filepath.Join(filepath.Dir(s.reposPath), "backup-config.json")
-	if data, err := os.ReadFile(backupConfigPath); err == nil {
-		var backupConfig map[string]interface{}
-		if json.Unmarshal(data, &backupConfig) == nil {
-			if v, ok := backupConfig["enabled"].(bool); ok {
-				backupEnabled = v
-			}
-			if v, ok := backupConfig["endpoint"].(string); ok {
-				backupEndpoint = v
-			}
-			if v, ok := backupConfig["bucket"].(string); ok {
-				backupBucket = v
-			}
-			if v, ok := backupConfig["region"].(string); ok {
-				backupRegion = v
-			}
-			if v, ok := backupConfig["access_key"].(string); ok {
-				backupAccessKey = v
-			}
-			if v, ok := backupConfig["secret_key"].(string); ok {
-				backupSecretKey = v
-			}
-			if v, ok := backupConfig["schedule"].(string); ok {
-				backupSchedule = v
+	if cfg, err := loadBackupConfig(filepath.Join(filepath.Dir(s.reposPath), "backup-config.json")); err == nil {
+		backupEnabled = cfg.Enabled
+		backupEndpoint = cfg.Endpoint
+		backupBucket = cfg.Bucket
+		backupRegion = cfg.Region
+		backupSchedule = cfg.Schedule
+	}
+
+	// LFS usage is counted live, it's a single listing for one repository
+	var lfsUsage *LFSUsage
+	var lfsQuota LFSQuotaStatus
+	var lfsStorageError string
+	repoLFSConfig, err := loadRepoLFSConfig(repoPath)
+	if err != nil {
+		log.Printf("Error reading LFS config of %s: %v", repoName, err)
+		repoLFSConfig = &RepoLFSConfig{}
+	}
+	if lfsEnabled || repoLFSConfig.Storage != nil {
+		if usage, err := s.lfsGC.RepoUsage(r.Context(), repoName); err == nil {
+			lfsUsage = &usage
+		} else {
+			log.Printf("LFS usage of %s: %v", repoName, err)
+			lfsStorageError = err.Error()
+		}
+		if cfg, err := loadLFSConfig(lfsConfigPath); err == nil && lfsUsage != nil {
+			lfsQuota = LFSQuotaStatus{
+				Repo:        repoName,
+				Used:        lfsUsage.Bytes,
+				Limit:       repoLFSQuota(cfg, repoPath),
+				WarnPercent: quotaWarningPercent(cfg),
 			}
 		}
 	}
+	lfsStorage := repoLFSConfig.Storage
+	if lfsStorage == nil {
+		lfsStorage = &RepoLFSStorage{}
+	}
+	var lfsCredentials []string
+	if cfg, err := loadLFSConfig(lfsConfigPath); err == nil {
+		for name := range cfg.Credentials {
+			lfsCredentials = append(lfsCredentials, name)
+		}
+		sort.Strings(lfsCredentials)
+	}
+
+	var repoAdmins []string
+	if acl, err := loadRepoACL(repoPath); err == nil {
+		repoAdmins = acl.Admins
+	}
 
 	data := map[string]interface{}{
 		"Title":             repoName + " Settings",
 		"RepoName":          repoName,
 		"Description":       description,
-		"IsPublic":          IsPublicRepo(repoPath),
+		"IsPublic":          isExportedRepo(repoPath),
+		"InPrivateGroup":    inPrivateGroup(s.reposPath, repoPath),
+		"IsTemplate":        IsTemplateRepo(repoPath),
+		"IsArchived":        IsArchivedRepo(repoPath),
+		"Topics":            strings.Join(ReadRepoTopics(repoPath), ", "),
 		"IsTailnet":         true,
 		"PublicURL":         s.publicURL,
 		"TailnetURL":        s.tailnetURL,
@@ -800,27 +1089,44 @@ func (s *Server) handleRepoSettings(w http.ResponseWriter, r *http.Request) {
 		"PagesBranch":       pagesBranch,
 		"PagesBuildCmd":     pagesBuildCmd,
 		"PagesOutputDir":    pagesOutputDir,
-		"MirrorEnabled":     mirrorEnabled,
-		"MirrorURL":         mirrorURL,
+		"MirrorTargets":     s.mirrors.mirrorTargetViews(repoName, mirrorConfig),
+		"MirrorProviders":   mirrorProviders,
+		"MirrorCredentials": mirrorCredentials,
+		"MirrorRunning":     s.mirrors.Running(repoName),
 		"Branches":          branches,
 		"SSHKeyExists":      sshKeyExists,
 		"SSHPublicKey":      sshPublicKey,
 		"SSHKeyFingerprint": sshKeyFingerprint,
 		// LFS config
-		"LFSEnabled":   lfsEnabled,
-		"LFSEndpoint":  lfsEndpoint,
-		"LFSBucket":    lfsBucket,
-		"LFSRegion":    lfsRegion,
-		"LFSAccessKey": lfsAccessKey,
-		"LFSSecretKey": lfsSecretKey,
+		"LFSEnabled":  lfsEnabled,
+		"LFSEndpoint": lfsEndpoint,
+		"LFSBucket":   lfsBucket,
+		"LFSRegion":   lfsRegion,
 		// Backup config
-		"BackupEnabled":   backupEnabled,
-		"BackupEndpoint":  backupEndpoint,
-		"BackupBucket":    backupBucket,
-		"BackupRegion":    backupRegion,
-		"BackupAccessKey": backupAccessKey,
-		"BackupSecretKey": backupSecretKey,
-		"BackupSchedule":  backupSchedule,
+		"BackupEnabled":  backupEnabled,
+		"BackupEndpoint": backupEndpoint,
+		"BackupBucket":   backupBucket,
+		"BackupRegion":   backupRegion,
+		"BackupSchedule": backupSchedule,
+		// LFS usage and garbage collection
+		"LFSUsage":     lfsUsage,
+		"LFSQuota":     lfsQuota,
+		"LFSRepoQuota": repoLFSConfig.Quota,
+		"LFSGCReport":  s.lfsGC.Report(repoName),
+		"LFSGCRunning": s.lfsGC.Running(),
+		// Per-repository LFS storage, only repo admins may change it
+		"LFSStorage":      lfsStorage,
+		"LFSOwnStorage":   repoLFSConfig.Storage != nil,
+		"LFSStorageError": lfsStorageError,
+		"LFSCredentials":  lfsCredentials,
+		"RepoAdmin":       s.isRepoAdmin(r, repoPath),
+		"RepoAdmins":      strings.Join(repoAdmins, ", "),
+		"InheritedAdmins": strings.Join(inheritedAdmins(s.reposPath, repoPath), ", "),
+		"TrashDays":       int(s.trash.Retention().Hours() / 24),
+		"CurrentUser":     lockOwner(r),
+		// Repository cache
+		"CacheStats":         repoCache.Stats(),
+		"CacheInvalidations": repoCache.invalidations.Load(),
 	}
 
 	s.renderTemplate(w, "settings.html", data)
@@ -833,7 +1139,7 @@ func (s *Server) handleRepoSettingsPost(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	repoName := chi.URLParam(r, "repo")
+	repoName := repoParam(r)
 
 	if !RepoExists(s.reposPath, repoName) {
 		http.Error(w, "Repository not found", http.StatusNotFound)
@@ -847,6 +1153,61 @@ func (s *Server) handleRepoSettingsPost(w http.ResponseWriter, r *http.Request)
 
 	repoPath := filepath.Join(s.reposPath, repoName+".git")
 
+	quota, err := parseSize(r.FormValue("lfs_quota"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// LFS quota and storage, mirror targets and admins are only changed by repo admins, and
+	// only shown to them. Pull mirrors overwrite and prune the repository's refs.
+	_, setLFSQuota := r.Form["lfs_quota"]
+	_, setLFSStorage := r.Form["lfs_backend"]
+	_, setMirrors := r.Form["mirror_count"]
+	_, setAdmins := r.Form["admins"]
+	if (setLFSQuota || setLFSStorage || setMirrors || setAdmins) && !s.isRepoAdmin(r, repoPath) {
+		http.Error(w, "Access denied - repository admin required", http.StatusForbidden)
+		return
+	}
+	var lfsStorage *RepoLFSStorage
+	if backend := r.FormValue("lfs_backend"); setLFSStorage && backend != "" {
+		lfsStorage = &RepoLFSStorage{
+			Backend:     backend,
+			Endpoint:    strings.TrimSpace(r.FormValue("lfs_endpoint")),
+			Bucket:      strings.TrimSpace(r.FormValue("lfs_bucket")),
+			Region:      strings.TrimSpace(r.FormValue("lfs_region")),
+			Prefix:      strings.Trim(strings.TrimSpace(r.FormValue("lfs_prefix")), "/"),
+			Credentials: r.FormValue("lfs_credentials"),
+		}
+		serverCfg, err := loadLFSConfig(filepath.Join(filepath.Dir(s.reposPath), "lfs-config.json"))
+		if err != nil {
+			serverCfg = &LFSConfig{}
+		}
+		if _, err := lfsStorage.resolve(serverCfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	existingMirrors, err := loadMirrorConfig(repoPath)
+	if err != nil {
+		existingMirrors = &MirrorConfig{}
+	}
+	mirrorCredentials, err := loadMirrorCredentials(s.reposPath)
+	if err != nil {
+		log.Printf("Error loading mirror credentials: %v", err)
+	}
+	mirrorConfig, err := parseMirrorForm(r, existingMirrors, mirrorCredentials)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	topics, err := parseRepoTopics(r.FormValue("topics"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Update description
 	description := strings.TrimSpace(r.FormValue("description"))
 	descPath := filepath.Join(repoPath, "description")
@@ -861,45 +1222,60 @@ func (s *Server) handleRepoSettingsPost(w http.ResponseWriter, r *http.Request)
 		os.Remove(exportPath)
 	}
 
-	// Update pages config
-	pagesEnabled := r.FormValue("pages_enabled") == "on"
-	pagesConfigPath := filepath.Join(repoPath, "git-pages.json")
-	pagesBranch := r.FormValue("pages_branch")
-	if pagesBranch == "" {
-		pagesBranch = "main"
+	// Update template flag and topics
+	if err := setTemplateRepo(repoPath, r.FormValue("is_template") == "on"); err != nil {
+		log.Printf("Error updating template flag for %s: %v", repoName, err)
 	}
-	pagesOutputDir := r.FormValue("pages_output_dir")
-	if pagesOutputDir == "" {
-		pagesOutputDir = "public"
+	if err := setRepoTopics(repoPath, topics); err != nil {
+		log.Printf("Error updating topics for %s: %v", repoName, err)
 	}
-	pagesConfig := map[string]interface{}{
-		"enabled":       pagesEnabled,
-		"branch":        pagesBranch,
-		"build_command": r.FormValue("pages_build_cmd"),
-		"output_dir":    pagesOutputDir,
+
+	// Update pages config
+	writePagesConfig(repoPath, r.FormValue("pages_enabled") == "on", r.FormValue("pages_branch"), r.FormValue("pages_build_cmd"), r.FormValue("pages_output_dir"))
+
+	// Update mirror targets
+	if err := saveMirrorConfig(repoPath, mirrorConfig); err != nil {
+		log.Printf("Error saving mirror config for %s: %v", repoName, err)
+	} else {
+		if pull := mirrorConfig.pullTarget(); pull != nil {
+			// Pushes are rejected by the hook, the first fetch runs right away
+			if err := installLockHook(repoPath); err != nil {
+				log.Printf("Warning: pushes to pull mirror %s are not rejected: %v", repoName, err)
+			}
+			go func() {
+				if _, err := s.mirrors.Sync(context.Background(), repoName, pull.Name, "manual"); err != nil {
+					log.Printf("Mirror of %s failed: %v", repoName, err)
+				}
+			}()
+		}
+		s.mirrors.Notify(repoPath)
 	}
-	pagesData, _ := json.MarshalIndent(pagesConfig, "", "  ")
-	os.WriteFile(pagesConfigPath, pagesData, 0644)
-
-	// Update mirror config
-	mirrorEnabled := r.FormValue("mirror_enabled") == "on"
-	mirrorURL := strings.TrimSpace(r.FormValue("mirror_url"))
-	mirrorConfigPath := filepath.Join(repoPath, "git-mirror.json")
-	if mirrorEnabled && mirrorURL != "" {
-		mirrorConfig := map[string]interface{}{
-			"enabled":    true,
-			"github_url": mirrorURL,
+
+	// Update the LFS quota and storage, only present when LFS is configured
+	if setLFSQuota || setLFSStorage {
+		repoLFSConfig, err := loadRepoLFSConfig(repoPath)
+		if err != nil {
+			repoLFSConfig = &RepoLFSConfig{}
+		}
+		if setLFSQuota {
+			repoLFSConfig.Quota = quota
+		}
+		if setLFSStorage {
+			if old := repoLFSConfig.Storage; (old == nil) != (lfsStorage == nil) || (old != nil && *old != *lfsStorage) {
+				log.Printf("LFS storage of %s changed by %s, existing objects stay where they are until migrated", repoName, lockOwner(r))
+			}
+			repoLFSConfig.Storage = lfsStorage
 		}
-		mirrorData, _ := json.MarshalIndent(mirrorConfig, "", "  ")
-		os.WriteFile(mirrorConfigPath, mirrorData, 0644)
-	} else if !mirrorEnabled {
-		// Set enabled to false instead of deleting
-		mirrorConfig := map[string]interface{}{
-			"enabled":    false,
-			"github_url": mirrorURL,
+		if err := saveRepoLFSConfig(repoPath, repoLFSConfig); err != nil {
+			log.Printf("Error writing LFS config of %s: %v", repoName, err)
+		}
+	}
+
+	if setAdmins {
+		acl := &RepoACL{Admins: parseRepoAdmins(r.FormValue("admins"))}
+		if err := saveRepoACL(repoPath, acl); err != nil {
+			log.Printf("Error writing access list of %s: %v", repoName, err)
 		}
-		mirrorData, _ := json.MarshalIndent(mirrorConfig, "", "  ")
-		os.WriteFile(mirrorConfigPath, mirrorData, 0644)
 	}
 
 	// Redirect back to repo
@@ -908,7 +1284,7 @@ func (s *Server) handleRepoSettingsPost(w http.ResponseWriter, r *http.Request)
 
 // handleCommit shows a specific commit with its diff
 func (s *Server) handleCommit(w http.ResponseWriter, r *http.Request) {
-	repoName := chi.URLParam(r, "repo")
+	repoName := repoParam(r)
 	hash := chi.URLParam(r, "hash")
 
 	if !RepoExists(s.reposPath, repoName) {
@@ -918,12 +1294,16 @@ func (s *Server) handleCommit(w http.ResponseWriter, r *http.Request) {
 
 	// Check access
 	repoPath := filepath.Join(s.reposPath, repoName+".git")
-	if !IsPublicRepo(repoPath) && !s.isTailnetRequest(r) {
+	if !IsPublicRepo(s.reposPath, repoPath) && !s.isTailnetRequest(r) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
 
 	commitDiff, err := GetCommitDiff(s.reposPath, repoName, hash)
+	if isRefError(err) {
+		s.renderRefNotFound(w, r, repoName, err)
+		return
+	}
 	if err != nil {
 		log.Printf("Error getting commit diff: %v", err)
 		http.Error(w, "Commit not found", http.StatusNotFound)
@@ -944,7 +1324,7 @@ func (s *Server) handleCommit(w http.ResponseWriter, r *http.Request) {
 		"CommitDiff":    commitDiff,
 		"Branches":      branches,
 		"IsTailnet":     s.isTailnetRequest(r),
-		"IsPublic":      IsPublicRepo(repoPath),
+		"IsPublic":      IsPublicRepo(s.reposPath, repoPath),
 		"PublicURL":     s.publicURL,
 		"TailnetURL":    s.tailnetURL,
 	}
@@ -1057,16 +1437,32 @@ func (s *Server) handleAdminSettings(w http.ResponseWriter, r *http.Request) {
 
 	// Read LFS config (server-level)
 	lfsEnabled := false
+	lfsBackend := "s3"
+	lfsPath := filepath.Join(filepath.Dir(s.reposPath), "lfs-objects")
 	lfsEndpoint := ""
 	lfsBucket := ""
 	lfsRegion := "auto"
-	lfsAccessKey := ""
-	lfsSecretKey := ""
+	lfsAccessKeySet := false
+	lfsSecretKeySet := false
+	lfsGC := false
+	lfsGCGraceDays := defaultLFSGCGraceDays
 	lfsConfigPath := filepath.Join(filepath.Dir(s.reposPath), "lfs-config.json")
 	if data, err := os.ReadFile(lfsConfigPath); err == nil {
 		var lfsConfig map[string]interface{}
 		if json.Unmarshal(data, &lfsConfig) == nil {
 			lfsEnabled = true
+			if v, ok := lfsConfig["gc"].(bool); ok {
+				lfsGC = v
+			}
+			if v, ok := lfsConfig["gc_grace_days"].(float64); ok && v > 0 {
+				lfsGCGraceDays = int(v)
+			}
+			if v, ok := lfsConfig["backend"].(string); ok && v != "" {
+				lfsBackend = v
+			}
+			if v, ok := lfsConfig["path"].(string); ok && v != "" {
+				lfsPath = v
+			}
 			if v, ok := lfsConfig["endpoint"].(string); ok {
 				lfsEndpoint = v
 			}
@@ -1076,11 +1472,12 @@ func (s *Server) handleAdminSettings(w http.ResponseWriter, r *http.Request) {
 			if v, ok := lfsConfig["region"].(string); ok {
 				lfsRegion = v
 			}
+			// Secrets are write-only, the page only shows whether they're set
 			if v, ok := lfsConfig["access_key"].(string); ok {
-				lfsAccessKey = v
+				lfsAccessKeySet = v != ""
 			}
 			if v, ok := lfsConfig["secret_key"].(string); ok {
-				lfsSecretKey = v
+				lfsSecretKeySet = v != ""
 			}
 		}
 	}
@@ -1090,36 +1487,49 @@ func (s *Server) handleAdminSettings(w http.ResponseWriter, r *http.Request) {
 	backupEndpoint := ""
 	backupBucket := ""
 	backupRegion := "auto"
-	backupAccessKey := ""
-	backupSecretKey := ""
+	backupAccessKeySet := false
+	backupSecretKeySet := false
 	backupSchedule := "daily"
-	backupConfigPath := filepath.Join(filepath.Dir(s.reposPath), "backup-config.json")
-	if data, err := os.ReadFile(backupConfigPath); err == nil {
-		var backupConfig map[string]interface{}
-		if json.Unmarshal(data, &backupConfig) == nil {
-			if v, ok := backupConfig["enabled"].(bool); ok {
-				backupEnabled = v
-			}
-			if v, ok := backupConfig["endpoint"].(string); ok {
-				backupEndpoint = v
-			}
-			if v, ok := backupConfig["bucket"].(string); ok {
-				backupBucket = v
-			}
-			if v, ok := backupConfig["region"].(string); ok {
-				backupRegion = v
-			}
-			if v, ok := backupConfig["access_key"].(string); ok {
-				backupAccessKey = v
-			}
-			if v, ok := backupConfig["secret_key"].(string); ok {
-				backupSecretKey = v
-			}
-			if v, ok := backupConfig["schedule"].(string); ok {
-				backupSchedule = v
-			}
+	backupRetention := defaultBackupRetention
+	backupVerify := defaultBackupVerify
+	backupEncrypt := false
+	backupAllowPlaintext := false
+	backupKeyID := ""
+	if cfg, err := loadBackupConfig(filepath.Join(filepath.Dir(s.reposPath), "backup-config.json")); err == nil {
+		backupEnabled = cfg.Enabled
+		backupEndpoint = cfg.Endpoint
+		backupBucket = cfg.Bucket
+		backupRegion = cfg.Region
+		backupAccessKeySet = cfg.AccessKey != ""
+		backupSecretKeySet = cfg.SecretKey != ""
+		backupSchedule = cfg.Schedule
+		if cfg.Retention > 0 {
+			backupRetention = cfg.Retention
+		}
+		backupVerify = cfg.verifySchedule()
+		backupEncrypt = cfg.Encrypt
+		backupAllowPlaintext = cfg.AllowPlaintext
+		if cipher, err := newBackupCipher(cfg.EncryptionKey); err == nil {
+			backupKeyID = cipher.KeyID()
 		}
 	}
+	_, isAlias := scheduleAliases[backupSchedule]
+
+	// LFS usage from the last scan, and the quotas it's close to
+	lfsUsage, lfsUsageScanned := s.lfsGC.Usage()
+	lfsLimits := &LFSConfig{QuotaWarningPercent: defaultLFSQuotaWarningPercent}
+	var lfsQuotaWarnings []LFSQuotaStatus
+	if cfg, err := loadLFSConfig(lfsConfigPath); err == nil {
+		lfsLimits = cfg
+		lfsLimits.QuotaWarningPercent = quotaWarningPercent(cfg)
+		lfsQuotaWarnings = s.lfsGC.QuotaWarnings(cfg)
+	}
+	repos, _ := ListRepos(s.reposPath, true)
+
+	trash, err := s.trash.List()
+	if err != nil {
+		log.Printf("Error listing deleted repositories: %v", err)
+	}
 
 	data := map[string]interface{}{
 		"Title":             "Server Settings",
@@ -1130,20 +1540,50 @@ func (s *Server) handleAdminSettings(w http.ResponseWriter, r *http.Request) {
 		"SSHPublicKey":      sshPublicKey,
 		"SSHKeyFingerprint": sshKeyFingerprint,
 		// LFS config
-		"LFSEnabled":   lfsEnabled,
-		"LFSEndpoint":  lfsEndpoint,
-		"LFSBucket":    lfsBucket,
-		"LFSRegion":    lfsRegion,
-		"LFSAccessKey": lfsAccessKey,
-		"LFSSecretKey": lfsSecretKey,
+		"LFSEnabled":      lfsEnabled,
+		"LFSBackend":      lfsBackend,
+		"LFSPath":         lfsPath,
+		"LFSEndpoint":     lfsEndpoint,
+		"LFSBucket":       lfsBucket,
+		"LFSRegion":       lfsRegion,
+		"LFSAccessKeySet": lfsAccessKeySet,
+		"LFSSecretKeySet": lfsSecretKeySet,
+		// LFS usage and garbage collection
+		"LFSGC":           lfsGC,
+		"LFSGCGraceDays":  lfsGCGraceDays,
+		"LFSUsage":        lfsUsage,
+		"LFSUsageScanned": lfsUsageScanned,
+		"LFSGCReports":    s.lfsGC.Reports(),
+		"LFSGCRunning":    s.lfsGC.Running(),
+		"Repos":           repos,
+		// LFS limits
+		"LFSLimits":        lfsLimits,
+		"LFSQuotaWarnings": lfsQuotaWarnings,
+		// Results of the last storage connection tests
+		"LFSTest":    storageConfigs.LastTest("lfs"),
+		"BackupTest": storageConfigs.LastTest("backup"),
 		// Backup config
-		"BackupEnabled":   backupEnabled,
-		"BackupEndpoint":  backupEndpoint,
-		"BackupBucket":    backupBucket,
-		"BackupRegion":    backupRegion,
-		"BackupAccessKey": backupAccessKey,
-		"BackupSecretKey": backupSecretKey,
-		"BackupSchedule":  backupSchedule,
+		"BackupEnabled":        backupEnabled,
+		"BackupEndpoint":       backupEndpoint,
+		"BackupBucket":         backupBucket,
+		"BackupRegion":         backupRegion,
+		"BackupAccessKeySet":   backupAccessKeySet,
+		"BackupSecretKeySet":   backupSecretKeySet,
+		"BackupSchedule":       backupSchedule,
+		"BackupCustom":         !isAlias && backupSchedule != "manual",
+		"BackupRetention":      backupRetention,
+		"BackupVerify":         backupVerify,
+		"BackupEncrypt":        backupEncrypt,
+		"BackupAllowPlaintext": backupAllowPlaintext,
+		"BackupKeyID":          backupKeyID,
+		// Backup status, snapshots and restores
+		"Backups": s.backups.Status(),
+		// Deleted repositories
+		"Trash":     trash,
+		"TrashDays": int(s.trash.Retention().Hours() / 24),
+		// Repository cache
+		"CacheStats":         repoCache.Stats(),
+		"CacheInvalidations": repoCache.invalidations.Load(),
 	}
 
 	s.renderTemplate(w, "admin.html", data)
@@ -1220,20 +1660,36 @@ func (s *Server) handleLFSConfigPost(w http.ResponseWriter, r *http.Request) {
 	lfsConfigPath := filepath.Join(filepath.Dir(s.reposPath), "lfs-config.json")
 
 	if lfsEnabled {
-		// Save LFS config
-		lfsConfig := map[string]interface{}{
-			"endpoint":   strings.TrimSpace(r.FormValue("lfs_endpoint")),
-			"bucket":     strings.TrimSpace(r.FormValue("lfs_bucket")),
-			"region":     strings.TrimSpace(r.FormValue("lfs_region")),
-			"access_key": strings.TrimSpace(r.FormValue("lfs_access_key")),
-			"secret_key": strings.TrimSpace(r.FormValue("lfs_secret_key")),
+		lfsConfig, err := parseLFSConfigForm(r, lfsConfigPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		// Set default region if empty
-		if lfsConfig["region"] == "" {
-			lfsConfig["region"] = "auto"
+		// Only storage that works is saved
+		cfg, err := decodeConfig[LFSConfig](lfsConfig)
+		if err == nil {
+			err = cfg.decryptSecrets()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		storage, err := openLFSStorage(r.Context(), cfg, filepath.Dir(s.reposPath))
+		if err != nil {
+			http.Error(w, "Invalid LFS storage: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if result := storageConfigs.Test(r.Context(), "lfs", storage); !result.OK {
+			http.Error(w, "LFS storage connection test failed: "+result.Error, http.StatusBadRequest)
+			return
 		}
 
+		if err := encryptConfigSecrets(lfsConfig); err != nil {
+			log.Printf("Error encrypting LFS config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
 		data, err := json.MarshalIndent(lfsConfig, "", "  ")
 		if err != nil {
 			log.Printf("Error marshaling LFS config: %v", err)
@@ -1253,6 +1709,7 @@ func (s *Server) handleLFSConfigPost(w http.ResponseWriter, r *http.Request) {
 		os.Remove(lfsConfigPath)
 		log.Printf("LFS configuration disabled, removed %s", lfsConfigPath)
 	}
+	storageConfigs.Invalidate(lfsConfigPath)
 
 	// Redirect back to referrer
 	referer := r.Header.Get("Referer")
@@ -1262,17 +1719,117 @@ func (s *Server) handleLFSConfigPost(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, referer, http.StatusFound)
 }
 
-// replaceConfigLine replaces a shell config line like KEY="value" with a new value
-func replaceConfigLine(content, key, newValue string) string {
-	lines := strings.Split(content, "\n")
-	for i, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if strings.HasPrefix(trimmed, key+"=") {
-			lines[i] = key + "=" + newValue
-			return strings.Join(lines, "\n")
+// parseBackupConfigForm returns the backup config submitted from Server Settings as it's saved,
+// keeping the saved S3 keys if their write-only fields are left empty
+func parseBackupConfigForm(r *http.Request, backupConfigPath string) map[string]interface{} {
+	backupConfig := map[string]interface{}{
+		"enabled":    r.FormValue("backup_enabled") == "on",
+		"endpoint":   strings.TrimSpace(r.FormValue("backup_endpoint")),
+		"bucket":     strings.TrimSpace(r.FormValue("backup_bucket")),
+		"region":     strings.TrimSpace(r.FormValue("backup_region")),
+		"access_key": strings.TrimSpace(r.FormValue("backup_access_key")),
+		"secret_key": strings.TrimSpace(r.FormValue("backup_secret_key")),
+		"schedule":   r.FormValue("backup_schedule"),
+	}
+
+	// Set defaults
+	if backupConfig["region"] == "" {
+		backupConfig["region"] = "auto"
+	}
+	if backupConfig["schedule"] == "" {
+		backupConfig["schedule"] = "daily"
+	}
+	if backupConfig["schedule"] == "custom" {
+		backupConfig["schedule"] = strings.TrimSpace(r.FormValue("backup_cron"))
+	}
+	if retention, err := strconv.Atoi(r.FormValue("backup_retention")); err == nil && retention > 0 {
+		backupConfig["retention"] = retention
+	}
+	if verify := strings.TrimSpace(r.FormValue("backup_verify")); verify != "" {
+		backupConfig["verify"] = verify
+	}
+	backupConfig["encrypt"] = r.FormValue("backup_encrypt") == "on"
+	backupConfig["encryption_key"] = strings.TrimSpace(r.FormValue("backup_encryption_key"))
+	backupConfig["allow_plaintext"] = r.FormValue("backup_allow_plaintext") == "on"
+
+	if data, err := os.ReadFile(backupConfigPath); err == nil {
+		var existing map[string]interface{}
+		if json.Unmarshal(data, &existing) == nil {
+			keepSecret(backupConfig, existing, "access_key")
+			keepSecret(backupConfig, existing, "secret_key")
+			keepSecret(backupConfig, existing, "encryption_key")
 		}
 	}
-	return content
+	return backupConfig
+}
+
+// parseLFSConfigForm returns the LFS config submitted from Server Settings as it's saved,
+// keeping the settings of the existing config that aren't on the form
+func parseLFSConfigForm(r *http.Request, lfsConfigPath string) (map[string]interface{}, error) {
+	lfsConfig := map[string]interface{}{
+		"backend":    "s3",
+		"endpoint":   strings.TrimSpace(r.FormValue("lfs_endpoint")),
+		"bucket":     strings.TrimSpace(r.FormValue("lfs_bucket")),
+		"region":     strings.TrimSpace(r.FormValue("lfs_region")),
+		"access_key": strings.TrimSpace(r.FormValue("lfs_access_key")),
+		"secret_key": strings.TrimSpace(r.FormValue("lfs_secret_key")),
+	}
+
+	// Set default region if empty
+	if lfsConfig["region"] == "" {
+		lfsConfig["region"] = "auto"
+	}
+
+	// Local storage needs no S3 settings
+	if r.FormValue("lfs_backend") == "local" {
+		lfsConfig = map[string]interface{}{
+			"backend": "local",
+			"path":    strings.TrimSpace(r.FormValue("lfs_path")),
+		}
+	}
+
+	// Garbage collection applies to either backend
+	lfsConfig["gc"] = r.FormValue("lfs_gc") == "on"
+	if days, err := strconv.Atoi(r.FormValue("lfs_gc_grace_days")); err == nil && days > 0 {
+		lfsConfig["gc_grace_days"] = days
+	}
+
+	// So do size limits and quotas
+	for field, key := range map[string]string{
+		"lfs_max_object_size": "max_object_size",
+		"lfs_quota":           "quota",
+		"lfs_repo_quota":      "repo_quota",
+	} {
+		size, err := parseSize(r.FormValue(field))
+		if err != nil {
+			return nil, err
+		}
+		if size > 0 {
+			lfsConfig[key] = size
+		}
+	}
+	if percent, err := strconv.Atoi(r.FormValue("lfs_quota_warning_percent")); err == nil && percent > 0 && percent <= 100 {
+		lfsConfig["quota_warning_percent"] = percent
+	}
+
+	// Named credentials and the key prefix are only edited in the file, keep them. So are
+	// the S3 keys if their write-only fields are left empty.
+	if data, err := os.ReadFile(lfsConfigPath); err == nil {
+		var existing map[string]interface{}
+		if json.Unmarshal(data, &existing) == nil {
+			if v, ok := existing["credentials"]; ok {
+				lfsConfig["credentials"] = v
+			}
+			if lfsConfig["backend"] == "s3" {
+				if v, ok := existing["prefix"]; ok {
+					lfsConfig["prefix"] = v
+				}
+				keepSecret(lfsConfig, existing, "access_key")
+				keepSecret(lfsConfig, existing, "secret_key")
+			}
+		}
+	}
+	return lfsConfig, nil
 }
 
 // handleBackupConfigPost saves the backup configuration (tailnet only)
@@ -1291,24 +1848,51 @@ func (s *Server) handleBackupConfigPost(w http.ResponseWriter, r *http.Request)
 	backupConfigPath := filepath.Join(filepath.Dir(s.reposPath), "backup-config.json")
 
 	// Save backup config (always save, just toggle enabled flag)
-	backupConfig := map[string]interface{}{
-		"enabled":    backupEnabled,
-		"endpoint":   strings.TrimSpace(r.FormValue("backup_endpoint")),
-		"bucket":     strings.TrimSpace(r.FormValue("backup_bucket")),
-		"region":     strings.TrimSpace(r.FormValue("backup_region")),
-		"access_key": strings.TrimSpace(r.FormValue("backup_access_key")),
-		"secret_key": strings.TrimSpace(r.FormValue("backup_secret_key")),
-		"schedule":   r.FormValue("backup_schedule"),
+	backupConfig := parseBackupConfigForm(r, backupConfigPath)
+	if _, err := ParseSchedule(backupConfig["schedule"].(string)); err != nil {
+		http.Error(w, "Invalid backup schedule: "+err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	// Set defaults
-	if backupConfig["region"] == "" {
-		backupConfig["region"] = "auto"
+	if verify, ok := backupConfig["verify"].(string); ok {
+		if _, err := ParseSchedule(verify); err != nil {
+			http.Error(w, "Invalid verification schedule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
-	if backupConfig["schedule"] == "" {
-		backupConfig["schedule"] = "daily"
+	// Saved keys are sealed, they were checked when they were entered
+	if key := backupConfig["encryption_key"].(string); !strings.HasPrefix(key, secretPrefix) {
+		if _, err := newBackupCipher(key); err != nil && (key != "" || backupConfig["encrypt"] == true) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
+	// Only a bucket that works is saved while backups are enabled
+	if backupEnabled {
+		cfg, err := decodeConfig[BackupConfig](backupConfig)
+		if err == nil {
+			err = cfg.decryptSecrets()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		storage, err := openBackupStorage(r.Context(), cfg)
+		if err != nil {
+			http.Error(w, "Invalid backup storage: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if result := storageConfigs.Test(r.Context(), "backup", storage); !result.OK {
+			http.Error(w, "Backup storage connection test failed: "+result.Error, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := encryptConfigSecrets(backupConfig); err != nil {
+		log.Printf("Error encrypting backup config: %v", err)
+		http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+		return
+	}
 	data, err := json.MarshalIndent(backupConfig, "", "  ")
 	if err != nil {
 		log.Printf("Error marshaling backup config: %v", err)
@@ -1322,50 +1906,9 @@ func (s *Server) handleBackupConfigPost(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	storageConfigs.Invalidate(backupConfigPath)
 	log.Printf("Backup configuration saved to %s (enabled: %v)", backupConfigPath, backupEnabled)
 
-	// Also update the backup shell script config file
-	backupShellConfigPath := filepath.Join(filepath.Dir(s.reposPath), "..", "backup", "backup.conf")
-	if _, err := os.Stat(backupShellConfigPath); err == nil {
-		// Read existing config
-		existingData, err := os.ReadFile(backupShellConfigPath)
-		if err == nil {
-			content := string(existingData)
-			endpoint := backupConfig["endpoint"].(string)
-			bucket := backupConfig["bucket"].(string)
-			accessKey := backupConfig["access_key"].(string)
-			secretKey := backupConfig["secret_key"].(string)
-
-			// Update AWS_ENDPOINT_URL
-			if endpoint != "" {
-				content = replaceConfigLine(content, "AWS_ENDPOINT_URL", fmt.Sprintf(`"%s"`, endpoint))
-			}
-			// Update S3_BUCKET
-			if bucket != "" {
-				content = replaceConfigLine(content, "S3_BUCKET", fmt.Sprintf(`"%s"`, bucket))
-			}
-
-			// Write AWS credentials file for the default profile
-			awsCredsDir := filepath.Join(os.Getenv("HOME"), ".aws")
-			if awsCredsDir == "/.aws" {
-				awsCredsDir = "/root/.aws"
-			}
-			if accessKey != "" && secretKey != "" {
-				os.MkdirAll(awsCredsDir, 0700)
-				credsContent := fmt.Sprintf("[default]\naws_access_key_id = %s\naws_secret_access_key = %s\n", accessKey, secretKey)
-				if err := os.WriteFile(filepath.Join(awsCredsDir, "credentials"), []byte(credsContent), 0600); err != nil {
-					log.Printf("Warning: Could not write AWS credentials: %v", err)
-				}
-			}
-
-			if err := os.WriteFile(backupShellConfigPath, []byte(content), 0644); err != nil {
-				log.Printf("Warning: Could not update backup.conf: %v", err)
-			} else {
-				log.Printf("Backup shell config updated at %s", backupShellConfigPath)
-			}
-		}
-	}
-
 	// Redirect back to referrer
 	referer := r.Header.Get("Referer")
 	if referer == "" {
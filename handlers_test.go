@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsLoopbackRequest(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		header     map[string]string
+		want       bool
+	}{
+		{"127.0.0.1:50000", nil, true},
+		{"[::1]:50000", nil, true},
+		{"100.64.0.1:50000", nil, false},
+		{"203.0.113.5:50000", map[string]string{"X-Forwarded-For": "127.0.0.1"}, false},
+		{"203.0.113.5:50000", map[string]string{"X-Real-IP": "127.0.0.1"}, false},
+		// Relayed by a local proxy for a client elsewhere
+		{"127.0.0.1:50000", map[string]string{"X-Forwarded-For": "203.0.113.5"}, false},
+		{"127.0.0.1:50000", map[string]string{"X-Real-IP": "127.0.0.1"}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/repos/repo/refs-changed", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for name, value := range tt.header {
+			r.Header.Set(name, value)
+		}
+		if got := isLoopbackRequest(r); got != tt.want {
+			t.Errorf("%s with %v: isLoopbackRequest = %v, want %v", tt.remoteAddr, tt.header, got, tt.want)
+		}
+	}
+}
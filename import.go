@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+const (
+	// importStatusFile keeps the state of a repository's import until it succeeds
+	importStatusFile = "git-import.json"
+
+	// importTimeout bounds an import, LFS objects included
+	importTimeout = 2 * time.Hour
+
+	// importLFSBatchSize is how many LFS objects are asked for in one batch request
+	importLFSBatchSize = 100
+)
+
+var (
+	// ErrImportRunning is returned when a repository is already being imported
+	ErrImportRunning = errors.New("import already running")
+
+	// errImporting rejects pushes to a repository while it's imported
+	errImporting = errors.New("repository is being imported, push once the import is done")
+
+	// importProgress matches the progress lines git prints while fetching
+	importProgress = regexp.MustCompile(`^(?:remote: )?([A-Za-z ]+):\s+(\d+)%`)
+
+	// scpLikeURL matches SSH remotes written the scp way, user@host:path
+	scpLikeURL = regexp.MustCompile(`^(?:[^@/]+@)?[^/:]+:.+$`)
+)
+
+// ImportStatus is the state of a repository imported from a remote. It's saved in the
+// repository while the import runs and kept if it fails, so it can be retried.
+type ImportStatus struct {
+	URL         string    `json:"url"` // Without credentials
+	Provider    string    `json:"provider,omitempty"`
+	Credentials string    `json:"credentials,omitempty"` // Named mirror credentials
+	Token       string    `json:"token,omitempty"`       // Encrypted with the master key
+	LFS         bool      `json:"lfs"`
+	Phase       string    `json:"phase"`              // connecting, fetching, lfs, failed
+	Progress    string    `json:"progress,omitempty"` // Last progress line from git
+	Percent     int       `json:"percent"`
+	LFSObjects  int       `json:"lfs_objects,omitempty"`
+	LFSFetched  int       `json:"lfs_fetched,omitempty"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// running returns whether the import hasn't finished yet
+func (st *ImportStatus) running() bool {
+	return st.Phase != "failed"
+}
+
+// source returns the remote as a mirror target, to authenticate the same way
+func (st *ImportStatus) source() *MirrorTarget {
+	return &MirrorTarget{Provider: st.Provider, URL: st.URL, Credentials: st.Credentials, Token: st.Token}
+}
+
+// view returns the status without its token, for pages and the API
+func (st *ImportStatus) view() *ImportStatus {
+	v := *st
+	v.Token = ""
+	return &v
+}
+
+// loadImportStatus reads the import state of a repository, nil if it isn't being imported
+func loadImportStatus(repoPath string) *ImportStatus {
+	data, err := os.ReadFile(filepath.Join(repoPath, importStatusFile))
+	if err != nil {
+		return nil
+	}
+	st := &ImportStatus{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return &ImportStatus{Phase: "failed", Error: fmt.Sprintf("%s: %v", importStatusFile, err)}
+	}
+	return st
+}
+
+// saveImportStatus writes the import state of a repository
+func saveImportStatus(repoPath string, st *ImportStatus) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(repoPath, importStatusFile), data, 0644)
+}
+
+// importing returns whether a repository is being imported, pushes wait for it
+func importing(repoPath string) bool {
+	st := loadImportStatus(repoPath)
+	return st != nil && st.running()
+}
+
+// parseRemoteURL checks the URL of a remote to fetch from or push to and returns it without
+// the password of an HTTPS URL, which is returned apart. Local paths are never remotes, they
+// would reach the server's own disk; file:// URLs are only allowed with allowFile.
+func parseRemoteURL(raw string, allowFile bool) (string, string, error) {
+	schemes := "an https:// or ssh:// URL"
+	if allowFile {
+		schemes = "an https://, ssh:// or file:// URL"
+	}
+	switch {
+	case strings.HasPrefix(raw, "https://"), strings.HasPrefix(raw, "http://"):
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return "", "", fmt.Errorf("URL %q is invalid", raw)
+		}
+		if u.User == nil {
+			return raw, "", nil
+		}
+		password, _ := u.User.Password()
+		u.User = nil
+		return u.String(), password, nil
+	case strings.HasPrefix(raw, "ssh://"), allowFile && strings.HasPrefix(raw, "file://"):
+		return raw, "", nil
+	case scpLikeURL.MatchString(raw) && !strings.Contains(raw, "://") && !strings.HasPrefix(raw, "-"):
+		return raw, "", nil
+	}
+	return "", "", fmt.Errorf("URL must be %s, or user@host:path", schemes)
+}
+
+// parseImportSource reads the remote and credentials of an import from the new repository
+// form. Credentials in an HTTPS URL are moved out of it, the token is encrypted.
+func parseImportSource(r *http.Request, credentials map[string]*MirrorCredentials) (*ImportStatus, error) {
+	st := &ImportStatus{
+		URL:         strings.TrimSpace(r.FormValue("import_url")),
+		Credentials: strings.TrimSpace(r.FormValue("import_credentials")),
+		Token:       strings.TrimSpace(r.FormValue("import_token")),
+		LFS:         r.FormValue("import_lfs") == "on",
+	}
+
+	remote, password, err := parseRemoteURL(st.URL, true)
+	if err != nil {
+		return nil, fmt.Errorf("import %w", err)
+	}
+	st.URL = remote
+	if password != "" && st.Token == "" {
+		st.Token = password
+	}
+
+	if st.Credentials != "" {
+		if _, ok := credentials[st.Credentials]; !ok {
+			return nil, fmt.Errorf("unknown credentials %s", st.Credentials)
+		}
+	}
+	st.Provider = detectMirrorProvider(st.URL)
+	if st.Token != "" {
+		var err error
+		if st.Token, err = secretStore.Encrypt(st.Token); err != nil {
+			return nil, fmt.Errorf("encrypting the import token: %w", err)
+		}
+	}
+	return st, nil
+}
+
+// Imports clones repositories from remotes in the background
+type Imports struct {
+	reposPath string
+
+	mu      sync.Mutex
+	running map[string]*ImportStatus // Repo -> live status
+}
+
+// NewImports creates the imports of the repositories in reposPath
+func NewImports(reposPath string) *Imports {
+	return &Imports{
+		reposPath: reposPath,
+		running:   make(map[string]*ImportStatus),
+	}
+}
+
+// Recover marks the imports a previous run of the server didn't finish as failed
+func (im *Imports) Recover() {
+	for _, repoPath := range repoPaths(im.reposPath) {
+		st := loadImportStatus(repoPath)
+		if st == nil || !st.running() {
+			continue
+		}
+		st.Phase, st.Error, st.Finished = "failed", "interrupted by a server restart", time.Now()
+		if err := saveImportStatus(repoPath, st); err != nil {
+			log.Printf("Import: %s: %v", repoPath, err)
+		}
+	}
+}
+
+// Status returns the state of a repository's import, nil once it succeeded
+func (im *Imports) Status(repoName string) *ImportStatus {
+	im.mu.Lock()
+	if st, ok := im.running[repoName]; ok {
+		defer im.mu.Unlock()
+		return st.view()
+	}
+	im.mu.Unlock()
+
+	st := loadImportStatus(filepath.Join(im.reposPath, repoName+".git"))
+	if st == nil {
+		return nil
+	}
+	return st.view()
+}
+
+// Start imports a repository from the source st describes in the background, a failed
+// import is retried with its saved status
+func (im *Imports) Start(repoName string, st *ImportStatus) error {
+	repoPath := filepath.Join(im.reposPath, repoName+".git")
+	im.mu.Lock()
+	if _, ok := im.running[repoName]; ok {
+		im.mu.Unlock()
+		return ErrImportRunning
+	}
+	st.Phase, st.Progress, st.Percent, st.Error = "connecting", "", 0, ""
+	st.LFSObjects, st.LFSFetched = 0, 0
+	st.Started, st.Finished = time.Now(), time.Time{}
+	im.running[repoName] = st
+	im.mu.Unlock()
+
+	if err := saveImportStatus(repoPath, st); err != nil {
+		im.mu.Lock()
+		delete(im.running, repoName)
+		im.mu.Unlock()
+		return err
+	}
+	// The pre-receive hook rejects pushes until the import is done
+	if err := installLockHook(repoPath); err != nil {
+		log.Printf("Import: %s: %v", repoName, err)
+	}
+
+	go im.run(repoName, st)
+	return nil
+}
+
+// update changes the live status of an import, saving it if the phase changed
+func (im *Imports) update(repoName string, fn func(st *ImportStatus)) {
+	im.mu.Lock()
+	st := im.running[repoName]
+	phase := st.Phase
+	fn(st)
+	saved := *st
+	im.mu.Unlock()
+
+	if saved.Phase != phase {
+		saveImportStatus(filepath.Join(im.reposPath, repoName+".git"), &saved)
+	}
+}
+
+// run imports a repository and records the outcome
+func (im *Imports) run(repoName string, st *ImportStatus) {
+	repoPath := filepath.Join(im.reposPath, repoName+".git")
+	ctx, cancel := context.WithTimeout(context.Background(), importTimeout)
+	defer cancel()
+
+	log.Printf("Import: %s from %s", repoName, st.URL)
+	err := im.importRepo(ctx, repoName, st.source(), st.LFS)
+	repoCache.Invalidate(repoPath)
+
+	im.mu.Lock()
+	delete(im.running, repoName)
+	st.Finished = time.Now()
+	if err != nil {
+		st.Phase, st.Error = "failed", err.Error()
+	}
+	im.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Import: %s failed: %v", repoName, err)
+		if err := saveImportStatus(repoPath, st); err != nil {
+			log.Printf("Import: %s: %v", repoName, err)
+		}
+		return
+	}
+	os.Remove(filepath.Join(repoPath, importStatusFile))
+	log.Printf("Import: %s done in %s", repoName, st.Finished.Sub(st.Started).Round(time.Second))
+}
+
+// importRepo fetches every ref of the remote into a repository, follows its default branch
+// and then fetches the LFS objects its commits point to
+func (im *Imports) importRepo(ctx context.Context, repoName string, source *MirrorTarget, lfs bool) error {
+	repoPath := filepath.Join(im.reposPath, repoName+".git")
+	creds, err := mirrorAuth(im.reposPath, source)
+	if err != nil {
+		return err
+	}
+	env := mirrorGitEnv(creds)
+
+	_, head, err := lsRemote(ctx, repoPath, source.URL, env)
+	if err != nil {
+		return err
+	}
+
+	im.update(repoName, func(st *ImportStatus) { st.Phase = "fetching" })
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "fetch", "--progress", "--prune", "--no-tags", "--", source.URL, "+refs/*:refs/*")
+	cmd.Env = env
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	last := im.readProgress(repoName, stderr)
+	err = cmd.Wait()
+	os.Remove(filepath.Join(repoPath, "FETCH_HEAD"))
+	if err != nil {
+		return fmt.Errorf("git fetch: %v: %s", err, last)
+	}
+
+	if head != "" {
+		if out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "symbolic-ref", "HEAD", head).CombinedOutput(); err != nil {
+			return fmt.Errorf("git symbolic-ref: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	if !lfs {
+		return nil
+	}
+	im.update(repoName, func(st *ImportStatus) { st.Phase, st.Progress, st.Percent = "lfs", "", 0 })
+	return fetchImportLFS(ctx, im.reposPath, repoName, source.URL, creds, env, func(fetched, total int) {
+		im.update(repoName, func(st *ImportStatus) {
+			st.LFSFetched, st.LFSObjects = fetched, total
+			if total > 0 {
+				st.Percent = fetched * 100 / total
+			}
+		})
+	})
+}
+
+// readProgress follows the progress git prints while fetching and returns its last line,
+// which explains a failure
+func (im *Imports) readProgress(repoName string, r io.Reader) string {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		// Progress lines are redrawn with \r
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	var last string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		last = line
+		m := importProgress.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		percent, _ := strconv.Atoi(m[2])
+		im.update(repoName, func(st *ImportStatus) {
+			st.Progress = strings.TrimPrefix(line, "remote: ")
+			st.Percent = percent
+		})
+	}
+	return last
+}
+
+// fetchImportLFS copies the LFS objects the commits of an imported repository point to from
+// its remote into the repository's LFS storage. Objects already stored are skipped.
+func fetchImportLFS(ctx context.Context, reposPath, repoName, remote string, creds *MirrorCredentials, env []string, progress func(fetched, total int)) error {
+	storage, _, err := openRepoLFSStorage(ctx, reposPath, repoName)
+	if err != nil {
+		return fmt.Errorf("LFS: %w", err)
+	}
+	r, err := git.PlainOpen(filepath.Join(reposPath, repoName+".git"))
+	if err != nil {
+		return err
+	}
+	pointers, err := collectLFSPointers(r)
+	if err != nil {
+		return fmt.Errorf("LFS: reading pointers: %w", err)
+	}
+
+	var missing []LFSObject
+	for oid, size := range pointers {
+		if _, err := storage.Size(ctx, lfsObjectKey(repoName, oid)); err != nil {
+			missing = append(missing, LFSObject{OID: oid, Size: size})
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].OID < missing[j].OID })
+	fetched := len(pointers) - len(missing)
+	progress(fetched, len(pointers))
+	if len(missing) == 0 {
+		return nil
+	}
+
+	put := func(obj LFSObject, body io.Reader) error {
+		if err := storage.Put(ctx, lfsObjectKey(repoName, obj.OID), newVerifyingReader(body, obj.OID, obj.Size), obj.Size); err != nil {
+			return fmt.Errorf("LFS object %s: %w", obj.OID, err)
+		}
+		fetched++
+		progress(fetched, len(pointers))
+		return nil
+	}
+
+	// Local remotes keep their objects the way git-lfs does
+	if dir, ok := strings.CutPrefix(remote, "file://"); ok {
+		for _, obj := range missing {
+			if err := copyLocalLFSObject(dir, obj, put); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	endpoint, header, err := lfsRemoteEndpoint(ctx, remote, creds, env)
+	if err != nil {
+		return fmt.Errorf("LFS: %w", err)
+	}
+	var failed []string
+	for start := 0; start < len(missing); start += importLFSBatchSize {
+		batch := missing[start:min(start+importLFSBatchSize, len(missing))]
+		resp, err := requestLFSDownloads(ctx, endpoint, header, batch)
+		if err != nil {
+			return fmt.Errorf("LFS: %w", err)
+		}
+		for _, obj := range resp.Objects {
+			if obj.Error != nil || obj.Actions == nil || obj.Actions.Download == nil {
+				message := "no download offered"
+				if obj.Error != nil {
+					message = obj.Error.Message
+				}
+				failed = append(failed, fmt.Sprintf("%s: %s", obj.OID, message))
+				continue
+			}
+			if err := downloadLFSObject(ctx, obj, header, put); err != nil {
+				return err
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("LFS: %d objects could not be fetched, %s", len(failed), failed[0])
+	}
+	return nil
+}
+
+// copyLocalLFSObject stores an object from the LFS directory of a local repository, bare or not
+func copyLocalLFSObject(dir string, obj LFSObject, put func(LFSObject, io.Reader) error) error {
+	rel := filepath.Join("lfs", "objects", obj.OID[0:2], obj.OID[2:4], obj.OID)
+	f, err := os.Open(filepath.Join(dir, rel))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(dir, ".git", rel))
+	}
+	if err != nil {
+		return fmt.Errorf("LFS object %s: %w", obj.OID, err)
+	}
+	defer f.Close()
+	return put(obj, f)
+}
+
+// lfsRemoteEndpoint returns the LFS API of a remote and the headers authenticating with it.
+// SSH remotes are asked with git-lfs-authenticate, HTTPS ones serve it under info/lfs.
+func lfsRemoteEndpoint(ctx context.Context, remote string, creds *MirrorCredentials, env []string) (string, map[string]string, error) {
+	if strings.HasPrefix(remote, "https://") || strings.HasPrefix(remote, "http://") {
+		endpoint := strings.TrimSuffix(remote, "/")
+		if !strings.HasSuffix(endpoint, ".git") {
+			endpoint += ".git"
+		}
+		header := make(map[string]string)
+		if creds.Token != "" {
+			header["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(creds.Username+":"+creds.Token))
+		}
+		return endpoint + "/info/lfs", header, nil
+	}
+
+	// ssh://[user@]host[:port]/path or [user@]host:path
+	var args []string
+	var host, repoPath string
+	if rest, ok := strings.CutPrefix(remote, "ssh://"); ok {
+		u, err := url.Parse("ssh://" + rest)
+		if err != nil {
+			return "", nil, err
+		}
+		host, repoPath = u.Hostname(), u.Path
+		if u.User != nil {
+			host = u.User.Username() + "@" + host
+		}
+		if u.Port() != "" {
+			args = append(args, "-p", u.Port())
+		}
+	} else {
+		host, repoPath, _ = strings.Cut(remote, ":")
+	}
+	args = append(args, host, "git-lfs-authenticate", repoPath, "download")
+
+	// GIT_SSH_COMMAND is a shell command, as git runs it
+	cmd := exec.CommandContext(ctx, "sh", append([]string{"-c", `${GIT_SSH_COMMAND:-ssh} "$@"`, "ssh"}, args...)...)
+	cmd.Env = env
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("git-lfs-authenticate: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var auth struct {
+		Href   string            `json:"href"`
+		Header map[string]string `json:"header"`
+	}
+	if err := json.Unmarshal(out, &auth); err != nil || auth.Href == "" {
+		return "", nil, fmt.Errorf("git-lfs-authenticate: unexpected response %q", strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSuffix(auth.Href, "/"), auth.Header, nil
+}
+
+// requestLFSDownloads asks an LFS API how to download objects
+func requestLFSDownloads(ctx context.Context, endpoint string, header map[string]string, objects []LFSObject) (*LFSBatchResponse, error) {
+	body, err := json.Marshal(LFSBatchRequest{Operation: "download", Transfers: []string{"basic"}, Objects: objects})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Accept", "application/vnd.git-lfs+json")
+	req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("batch request: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	batch := &LFSBatchResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(batch); err != nil {
+		return nil, fmt.Errorf("batch response: %w", err)
+	}
+	return batch, nil
+}
+
+// downloadLFSObject downloads an object as its batch response says and stores it. The
+// remote's credentials are only sent along when the response doesn't carry its own.
+func downloadLFSObject(ctx context.Context, obj LFSObjectResponse, header map[string]string, put func(LFSObject, io.Reader) error) error {
+	action := obj.Actions.Download
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, action.Href, nil)
+	if err != nil {
+		return err
+	}
+	if len(action.Header) == 0 && !obj.Authenticated {
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+	}
+	for k, v := range action.Header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("LFS object %s: %w", obj.OID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("LFS object %s: download: %s", obj.OID, resp.Status)
+	}
+	return put(LFSObject{OID: obj.OID, Size: obj.Size}, resp.Body)
+}
+
+// handleImportRetryPost retries a failed import, optionally with a new token (tailnet only)
+func (s *Server) handleImportRetryPost(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied - Tailnet required", http.StatusForbidden)
+		return
+	}
+
+	repoName := repoParam(r)
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	if !RepoExists(s.reposPath, repoName) {
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+	st := loadImportStatus(repoPath)
+	if st == nil || st.URL == "" {
+		http.Error(w, "Repository has no import to retry", http.StatusBadRequest)
+		return
+	}
+	if token := strings.TrimSpace(r.FormValue("import_token")); token != "" {
+		var err error
+		if st.Token, err = secretStore.Encrypt(token); err != nil {
+			log.Printf("Error encrypting import token: %v", err)
+			http.Error(w, "Failed to save the token", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := s.imports.Start(repoName, st); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrImportRunning) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	http.Redirect(w, r, "/"+repoName, http.StatusFound)
+}
+
+// handleAPIImportStatus returns the state of a repository's import, 404 once it succeeded (tailnet only)
+func (s *Server) handleAPIImportStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "Access denied - Tailnet required"})
+		return
+	}
+
+	repoName := repoParam(r)
+	if !RepoExists(s.reposPath, repoName) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Repository not found"})
+		return
+	}
+	st := s.imports.Status(repoName)
+	if st == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Repository is not being imported"})
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
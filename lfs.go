@@ -3,28 +3,53 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
-	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 )
 
-// LFSConfig holds S3 configuration for LFS storage
+// lfsOIDPattern matches a valid LFS object ID, a lowercase hex SHA-256
+var lfsOIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// LFSConfig holds the storage configuration for LFS objects
 type LFSConfig struct {
+	Backend   string `json:"backend,omitempty"` // "s3" (default) or "local"
+	Path      string `json:"path,omitempty"`    // Local backend directory, defaults to lfs-objects/ in the data directory
 	Endpoint  string `json:"endpoint"`
 	Bucket    string `json:"bucket"`
 	AccessKey string `json:"access_key"`
 	SecretKey string `json:"secret_key"`
 	Region    string `json:"region"`
+	Prefix    string `json:"prefix,omitempty"` // Prepended to object keys in the bucket
+
+	// Named S3 credentials that repositories with their own storage can refer to
+	Credentials map[string]LFSCredentials `json:"credentials,omitempty"`
+
+	GC          bool `json:"gc,omitempty"`            // Delete unreferenced objects periodically
+	GCGraceDays int  `json:"gc_grace_days,omitempty"` // Age unreferenced objects must reach before deletion
+
+	MaxObjectSize       int64 `json:"max_object_size,omitempty"`       // Bytes, 0 for no limit
+	Quota               int64 `json:"quota,omitempty"`                 // Bytes across all repositories, 0 for no limit
+	RepoQuota           int64 `json:"repo_quota,omitempty"`            // Default bytes per repository, 0 for no limit
+	QuotaWarningPercent int   `json:"quota_warning_percent,omitempty"` // Usage at which admins are warned
+}
+
+// LFSCredentials is an S3 access key pair
+type LFSCredentials struct {
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
 }
 
 // LFSBatchRequest is the Git LFS batch API request
@@ -33,6 +58,7 @@ type LFSBatchRequest struct {
 	Transfers []string     `json:"transfers,omitempty"`
 	Ref       *LFSRef      `json:"ref,omitempty"`
 	Objects   []LFSObject  `json:"objects"`
+	HashAlgo  string       `json:"hash_algo,omitempty"`
 }
 
 // LFSRef represents a Git reference
@@ -50,6 +76,7 @@ type LFSObject struct {
 type LFSBatchResponse struct {
 	Transfer string              `json:"transfer,omitempty"`
 	Objects  []LFSObjectResponse `json:"objects"`
+	HashAlgo string              `json:"hash_algo,omitempty"`
 }
 
 // LFSObjectResponse is the response for a single object
@@ -57,16 +84,31 @@ type LFSObjectResponse struct {
 	OID           string                 `json:"oid"`
 	Size          int64                  `json:"size"`
 	Authenticated bool                   `json:"authenticated,omitempty"`
-	Actions       map[string]*LFSAction  `json:"actions,omitempty"`
+	Actions       *LFSActions            `json:"actions,omitempty"`
 	Error         *LFSError              `json:"error,omitempty"`
 }
 
+// LFSActions are the actions the client performs to transfer an object
+type LFSActions struct {
+	Download *LFSAction `json:"download,omitempty"`
+	Upload   *LFSAction `json:"upload,omitempty"`
+	Verify   *LFSAction `json:"verify,omitempty"`
+
+	// multipart-basic transfers upload the parts, then commit or abort the upload
+	Parts  []*LFSAction `json:"parts,omitempty"`
+	Commit *LFSAction   `json:"commit,omitempty"`
+	Abort  *LFSAction   `json:"abort,omitempty"`
+}
+
 // LFSAction describes how to upload/download an object
 type LFSAction struct {
 	Href      string            `json:"href"`
 	Header    map[string]string `json:"header,omitempty"`
 	ExpiresIn int               `json:"expires_in,omitempty"`
 	ExpiresAt string            `json:"expires_at,omitempty"`
+	Method    string            `json:"method,omitempty"`
+	Pos       int64             `json:"pos,omitempty"`
+	Size      int64             `json:"size,omitempty"`
 }
 
 // LFSError represents an error for a specific object
@@ -75,114 +117,135 @@ type LFSError struct {
 	Message string `json:"message"`
 }
 
-// loadLFSConfig loads the LFS configuration from file
+// loadLFSConfig loads the LFS configuration from file, with its secrets decrypted
 func loadLFSConfig(configPath string) (*LFSConfig, error) {
-	data, err := os.ReadFile(configPath)
+	cfg, err := loadCachedConfig[LFSConfig](storageConfigs, configPath)
 	if err != nil {
 		return nil, err
 	}
-
-	var cfg LFSConfig
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+	if err := cfg.decryptSecrets(); err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
 	}
-
-	return &cfg, nil
+	return cfg, nil
 }
 
-// createS3Client creates an S3 client from LFS config
-func createS3Client(ctx context.Context, lfsCfg *LFSConfig) (*s3.Client, error) {
-	region := lfsCfg.Region
-	if region == "" || region == "auto" {
-		region = "auto"
-	}
-
-	// Create custom endpoint resolver for S3-compatible services
-	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-		return aws.Endpoint{
-			URL:               lfsCfg.Endpoint,
-			SigningRegion:     region,
-			HostnameImmutable: true,
-		}, nil
-	})
-
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithRegion(region),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			lfsCfg.AccessKey,
-			lfsCfg.SecretKey,
-			"",
-		)),
-		config.WithEndpointResolverWithOptions(customResolver),
-	)
-	if err != nil {
-		return nil, err
+// decryptSecrets decrypts the S3 keys of the config, the cached config it was copied from stays encrypted
+func (cfg *LFSConfig) decryptSecrets() error {
+	if err := decryptSecrets(&cfg.AccessKey, &cfg.SecretKey); err != nil {
+		return err
 	}
+	if cfg.Credentials != nil {
+		credentials := make(map[string]LFSCredentials, len(cfg.Credentials))
+		for name, creds := range cfg.Credentials {
+			if err := decryptSecrets(&creds.AccessKey, &creds.SecretKey); err != nil {
+				return fmt.Errorf("credentials %s: %w", name, err)
+			}
+			credentials[name] = creds
+		}
+		cfg.Credentials = credentials
+	}
+	return nil
+}
 
-	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.UsePathStyle = true // Required for some S3-compatible services
+// createS3Client returns the S3 client for an LFS config
+func createS3Client(ctx context.Context, lfsCfg *LFSConfig) (*s3.Client, error) {
+	return storageConfigs.S3Client(ctx, s3ClientConfig{
+		Endpoint:  lfsCfg.Endpoint,
+		Region:    lfsCfg.Region,
+		AccessKey: lfsCfg.AccessKey,
+		SecretKey: lfsCfg.SecretKey,
 	})
-
-	return client, nil
 }
 
 // handleLFSBatch handles the LFS batch API endpoint
 func (s *Server) handleLFSBatch(w http.ResponseWriter, r *http.Request) {
-	repoName := chi.URLParam(r, "repo")
+	repoName := repoParam(r)
 
 	// Check if repo exists and is accessible
 	if !RepoExists(s.reposPath, repoName) {
-		http.Error(w, "Repository not found", http.StatusNotFound)
+		writeLFSJSON(w, http.StatusNotFound, map[string]string{"message": "Repository not found"})
 		return
 	}
 
 	// Check access (only allow from tailnet for write operations)
 	repoPath := filepath.Join(s.reposPath, repoName+".git")
-	isPublic := IsPublicRepo(repoPath)
+	isPublic := IsPublicRepo(s.reposPath, repoPath)
 	isTailnet := s.isTailnetRequest(r)
 
 	// Parse request
 	var req LFSBatchRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		writeLFSJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid request"})
+		return
+	}
+	if req.Operation != "upload" && req.Operation != "download" {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "Operation must be upload or download"})
 		return
 	}
 
 	// For upload operations, require tailnet access
 	if req.Operation == "upload" && !isTailnet {
-		http.Error(w, "Upload requires tailnet access", http.StatusForbidden)
+		writeLFSJSON(w, http.StatusForbidden, map[string]string{"message": "Upload requires tailnet access"})
+		return
+	}
+
+	// Pull mirrors only change by fetching from their upstream
+	if req.Operation == "upload" && pullMirrorURL(repoPath) != "" {
+		writeLFSJSON(w, http.StatusForbidden, map[string]string{"message": errPullMirror.Error()})
+		return
+	}
+
+	// Archived repositories are read-only
+	if req.Operation == "upload" && IsArchivedRepo(repoPath) {
+		writeLFSJSON(w, http.StatusForbidden, map[string]string{"message": errArchived.Error()})
 		return
 	}
 
 	// For download operations on private repos, require tailnet
 	if req.Operation == "download" && !isPublic && !isTailnet {
-		http.Error(w, "Access denied", http.StatusForbidden)
+		writeLFSJSON(w, http.StatusForbidden, map[string]string{"message": "Access denied"})
 		return
 	}
 
-	// Load LFS config
-	lfsConfigPath := filepath.Join(filepath.Dir(s.reposPath), "lfs-config.json")
-	lfsCfg, err := loadLFSConfig(lfsConfigPath)
-	if err != nil {
-		log.Printf("LFS config error: %v", err)
-		http.Error(w, "LFS not configured", http.StatusServiceUnavailable)
+	// Only SHA-256 object IDs are supported
+	if req.HashAlgo != "" && req.HashAlgo != "sha256" {
+		writeLFSJSON(w, http.StatusConflict, map[string]string{"message": "Unsupported hash algorithm: " + req.HashAlgo})
 		return
 	}
 
-	// Create S3 client
+	// Downloads are only authorised for refs of this repository, uploads for valid ref names
+	if req.Ref != nil && req.Ref.Name != "" {
+		if err := lfsCheckRef(repoPath, req.Operation, req.Ref.Name); err != nil {
+			writeLFSJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": err.Error()})
+			return
+		}
+	}
+
 	ctx := r.Context()
-	s3Client, err := createS3Client(ctx, lfsCfg)
-	if err != nil {
-		log.Printf("S3 client error: %v", err)
-		http.Error(w, "Storage error", http.StatusInternalServerError)
+	storage, lfsCfg := s.lfsRepoStorage(w, r, repoName)
+	if storage == nil {
 		return
 	}
 
+	transfer, ok := chooseLFSTransfer(req.Transfers, req.Operation, storage)
+	if !ok {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "No supported transfer adapter, the server supports " + strings.Join(lfsTransfers(req.Operation, storage), ", ")})
+		return
+	}
+
+	// Uploads must fit the size limit and quotas
+	var quota *lfsQuotaCheck
+	if req.Operation == "upload" {
+		quota = s.newLFSQuotaCheck(lfsCfg, repoName)
+	}
+
 	// Process objects
-	presignClient := s3.NewPresignClient(s3Client)
+	presigner, direct := storage.(lfsPresigner)
+	repoURL := lfsBaseURL(r) + "/" + repoName + ".git/info/lfs/"
 	response := LFSBatchResponse{
-		Transfer: "basic",
+		Transfer: transfer,
 		Objects:  make([]LFSObjectResponse, len(req.Objects)),
+		HashAlgo: "sha256",
 	}
 
 	for i, obj := range req.Objects {
@@ -191,92 +254,295 @@ func (s *Server) handleLFSBatch(w http.ResponseWriter, r *http.Request) {
 			Size: obj.Size,
 		}
 
-		// S3 key format: {repo}/{oid[0:2]}/{oid[2:4]}/{oid}
-		s3Key := fmt.Sprintf("%s/%s/%s/%s", repoName, obj.OID[:2], obj.OID[2:4], obj.OID)
+		// The OID becomes part of the storage key, so anything but a SHA-256 is rejected
+		if !lfsOIDPattern.MatchString(obj.OID) {
+			response.Objects[i].Error = &LFSError{
+				Code:    422,
+				Message: "Invalid object ID, expected 64 lowercase hex characters",
+			}
+			continue
+		}
+		if obj.Size < 0 {
+			response.Objects[i].Error = &LFSError{
+				Code:    422,
+				Message: "Invalid object size",
+			}
+			continue
+		}
+
+		key := lfsObjectKey(repoName, obj.OID)
+		size, err := storage.Size(ctx, key)
+		exists := err == nil
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("LFS storage error: %v", err)
+			response.Objects[i].Error = &LFSError{
+				Code:    500,
+				Message: "Failed to look up object",
+			}
+			continue
+		}
 
 		if req.Operation == "upload" {
-			// Generate presigned PUT URL
-			presignReq, err := presignClient.PresignPutObject(ctx, &s3.PutObjectInput{
-				Bucket:        aws.String(lfsCfg.Bucket),
-				Key:           aws.String(s3Key),
-				ContentLength: aws.Int64(obj.Size),
-			}, func(opts *s3.PresignOptions) {
-				opts.Expires = time.Hour
-			})
+			// Objects the server already has need no upload
+			if exists && size == obj.Size {
+				continue
+			}
+			if err := quota.admit(obj.Size); err != nil {
+				response.Objects[i].Error = err
+				continue
+			}
+
+			actions, err := lfsUploadActions(ctx, storage, transfer, repoURL, key, obj)
 			if err != nil {
+				log.Printf("LFS storage error: %v", err)
 				response.Objects[i].Error = &LFSError{
 					Code:    500,
-					Message: "Failed to generate upload URL",
+					Message: "Failed to prepare upload",
 				}
 				continue
 			}
 
-			response.Objects[i].Actions = map[string]*LFSAction{
-				"upload": {
-					Href:      presignReq.URL,
-					ExpiresIn: 3600,
-				},
-			}
-		} else if req.Operation == "download" {
-			// Check if object exists
-			_, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
-				Bucket: aws.String(lfsCfg.Bucket),
-				Key:    aws.String(s3Key),
-			})
-			if err != nil {
+			// The client confirms the upload so truncated objects are detected
+			actions.Verify = &LFSAction{Href: repoURL + "verify"}
+			response.Objects[i].Actions = actions
+			s.lfsGC.ExpectUpload(key)
+		} else {
+			if !exists {
 				response.Objects[i].Error = &LFSError{
 					Code:    404,
 					Message: "Object not found",
 				}
 				continue
 			}
-
-			// Generate presigned GET URL
-			presignReq, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
-				Bucket: aws.String(lfsCfg.Bucket),
-				Key:    aws.String(s3Key),
-			}, func(opts *s3.PresignOptions) {
-				opts.Expires = time.Hour
-			})
-			if err != nil {
+			if size != obj.Size {
 				response.Objects[i].Error = &LFSError{
-					Code:    500,
-					Message: "Failed to generate download URL",
+					Code:    422,
+					Message: fmt.Sprintf("Object size is %d bytes, not %d", size, obj.Size),
 				}
 				continue
 			}
 
-			response.Objects[i].Actions = map[string]*LFSAction{
-				"download": {
-					Href:      presignReq.URL,
-					ExpiresIn: 3600,
-				},
+			action := &LFSAction{Href: repoURL + "objects/" + obj.OID}
+			if direct {
+				action.Href, err = presigner.PresignDownload(ctx, key)
+				if err != nil {
+					response.Objects[i].Error = &LFSError{
+						Code:    500,
+						Message: "Failed to generate download URL",
+					}
+					continue
+				}
+				action.ExpiresIn = int(lfsPresignExpiry.Seconds())
 			}
+
+			response.Objects[i].Actions = &LFSActions{Download: action}
 		}
 	}
 
 	// Send response
-	w.Header().Set("Content-Type", "application/vnd.git-lfs+json")
-	json.NewEncoder(w).Encode(response)
+	writeLFSJSON(w, http.StatusOK, response)
 }
 
-// handleLFSLocksVerify handles the LFS locks verify endpoint (stub)
-func (s *Server) handleLFSLocksVerify(w http.ResponseWriter, r *http.Request) {
-	// LFS file locking is not implemented - return empty response
-	w.Header().Set("Content-Type", "application/vnd.git-lfs+json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"ours":   []interface{}{},
-		"theirs": []interface{}{},
+// lfsCheckRef checks the ref of a batch request. Downloads must name an existing ref,
+// uploads may create one so only the name is validated.
+func lfsCheckRef(repoPath, operation, ref string) error {
+	name := plumbing.ReferenceName(ref)
+	if !strings.HasPrefix(ref, "refs/") {
+		name = plumbing.NewBranchReferenceName(ref)
+	}
+	if err := name.Validate(); err != nil {
+		return fmt.Errorf("Invalid ref: %s", ref)
+	}
+	if operation == "upload" || IsEmptyRepo(repoPath) {
+		return nil
+	}
+
+	_, err := withCachedRepo(repoPath, func(r *git.Repository) (*plumbing.Reference, error) {
+		return r.Reference(name, true)
 	})
+	if err != nil {
+		return fmt.Errorf("Ref not found: %s", ref)
+	}
+	return nil
 }
 
-// handleLFSLocks handles the LFS locks list endpoint (stub)
-func (s *Server) handleLFSLocks(w http.ResponseWriter, r *http.Request) {
-	// LFS file locking is not implemented - return empty response
-	w.Header().Set("Content-Type", "application/vnd.git-lfs+json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"locks": []interface{}{},
-	})
+// handleLFSVerify confirms that an uploaded object is stored with the expected size (tailnet only)
+func (s *Server) handleLFSVerify(w http.ResponseWriter, r *http.Request) {
+	repoName := repoParam(r)
+	if !RepoExists(s.reposPath, repoName) {
+		writeLFSJSON(w, http.StatusNotFound, map[string]string{"message": "Repository not found"})
+		return
+	}
+	if !s.isTailnetRequest(r) {
+		writeLFSJSON(w, http.StatusForbidden, map[string]string{"message": "Verify requires tailnet access"})
+		return
+	}
+
+	var obj LFSObject
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+		writeLFSJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid request"})
+		return
+	}
+	if !lfsOIDPattern.MatchString(obj.OID) {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "Invalid object ID"})
+		return
+	}
+
+	storage, _ := s.lfsRepoStorage(w, r, repoName)
+	if storage == nil {
+		return
+	}
+
+	size, err := storage.Size(r.Context(), lfsObjectKey(repoName, obj.OID))
+	if errors.Is(err, os.ErrNotExist) {
+		writeLFSJSON(w, http.StatusNotFound, map[string]string{"message": "Object not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("LFS storage error: %v", err)
+		writeLFSJSON(w, http.StatusInternalServerError, map[string]string{"message": "Storage error"})
+		return
+	}
+	if size != obj.Size {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, map[string]string{
+			"message": fmt.Sprintf("Object size is %d bytes, expected %d", size, obj.Size),
+		})
+		return
+	}
+
+	// Uploads that bypassed the server are counted towards quotas here, once
+	s.lfsGC.AddVerifiedUsage(repoName, lfsObjectKey(repoName, obj.OID), size)
+	writeLFSJSON(w, http.StatusOK, map[string]string{"message": "Object verified"})
+}
+
+// lfsBaseURL returns the URL clients reached the server at, for server-proxied transfers
+func lfsBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// lfsObjectStorage opens the repository's LFS storage for an object transfer request, writing
+// an error response and returning nil if the repository or object can't be accessed
+func (s *Server) lfsObjectStorage(w http.ResponseWriter, r *http.Request, write bool) LFSStorage {
+	repoName := repoParam(r)
+	if !RepoExists(s.reposPath, repoName) {
+		writeLFSJSON(w, http.StatusNotFound, map[string]string{"message": "Repository not found"})
+		return nil
+	}
+
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	isTailnet := s.isTailnetRequest(r)
+	if write && !isTailnet {
+		writeLFSJSON(w, http.StatusForbidden, map[string]string{"message": "Upload requires tailnet access"})
+		return nil
+	}
+	if !IsPublicRepo(s.reposPath, repoPath) && !isTailnet {
+		writeLFSJSON(w, http.StatusForbidden, map[string]string{"message": "Access denied"})
+		return nil
+	}
+	if write && pullMirrorURL(repoPath) != "" {
+		writeLFSJSON(w, http.StatusForbidden, map[string]string{"message": errPullMirror.Error()})
+		return nil
+	}
+	if write && IsArchivedRepo(repoPath) {
+		writeLFSJSON(w, http.StatusForbidden, map[string]string{"message": errArchived.Error()})
+		return nil
+	}
+
+	if !lfsOIDPattern.MatchString(chi.URLParam(r, "oid")) {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "Invalid object ID"})
+		return nil
+	}
+
+	storage, _ := s.lfsRepoStorage(w, r, repoName)
+	return storage
+}
+
+// lfsRepoStorage opens the LFS storage of a repository and returns it with the server's LFS
+// config, writing an error response and returning nil if LFS isn't configured or available
+func (s *Server) lfsRepoStorage(w http.ResponseWriter, r *http.Request, repoName string) (LFSStorage, *LFSConfig) {
+	storage, lfsCfg, err := openRepoLFSStorage(r.Context(), s.reposPath, repoName)
+	if errors.Is(err, ErrLFSNotConfigured) {
+		writeLFSJSON(w, http.StatusServiceUnavailable, map[string]string{"message": "LFS not configured"})
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("LFS storage error: %s: %v", repoName, err)
+		writeLFSJSON(w, http.StatusInternalServerError, map[string]string{"message": "Storage error"})
+		return nil, nil
+	}
+	return storage, lfsCfg
+}
+
+// handleLFSObjectDownload serves the bytes of an LFS object
+func (s *Server) handleLFSObjectDownload(w http.ResponseWriter, r *http.Request) {
+	storage := s.lfsObjectStorage(w, r, false)
+	if storage == nil {
+		return
+	}
+
+	key := lfsObjectKey(repoParam(r), chi.URLParam(r, "oid"))
+	size, err := storage.Size(r.Context(), key)
+	if err == nil {
+		var body io.ReadCloser
+		if body, err = storage.Get(r.Context(), key); err == nil {
+			defer body.Close()
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			if _, err := io.Copy(w, body); err != nil {
+				log.Printf("Error sending LFS object %s: %v", key, err)
+			}
+			return
+		}
+	}
+
+	if errors.Is(err, os.ErrNotExist) {
+		writeLFSJSON(w, http.StatusNotFound, map[string]string{"message": "Object not found"})
+		return
+	}
+	log.Printf("LFS storage error: %v", err)
+	writeLFSJSON(w, http.StatusInternalServerError, map[string]string{"message": "Storage error"})
+}
+
+// handleLFSObjectUpload stores the bytes of an LFS object after verifying its SHA-256 and size (tailnet only)
+func (s *Server) handleLFSObjectUpload(w http.ResponseWriter, r *http.Request) {
+	storage := s.lfsObjectStorage(w, r, true)
+	if storage == nil {
+		return
+	}
+
+	if r.ContentLength < 0 {
+		writeLFSJSON(w, http.StatusLengthRequired, map[string]string{"message": "Content-Length is required"})
+		return
+	}
+
+	oid := chi.URLParam(r, "oid")
+	repoName := repoParam(r)
+	key := lfsObjectKey(repoName, oid)
+	_, err := storage.Size(r.Context(), key)
+	stored := err == nil
+	if !stored && !s.admitLFSUpload(w, repoName, r.ContentLength) {
+		return
+	}
+	body := newVerifyingReader(r.Body, oid, r.ContentLength)
+	if err := storage.Put(r.Context(), key, body, r.ContentLength); err != nil {
+		if errors.Is(err, ErrLFSObjectMismatch) {
+			writeLFSJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": err.Error()})
+			return
+		}
+		log.Printf("Error storing LFS object %s: %v", key, err)
+		writeLFSJSON(w, http.StatusInternalServerError, map[string]string{"message": "Failed to store object"})
+		return
+	}
+
+	log.Printf("Stored LFS object %s (%d bytes)", key, r.ContentLength)
+	if !stored {
+		s.lfsGC.AddUsage(repoName, key, r.ContentLength)
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
 // LFSMiddleware adds required headers for LFS requests
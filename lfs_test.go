@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// lfsTestObject returns data with its OID
+func lfsTestObject(data string) (string, []byte) {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:]), []byte(data)
+}
+
+func TestLocalLFSStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := &LocalLFSStorage{root: t.TempDir()}
+	oid, data := lfsTestObject("hello lfs")
+	key := lfsObjectKey("group/repo", oid)
+
+	if _, err := storage.Size(ctx, key); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Size of a missing object: %v, want os.ErrNotExist", err)
+	}
+	if err := storage.Put(ctx, key, newVerifyingReader(bytes.NewReader(data), oid, int64(len(data))), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := storage.Size(ctx, key); err != nil || size != int64(len(data)) {
+		t.Fatalf("Size = %d, %v, want %d", size, err, len(data))
+	}
+	body, err := storage.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(got, data) {
+		t.Errorf("Get = %q, want %q", got, data)
+	}
+
+	var listed []string
+	err = storage.List(ctx, "group/", func(obj LFSStoredObject) error {
+		listed = append(listed, obj.Key)
+		return nil
+	})
+	if err != nil || len(listed) != 1 || listed[0] != key {
+		t.Errorf("List = %v, %v, want [%s]", listed, err, key)
+	}
+
+	if err := storage.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Size(ctx, key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Size after Delete: %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestLocalLFSStorageRejectsMismatch(t *testing.T) {
+	ctx := context.Background()
+	storage := &LocalLFSStorage{root: t.TempDir()}
+	oid, _ := lfsTestObject("expected")
+	key := lfsObjectKey("repo", oid)
+
+	for _, data := range []string{"tampered", "expected and more"} {
+		err := storage.Put(ctx, key, newVerifyingReader(strings.NewReader(data), oid, int64(len("expected"))), int64(len("expected")))
+		if !errors.Is(err, ErrLFSObjectMismatch) {
+			t.Errorf("Put %q: %v, want ErrLFSObjectMismatch", data, err)
+		}
+		if _, err := storage.Size(ctx, key); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Put %q stored the object", data)
+		}
+	}
+}
+
+func TestLocalLFSStorageResume(t *testing.T) {
+	ctx := context.Background()
+	storage := &LocalLFSStorage{root: t.TempDir()}
+	oid, data := lfsTestObject("resumable upload of an object")
+	key := lfsObjectKey("repo", oid)
+	size := int64(len(data))
+
+	offset, err := storage.Resume(ctx, key, 0, bytes.NewReader(data[:10]), oid, size)
+	if err != nil || offset != 10 {
+		t.Fatalf("Resume = %d, %v, want 10", offset, err)
+	}
+	if offset, err := storage.UploadOffset(ctx, key); err != nil || offset != 10 {
+		t.Fatalf("UploadOffset = %d, %v, want 10", offset, err)
+	}
+	if _, err := storage.Size(ctx, key); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("a partial upload is visible")
+	}
+
+	// Continuing anywhere but at the stored offset is rejected
+	if _, err := storage.Resume(ctx, key, 5, bytes.NewReader(data[5:]), oid, size); !errors.Is(err, ErrLFSUploadOffset) {
+		t.Fatalf("Resume at the wrong offset: %v, want ErrLFSUploadOffset", err)
+	}
+
+	offset, err = storage.Resume(ctx, key, 10, bytes.NewReader(data[10:]), oid, size)
+	if err != nil || offset != size {
+		t.Fatalf("Resume = %d, %v, want %d", offset, err, size)
+	}
+	if got, err := storage.Size(ctx, key); err != nil || got != size {
+		t.Errorf("Size = %d, %v, want %d", got, err, size)
+	}
+}
+
+// newLFSTestServer serves the LFS API of repo.git with local storage in a temporary directory
+func newLFSTestServer(t *testing.T, lfsConfig string) (*Server, *httptest.Server) {
+	t.Helper()
+	dataDir := t.TempDir()
+	reposPath := filepath.Join(dataDir, "repos")
+	if err := CreateBareRepo(filepath.Join(reposPath, "repo.git")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "lfs-config.json"), []byte(lfsConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{reposPath: reposPath, lfsGC: NewLFSGC(reposPath)}
+	r := chi.NewRouter()
+	r.Post("/{repo}.git/info/lfs/objects/batch", s.handleLFSBatch)
+	r.Get("/{repo}.git/info/lfs/objects/{oid}", s.handleLFSObjectDownload)
+	r.Put("/{repo}.git/info/lfs/objects/{oid}", s.handleLFSObjectUpload)
+	r.Post("/{repo}.git/info/lfs/verify", s.handleLFSVerify)
+	r.Head("/{repo}.git/info/lfs/uploads/{oid}", s.handleLFSTusOffset)
+	r.Patch("/{repo}.git/info/lfs/uploads/{oid}", s.handleLFSTusPatch)
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// lfsRequest sends a request from a tailnet address and returns the response status and body
+func lfsRequest(t *testing.T, method, url string, body []byte, header map[string]string) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Real-IP", "100.64.0.1")
+	req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
+
+// lfsBatch runs a batch request for one object
+func lfsBatch(t *testing.T, baseURL, operation, oid string, size int64) LFSObjectResponse {
+	t.Helper()
+	req, _ := json.Marshal(LFSBatchRequest{Operation: operation, Objects: []LFSObject{{OID: oid, Size: size}}})
+	status, body := lfsRequest(t, http.MethodPost, baseURL+"/repo.git/info/lfs/objects/batch", req, nil)
+	if status != http.StatusOK {
+		t.Fatalf("batch %s: %d %s", operation, status, body)
+	}
+	var resp LFSBatchResponse
+	if err := json.Unmarshal(body, &resp); err != nil || len(resp.Objects) != 1 {
+		t.Fatalf("batch %s: %s", operation, body)
+	}
+	return resp.Objects[0]
+}
+
+func TestLFSUploadAndDownload(t *testing.T) {
+	_, ts := newLFSTestServer(t, `{"backend":"local"}`)
+	oid, data := lfsTestObject("object stored through the server")
+	size := int64(len(data))
+
+	if obj := lfsBatch(t, ts.URL, "download", oid, size); obj.Error == nil || obj.Error.Code != 404 {
+		t.Fatalf("download of a missing object: %+v", obj)
+	}
+
+	obj := lfsBatch(t, ts.URL, "upload", oid, size)
+	if obj.Error != nil || obj.Actions == nil || obj.Actions.Upload == nil || obj.Actions.Verify == nil {
+		t.Fatalf("upload batch: %+v", obj)
+	}
+	if status, body := lfsRequest(t, http.MethodPut, obj.Actions.Upload.Href, bytes.Repeat([]byte("x"), len(data)), nil); status != http.StatusUnprocessableEntity {
+		t.Fatalf("upload of corrupted data: %d %s", status, body)
+	}
+	if status, body := lfsRequest(t, http.MethodPut, obj.Actions.Upload.Href, data, nil); status != http.StatusOK {
+		t.Fatalf("upload: %d %s", status, body)
+	}
+	verify, _ := json.Marshal(LFSObject{OID: oid, Size: size})
+	if status, body := lfsRequest(t, http.MethodPost, obj.Actions.Verify.Href, verify, nil); status != http.StatusOK {
+		t.Fatalf("verify: %d %s", status, body)
+	}
+
+	// Objects the server has need no upload
+	if obj := lfsBatch(t, ts.URL, "upload", oid, size); obj.Actions != nil || obj.Error != nil {
+		t.Errorf("upload batch of a stored object: %+v", obj)
+	}
+
+	obj = lfsBatch(t, ts.URL, "download", oid, size)
+	if obj.Error != nil || obj.Actions == nil || obj.Actions.Download == nil {
+		t.Fatalf("download batch: %+v", obj)
+	}
+	status, body := lfsRequest(t, http.MethodGet, obj.Actions.Download.Href, nil, nil)
+	if status != http.StatusOK || !bytes.Equal(body, data) {
+		t.Errorf("download: %d %q, want %q", status, body, data)
+	}
+}
+
+func TestLFSUploadRequiresTailnet(t *testing.T) {
+	_, ts := newLFSTestServer(t, `{"backend":"local"}`)
+	oid, data := lfsTestObject("anonymous upload")
+
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/repo.git/info/lfs/objects/"+oid, bytes.NewReader(data))
+	req.Header.Set("X-Real-IP", "203.0.113.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("upload from outside the tailnet: %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestLFSQuota(t *testing.T) {
+	s, ts := newLFSTestServer(t, `{"backend":"local","repo_quota":40}`)
+	if err := s.lfsGC.RefreshUsage(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	first, data := lfsTestObject(strings.Repeat("a", 30))
+	if obj := lfsBatch(t, ts.URL, "upload", first, 30); obj.Error != nil {
+		t.Fatalf("upload batch within the quota: %+v", obj)
+	}
+	if status, body := lfsRequest(t, http.MethodPut, ts.URL+"/repo.git/info/lfs/objects/"+first, data, nil); status != http.StatusOK {
+		t.Fatalf("upload: %d %s", status, body)
+	}
+
+	// Verifying again, as clients retrying do, doesn't count the object twice
+	verify, _ := json.Marshal(LFSObject{OID: first, Size: 30})
+	for range 2 {
+		lfsRequest(t, http.MethodPost, ts.URL+"/repo.git/info/lfs/verify", verify, nil)
+	}
+	if usage, _ := s.lfsGC.CurrentUsage(lfsUsageMaxAge); usage["repo"].Bytes != 30 {
+		t.Errorf("usage = %d bytes, want 30", usage["repo"].Bytes)
+	}
+
+	second, data := lfsTestObject(strings.Repeat("b", 20))
+	if obj := lfsBatch(t, ts.URL, "upload", second, 20); obj.Error == nil || obj.Error.Code != 507 {
+		t.Errorf("upload batch over the quota: %+v", obj)
+	}
+	if status, _ := lfsRequest(t, http.MethodPut, ts.URL+"/repo.git/info/lfs/objects/"+second, data, nil); status != http.StatusInsufficientStorage {
+		t.Errorf("upload over the quota: %d, want 507", status)
+	}
+	header := map[string]string{"Upload-Length": "20", "Upload-Offset": "0", "Tus-Resumable": "1.0.0", "Content-Type": "application/offset+octet-stream"}
+	if status, _ := lfsRequest(t, http.MethodPatch, ts.URL+"/repo.git/info/lfs/uploads/"+second, data, header); status != http.StatusInsufficientStorage {
+		t.Errorf("resumable upload over the quota: %d, want 507", status)
+	}
+}
+
+func TestLFSQuotaBeforeUsageCounted(t *testing.T) {
+	s, ts := newLFSTestServer(t, `{"backend":"local","repo_quota":1000,"max_object_size":100}`)
+	// Keep the first scan from finishing while the uploads are checked
+	s.lfsGC.refreshing = true
+
+	oid, data := lfsTestObject("uncounted")
+	if obj := lfsBatch(t, ts.URL, "upload", oid, int64(len(data))); obj.Error == nil || obj.Error.Code != 507 {
+		t.Errorf("upload batch before usage was counted: %+v", obj)
+	}
+	if status, _ := lfsRequest(t, http.MethodPut, ts.URL+"/repo.git/info/lfs/objects/"+oid, data, nil); status != http.StatusInsufficientStorage {
+		t.Errorf("upload before usage was counted: %d, want 507", status)
+	}
+	large, _ := lfsTestObject(strings.Repeat("c", 200))
+	if obj := lfsBatch(t, ts.URL, "upload", large, 200); obj.Error == nil || obj.Error.Code != 422 {
+		t.Errorf("oversized upload batch before usage was counted: %+v", obj)
+	}
+}
+
+func TestLFSResumableUpload(t *testing.T) {
+	_, ts := newLFSTestServer(t, `{"backend":"local"}`)
+	oid, data := lfsTestObject(strings.Repeat("resumable ", 10))
+	size := strconv.Itoa(len(data))
+	url := ts.URL + "/repo.git/info/lfs/uploads/" + oid
+
+	header := map[string]string{"Upload-Length": size, "Upload-Offset": "0", "Tus-Resumable": "1.0.0", "Content-Type": "application/offset+octet-stream"}
+	if status, body := lfsRequest(t, http.MethodPatch, url, data[:40], header); status != http.StatusNoContent {
+		t.Fatalf("first chunk: %d %s", status, body)
+	}
+
+	req, _ := http.NewRequest(http.MethodHead, url, nil)
+	req.Header.Set("X-Real-IP", "100.64.0.1")
+	req.Header.Set("Upload-Length", size)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if offset := resp.Header.Get("Upload-Offset"); offset != "40" {
+		t.Fatalf("Upload-Offset = %q, want 40", offset)
+	}
+
+	header["Upload-Offset"] = "40"
+	if status, body := lfsRequest(t, http.MethodPatch, url, data[40:], header); status != http.StatusNoContent {
+		t.Fatalf("last chunk: %d %s", status, body)
+	}
+	status, body := lfsRequest(t, http.MethodGet, ts.URL+"/repo.git/info/lfs/objects/"+oid, nil, nil)
+	if status != http.StatusOK || !bytes.Equal(body, data) {
+		t.Errorf("download: %d %q, want %q", status, body, data)
+	}
+}
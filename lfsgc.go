@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+)
+
+const (
+	// lfsGCInterval is how often LFS usage is recounted and, if enabled, garbage collected
+	lfsGCInterval = 24 * time.Hour
+
+	// defaultLFSGCGraceDays protects objects uploaded for pushes that haven't landed yet
+	defaultLFSGCGraceDays = 14
+
+	// lfsPointerMaxSize is the size above which blobs can't be LFS pointers
+	lfsPointerMaxSize = 1024
+)
+
+// ErrLFSGCRunning is returned when a garbage collection is already in progress
+var ErrLFSGCRunning = errors.New("LFS garbage collection already running")
+
+// LFSUsage is the storage used by the LFS objects of a repository
+type LFSUsage struct {
+	Repo    string `json:"repo"`
+	Objects int    `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// LFSGCObject is an object deleted by a garbage collection, or that would be in a dry run
+type LFSGCObject struct {
+	OID     string    `json:"oid"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+}
+
+// LFSGCReport describes a garbage collection of one repository
+type LFSGCReport struct {
+	Repo         string        `json:"repo"`
+	DryRun       bool          `json:"dry_run"`
+	Started      time.Time     `json:"started"`
+	Finished     time.Time     `json:"finished"`
+	GraceDays    int           `json:"grace_days"`
+	Referenced   int           `json:"referenced"` // Pointers in reachable commits
+	Missing      int           `json:"missing"`    // Referenced objects not in storage
+	Stored       LFSUsage      `json:"stored"`     // Before collection
+	Recent       int           `json:"recent"`     // Unreferenced but within the grace period
+	Deleted      []LFSGCObject `json:"deleted"`
+	DeletedBytes int64         `json:"deleted_bytes"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// LFSGC deletes LFS objects no reachable commit points to and keeps track of LFS usage
+type LFSGC struct {
+	reposPath string
+	runMu     sync.Mutex // Held while collecting
+
+	mu         sync.Mutex
+	usage      map[string]LFSUsage
+	scanned    time.Time
+	refreshing bool                    // A background recount of usage is running
+	expected   map[string]bool         // Keys of uploads batches asked for, not counted yet
+	reports    map[string]*LFSGCReport // Repo -> last report
+}
+
+// NewLFSGC creates the LFS garbage collector of the repositories in reposPath
+func NewLFSGC(reposPath string) *LFSGC {
+	return &LFSGC{
+		reposPath: reposPath,
+		usage:     make(map[string]LFSUsage),
+		expected:  make(map[string]bool),
+		reports:   make(map[string]*LFSGCReport),
+	}
+}
+
+// Run recounts usage periodically and collects garbage when enabled, it never returns
+func (g *LFSGC) Run(interval time.Duration) {
+	for {
+		ctx := context.Background()
+		if cfg, err := g.config(); err == nil {
+			if cfg.GC {
+				if _, err := g.CollectAll(ctx, false); err != nil {
+					log.Printf("LFS GC failed: %v", err)
+				}
+			} else if err := g.RefreshUsage(ctx); err != nil {
+				log.Printf("LFS usage scan failed: %v", err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// config loads the LFS config, returning an error if LFS isn't configured
+func (g *LFSGC) config() (*LFSConfig, error) {
+	return loadLFSConfig(filepath.Join(filepath.Dir(g.reposPath), "lfs-config.json"))
+}
+
+// storage opens the LFS storage of a repository and returns the grace period
+func (g *LFSGC) storage(ctx context.Context, repoName string) (LFSStorage, int, error) {
+	storage, cfg, err := openRepoLFSStorage(ctx, g.reposPath, repoName)
+	if err != nil {
+		return nil, 0, err
+	}
+	graceDays := cfg.GCGraceDays
+	if graceDays <= 0 {
+		graceDays = defaultLFSGCGraceDays
+	}
+	return storage, graceDays, nil
+}
+
+// RefreshUsage recounts the objects and bytes stored for every repository. Repositories
+// with their own storage are counted there, what's left of them in the server's is ignored.
+func (g *LFSGC) RefreshUsage(ctx context.Context) error {
+	cfg, err := g.config()
+	if err != nil {
+		return err
+	}
+	storage, err := openLFSStorage(ctx, cfg, filepath.Dir(g.reposPath))
+	if err != nil {
+		return err
+	}
+
+	repos, err := ListRepos(g.reposPath, true)
+	if err != nil {
+		return err
+	}
+	ownStorage := make(map[string]bool)
+	for _, repo := range repos {
+		if repoCfg, err := loadRepoLFSConfig(filepath.Join(g.reposPath, repo.Name+".git")); err == nil && repoCfg.Storage != nil {
+			ownStorage[repo.Name] = true
+		}
+	}
+
+	usage := make(map[string]LFSUsage)
+	err = storage.List(ctx, "", func(obj LFSStoredObject) error {
+		// Keys are <repo>/<oid[:2]>/<oid[2:4]>/<oid>, repositories in groups have slashes too
+		oid := path.Base(obj.Key)
+		repo := path.Dir(path.Dir(path.Dir(obj.Key)))
+		if !lfsOIDPattern.MatchString(oid) || repo == "." || obj.Key != lfsObjectKey(repo, oid) || ownStorage[repo] {
+			return nil
+		}
+		u := usage[repo]
+		u.Repo = repo
+		u.Objects++
+		u.Bytes += obj.Size
+		usage[repo] = u
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for repo := range ownStorage {
+		u, err := g.countUsage(ctx, repo)
+		if err != nil {
+			log.Printf("LFS usage scan failed: %s: %v", repo, err)
+			continue
+		}
+		if u.Objects > 0 {
+			usage[repo] = u
+		}
+	}
+
+	g.mu.Lock()
+	g.usage = usage
+	g.scanned = time.Now()
+	g.expected = make(map[string]bool)
+	g.mu.Unlock()
+	return nil
+}
+
+// RepoUsage counts the objects and bytes stored for one repository
+func (g *LFSGC) RepoUsage(ctx context.Context, repoName string) (LFSUsage, error) {
+	usage, err := g.countUsage(ctx, repoName)
+	if err != nil {
+		return usage, err
+	}
+	g.setUsage(usage)
+	return usage, nil
+}
+
+// countUsage lists the objects of one repository in its storage
+func (g *LFSGC) countUsage(ctx context.Context, repoName string) (LFSUsage, error) {
+	usage := LFSUsage{Repo: repoName}
+	storage, _, err := g.storage(ctx, repoName)
+	if err != nil {
+		return usage, err
+	}
+	objects, err := listLFSObjects(ctx, storage, repoName)
+	for _, obj := range objects {
+		usage.Objects++
+		usage.Bytes += obj.Size
+	}
+	return usage, err
+}
+
+// setUsage records the usage of one repository
+func (g *LFSGC) setUsage(usage LFSUsage) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if usage.Objects == 0 {
+		delete(g.usage, usage.Repo)
+	} else {
+		g.usage[usage.Repo] = usage
+	}
+}
+
+// Usage returns the last known usage of every repository, largest first, and when it was counted
+func (g *LFSGC) Usage() ([]LFSUsage, time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	usage := make([]LFSUsage, 0, len(g.usage))
+	for _, u := range g.usage {
+		usage = append(usage, u)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Bytes != usage[j].Bytes {
+			return usage[i].Bytes > usage[j].Bytes
+		}
+		return usage[i].Repo < usage[j].Repo
+	})
+	return usage, g.scanned
+}
+
+// Reports returns the last garbage collection report of every repository, newest first
+func (g *LFSGC) Reports() []*LFSGCReport {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	reports := make([]*LFSGCReport, 0, len(g.reports))
+	for _, report := range g.reports {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Started.After(reports[j].Started)
+	})
+	return reports
+}
+
+// Report returns the last garbage collection report of a repository, or nil
+func (g *LFSGC) Report(repoName string) *LFSGCReport {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.reports[repoName]
+}
+
+// Running reports whether a garbage collection is in progress
+func (g *LFSGC) Running() bool {
+	if g.runMu.TryLock() {
+		g.runMu.Unlock()
+		return false
+	}
+	return true
+}
+
+// CollectAll garbage collects every repository, then recounts usage
+func (g *LFSGC) CollectAll(ctx context.Context, dryRun bool) ([]*LFSGCReport, error) {
+	if !g.runMu.TryLock() {
+		return nil, ErrLFSGCRunning
+	}
+	defer g.runMu.Unlock()
+
+	repos, err := ListRepos(g.reposPath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []*LFSGCReport
+	for _, repo := range repos {
+		report, err := g.collect(ctx, repo.Name, dryRun)
+		if err != nil {
+			log.Printf("LFS GC: %s: %v", repo.Name, err)
+		}
+		reports = append(reports, report)
+	}
+
+	if err := g.RefreshUsage(ctx); err != nil {
+		log.Printf("LFS usage scan failed: %v", err)
+	}
+	return reports, nil
+}
+
+// Collect garbage collects one repository. A dry run only reports what would be deleted.
+func (g *LFSGC) Collect(ctx context.Context, repoName string, dryRun bool) (*LFSGCReport, error) {
+	if !g.runMu.TryLock() {
+		return nil, ErrLFSGCRunning
+	}
+	defer g.runMu.Unlock()
+	return g.collect(ctx, repoName, dryRun)
+}
+
+// collect deletes the objects of a repository that no reachable commit points to and that
+// are older than the grace period. The report is recorded even if collection fails.
+func (g *LFSGC) collect(ctx context.Context, repoName string, dryRun bool) (*LFSGCReport, error) {
+	report := &LFSGCReport{Repo: repoName, DryRun: dryRun, Started: time.Now(), Deleted: []LFSGCObject{}}
+	defer func() {
+		report.Finished = time.Now()
+		g.mu.Lock()
+		g.reports[repoName] = report
+		g.mu.Unlock()
+	}()
+
+	err := g.collectRepo(ctx, repoName, report)
+	if err != nil {
+		report.Error = err.Error()
+		return report, err
+	}
+
+	if !dryRun {
+		g.setUsage(LFSUsage{
+			Repo:    repoName,
+			Objects: report.Stored.Objects - len(report.Deleted),
+			Bytes:   report.Stored.Bytes - report.DeletedBytes,
+		})
+		if len(report.Deleted) > 0 {
+			log.Printf("LFS GC: deleted %d objects (%d bytes) from %s", len(report.Deleted), report.DeletedBytes, repoName)
+		}
+	}
+	return report, nil
+}
+
+// collectRepo fills in a garbage collection report, deleting objects unless it's a dry run
+func (g *LFSGC) collectRepo(ctx context.Context, repoName string, report *LFSGCReport) error {
+	storage, graceDays, err := g.storage(ctx, repoName)
+	if err != nil {
+		return err
+	}
+	report.GraceDays = graceDays
+
+	repoPath := filepath.Join(g.reposPath, repoName+".git")
+	r, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return err
+	}
+	tips, err := refTips(r)
+	if err != nil {
+		return err
+	}
+	referenced, err := collectLFSPointers(r)
+	if err != nil {
+		return err
+	}
+	report.Referenced = len(referenced)
+
+	// Unreferenced objects become candidates once they're older than the grace period
+	cutoff := time.Now().AddDate(0, 0, -graceDays)
+	stored := make(map[string]bool)
+	var candidates []LFSGCObject
+	report.Stored.Repo = repoName
+	err = storage.List(ctx, repoName+"/", func(obj LFSStoredObject) error {
+		oid := path.Base(obj.Key)
+		if !lfsOIDPattern.MatchString(oid) || obj.Key != lfsObjectKey(repoName, oid) {
+			return nil
+		}
+		stored[oid] = true
+		report.Stored.Objects++
+		report.Stored.Bytes += obj.Size
+
+		switch _, ok := referenced[oid]; {
+		case ok:
+		case obj.ModTime.After(cutoff):
+			report.Recent++
+		default:
+			candidates = append(candidates, LFSGCObject{OID: oid, Size: obj.Size, ModTime: obj.ModTime})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for oid := range referenced {
+		if !stored[oid] {
+			report.Missing++
+		}
+	}
+
+	// A push that landed while listing may reference candidates again
+	if r, err = git.PlainOpen(repoPath); err != nil {
+		return err
+	}
+	if current, err := refTips(r); err != nil || !sameTips(tips, current) {
+		if referenced, err = collectLFSPointers(r); err != nil {
+			return err
+		}
+	}
+
+	for _, obj := range candidates {
+		if _, ok := referenced[obj.OID]; ok {
+			continue
+		}
+		if !report.DryRun {
+			if err := storage.Delete(ctx, lfsObjectKey(repoName, obj.OID)); err != nil {
+				return err
+			}
+		}
+		report.Deleted = append(report.Deleted, obj)
+		report.DeletedBytes += obj.Size
+	}
+	return nil
+}
+
+// collectLFSPointers returns the OIDs and sizes of the LFS pointers in every commit reachable
+// from any ref
+func collectLFSPointers(r *git.Repository) (map[string]int64, error) {
+	oids := make(map[string]int64)
+	commits, err := r.Log(&git.LogOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	defer commits.Close()
+
+	seen := make(map[plumbing.Hash]bool) // Trees and blobs already looked at
+	for {
+		c, err := commits.Next()
+		if err != nil {
+			if err == io.EOF {
+				return oids, nil
+			}
+			return nil, err
+		}
+		if err := collectTreePointers(r, c.TreeHash, seen, oids); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// collectTreePointers adds the OIDs and sizes of the LFS pointers in a tree and its subtrees to oids
+func collectTreePointers(r *git.Repository, treeHash plumbing.Hash, seen map[plumbing.Hash]bool, oids map[string]int64) error {
+	if seen[treeHash] {
+		return nil
+	}
+	seen[treeHash] = true
+
+	tree, err := r.TreeObject(treeHash)
+	if err != nil {
+		return err
+	}
+	for _, entry := range tree.Entries {
+		switch {
+		case entry.Mode == filemode.Dir:
+			if err := collectTreePointers(r, entry.Hash, seen, oids); err != nil {
+				return err
+			}
+		case entry.Mode.IsFile() && !seen[entry.Hash]:
+			seen[entry.Hash] = true
+			blob, err := r.BlobObject(entry.Hash)
+			if err != nil {
+				return err
+			}
+			if blob.Size > lfsPointerMaxSize {
+				continue
+			}
+			reader, err := blob.Reader()
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			_, err = buf.ReadFrom(reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+			if oid, size, ok := parseLFSPointer(buf.Bytes()); ok {
+				oids[oid] = size
+			}
+		}
+	}
+	return nil
+}
+
+// parseLFSPointer returns the OID and size of a Git LFS pointer file
+func parseLFSPointer(data []byte) (string, int64, bool) {
+	if !bytes.HasPrefix(data, []byte("version https://git-lfs.github.com/spec/")) &&
+		!bytes.HasPrefix(data, []byte("version https://hawser.github.com/spec/")) {
+		return "", 0, false
+	}
+
+	var oid string
+	var size int64 = -1
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		switch key {
+		case "oid":
+			oid, _ = strings.CutPrefix(value, "sha256:")
+		case "size":
+			size, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return oid, size, lfsOIDPattern.MatchString(oid) && size >= 0
+}
+
+// handleLFSGCPost starts a garbage collection of one or all repositories in the background (tailnet only)
+func (s *Server) handleLFSGCPost(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied - Tailnet required", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	repoName := r.FormValue("repo")
+	if repoName != "" && !RepoExists(s.reposPath, repoName) {
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+	if s.lfsGC.Running() {
+		http.Error(w, ErrLFSGCRunning.Error(), http.StatusConflict)
+		return
+	}
+
+	dryRun := r.FormValue("dry_run") == "on"
+	go func() {
+		ctx := context.Background()
+		var err error
+		if repoName != "" {
+			_, err = s.lfsGC.Collect(ctx, repoName, dryRun)
+		} else {
+			_, err = s.lfsGC.CollectAll(ctx, dryRun)
+		}
+		if err != nil {
+			log.Printf("LFS GC failed: %v", err)
+		}
+	}()
+
+	// Redirect back to referrer
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		referer = "/admin/settings"
+	}
+	http.Redirect(w, r, referer, http.StatusFound)
+}
+
+// handleAPILFSGC garbage collects a repository and returns the report, ?dry_run=true only reports (tailnet only)
+func (s *Server) handleAPILFSGC(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "Access denied - Tailnet required"})
+		return
+	}
+
+	repoName := repoParam(r)
+	if !RepoExists(s.reposPath, repoName) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Repository not found"})
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	report, err := s.lfsGC.Collect(r.Context(), repoName, dryRun)
+	if errors.Is(err, ErrLFSGCRunning) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("LFS GC: %s: %v", repoName, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Garbage collection failed", "report": report})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleAPILFSUsage returns the last known LFS usage of every repository (tailnet only)
+func (s *Server) handleAPILFSUsage(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "Access denied - Tailnet required"})
+		return
+	}
+
+	usage, scanned := s.lfsGC.Usage()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"usage":   usage,
+		"scanned": scanned,
+		"running": s.lfsGC.Running(),
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// lfsUsageMaxAge is how old counted usage may get before quotas recount it
+	lfsUsageMaxAge = time.Hour
+
+	// defaultLFSQuotaWarningPercent is the usage at which admins are warned by default
+	defaultLFSQuotaWarningPercent = 80
+)
+
+// LFSQuotaStatus compares the LFS usage of a repository, or the whole server, to its quota
+type LFSQuotaStatus struct {
+	Repo        string `json:"repo,omitempty"` // Empty for the server
+	Used        int64  `json:"used"`
+	Limit       int64  `json:"limit"` // 0 for no limit
+	WarnPercent int    `json:"warn_percent"`
+}
+
+// Percent returns the used share of the quota as a whole percentage
+func (q LFSQuotaStatus) Percent() int {
+	if q.Limit <= 0 {
+		return 0
+	}
+	return int(q.Used * 100 / q.Limit)
+}
+
+// Warn reports whether usage crossed the warning threshold
+func (q LFSQuotaStatus) Warn() bool {
+	return q.Limit > 0 && q.Percent() >= q.WarnPercent
+}
+
+// Exceeded reports whether usage reached the quota
+func (q LFSQuotaStatus) Exceeded() bool {
+	return q.Limit > 0 && q.Used >= q.Limit
+}
+
+// repoLFSQuota returns the quota of a repository, its own or the server default
+func repoLFSQuota(cfg *LFSConfig, repoPath string) int64 {
+	if repoCfg, err := loadRepoLFSConfig(repoPath); err == nil && repoCfg.Quota > 0 {
+		return repoCfg.Quota
+	}
+	return cfg.RepoQuota
+}
+
+// quotaWarningPercent returns the configured warning threshold
+func quotaWarningPercent(cfg *LFSConfig) int {
+	if cfg.QuotaWarningPercent > 0 {
+		return cfg.QuotaWarningPercent
+	}
+	return defaultLFSQuotaWarningPercent
+}
+
+// parseSize parses sizes like "500 MB", "1.5GB" or "1048576" into bytes, empty means 0
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		bytes  int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// formatQuota formats a byte count for a size input, so parseSize reads it back unchanged
+func formatQuota(n int64) string {
+	if n <= 0 {
+		return ""
+	}
+	for _, unit := range []struct {
+		suffix string
+		bytes  int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if n%unit.bytes == 0 {
+			return fmt.Sprintf("%d %s", n/unit.bytes, unit.suffix)
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// CurrentUsage returns the usage of every repository. Usage older than maxAge is
+// recounted in the background, meanwhile the last count and objects added since apply.
+func (g *LFSGC) CurrentUsage(maxAge time.Duration) (map[string]LFSUsage, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.scanned) > maxAge && !g.refreshing {
+		g.refreshing = true
+		go func() {
+			if err := g.RefreshUsage(context.Background()); err != nil {
+				log.Printf("LFS usage scan failed: %v", err)
+			}
+			g.mu.Lock()
+			g.refreshing = false
+			g.mu.Unlock()
+		}()
+	}
+	if g.scanned.IsZero() {
+		return nil, errors.New("usage hasn't been counted yet")
+	}
+
+	usage := make(map[string]LFSUsage, len(g.usage))
+	for repo, u := range g.usage {
+		usage[repo] = u
+	}
+	return usage, nil
+}
+
+// AddUsage accounts for a newly stored object until usage is next recounted
+func (g *LFSGC) AddUsage(repoName, key string, size int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.expected, key)
+	g.addUsage(repoName, size)
+}
+
+// ExpectUpload remembers an object a batch asked the client to upload, so that
+// verifying it counts it once even if its bytes didn't pass through the server
+func (g *LFSGC) ExpectUpload(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expected[key] = true
+}
+
+// AddVerifiedUsage accounts for a verified object if a batch expected its upload
+// and it wasn't counted yet
+func (g *LFSGC) AddVerifiedUsage(repoName, key string, size int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.expected[key] {
+		return
+	}
+	delete(g.expected, key)
+	g.addUsage(repoName, size)
+}
+
+// addUsage adds an object to a repository's usage, g.mu must be held
+func (g *LFSGC) addUsage(repoName string, size int64) {
+	u := g.usage[repoName]
+	u.Repo = repoName
+	u.Objects++
+	u.Bytes += size
+	g.usage[repoName] = u
+}
+
+// QuotaWarnings returns the repositories, and the server, whose usage crossed the warning threshold
+func (g *LFSGC) QuotaWarnings(cfg *LFSConfig) []LFSQuotaStatus {
+	usage, _ := g.Usage()
+	warnPercent := quotaWarningPercent(cfg)
+
+	var warnings []LFSQuotaStatus
+	var total int64
+	for _, u := range usage {
+		total += u.Bytes
+		status := LFSQuotaStatus{
+			Repo:        u.Repo,
+			Used:        u.Bytes,
+			Limit:       repoLFSQuota(cfg, filepath.Join(g.reposPath, u.Repo+".git")),
+			WarnPercent: warnPercent,
+		}
+		if status.Warn() {
+			warnings = append(warnings, status)
+		}
+	}
+	if global := (LFSQuotaStatus{Used: total, Limit: cfg.Quota, WarnPercent: warnPercent}); global.Warn() {
+		warnings = append([]LFSQuotaStatus{global}, warnings...)
+	}
+	return warnings
+}
+
+// admitLFSUpload checks an object stored through the server against the size limit and
+// quotas, writing an error response and returning false if it doesn't fit
+func (s *Server) admitLFSUpload(w http.ResponseWriter, repoName string, size int64) bool {
+	cfg, err := loadLFSConfig(filepath.Join(filepath.Dir(s.reposPath), "lfs-config.json"))
+	if os.IsNotExist(err) {
+		cfg = &LFSConfig{}
+	} else if err != nil {
+		log.Printf("LFS quota: loading config: %v", err)
+		writeLFSJSON(w, http.StatusInternalServerError, map[string]string{"message": "Failed to load LFS limits"})
+		return false
+	}
+	lfsErr := s.newLFSQuotaCheck(cfg, repoName).admit(size)
+	if lfsErr == nil {
+		return true
+	}
+	status := http.StatusInsufficientStorage
+	if lfsErr.Code == http.StatusUnprocessableEntity {
+		status = http.StatusRequestEntityTooLarge
+	}
+	writeLFSJSON(w, status, map[string]string{"message": lfsErr.Message})
+	return false
+}
+
+// lfsQuotaCheck admits the objects of an upload batch while they fit the size limit and quotas
+type lfsQuotaCheck struct {
+	maxObjectSize int64
+	repo          LFSQuotaStatus
+	global        LFSQuotaStatus
+	uncounted     bool // Usage couldn't be counted, nothing is admitted against the quotas
+}
+
+// newLFSQuotaCheck loads the quotas and current usage for uploads. Usage is only
+// counted when a quota is configured, and uploads are refused until it can be counted.
+func (s *Server) newLFSQuotaCheck(cfg *LFSConfig, repoName string) *lfsQuotaCheck {
+	warnPercent := quotaWarningPercent(cfg)
+	q := &lfsQuotaCheck{
+		maxObjectSize: cfg.MaxObjectSize,
+		repo: LFSQuotaStatus{
+			Repo:        repoName,
+			Limit:       repoLFSQuota(cfg, filepath.Join(s.reposPath, repoName+".git")),
+			WarnPercent: warnPercent,
+		},
+		global: LFSQuotaStatus{Limit: cfg.Quota, WarnPercent: warnPercent},
+	}
+	if q.repo.Limit <= 0 && q.global.Limit <= 0 {
+		return q
+	}
+
+	usage, err := s.lfsGC.CurrentUsage(lfsUsageMaxAge)
+	if err != nil {
+		log.Printf("LFS quota: usage unavailable, refusing uploads: %v", err)
+		q.uncounted = true
+		return q
+	}
+	q.repo.Used = usage[repoName].Bytes
+	for _, u := range usage {
+		q.global.Used += u.Bytes
+	}
+	return q
+}
+
+// admit checks an object that needs uploading, returning the per-object error if it doesn't fit
+func (q *lfsQuotaCheck) admit(size int64) *LFSError {
+	if q.maxObjectSize > 0 && size > q.maxObjectSize {
+		return &LFSError{
+			Code:    422,
+			Message: fmt.Sprintf("Object is %d bytes, larger than the maximum of %d bytes", size, q.maxObjectSize),
+		}
+	}
+	if q.uncounted {
+		return &LFSError{
+			Code:    507,
+			Message: "LFS usage hasn't been counted yet, retry the upload later",
+		}
+	}
+	if q.repo.Limit > 0 && q.repo.Used+size > q.repo.Limit {
+		return &LFSError{
+			Code:    507,
+			Message: fmt.Sprintf("Repository LFS quota of %d bytes exceeded (%d bytes used)", q.repo.Limit, q.repo.Used),
+		}
+	}
+	if q.global.Limit > 0 && q.global.Used+size > q.global.Limit {
+		return &LFSError{
+			Code:    507,
+			Message: fmt.Sprintf("Server LFS quota of %d bytes exceeded", q.global.Limit),
+		}
+	}
+
+	// Objects of the same batch count against the quotas together
+	repoWarned, globalWarned := q.repo.Warn(), q.global.Warn()
+	q.repo.Used += size
+	q.global.Used += size
+	if !repoWarned && q.repo.Warn() {
+		log.Printf("LFS quota warning: %s is at %d%% of its %d byte quota", q.repo.Repo, q.repo.Percent(), q.repo.Limit)
+	}
+	if !globalWarned && q.global.Warn() {
+		log.Printf("LFS quota warning: server is at %d%% of its %d byte quota", q.global.Percent(), q.global.Limit)
+	}
+	return nil
+}
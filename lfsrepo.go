@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// repoLFSConfigFile holds a repository's LFS settings inside the repository
+const repoLFSConfigFile = "git-lfs.json"
+
+// repoLFSNamespace follows the prefix of repositories storing objects outside the server's
+// bucket. Repository names can't contain "@", so their keys can't overlap.
+const repoLFSNamespace = "@repo-lfs"
+
+// RepoLFSConfig holds the LFS settings of one repository
+type RepoLFSConfig struct {
+	Quota   int64           `json:"quota,omitempty"`   // Bytes, overrides the server's repo_quota
+	Storage *RepoLFSStorage `json:"storage,omitempty"` // Overrides the server's storage
+}
+
+// RepoLFSStorage is where a repository stores its LFS objects instead of the server's storage
+type RepoLFSStorage struct {
+	Backend     string `json:"backend"` // "s3" or "local", the server's local object directory
+	Endpoint    string `json:"endpoint,omitempty"`
+	Bucket      string `json:"bucket,omitempty"`
+	Region      string `json:"region,omitempty"`
+	Prefix      string `json:"prefix,omitempty"`
+	Credentials string `json:"credentials,omitempty"` // Name in the server's credentials, empty for its own keys
+}
+
+// ErrLFSNotConfigured means neither the server nor the repository configured LFS storage
+var ErrLFSNotConfigured = errors.New("LFS storage is not configured")
+
+// loadRepoLFSConfig loads the LFS settings of a repository, a missing file means defaults
+func loadRepoLFSConfig(repoPath string) (*RepoLFSConfig, error) {
+	cfg := &RepoLFSConfig{}
+	data, err := os.ReadFile(filepath.Join(repoPath, repoLFSConfigFile))
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// saveRepoLFSConfig saves the LFS settings of a repository
+func saveRepoLFSConfig(repoPath string, cfg *RepoLFSConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(repoPath, repoLFSConfigFile), data, 0644)
+}
+
+// resolve returns the storage config of the override. Settings it leaves empty, and the
+// S3 keys unless it names other credentials, come from the server config.
+func (o *RepoLFSStorage) resolve(server *LFSConfig) (*LFSConfig, error) {
+	cfg := &LFSConfig{Backend: o.Backend}
+	switch o.Backend {
+	case "local":
+		// Repositories can't pick a directory, only the server's local storage
+		if server.Backend == "local" {
+			cfg.Path = server.Path
+		}
+		return cfg, nil
+	case "s3":
+	default:
+		return nil, fmt.Errorf("unknown LFS backend: %s", o.Backend)
+	}
+
+	cfg.Endpoint, cfg.Bucket, cfg.Region = o.Endpoint, o.Bucket, o.Region
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = server.Endpoint
+	}
+	if cfg.Region == "" {
+		cfg.Region = server.Region
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("LFS storage bucket is required")
+	}
+	prefix := strings.Trim(o.Prefix, "/")
+	if prefix != "" && !validRepoPath(prefix) {
+		return nil, fmt.Errorf("invalid LFS storage prefix: %s", o.Prefix)
+	}
+
+	// Keys are the prefix followed by the repository's name, so in the server's bucket another
+	// prefix could be another repository's name. Other buckets get a namespace no repository
+	// name can start with, repositories sharing one can't reach each other's keys.
+	serverBucket := (server.Backend == "" || server.Backend == "s3") && cfg.Bucket == server.Bucket &&
+		strings.TrimSuffix(cfg.Endpoint, "/") == strings.TrimSuffix(server.Endpoint, "/")
+	if serverBucket {
+		if prefix != "" && prefix != strings.Trim(server.Prefix, "/") {
+			return nil, errors.New("repositories in the server's bucket use the server's prefix")
+		}
+		cfg.Prefix = server.Prefix
+	} else {
+		cfg.Prefix = path.Join(prefix, repoLFSNamespace)
+	}
+
+	// The server's keys only reach its own bucket, other buckets need credentials an admin named
+	if o.Credentials == "" {
+		if !serverBucket {
+			return nil, errors.New("LFS credentials are required for buckets other than the server's")
+		}
+		cfg.AccessKey, cfg.SecretKey = server.AccessKey, server.SecretKey
+		return cfg, nil
+	}
+	creds, ok := server.Credentials[o.Credentials]
+	if !ok {
+		return nil, fmt.Errorf("unknown LFS credentials: %s", o.Credentials)
+	}
+	cfg.AccessKey, cfg.SecretKey = creds.AccessKey, creds.SecretKey
+	return cfg, nil
+}
+
+// openRepoLFSStorage opens the LFS storage of a repository, its own or the server's, and
+// returns it with the server config, which holds the limits for every repository
+func openRepoLFSStorage(ctx context.Context, reposPath, repoName string) (LFSStorage, *LFSConfig, error) {
+	return openRepoLFSStorageAt(ctx, reposPath, filepath.Join(reposPath, repoName+".git"))
+}
+
+// openRepoLFSStorageAt opens the LFS storage of the repository at repoPath, which may have
+// been moved out of reposPath, like deleted repositories waiting in the trash
+func openRepoLFSStorageAt(ctx context.Context, reposPath, repoPath string) (LFSStorage, *LFSConfig, error) {
+	dataDir := filepath.Dir(reposPath)
+	serverCfg, err := loadLFSConfig(filepath.Join(dataDir, "lfs-config.json"))
+	if os.IsNotExist(err) {
+		serverCfg = &LFSConfig{}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	repoCfg, err := loadRepoLFSConfig(repoPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	storageCfg := serverCfg
+	if repoCfg.Storage != nil {
+		if storageCfg, err = repoCfg.Storage.resolve(serverCfg); err != nil {
+			return nil, nil, err
+		}
+	} else if serverCfg.Backend != "local" && serverCfg.Bucket == "" {
+		return nil, nil, ErrLFSNotConfigured
+	}
+
+	storage, err := openLFSStorage(ctx, storageCfg, dataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return storage, serverCfg, nil
+}
+
+// openLFSMigrationStorage opens one side of an LFS migration: "server" for the server's
+// storage, "repo" for the storage the repository is configured with, or an LFS config file
+func openLFSMigrationStorage(ctx context.Context, reposPath, repoName, which string) (LFSStorage, error) {
+	dataDir := filepath.Dir(reposPath)
+	switch which {
+	case "repo":
+		storage, _, err := openRepoLFSStorage(ctx, reposPath, repoName)
+		return storage, err
+	case "server":
+		which = filepath.Join(dataDir, "lfs-config.json")
+	}
+	cfg, err := loadLFSConfig(which)
+	if err != nil {
+		return nil, err
+	}
+	return openLFSStorage(ctx, cfg, dataDir)
+}
+
+// migrateLFSObjects copies the objects of a repository from one storage to another,
+// skipping objects the destination already has, and deletes them from the source if asked.
+// Every copy is verified against its OID.
+func migrateLFSObjects(ctx context.Context, src, dst LFSStorage, repoName string, deleteSource bool, out io.Writer) (copied, skipped int, err error) {
+	objects, err := listLFSObjects(ctx, src, repoName)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, obj := range objects {
+		if size, err := dst.Size(ctx, obj.Key); err == nil && size == obj.Size {
+			skipped++
+		} else {
+			if err := copyLFSObject(ctx, src, obj.Key, dst, obj.Key, obj.Size); err != nil {
+				return copied, skipped, fmt.Errorf("%s: %w", obj.Key, err)
+			}
+			copied++
+			fmt.Fprintf(out, "copied %s (%d bytes)\n", obj.Key, obj.Size)
+		}
+
+		if deleteSource {
+			if err := src.Delete(ctx, obj.Key); err != nil {
+				return copied, skipped, fmt.Errorf("%s: %w", obj.Key, err)
+			}
+		}
+	}
+	return copied, skipped, nil
+}
+
+// listLFSObjects returns the objects of a repository in a storage, ignoring anything else
+// stored under its name
+func listLFSObjects(ctx context.Context, storage LFSStorage, repoName string) ([]LFSStoredObject, error) {
+	var objects []LFSStoredObject
+	err := storage.List(ctx, repoName+"/", func(obj LFSStoredObject) error {
+		oid := filepath.Base(obj.Key)
+		if lfsOIDPattern.MatchString(oid) && obj.Key == lfsObjectKey(repoName, oid) {
+			objects = append(objects, obj)
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// copyRepoLFSObjects copies the objects of a repository to the keys of another name, skipping
+// those already copied, and returns the objects copied from. They're left in place for the
+// caller to delete once the repository goes by its new name.
+func copyRepoLFSObjects(ctx context.Context, storage LFSStorage, from, to string) ([]LFSStoredObject, error) {
+	objects, err := listLFSObjects(ctx, storage, from)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objects {
+		key := lfsObjectKey(to, filepath.Base(obj.Key))
+		if size, err := storage.Size(ctx, key); err == nil && size == obj.Size {
+			continue
+		}
+		if err := copyLFSObject(ctx, storage, obj.Key, storage, key, obj.Size); err != nil {
+			return nil, fmt.Errorf("%s: %w", obj.Key, err)
+		}
+	}
+	return objects, nil
+}
+
+// deleteLFSObjects deletes objects from a storage, it returns the first error after trying
+// every object
+func deleteLFSObjects(ctx context.Context, storage LFSStorage, objects []LFSStoredObject) error {
+	var first error
+	for _, obj := range objects {
+		if err := storage.Delete(ctx, obj.Key); err != nil && first == nil {
+			first = fmt.Errorf("%s: %w", obj.Key, err)
+		}
+	}
+	return first
+}
+
+// copyLFSObject copies one object between storages, the key names its OID
+func copyLFSObject(ctx context.Context, src LFSStorage, srcKey string, dst LFSStorage, dstKey string, size int64) error {
+	body, err := src.Get(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return dst.Put(ctx, dstKey, newVerifyingReader(body, filepath.Base(srcKey), size), size)
+}
+
+// runLFSMigrate copies a repository's LFS objects between storages, for the -lfs-migrate
+// command, and returns the exit code
+func runLFSMigrate(reposPath, repoName, from, to string, deleteSource bool, out io.Writer) int {
+	if !RepoExists(reposPath, repoName) {
+		fmt.Fprintf(out, "repository not found: %s\n", repoName)
+		return 1
+	}
+
+	ctx := context.Background()
+	src, err := openLFSMigrationStorage(ctx, reposPath, repoName, from)
+	if err != nil {
+		fmt.Fprintf(out, "opening %s storage: %v\n", from, err)
+		return 1
+	}
+	dst, err := openLFSMigrationStorage(ctx, reposPath, repoName, to)
+	if err != nil {
+		fmt.Fprintf(out, "opening %s storage: %v\n", to, err)
+		return 1
+	}
+	if sameLFSStorage(src, dst) {
+		fmt.Fprintln(out, "source and destination are the same storage")
+		return 1
+	}
+
+	copied, skipped, err := migrateLFSObjects(ctx, src, dst, repoName, deleteSource, out)
+	if err != nil {
+		fmt.Fprintf(out, "migration failed after %d objects: %v\n", copied+skipped, err)
+		return 1
+	}
+	fmt.Fprintf(out, "%s: copied %d LFS objects, %d already present\n", repoName, copied, skipped)
+	return 0
+}
+
+// sameLFSStorage reports whether two storages hold their objects in the same place
+func sameLFSStorage(a, b LFSStorage) bool {
+	switch a := a.(type) {
+	case *LocalLFSStorage:
+		b, ok := b.(*LocalLFSStorage)
+		return ok && filepath.Clean(a.root) == filepath.Clean(b.root)
+	case *S3LFSStorage:
+		b, ok := b.(*S3LFSStorage)
+		return ok && a.endpoint == b.endpoint && a.bucket == b.bucket && a.prefix == b.prefix
+	}
+	return false
+}
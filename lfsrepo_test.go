@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRepoLFSStorageResolve(t *testing.T) {
+	server := &LFSConfig{
+		Endpoint: "https://s3.example.com", Bucket: "server", Prefix: "gitraf",
+		AccessKey: "server-key", SecretKey: "server-secret",
+		Credentials: map[string]LFSCredentials{"team": {AccessKey: "team-key", SecretKey: "team-secret"}},
+	}
+	tests := []struct {
+		name       string
+		override   RepoLFSStorage
+		wantPrefix string
+		wantKey    string
+		wantErr    bool
+	}{
+		{"server bucket", RepoLFSStorage{Backend: "s3", Bucket: "server"}, "gitraf", "server-key", false},
+		{"server bucket with its prefix", RepoLFSStorage{Backend: "s3", Bucket: "server", Prefix: "/gitraf/"}, "gitraf", "server-key", false},
+		{"server bucket with another prefix", RepoLFSStorage{Backend: "s3", Bucket: "server", Prefix: "other"}, "", "", true},
+		{"server bucket with credentials and another prefix", RepoLFSStorage{Backend: "s3", Bucket: "server", Prefix: "other", Credentials: "team"}, "", "", true},
+		{"other bucket", RepoLFSStorage{Backend: "s3", Bucket: "team", Credentials: "team"}, repoLFSNamespace, "team-key", false},
+		{"other bucket with a prefix", RepoLFSStorage{Backend: "s3", Bucket: "team", Prefix: "a/b", Credentials: "team"}, "a/b/" + repoLFSNamespace, "team-key", false},
+		{"other bucket without credentials", RepoLFSStorage{Backend: "s3", Bucket: "team"}, "", "", true},
+		{"other endpoint", RepoLFSStorage{Backend: "s3", Endpoint: "https://other.example.com", Bucket: "server"}, "", "", true},
+		{"prefix taking the namespace", RepoLFSStorage{Backend: "s3", Bucket: "team", Prefix: repoLFSNamespace, Credentials: "team"}, "", "", true},
+		{"unknown credentials", RepoLFSStorage{Backend: "s3", Bucket: "team", Credentials: "nobody"}, "", "", true},
+		{"missing bucket", RepoLFSStorage{Backend: "s3"}, "", "", true},
+	}
+	for _, tt := range tests {
+		cfg, err := tt.override.resolve(server)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: resolved to %+v, want an error", tt.name, cfg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if cfg.Prefix != tt.wantPrefix || cfg.AccessKey != tt.wantKey {
+			t.Errorf("%s: prefix %q with key %q, want %q with %q", tt.name, cfg.Prefix, cfg.AccessKey, tt.wantPrefix, tt.wantKey)
+		}
+	}
+}
+
+// TestRepoLFSStorageKeysDontCollide checks that a repository's prefix can't make its keys those
+// of another repository, like repository a with prefix b and repository b/a
+func TestRepoLFSStorageKeysDontCollide(t *testing.T) {
+	oid, _ := lfsTestObject("shared")
+	storageKey := func(server *LFSConfig, repoName string, override *RepoLFSStorage) (string, bool) {
+		cfg := server
+		if override != nil {
+			var err error
+			if cfg, err = override.resolve(server); err != nil {
+				return "", false
+			}
+		}
+		prefix := strings.Trim(cfg.Prefix, "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+		return prefix + lfsObjectKey(repoName, oid), true
+	}
+
+	for _, serverPrefix := range []string{"", "gitraf"} {
+		server := &LFSConfig{Bucket: "server", Prefix: serverPrefix,
+			Credentials: map[string]LFSCredentials{"team": {AccessKey: "team-key"}}}
+		victim, _ := storageKey(server, "b/a", nil)
+		sharedVictim, _ := storageKey(server, "b/a", &RepoLFSStorage{Backend: "s3", Bucket: "team", Credentials: "team"})
+
+		for _, prefix := range []string{"b", serverPrefix + "/b", "b/" + repoLFSNamespace} {
+			for _, bucket := range []string{"server", "team"} {
+				key, ok := storageKey(server, "a", &RepoLFSStorage{Backend: "s3", Bucket: bucket, Prefix: prefix, Credentials: "team"})
+				if ok && (key == victim || key == sharedVictim) {
+					t.Errorf("server prefix %q: repository a with prefix %q in bucket %s stores %s, a key of b/a", serverPrefix, prefix, bucket, key)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// lfsPresignExpiry is how long presigned transfer URLs stay valid
+	lfsPresignExpiry = time.Hour
+
+	// lfsPartExpiry is how long presigned multipart URLs stay valid, all parts are handed out at once
+	lfsPartExpiry = 24 * time.Hour
+
+	// lfsPartSize is the multipart part size, raised for objects that would need more than lfsMaxParts
+	lfsPartSize = 64 << 20
+	lfsMaxParts = 10000
+)
+
+// LFSStorage stores LFS objects under keys of the form {repo}/{oid[0:2]}/{oid[2:4]}/{oid}
+type LFSStorage interface {
+	// Size returns the size of a stored object, or an error wrapping os.ErrNotExist
+	Size(ctx context.Context, key string) (int64, error)
+	// Get opens a stored object for reading
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Put stores an object. Nothing is stored if reading r fails.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Delete removes a stored object
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every stored object whose key starts with prefix
+	List(ctx context.Context, prefix string, fn func(obj LFSStoredObject) error) error
+}
+
+// LFSStoredObject describes an object in an LFS storage
+type LFSStoredObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// lfsPresigner is implemented by storages that clients can transfer objects with directly,
+// storages without it are proxied through /{repo}.git/info/lfs/objects/{oid}
+type lfsPresigner interface {
+	PresignUpload(ctx context.Context, key string, size int64) (string, error)
+	PresignDownload(ctx context.Context, key string) (string, error)
+}
+
+// lfsResumable is implemented by storages that keep interrupted uploads, for the tus transfer adapter
+type lfsResumable interface {
+	// UploadOffset returns how many bytes of an object's upload are stored
+	UploadOffset(ctx context.Context, key string) (int64, error)
+	// Resume appends to an upload at offset and returns the new offset. The object is
+	// verified against its OID and stored once all of its bytes arrived.
+	Resume(ctx context.Context, key string, offset int64, r io.Reader, oid string, size int64) (int64, error)
+}
+
+// lfsRangeReader is implemented by storages that can read the start of an object without
+// downloading the rest
+type lfsRangeReader interface {
+	// GetRange opens length bytes of a stored object at offset for reading
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// lfsMultipartUploader is implemented by storages that clients can upload objects to in parts,
+// for the multipart-basic transfer adapter
+type lfsMultipartUploader interface {
+	// StartMultipart starts an upload, or resumes an interrupted one of the same object
+	StartMultipart(ctx context.Context, key string, size int64) (*lfsMultipartUpload, error)
+	// CompleteMultipart assembles the uploaded parts into the object
+	CompleteMultipart(ctx context.Context, key, uploadID string, size int64) error
+	// AbortMultipart discards an upload and its parts
+	AbortMultipart(ctx context.Context, key, uploadID string) error
+}
+
+// lfsMultipartUpload is a started multipart upload and the parts still missing from it
+type lfsMultipartUpload struct {
+	UploadID string
+	Parts    []*LFSAction
+}
+
+// ErrLFSUploadOffset means a resumed upload didn't continue where the stored data ends
+var ErrLFSUploadOffset = errors.New("upload offset does not match the stored data")
+
+// lfsObjectKey returns the storage key of an object
+func lfsObjectKey(repoName, oid string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", repoName, oid[:2], oid[2:4], oid)
+}
+
+// openLFSStorage creates the storage backend selected by an LFS config. Local storage
+// defaults to lfs-objects/ in dataDir.
+func openLFSStorage(ctx context.Context, cfg *LFSConfig, dataDir string) (LFSStorage, error) {
+	switch cfg.Backend {
+	case "local":
+		root := cfg.Path
+		if root == "" {
+			root = filepath.Join(dataDir, "lfs-objects")
+		}
+		return &LocalLFSStorage{root: root}, nil
+	case "", "s3":
+		client, err := createS3Client(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		prefix := strings.Trim(cfg.Prefix, "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+		return &S3LFSStorage{client: client, endpoint: strings.TrimSuffix(cfg.Endpoint, "/"), bucket: cfg.Bucket, prefix: prefix}, nil
+	default:
+		return nil, fmt.Errorf("unknown LFS backend: %s", cfg.Backend)
+	}
+}
+
+// LocalLFSStorage stores LFS objects on the local disk
+type LocalLFSStorage struct {
+	root string
+}
+
+// Size returns the size of a stored object
+func (l *LocalLFSStorage) Size(ctx context.Context, key string) (int64, error) {
+	info, err := os.Stat(filepath.Join(l.root, filepath.FromSlash(key)))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Get opens a stored object for reading
+func (l *LocalLFSStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(l.root, filepath.FromSlash(key)))
+}
+
+// Put writes an object to a temporary file and moves it into place once fully read
+func (l *LocalLFSStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	path := filepath.Join(l.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Delete removes a stored object and the directories it leaves empty
+func (l *LocalLFSStorage) Delete(ctx context.Context, key string) error {
+	path := filepath.Join(l.root, filepath.FromSlash(key))
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != l.root && strings.HasPrefix(dir, l.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// List walks the storage directory, skipping temporary and partial uploads
+func (l *LocalLFSStorage) List(ctx context.Context, prefix string, fn func(obj LFSStoredObject) error) error {
+	err := filepath.WalkDir(l.root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") || strings.HasSuffix(d.Name(), ".part") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(LFSStoredObject{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// lfsPartialUploads serialises appends to the same interrupted upload
+var lfsPartialUploads sync.Map // Key -> *sync.Mutex
+
+// UploadOffset returns the size of an object's interrupted upload, or its size once stored
+func (l *LocalLFSStorage) UploadOffset(ctx context.Context, key string) (int64, error) {
+	path := filepath.Join(l.root, filepath.FromSlash(key))
+	if info, err := os.Stat(path); err == nil {
+		return info.Size(), nil
+	}
+	info, err := os.Stat(path + ".part")
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Resume appends to the .part file next to the object, keeping whatever arrived if reading r
+// fails so the client can continue from there
+func (l *LocalLFSStorage) Resume(ctx context.Context, key string, offset int64, r io.Reader, oid string, size int64) (int64, error) {
+	path := filepath.Join(l.root, filepath.FromSlash(key))
+	mu, _ := lfsPartialUploads.LoadOrStore(key, &sync.Mutex{})
+	if !mu.(*sync.Mutex).TryLock() {
+		return 0, fmt.Errorf("%w: upload in progress", ErrLFSUploadOffset)
+	}
+	defer mu.(*sync.Mutex).Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path+".part", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != offset {
+		return info.Size(), ErrLFSUploadOffset
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	n, err := io.Copy(f, io.LimitReader(r, size-offset))
+	offset += n
+	if err != nil {
+		return offset, err
+	}
+	if offset < size {
+		return offset, nil
+	}
+	if extra, _ := r.Read(make([]byte, 1)); extra > 0 {
+		return offset, fmt.Errorf("%w: larger than %d bytes", ErrLFSObjectMismatch, size)
+	}
+	if err := f.Close(); err != nil {
+		return offset, err
+	}
+
+	// Check the complete upload against its OID before it becomes visible
+	part, err := os.Open(path + ".part")
+	if err != nil {
+		return offset, err
+	}
+	_, err = io.Copy(io.Discard, newVerifyingReader(part, oid, size))
+	part.Close()
+	if err != nil {
+		os.Remove(path + ".part")
+		return 0, err
+	}
+	return offset, os.Rename(path+".part", path)
+}
+
+// S3LFSStorage stores LFS objects in an S3-compatible bucket
+type S3LFSStorage struct {
+	client   *s3.Client
+	endpoint string // Empty for AWS
+	bucket   string
+	prefix   string // Prepended to keys, so several servers or repositories can share a bucket
+}
+
+// Size returns the size of a stored object
+func (b *S3LFSStorage) Size(ctx context.Context, key string) (int64, error) {
+	out, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return 0, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+		}
+		return 0, err
+	}
+	return aws.ToInt64(out.ContentLength), nil
+}
+
+// Get opens a stored object for reading
+func (b *S3LFSStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// GetRange opens part of a stored object for reading
+func (b *S3LFSStorage) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Put uploads an object. Bodies that can't seek are spooled to a temporary file first, the
+// SDK can't sign them for endpoints without TLS.
+func (b *S3LFSStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if _, ok := r.(io.Seeker); !ok {
+		tmp, err := os.CreateTemp("", "gitraf-s3-put-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, r); err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r = tmp
+	}
+
+	_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(b.prefix + key),
+		Body:          r,
+		ContentLength: aws.Int64(size),
+	})
+	return err
+}
+
+// Delete removes a stored object
+func (b *S3LFSStorage) Delete(ctx context.Context, key string) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + key),
+	})
+	return err
+}
+
+// List lists the objects in the bucket
+func (b *S3LFSStorage) List(ctx context.Context, prefix string, fn func(obj LFSStoredObject) error) error {
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(b.prefix + prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			err := fn(LFSStoredObject{
+				Key:     strings.TrimPrefix(aws.ToString(obj.Key), b.prefix),
+				Size:    aws.ToInt64(obj.Size),
+				ModTime: aws.ToTime(obj.LastModified),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PresignUpload returns a presigned PUT URL for an object
+func (b *S3LFSStorage) PresignUpload(ctx context.Context, key string, size int64) (string, error) {
+	req, err := s3.NewPresignClient(b.client).PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(b.prefix + key),
+		ContentLength: aws.Int64(size),
+	}, func(opts *s3.PresignOptions) {
+		opts.Expires = lfsPresignExpiry
+	})
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// PresignDownload returns a presigned GET URL for an object
+func (b *S3LFSStorage) PresignDownload(ctx context.Context, key string) (string, error) {
+	req, err := s3.NewPresignClient(b.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + key),
+	}, func(opts *s3.PresignOptions) {
+		opts.Expires = lfsPresignExpiry
+	})
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// StartMultipart starts a multipart upload with a presigned URL per part. An interrupted upload
+// of the same object is resumed, only its missing parts are handed out.
+func (b *S3LFSStorage) StartMultipart(ctx context.Context, key string, size int64) (*lfsMultipartUpload, error) {
+	upload := &lfsMultipartUpload{}
+	uploaded := make(map[int32]int64)
+
+	list, err := b.client.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(b.prefix + key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range list.Uploads {
+		if aws.ToString(u.Key) == b.prefix+key {
+			upload.UploadID = aws.ToString(u.UploadId)
+			break
+		}
+	}
+
+	if upload.UploadID != "" {
+		parts, err := b.listParts(ctx, key, upload.UploadID)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range parts {
+			uploaded[aws.ToInt32(part.PartNumber)] = aws.ToInt64(part.Size)
+		}
+	} else {
+		out, err := b.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(b.prefix + key),
+		})
+		if err != nil {
+			return nil, err
+		}
+		upload.UploadID = aws.ToString(out.UploadId)
+	}
+
+	partSize := lfsMultipartPartSize(size)
+	presign := s3.NewPresignClient(b.client)
+	for number, pos := int32(1), int64(0); pos < size || number == 1; number, pos = number+1, pos+partSize {
+		length := min(partSize, size-pos)
+		if n, ok := uploaded[number]; ok && n == length {
+			continue
+		}
+
+		req, err := presign.PresignUploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(b.bucket),
+			Key:           aws.String(b.prefix + key),
+			UploadId:      aws.String(upload.UploadID),
+			PartNumber:    aws.Int32(number),
+			ContentLength: aws.Int64(length),
+		}, func(opts *s3.PresignOptions) {
+			opts.Expires = lfsPartExpiry
+		})
+		if err != nil {
+			return nil, err
+		}
+		upload.Parts = append(upload.Parts, &LFSAction{
+			Href:      req.URL,
+			Pos:       pos,
+			Size:      length,
+			ExpiresIn: int(lfsPartExpiry.Seconds()),
+		})
+	}
+	return upload, nil
+}
+
+// CompleteMultipart assembles the uploaded parts, failing if they don't add up to size
+func (b *S3LFSStorage) CompleteMultipart(ctx context.Context, key, uploadID string, size int64) error {
+	parts, err := b.listParts(ctx, key, uploadID)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	completed := make([]types.CompletedPart, len(parts))
+	for i, part := range parts {
+		total += aws.ToInt64(part.Size)
+		completed[i] = types.CompletedPart{ETag: part.ETag, PartNumber: part.PartNumber}
+	}
+	if total != size {
+		return fmt.Errorf("%w: parts add up to %d bytes, expected %d", ErrLFSObjectMismatch, total, size)
+	}
+
+	_, err = b.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.bucket),
+		Key:             aws.String(b.prefix + key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+// AbortMultipart discards a multipart upload
+func (b *S3LFSStorage) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	_, err := b.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(b.bucket),
+		Key:      aws.String(b.prefix + key),
+		UploadId: aws.String(uploadID),
+	})
+	return err
+}
+
+// listParts returns the uploaded parts of a multipart upload in part number order
+func (b *S3LFSStorage) listParts(ctx context.Context, key, uploadID string) ([]types.Part, error) {
+	var parts []types.Part
+	paginator := s3.NewListPartsPaginator(b.client, &s3.ListPartsInput{
+		Bucket:   aws.String(b.bucket),
+		Key:      aws.String(b.prefix + key),
+		UploadId: aws.String(uploadID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			var noSuchUpload *types.NoSuchUpload
+			if errors.As(err, &noSuchUpload) {
+				return nil, fmt.Errorf("upload %s: %w", uploadID, os.ErrNotExist)
+			}
+			return nil, err
+		}
+		parts = append(parts, page.Parts...)
+	}
+	return parts, nil
+}
+
+// lfsMultipartPartSize returns the part size for an object, large enough to stay within lfsMaxParts
+func lfsMultipartPartSize(size int64) int64 {
+	partSize := int64(lfsPartSize)
+	if minSize := (size + lfsMaxParts - 1) / lfsMaxParts; minSize > partSize {
+		partSize = minSize
+	}
+	return partSize
+}
+
+// ErrLFSObjectMismatch means uploaded data didn't match the object's OID or size
+var ErrLFSObjectMismatch = errors.New("object does not match its OID")
+
+// verifyingReader fails at EOF unless the data read has the expected SHA-256 and size,
+// so storages discard uploads that don't match their OID
+type verifyingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+	oid  string
+	size int64
+}
+
+// newVerifyingReader wraps r to verify it against an LFS object's OID and size
+func newVerifyingReader(r io.Reader, oid string, size int64) *verifyingReader {
+	return &verifyingReader{r: r, hash: sha256.New(), oid: oid, size: size}
+}
+
+// Read reads from the underlying reader, checking the hash and size at EOF
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	v.n += int64(n)
+	if v.n > v.size {
+		return n, fmt.Errorf("%w: larger than %d bytes", ErrLFSObjectMismatch, v.size)
+	}
+	if err == io.EOF {
+		if v.n != v.size {
+			return n, fmt.Errorf("%w: size is %d bytes, expected %d", ErrLFSObjectMismatch, v.n, v.size)
+		}
+		if sum := hex.EncodeToString(v.hash.Sum(nil)); sum != v.oid {
+			return n, fmt.Errorf("%w: SHA-256 is %s", ErrLFSObjectMismatch, sum)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory S3 bucket API with path-style addressing. It doesn't check
+// signatures and only knows the calls S3LFSStorage makes outside multipart uploads.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte // By bucket/key
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, bucket, r.URL.Query().Get("prefix"))
+		return
+	}
+	name := bucket + "/" + key
+	switch r.Method {
+	case http.MethodPut:
+		body, err := readS3Body(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[name] = body
+	case http.MethodHead, http.MethodGet:
+		data, ok := f.objects[name]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+			}
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+// list answers ListObjectsV2 in a single page
+func (f *fakeS3) list(w http.ResponseWriter, bucket, prefix string) {
+	type object struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []object
+	}{Name: bucket, Prefix: prefix}
+	for name, data := range f.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok && strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, object{key, int64(len(data)), time.Now().UTC()})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// readS3Body reads an upload, decoding the aws-chunked encoding the SDK uses to send checksums
+func readS3Body(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return body, err
+	}
+	var data []byte
+	for {
+		line, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return nil, errors.New("truncated chunk")
+		}
+		sizeHex, _, _ := bytes.Cut(line, []byte(";"))
+		var size int
+		if _, err := fmt.Sscanf(string(sizeHex), "%x", &size); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		if len(rest) < size+2 {
+			return nil, errors.New("truncated chunk")
+		}
+		data = append(data, rest[:size]...)
+		body = rest[size+2:]
+	}
+}
+
+func TestS3LFSStorage(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("AWS_CONFIG_FILE", os.DevNull)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", os.DevNull)
+	fake, srv := newFakeS3(t)
+
+	backend, err := openLFSStorage(ctx, &LFSConfig{
+		Backend: "s3", Endpoint: srv.URL + "/", Bucket: "objects",
+		AccessKey: "key", SecretKey: "secret", Prefix: "/server/",
+	}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, ok := backend.(*S3LFSStorage)
+	if !ok {
+		t.Fatalf("openLFSStorage returned %T, want *S3LFSStorage", backend)
+	}
+	if storage.endpoint != srv.URL || storage.prefix != "server/" {
+		t.Errorf("endpoint %q, prefix %q", storage.endpoint, storage.prefix)
+	}
+
+	oid, data := lfsTestObject("hello s3")
+	key := lfsObjectKey("group/repo", oid)
+	if _, err := storage.Size(ctx, key); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Size of a missing object: %v, want os.ErrNotExist", err)
+	}
+	if _, err := storage.Get(ctx, key); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Get of a missing object: %v, want os.ErrNotExist", err)
+	}
+
+	// A body that can't seek is spooled before it's sent
+	if err := storage.Put(ctx, key, io.MultiReader(bytes.NewReader(data)), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.objects["objects/server/"+key]; !bytes.Equal(got, data) {
+		t.Fatalf("bucket holds %q under the prefixed key, want %q", got, data)
+	}
+	if size, err := storage.Size(ctx, key); err != nil || size != int64(len(data)) {
+		t.Fatalf("Size = %d, %v, want %d", size, err, len(data))
+	}
+	body, err := storage.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(got, data) {
+		t.Errorf("Get = %q, want %q", got, data)
+	}
+
+	fake.objects["objects/other/"+key] = data
+	var listed []string
+	err = storage.List(ctx, "group/", func(obj LFSStoredObject) error {
+		listed = append(listed, obj.Key)
+		if obj.Size != int64(len(data)) {
+			t.Errorf("listed %s with size %d, want %d", obj.Key, obj.Size, len(data))
+		}
+		return nil
+	})
+	if err != nil || len(listed) != 1 || listed[0] != key {
+		t.Errorf("List = %v, %v, want [%s]", listed, err, key)
+	}
+
+	for _, presign := range []func() (string, error){
+		func() (string, error) { return storage.PresignUpload(ctx, key, int64(len(data))) },
+		func() (string, error) { return storage.PresignDownload(ctx, key) },
+	} {
+		raw, err := presign()
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "/objects/server/" + key; u.Host != strings.TrimPrefix(srv.URL, "http://") || u.Path != want {
+			t.Errorf("presigned URL %s, want path-style %s%s", raw, srv.URL, want)
+		}
+		if u.Query().Get("X-Amz-Signature") == "" || u.Query().Get("X-Amz-Expires") != fmt.Sprint(int(lfsPresignExpiry.Seconds())) {
+			t.Errorf("presigned URL %s isn't signed with the LFS expiry", raw)
+		}
+	}
+
+	if err := storage.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Size(ctx, key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Size after Delete: %v, want os.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Transfer adapters of the LFS batch API
+const (
+	lfsTransferBasic     = "basic"
+	lfsTransferMultipart = "multipart-basic"
+	lfsTransferTus       = "tus"
+
+	tusVersion = "1.0.0"
+)
+
+// lfsTransfers returns the transfer adapters a storage supports for an operation, preferred first
+func lfsTransfers(operation string, storage LFSStorage) []string {
+	var transfers []string
+	if operation == "upload" {
+		if _, ok := storage.(lfsMultipartUploader); ok {
+			transfers = append(transfers, lfsTransferMultipart)
+		}
+		if _, ok := storage.(lfsResumable); ok {
+			transfers = append(transfers, lfsTransferTus)
+		}
+	}
+	return append(transfers, lfsTransferBasic)
+}
+
+// chooseLFSTransfer picks the transfer adapter for a batch request. Clients list adapters
+// in no particular order, so the server's preference wins. Clients that don't list any get basic.
+func chooseLFSTransfer(requested []string, operation string, storage LFSStorage) (string, bool) {
+	if len(requested) == 0 {
+		return lfsTransferBasic, true
+	}
+	for _, transfer := range lfsTransfers(operation, storage) {
+		if slices.Contains(requested, transfer) {
+			return transfer, true
+		}
+	}
+	return "", false
+}
+
+// lfsUploadActions returns the actions uploading an object with the chosen transfer adapter
+func lfsUploadActions(ctx context.Context, storage LFSStorage, transfer, repoURL, key string, obj LFSObject) (*LFSActions, error) {
+	switch transfer {
+	case lfsTransferMultipart:
+		upload, err := storage.(lfsMultipartUploader).StartMultipart(ctx, key, obj.Size)
+		if err != nil {
+			return nil, err
+		}
+		query := "?" + url.Values{"upload_id": {upload.UploadID}}.Encode()
+		return &LFSActions{
+			Parts:  upload.Parts,
+			Commit: &LFSAction{Href: repoURL + "multipart/" + obj.OID + "/commit" + query, Method: http.MethodPost},
+			Abort:  &LFSAction{Href: repoURL + "multipart/" + obj.OID + "/abort" + query, Method: http.MethodPost},
+		}, nil
+
+	case lfsTransferTus:
+		// The upload is created implicitly, its length travels with every request
+		return &LFSActions{Upload: &LFSAction{
+			Href:   repoURL + "uploads/" + obj.OID,
+			Header: map[string]string{"Upload-Length": strconv.FormatInt(obj.Size, 10)},
+		}}, nil
+
+	default:
+		action := &LFSAction{Href: repoURL + "objects/" + obj.OID}
+		if presigner, ok := storage.(lfsPresigner); ok {
+			href, err := presigner.PresignUpload(ctx, key, obj.Size)
+			if err != nil {
+				return nil, err
+			}
+			action.Href = href
+			action.ExpiresIn = int(lfsPresignExpiry.Seconds())
+		}
+		return &LFSActions{Upload: action}, nil
+	}
+}
+
+// lfsResumableStorage returns the storage of a tus upload request, writing an error response
+// and returning nil if it can't be accessed or doesn't keep interrupted uploads
+func (s *Server) lfsResumableStorage(w http.ResponseWriter, r *http.Request) (lfsResumable, int64) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	storage := s.lfsObjectStorage(w, r, true)
+	if storage == nil {
+		return nil, 0
+	}
+	resumable, ok := storage.(lfsResumable)
+	if !ok {
+		writeLFSJSON(w, http.StatusNotFound, map[string]string{"message": "Resumable uploads are not supported by this storage"})
+		return nil, 0
+	}
+
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		writeLFSJSON(w, http.StatusBadRequest, map[string]string{"message": "Upload-Length is required"})
+		return nil, 0
+	}
+	if !s.admitLFSUpload(w, repoParam(r), size) {
+		return nil, 0
+	}
+	return resumable, size
+}
+
+// handleLFSTusOffset reports how much of a resumable upload the server has (tailnet only)
+func (s *Server) handleLFSTusOffset(w http.ResponseWriter, r *http.Request) {
+	storage, size := s.lfsResumableStorage(w, r)
+	if storage == nil {
+		return
+	}
+
+	key := lfsObjectKey(repoParam(r), chi.URLParam(r, "oid"))
+	offset, err := storage.UploadOffset(r.Context(), key)
+	if err != nil {
+		log.Printf("LFS storage error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleLFSTusPatch appends to a resumable upload at the offset the client sends (tailnet only)
+func (s *Server) handleLFSTusPatch(w http.ResponseWriter, r *http.Request) {
+	storage, size := s.lfsResumableStorage(w, r)
+	if storage == nil {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeLFSJSON(w, http.StatusUnsupportedMediaType, map[string]string{"message": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 || offset > size {
+		writeLFSJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid Upload-Offset"})
+		return
+	}
+
+	oid := chi.URLParam(r, "oid")
+	repoName := repoParam(r)
+	key := lfsObjectKey(repoName, oid)
+	offset, err = storage.Resume(r.Context(), key, offset, r.Body, oid, size)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	switch {
+	case errors.Is(err, ErrLFSUploadOffset):
+		writeLFSJSON(w, http.StatusConflict, map[string]string{"message": err.Error()})
+	case errors.Is(err, ErrLFSObjectMismatch):
+		writeLFSJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": err.Error()})
+	case err != nil:
+		log.Printf("Error resuming LFS upload %s at %d bytes: %v", key, offset, err)
+		writeLFSJSON(w, http.StatusInternalServerError, map[string]string{"message": "Failed to store upload"})
+	default:
+		if offset == size {
+			log.Printf("Stored LFS object %s (%d bytes, resumable)", key, size)
+			s.lfsGC.AddUsage(repoName, key, size)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// lfsMultipartStorage returns the storage of a multipart upload request, writing an error
+// response and returning nil if it can't be accessed or doesn't support multipart uploads
+func (s *Server) lfsMultipartStorage(w http.ResponseWriter, r *http.Request) (lfsMultipartUploader, string) {
+	storage := s.lfsObjectStorage(w, r, true)
+	if storage == nil {
+		return nil, ""
+	}
+	uploader, ok := storage.(lfsMultipartUploader)
+	if !ok {
+		writeLFSJSON(w, http.StatusNotFound, map[string]string{"message": "Multipart uploads are not supported by this storage"})
+		return nil, ""
+	}
+
+	uploadID := r.URL.Query().Get("upload_id")
+	if uploadID == "" {
+		writeLFSJSON(w, http.StatusBadRequest, map[string]string{"message": "upload_id is required"})
+		return nil, ""
+	}
+	return uploader, uploadID
+}
+
+// handleLFSMultipartCommit assembles the parts of a multipart upload (tailnet only)
+func (s *Server) handleLFSMultipartCommit(w http.ResponseWriter, r *http.Request) {
+	uploader, uploadID := s.lfsMultipartStorage(w, r)
+	if uploader == nil {
+		return
+	}
+
+	var obj LFSObject
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+		writeLFSJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid request"})
+		return
+	}
+	oid := chi.URLParam(r, "oid")
+	if obj.OID != oid {
+		writeLFSJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "Object ID does not match the upload"})
+		return
+	}
+	if !s.admitLFSUpload(w, repoParam(r), obj.Size) {
+		return
+	}
+
+	repoName := repoParam(r)
+	key := lfsObjectKey(repoName, oid)
+	err := uploader.CompleteMultipart(r.Context(), key, uploadID, obj.Size)
+	if err == nil {
+		err = verifyLFSObject(r.Context(), uploader.(LFSStorage), key, oid, obj.Size)
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeLFSJSON(w, http.StatusNotFound, map[string]string{"message": "Upload not found"})
+	case errors.Is(err, ErrLFSObjectMismatch):
+		writeLFSJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": err.Error()})
+	case err != nil:
+		log.Printf("Error completing LFS upload %s: %v", key, err)
+		writeLFSJSON(w, http.StatusInternalServerError, map[string]string{"message": "Failed to complete upload"})
+	default:
+		log.Printf("Stored LFS object %s (%d bytes, multipart)", key, obj.Size)
+		s.lfsGC.AddUsage(repoName, key, obj.Size)
+		writeLFSJSON(w, http.StatusOK, map[string]string{"message": "Upload complete"})
+	}
+}
+
+// verifyLFSObject hashes a stored object and deletes it if it doesn't match its OID and size,
+// for uploads whose bytes didn't pass through the server
+func verifyLFSObject(ctx context.Context, storage LFSStorage, key, oid string, size int64) error {
+	rc, err := storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, newVerifyingReader(rc, oid, size))
+	rc.Close()
+	if errors.Is(err, ErrLFSObjectMismatch) {
+		if delErr := storage.Delete(ctx, key); delErr != nil {
+			log.Printf("Error deleting mismatched LFS object %s: %v", key, delErr)
+		}
+	}
+	return err
+}
+
+// handleLFSMultipartAbort discards a multipart upload (tailnet only)
+func (s *Server) handleLFSMultipartAbort(w http.ResponseWriter, r *http.Request) {
+	uploader, uploadID := s.lfsMultipartStorage(w, r)
+	if uploader == nil {
+		return
+	}
+
+	key := lfsObjectKey(repoParam(r), chi.URLParam(r, "oid"))
+	if err := uploader.AbortMultipart(r.Context(), key, uploadID); err != nil {
+		log.Printf("Error aborting LFS upload %s: %v", key, err)
+		writeLFSJSON(w, http.StatusInternalServerError, map[string]string{"message": "Failed to abort upload"})
+		return
+	}
+	writeLFSJSON(w, http.StatusOK, map[string]string{"message": "Upload aborted"})
+}
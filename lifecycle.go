@@ -0,0 +1,643 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// repoArchivedFile marks a read-only repository, hidden from the index unless asked for
+	repoArchivedFile = "git-archived"
+
+	// repoRedirectsFile maps the old names of renamed repositories to their new ones, in the
+	// data directory
+	repoRedirectsFile = "repo-redirects.json"
+
+	// trashDir holds deleted repositories until they're purged, in the data directory
+	trashDir = "trash"
+
+	// trashInfoFile records in a deleted repository what it was called and who deleted it
+	trashInfoFile = "git-deleted.json"
+
+	// defaultTrashDays is how long deleted repositories are kept by default
+	defaultTrashDays = 30
+
+	// trashCheckInterval is how often repositories kept long enough are purged
+	trashCheckInterval = time.Hour
+)
+
+var (
+	// errArchived rejects changes to an archived repository
+	errArchived = errors.New("repository is archived and read-only, unarchive it in its settings first")
+
+	// trashID is what the IDs of deleted repositories look like
+	trashID = regexp.MustCompile(`^[0-9]+$`)
+
+	// reservedRepoNames are taken by the server's own pages, repositories and groups can't be
+	// named like them
+	reservedRepoNames = []string{"-", "admin", "api", "docs", "new", "robots.txt", "search", "static"}
+
+	// redirectsMu serializes changes to the redirects file
+	redirectsMu sync.Mutex
+)
+
+// IsArchivedRepo checks if a repository has been archived
+func IsArchivedRepo(repoPath string) bool {
+	_, err := os.Stat(filepath.Join(repoPath, repoArchivedFile))
+	return err == nil
+}
+
+// setArchivedRepo archives a repository or unarchives it
+func setArchivedRepo(repoPath string, archived bool) error {
+	path := filepath.Join(repoPath, repoArchivedFile)
+	if archived {
+		return os.WriteFile(path, []byte{}, 0644)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// filterArchivedRepos drops archived repositories unless they're asked for
+func filterArchivedRepos(repos []Repo, showArchived bool) []Repo {
+	if showArchived {
+		return repos
+	}
+	var filtered []Repo
+	for _, repo := range repos {
+		if !repo.IsArchived {
+			filtered = append(filtered, repo)
+		}
+	}
+	return filtered
+}
+
+// countArchivedRepos returns how many repositories are archived
+func countArchivedRepos(repos []Repo) int {
+	n := 0
+	for _, repo := range repos {
+		if repo.IsArchived {
+			n++
+		}
+	}
+	return n
+}
+
+// showArchived returns whether a request asks for archived repositories with ?archived=1
+func showArchived(r *http.Request) bool {
+	show, _ := strconv.ParseBool(r.URL.Query().Get("archived"))
+	return show
+}
+
+// loadRepoRedirects returns the old names of renamed repositories mapped to their new ones
+func loadRepoRedirects(reposPath string) (map[string]string, error) {
+	file := struct {
+		Redirects map[string]string `json:"redirects"`
+	}{}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(reposPath), repoRedirectsFile))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if file.Redirects == nil {
+		file.Redirects = map[string]string{}
+	}
+	return file.Redirects, nil
+}
+
+// saveRepoRedirects writes the redirects of renamed repositories
+func saveRepoRedirects(reposPath string, redirects map[string]string) error {
+	data, err := json.MarshalIndent(map[string]interface{}{"redirects": redirects}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(filepath.Dir(reposPath), repoRedirectsFile), data, 0644)
+}
+
+// addRepoRedirect redirects the old name of a repository to its new one. Names that
+// redirected to the old name follow it, and the new name doesn't redirect anymore.
+func addRepoRedirect(reposPath, from, to string) error {
+	redirectsMu.Lock()
+	defer redirectsMu.Unlock()
+	redirects, err := loadRepoRedirects(reposPath)
+	if err != nil {
+		return err
+	}
+	for name, target := range redirects {
+		if target == from {
+			redirects[name] = to
+		}
+	}
+	redirects[from] = to
+	delete(redirects, to)
+	return saveRepoRedirects(reposPath, redirects)
+}
+
+// removeRepoRedirect stops redirecting a name, when a repository is created with it
+func removeRepoRedirect(reposPath, name string) error {
+	redirectsMu.Lock()
+	defer redirectsMu.Unlock()
+	redirects, err := loadRepoRedirects(reposPath)
+	if err != nil || redirects[name] == "" {
+		return err
+	}
+	delete(redirects, name)
+	return saveRepoRedirects(reposPath, redirects)
+}
+
+// redirectRenamedRepos sends requests for the old name of a renamed repository to its new
+// one. Only names no repository or group has are redirected, GET and HEAD permanently, other
+// methods keeping their method and body.
+func (s *Server) redirectRenamedRepos(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		start := repoPathStart(segments)
+		if start < 0 || segments[start] == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, n, _ := splitRepoPath(segments[start:], func(name string) bool { return RepoExists(s.reposPath, name) }); n > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		redirects, err := loadRepoRedirects(s.reposPath)
+		if err != nil {
+			log.Printf("Error reading repository redirects: %v", err)
+		}
+		name, n, hasSuffix := splitRepoPath(segments[start:], func(name string) bool { return redirects[name] != "" })
+		if n == 0 || GroupExists(s.reposPath, name) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		target := redirects[name]
+		if hasSuffix {
+			target += ".git"
+		}
+		redirected := append(slices.Clone(segments[:start]), target)
+		url := "/" + strings.Join(append(redirected, segments[start+n:]...), "/")
+		if r.URL.RawQuery != "" {
+			url += "?" + r.URL.RawQuery
+		}
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, url, status)
+	})
+}
+
+// repoBusy returns why a repository can't be renamed or deleted right now, nil if it can
+func (s *Server) repoBusy(repoName, repoPath string) error {
+	switch {
+	case importing(repoPath):
+		return errImporting
+	case s.mirrors.Running(repoName):
+		return ErrMirrorRunning
+	case s.lfsGC.Running():
+		return errors.New("LFS garbage collection is running, try again once it's done")
+	case s.backups.Running():
+		return ErrBackupRunning
+	}
+	return nil
+}
+
+// renameRepo renames a repository and redirects its old name to the new one. Its LFS
+// objects are copied to the keys of the new name first, so a failed copy leaves the
+// repository as it was, then again for objects uploaded meanwhile once it's renamed, and
+// deleted from the old keys after that.
+func renameRepo(ctx context.Context, reposPath, from, to string) error {
+	oldPath := filepath.Join(reposPath, from+".git")
+	newPath := filepath.Join(reposPath, to+".git")
+
+	storage, _, err := openRepoLFSStorage(ctx, reposPath, from)
+	if err != nil && !errors.Is(err, ErrLFSNotConfigured) {
+		return fmt.Errorf("opening LFS storage: %w", err)
+	}
+	var moved []LFSStoredObject
+	if storage != nil {
+		if moved, err = copyRepoLFSObjects(ctx, storage, from, to); err != nil {
+			return fmt.Errorf("copying LFS objects: %w", err)
+		}
+	}
+
+	if err := createRepoGroups(reposPath, to); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	repoCache.Invalidate(oldPath)
+	repoCache.Invalidate(newPath)
+
+	if err := addRepoRedirect(reposPath, from, to); err != nil {
+		log.Printf("Error redirecting %s to %s: %v", from, to, err)
+	}
+	if storage == nil {
+		return nil
+	}
+	if moved, err = copyRepoLFSObjects(ctx, storage, from, to); err != nil {
+		log.Printf("Error copying LFS objects of %s after renaming it to %s, keeping them: %v", from, to, err)
+		return nil
+	}
+	if err := deleteLFSObjects(ctx, storage, moved); err != nil {
+		log.Printf("Error deleting LFS objects of %s after renaming it to %s: %v", from, to, err)
+	}
+	return nil
+}
+
+// handleRepoRenamePost renames a repository (repo admins only)
+func (s *Server) handleRepoRenamePost(w http.ResponseWriter, r *http.Request) {
+	repoName := repoParam(r)
+
+	if !RepoExists(s.reposPath, repoName) {
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	if !s.isRepoAdmin(r, repoPath) {
+		http.Error(w, "Access denied - repository admin required", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	newName := strings.TrimSpace(r.FormValue("name"))
+	if newName == repoName {
+		http.Redirect(w, r, "/"+repoName+"/settings", http.StatusFound)
+		return
+	}
+	if status, msg := checkNewRepoName(s.reposPath, newName); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	// Transferring into a group with admins takes being one of them
+	if admins := inheritedAdmins(s.reposPath, filepath.Join(s.reposPath, newName+".git")); len(admins) > 0 && !slices.Contains(admins, lockOwner(r)) {
+		http.Error(w, "Access denied - admin of the destination group required", http.StatusForbidden)
+		return
+	}
+	if err := s.repoBusy(repoName, repoPath); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	// The copy isn't cut short if the client goes away
+	if err := renameRepo(context.Background(), s.reposPath, repoName, newName); err != nil {
+		log.Printf("Error renaming %s to %s: %v", repoName, newName, err)
+		http.Error(w, "Failed to rename repository: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Repository %s renamed to %s by %s", repoName, newName, lockOwner(r))
+	http.Redirect(w, r, "/"+newName+"/settings", http.StatusFound)
+}
+
+// handleRepoArchivePost archives or unarchives a repository (repo admins only)
+func (s *Server) handleRepoArchivePost(w http.ResponseWriter, r *http.Request) {
+	repoName := repoParam(r)
+
+	if !RepoExists(s.reposPath, repoName) {
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	if !s.isRepoAdmin(r, repoPath) {
+		http.Error(w, "Access denied - repository admin required", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	archived := r.FormValue("archived") == "on"
+	if err := setArchivedRepo(repoPath, archived); err != nil {
+		log.Printf("Error archiving %s: %v", repoName, err)
+		http.Error(w, "Failed to update repository", http.StatusInternalServerError)
+		return
+	}
+	if archived {
+		// Pushes are rejected by the hook
+		if err := installLockHook(repoPath); err != nil {
+			log.Printf("Warning: pushes to archived repository %s are not rejected: %v", repoName, err)
+		}
+		log.Printf("Repository %s archived by %s", repoName, lockOwner(r))
+	} else {
+		log.Printf("Repository %s unarchived by %s", repoName, lockOwner(r))
+	}
+
+	http.Redirect(w, r, "/"+repoName, http.StatusFound)
+}
+
+// handleRepoDeletePost moves a repository to the trash (repo admins only), the form has to
+// repeat its name
+func (s *Server) handleRepoDeletePost(w http.ResponseWriter, r *http.Request) {
+	repoName := repoParam(r)
+
+	if !RepoExists(s.reposPath, repoName) {
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	if !s.isRepoAdmin(r, repoPath) {
+		http.Error(w, "Access denied - repository admin required", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(r.FormValue("confirm")) != repoName {
+		http.Error(w, "Type the repository name to confirm deleting it", http.StatusBadRequest)
+		return
+	}
+	if err := s.repoBusy(repoName, repoPath); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if err := s.trash.Delete(repoName, lockOwner(r)); err != nil {
+		log.Printf("Error deleting %s: %v", repoName, err)
+		http.Error(w, "Failed to delete repository", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Repository %s moved to the trash by %s", repoName, lockOwner(r))
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// TrashedRepo is a deleted repository waiting in the trash
+type TrashedRepo struct {
+	ID        string    `json:"-"`
+	Name      string    `json:"name"`
+	Deleted   time.Time `json:"deleted"`
+	DeletedBy string    `json:"deleted_by"`
+	Expires   time.Time `json:"-"`
+}
+
+// Trash keeps deleted repositories for a while before purging them with their LFS objects
+type Trash struct {
+	reposPath string
+	dir       string
+	retention time.Duration
+	mu        sync.Mutex
+}
+
+// NewTrash creates the trash of the repositories in reposPath, keeping them for retention
+func NewTrash(reposPath string, retention time.Duration) *Trash {
+	return &Trash{
+		reposPath: reposPath,
+		dir:       filepath.Join(filepath.Dir(reposPath), trashDir),
+		retention: retention,
+	}
+}
+
+// Retention returns how long deleted repositories are kept
+func (t *Trash) Retention() time.Duration {
+	return t.retention
+}
+
+// path returns where a deleted repository is kept
+func (t *Trash) path(id string) string {
+	return filepath.Join(t.dir, id+".git")
+}
+
+// Delete moves a repository to the trash. Its LFS objects stay where they are until it's purged.
+func (t *Trash) Delete(repoName, by string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	repoPath := filepath.Join(t.reposPath, repoName+".git")
+	info, err := json.MarshalIndent(&TrashedRepo{Name: repoName, Deleted: time.Now(), DeletedBy: by}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(repoPath, trashInfoFile), info, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(repoPath, t.path(strconv.FormatInt(time.Now().UnixNano(), 10))); err != nil {
+		os.Remove(filepath.Join(repoPath, trashInfoFile))
+		return err
+	}
+	repoCache.Invalidate(repoPath)
+	return nil
+}
+
+// List returns the repositories in the trash, most recently deleted first
+func (t *Trash) List() ([]TrashedRepo, error) {
+	entries, err := os.ReadDir(t.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var repos []TrashedRepo
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".git")
+		if !entry.IsDir() || !ok || !trashID.MatchString(id) {
+			continue
+		}
+		repo, err := t.load(id)
+		if err != nil {
+			log.Printf("Trash: %s: %v", entry.Name(), err)
+			continue
+		}
+		repos = append(repos, *repo)
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].Deleted.After(repos[j].Deleted)
+	})
+	return repos, nil
+}
+
+// load reads what a deleted repository was called and when it expires
+func (t *Trash) load(id string) (*TrashedRepo, error) {
+	if !trashID.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(filepath.Join(t.path(id), trashInfoFile))
+	if err != nil {
+		return nil, err
+	}
+	repo := &TrashedRepo{}
+	if err := json.Unmarshal(data, repo); err != nil {
+		return nil, err
+	}
+	repo.ID = id
+	repo.Expires = repo.Deleted.Add(t.retention)
+	return repo, nil
+}
+
+// Restore moves a deleted repository back under its name, which must be free
+func (t *Trash) Restore(id string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	repo, err := t.load(id)
+	if err != nil {
+		return "", err
+	}
+	if RepoExists(t.reposPath, repo.Name) {
+		return "", fmt.Errorf("a repository named %s exists, rename it first", repo.Name)
+	}
+	if GroupExists(t.reposPath, repo.Name) {
+		return "", fmt.Errorf("a group named %s exists, rename it first", repo.Name)
+	}
+	if err := createRepoGroups(t.reposPath, repo.Name); err != nil {
+		return "", err
+	}
+	repoPath := filepath.Join(t.reposPath, repo.Name+".git")
+	if err := os.Rename(t.path(id), repoPath); err != nil {
+		return "", err
+	}
+	os.Remove(filepath.Join(repoPath, trashInfoFile))
+	repoCache.Invalidate(repoPath)
+	return repo.Name, nil
+}
+
+// Purge deletes a repository from the trash for good, with its LFS objects unless a new
+// repository took its name, whose garbage collection then deletes those it doesn't use
+func (t *Trash) Purge(ctx context.Context, id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	repo, err := t.load(id)
+	if err != nil {
+		return err
+	}
+	repoPath := t.path(id)
+
+	if !RepoExists(t.reposPath, repo.Name) {
+		storage, _, err := openRepoLFSStorageAt(ctx, t.reposPath, repoPath)
+		if err != nil && !errors.Is(err, ErrLFSNotConfigured) {
+			return fmt.Errorf("opening LFS storage: %w", err)
+		}
+		if storage != nil {
+			objects, err := listLFSObjects(ctx, storage, repo.Name)
+			if err != nil {
+				return fmt.Errorf("listing LFS objects: %w", err)
+			}
+			if err := deleteLFSObjects(ctx, storage, objects); err != nil {
+				return fmt.Errorf("deleting LFS objects: %w", err)
+			}
+		}
+	}
+	return os.RemoveAll(repoPath)
+}
+
+// Run purges the repositories kept long enough every interval, it never returns
+func (t *Trash) Run(interval time.Duration) {
+	for {
+		t.purgeExpired(time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// purgeExpired purges the repositories deleted longer than the retention ago
+func (t *Trash) purgeExpired(now time.Time) {
+	repos, err := t.List()
+	if err != nil {
+		log.Printf("Trash: listing deleted repositories: %v", err)
+		return
+	}
+	for _, repo := range repos {
+		if now.Before(repo.Expires) {
+			continue
+		}
+		if err := t.Purge(context.Background(), repo.ID); err != nil {
+			log.Printf("Trash: purging %s: %v", repo.Name, err)
+			continue
+		}
+		log.Printf("Trash: purged %s, deleted %s by %s", repo.Name, repo.Deleted.Format(time.RFC3339), repo.DeletedBy)
+	}
+}
+
+// trashedRepoAdmin loads a deleted repository if the request may restore or purge it, its
+// admins being those it had, or those of the groups it was in
+func (s *Server) trashedRepoAdmin(w http.ResponseWriter, r *http.Request) *TrashedRepo {
+	if !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied - Tailnet required", http.StatusForbidden)
+		return nil
+	}
+	repo, err := s.trash.load(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Deleted repository not found", http.StatusNotFound)
+		return nil
+	}
+	if !s.isRepoAdminIn(r, s.trash.path(repo.ID), filepath.Join(s.reposPath, repo.Name+".git")) {
+		http.Error(w, "Access denied - repository admin required", http.StatusForbidden)
+		return nil
+	}
+	return repo
+}
+
+// handleTrashRestorePost restores a deleted repository
+func (s *Server) handleTrashRestorePost(w http.ResponseWriter, r *http.Request) {
+	repo := s.trashedRepoAdmin(w, r)
+	if repo == nil {
+		return
+	}
+
+	name, err := s.trash.Restore(repo.ID)
+	if err != nil {
+		log.Printf("Error restoring %s: %v", repo.Name, err)
+		http.Error(w, "Failed to restore repository: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	log.Printf("Repository %s restored from the trash by %s", name, lockOwner(r))
+	http.Redirect(w, r, "/"+name, http.StatusFound)
+}
+
+// handleTrashPurgePost deletes a repository from the trash for good
+func (s *Server) handleTrashPurgePost(w http.ResponseWriter, r *http.Request) {
+	repo := s.trashedRepoAdmin(w, r)
+	if repo == nil {
+		return
+	}
+
+	if err := s.trash.Purge(r.Context(), repo.ID); err != nil {
+		log.Printf("Error purging %s: %v", repo.Name, err)
+		http.Error(w, "Failed to delete repository: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Repository %s deleted from the trash by %s", repo.Name, lockOwner(r))
+	http.Redirect(w, r, "/admin/settings", http.StatusFound)
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// lfsLocksFile is the per-repository file holding LFS locks
+	lfsLocksFile = "lfs-locks.json"
+	// defaultLockLimit is the page size of lock listings when the client sets none
+	defaultLockLimit = 100
+	// lockHookMarker identifies pre-receive hooks installed by gitraf-server
+	lockHookMarker = "# gitraf-server: enforce LFS locks"
+)
+
+// zeroHash is the object name git uses for a missing ref in hook input
+const zeroHash = "0000000000000000000000000000000000000000"
+
+// lfsLocksMu serialises reads and writes of lock files
+var lfsLocksMu sync.Mutex
+
+// LFSLock is a file lock as defined by the Git LFS locking API
+type LFSLock struct {
+	ID       string       `json:"id"`
+	Path     string       `json:"path"`
+	LockedAt time.Time    `json:"locked_at"`
+	Owner    LFSLockOwner `json:"owner"`
+}
+
+// LFSLockOwner identifies who holds a lock
+type LFSLockOwner struct {
+	Name string `json:"name"`
+}
+
+// LFSLockRequest is the body of a lock creation request
+type LFSLockRequest struct {
+	Path string  `json:"path"`
+	Ref  *LFSRef `json:"ref,omitempty"`
+}
+
+// LFSLocksVerifyRequest is the body of a lock verification request
+type LFSLocksVerifyRequest struct {
+	Cursor string  `json:"cursor,omitempty"`
+	Limit  int     `json:"limit,omitempty"`
+	Ref    *LFSRef `json:"ref,omitempty"`
+}
+
+// LFSUnlockRequest is the body of an unlock request
+type LFSUnlockRequest struct {
+	Force bool    `json:"force,omitempty"`
+	Ref   *LFSRef `json:"ref,omitempty"`
+}
+
+// loadLocks reads the locks of a repository, oldest first. The caller must hold lfsLocksMu.
+func loadLocks(repoPath string) ([]LFSLock, error) {
+	data, err := os.ReadFile(filepath.Join(repoPath, lfsLocksFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []LFSLock
+	if err := json.Unmarshal(data, &locks); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(locks, func(i, j int) bool {
+		return locks[i].LockedAt.Before(locks[j].LockedAt)
+	})
+	return locks, nil
+}
+
+// saveLocks writes the locks of a repository atomically. The caller must hold lfsLocksMu.
+func saveLocks(repoPath string, locks []LFSLock) error {
+	path := filepath.Join(repoPath, lfsLocksFile)
+	if len(locks) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(locks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// CreateLock locks a path for owner. If the path is already locked the existing lock is returned with an error.
+func CreateLock(repoPath, path, owner string) (*LFSLock, error) {
+	lfsLocksMu.Lock()
+	defer lfsLocksMu.Unlock()
+
+	locks, err := loadLocks(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	for i := range locks {
+		if locks[i].Path == path {
+			return &locks[i], fmt.Errorf("already created lock")
+		}
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	lock := LFSLock{
+		ID:       hex.EncodeToString(id),
+		Path:     path,
+		LockedAt: time.Now().UTC().Truncate(time.Second),
+		Owner:    LFSLockOwner{Name: owner},
+	}
+	if err := saveLocks(repoPath, append(locks, lock)); err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// DeleteLock removes a lock and returns it, or nil if no lock has the ID. Locks held by
+// someone else are only removed when force is set.
+func DeleteLock(repoPath, id, owner string, force bool) (*LFSLock, error) {
+	lfsLocksMu.Lock()
+	defer lfsLocksMu.Unlock()
+
+	locks, err := loadLocks(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	for i, lock := range locks {
+		if lock.ID != id {
+			continue
+		}
+		if lock.Owner.Name != owner && !force {
+			return &lock, fmt.Errorf("lock is owned by %s, use force to unlock", lock.Owner.Name)
+		}
+		if err := saveLocks(repoPath, append(locks[:i:i], locks[i+1:]...)); err != nil {
+			return nil, err
+		}
+		return &lock, nil
+	}
+	return nil, nil
+}
+
+// ListLocks returns the locks of a repository
+func ListLocks(repoPath string) ([]LFSLock, error) {
+	lfsLocksMu.Lock()
+	defer lfsLocksMu.Unlock()
+	return loadLocks(repoPath)
+}
+
+// pageLocks returns up to limit locks starting at the lock with ID cursor, and the cursor of the next page
+func pageLocks(locks []LFSLock, cursor string, limit int) ([]LFSLock, string) {
+	if limit <= 0 || limit > defaultLockLimit {
+		limit = defaultLockLimit
+	}
+
+	start := 0
+	if cursor != "" {
+		start = len(locks)
+		for i, lock := range locks {
+			if lock.ID == cursor {
+				start = i
+				break
+			}
+		}
+	}
+	locks = locks[start:]
+
+	if len(locks) > limit {
+		return locks[:limit], locks[limit].ID
+	}
+	return locks, ""
+}
+
+// lockOwner returns the identity requests act as: the user's login when Tailscale Serve
+// passed it, otherwise the address of the connecting client. Pushes are matched against
+// the same identity by the pre-receive hook.
+func lockOwner(r *http.Request) string {
+	if login := tailscaleUserLogin(r); login != "" {
+		return login
+	}
+	return cleanIPString(peerAddr(r))
+}
+
+// tailscaleUserLogin returns the login Tailscale Serve passed along, or "" unless the request
+// came straight from Serve. Serve connects over loopback and appends the tailnet address of the
+// client to X-Forwarded-For, other local proxies like nginx set X-Real-IP and may pass client
+// headers through.
+func tailscaleUserLogin(r *http.Request) string {
+	login := r.Header.Get("Tailscale-User-Login")
+	if login == "" || r.Header.Get("X-Real-IP") != "" || !IsLoopbackIP(peerAddr(r)) {
+		return ""
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		if !IsTailnetIP(strings.TrimSpace(hops[len(hops)-1])) {
+			return ""
+		}
+	}
+	return login
+}
+
+// writeLFSJSON writes a Git LFS JSON response
+func writeLFSJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/vnd.git-lfs+json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding LFS response: %v", err)
+	}
+}
+
+// lfsLockRepo checks that the repository of an LFS locks request exists and may be accessed,
+// writing an error response and returning "" otherwise
+func (s *Server) lfsLockRepo(w http.ResponseWriter, r *http.Request, write bool) string {
+	repoName := repoParam(r)
+	if !RepoExists(s.reposPath, repoName) {
+		writeLFSJSON(w, http.StatusNotFound, map[string]string{"message": "Repository not found"})
+		return ""
+	}
+
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	isTailnet := s.isTailnetRequest(r)
+	if write && !isTailnet {
+		writeLFSJSON(w, http.StatusForbidden, map[string]string{"message": "Locking requires tailnet access"})
+		return ""
+	}
+	if !IsPublicRepo(s.reposPath, repoPath) && !isTailnet {
+		writeLFSJSON(w, http.StatusForbidden, map[string]string{"message": "Access denied"})
+		return ""
+	}
+	return repoPath
+}
+
+// handleLFSLockCreate locks a file (tailnet only)
+func (s *Server) handleLFSLockCreate(w http.ResponseWriter, r *http.Request) {
+	repoPath := s.lfsLockRepo(w, r, true)
+	if repoPath == "" {
+		return
+	}
+
+	var req LFSLockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.Trim(req.Path, "/") == "" {
+		writeLFSJSON(w, http.StatusBadRequest, map[string]string{"message": "A path is required"})
+		return
+	}
+
+	owner := lockOwner(r)
+	lock, err := CreateLock(repoPath, strings.Trim(req.Path, "/"), owner)
+	if lock != nil && err != nil {
+		writeLFSJSON(w, http.StatusConflict, map[string]interface{}{"lock": lock, "message": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating lock: %v", err)
+		writeLFSJSON(w, http.StatusInternalServerError, map[string]string{"message": "Failed to create lock"})
+		return
+	}
+
+	if err := installLockHook(repoPath); err != nil {
+		log.Printf("Error installing lock hook in %s: %v", repoPath, err)
+	}
+
+	log.Printf("LFS lock %s created on %s by %s", lock.ID, lock.Path, owner)
+	writeLFSJSON(w, http.StatusCreated, map[string]interface{}{"lock": lock})
+}
+
+// handleLFSLocks lists locks, filtered by path or id and paginated by cursor
+func (s *Server) handleLFSLocks(w http.ResponseWriter, r *http.Request) {
+	repoPath := s.lfsLockRepo(w, r, false)
+	if repoPath == "" {
+		return
+	}
+
+	locks, err := ListLocks(repoPath)
+	if err != nil {
+		log.Printf("Error reading locks: %v", err)
+		writeLFSJSON(w, http.StatusInternalServerError, map[string]string{"message": "Failed to read locks"})
+		return
+	}
+
+	query := r.URL.Query()
+	path := strings.Trim(query.Get("path"), "/")
+	id := query.Get("id")
+	filtered := []LFSLock{}
+	for _, lock := range locks {
+		if (path == "" || lock.Path == path) && (id == "" || lock.ID == id) {
+			filtered = append(filtered, lock)
+		}
+	}
+
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	page, next := pageLocks(filtered, query.Get("cursor"), limit)
+	writeLFSJSON(w, http.StatusOK, map[string]interface{}{
+		"locks":       page,
+		"next_cursor": next,
+	})
+}
+
+// handleLFSLocksVerify lists locks split into those held by the caller and by others (tailnet only)
+func (s *Server) handleLFSLocksVerify(w http.ResponseWriter, r *http.Request) {
+	repoPath := s.lfsLockRepo(w, r, true)
+	if repoPath == "" {
+		return
+	}
+
+	var req LFSLocksVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeLFSJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid request"})
+		return
+	}
+
+	locks, err := ListLocks(repoPath)
+	if err != nil {
+		log.Printf("Error reading locks: %v", err)
+		writeLFSJSON(w, http.StatusInternalServerError, map[string]string{"message": "Failed to read locks"})
+		return
+	}
+
+	owner := lockOwner(r)
+	page, next := pageLocks(locks, req.Cursor, req.Limit)
+	ours, theirs := []LFSLock{}, []LFSLock{}
+	for _, lock := range page {
+		if lock.Owner.Name == owner {
+			ours = append(ours, lock)
+		} else {
+			theirs = append(theirs, lock)
+		}
+	}
+
+	writeLFSJSON(w, http.StatusOK, map[string]interface{}{
+		"ours":        ours,
+		"theirs":      theirs,
+		"next_cursor": next,
+	})
+}
+
+// handleLFSUnlock removes a lock, locks of other users require force (tailnet only)
+func (s *Server) handleLFSUnlock(w http.ResponseWriter, r *http.Request) {
+	repoPath := s.lfsLockRepo(w, r, true)
+	if repoPath == "" {
+		return
+	}
+
+	var req LFSUnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeLFSJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid request"})
+		return
+	}
+
+	owner := lockOwner(r)
+	lock, err := DeleteLock(repoPath, chi.URLParam(r, "id"), owner, req.Force)
+	if lock != nil && err != nil {
+		writeLFSJSON(w, http.StatusForbidden, map[string]interface{}{"lock": lock, "message": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting lock: %v", err)
+		writeLFSJSON(w, http.StatusInternalServerError, map[string]string{"message": "Failed to delete lock"})
+		return
+	}
+	if lock == nil {
+		writeLFSJSON(w, http.StatusNotFound, map[string]string{"message": "Lock not found"})
+		return
+	}
+
+	log.Printf("LFS lock %s on %s released by %s (force=%v)", lock.ID, lock.Path, owner, req.Force)
+	writeLFSJSON(w, http.StatusOK, map[string]interface{}{"lock": lock})
+}
+
+// handleLocks shows the locks page of a repository
+func (s *Server) handleLocks(w http.ResponseWriter, r *http.Request) {
+	repoName := repoParam(r)
+
+	if !RepoExists(s.reposPath, repoName) {
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+
+	// Check access
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	if !IsPublicRepo(s.reposPath, repoPath) && !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	locks, err := ListLocks(repoPath)
+	if err != nil {
+		log.Printf("Error reading locks: %v", err)
+		http.Error(w, "Error reading locks", http.StatusInternalServerError)
+		return
+	}
+
+	defaultBranch, err := GetDefaultBranch(repoPath)
+	if err != nil {
+		defaultBranch = "main"
+	}
+
+	data := map[string]interface{}{
+		"Title":      "Locks - " + repoName,
+		"RepoName":   repoName,
+		"Ref":        defaultBranch,
+		"Locks":      locks,
+		"Owner":      lockOwner(r),
+		"IsTailnet":  s.isTailnetRequest(r),
+		"IsPublic":   IsPublicRepo(s.reposPath, repoPath),
+		"PublicURL":  s.publicURL,
+		"TailnetURL": s.tailnetURL,
+	}
+
+	s.renderTemplate(w, "locks.html", data)
+}
+
+// handleLockRelease force-releases a lock from the locks page (tailnet only)
+func (s *Server) handleLockRelease(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied - Tailnet required", http.StatusForbidden)
+		return
+	}
+
+	repoName := repoParam(r)
+
+	if !RepoExists(s.reposPath, repoName) {
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	owner := lockOwner(r)
+	lock, err := DeleteLock(repoPath, chi.URLParam(r, "id"), owner, true)
+	if err != nil {
+		log.Printf("Error deleting lock: %v", err)
+		http.Error(w, "Failed to release lock", http.StatusInternalServerError)
+		return
+	}
+	if lock == nil {
+		http.Error(w, "Lock not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("LFS lock %s on %s in %s released by %s from the web UI", lock.ID, lock.Path, repoName, owner)
+	http.Redirect(w, r, "/"+repoName+"/locks", http.StatusFound)
+}
+
+// installLockHook installs the pre-receive hook that rejects pushes touching files
+// locked by someone else, and pushes to pull mirrors, archived repositories and
+// repositories being imported. Hooks not installed by gitraf-server are left alone.
+func installLockHook(repoPath string) error {
+	hookPath := filepath.Join(repoPath, "hooks", "pre-receive")
+	if existing, err := os.ReadFile(hookPath); err == nil {
+		if strings.Contains(string(existing), lockHookMarker) {
+			return nil
+		}
+		return fmt.Errorf("%s already exists, add `gitraf-server --hook pre-receive` to it to enforce locks and mirrors", hookPath)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(hookPath), 0755); err != nil {
+		return err
+	}
+	script := fmt.Sprintf("#!/bin/sh\n%s\nexec %q --hook pre-receive\n", lockHookMarker, exe)
+	return os.WriteFile(hookPath, []byte(script), 0755)
+}
+
+// pushIdentity returns the identity of the user running a git hook: GITRAF_USER if set
+// (e.g. through the SSH authorized_keys environment option), else the SSH client address
+func pushIdentity() string {
+	if user := os.Getenv("GITRAF_USER"); user != "" {
+		return user
+	}
+	if client := os.Getenv("SSH_CLIENT"); client != "" {
+		return strings.Fields(client)[0]
+	}
+	if user := os.Getenv("USER"); user != "" {
+		return user
+	}
+	return "unknown"
+}
+
+// runPreReceiveHook rejects ref updates that change files locked by someone other than
+// the pusher, and every update of a pull mirror, an archived repository or a repository
+// being imported. It runs inside git's pre-receive hook and returns the exit status.
+func runPreReceiveHook(stdin io.Reader, stderr io.Writer) int {
+	repoPath := os.Getenv("GIT_DIR")
+	if repoPath == "" {
+		repoPath = "."
+	}
+
+	if upstream := pullMirrorURL(repoPath); upstream != "" {
+		fmt.Fprintf(stderr, "gitraf: %v (%s)\n", errPullMirror, upstream)
+		return 1
+	}
+	if importing(repoPath) {
+		fmt.Fprintf(stderr, "gitraf: %v\n", errImporting)
+		return 1
+	}
+	if IsArchivedRepo(repoPath) {
+		fmt.Fprintf(stderr, "gitraf: %v\n", errArchived)
+		return 1
+	}
+
+	locks, err := ListLocks(repoPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "gitraf: failed to read LFS locks: %v\n", err)
+		return 1
+	}
+	if len(locks) == 0 {
+		return 0
+	}
+
+	pusher := pushIdentity()
+	theirs := make(map[string]LFSLock)
+	for _, lock := range locks {
+		if lock.Owner.Name != pusher {
+			theirs[lock.Path] = lock
+		}
+	}
+
+	rejected := false
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[1] == zeroHash {
+			continue // Deletions don't change files
+		}
+		oldHash, newHash, ref := fields[0], fields[1], fields[2]
+
+		// Files changed by commits the update introduces. The new objects are still in
+		// git's quarantine area, which the git command line can read.
+		args := []string{"log", "--format=", "--name-only", "--no-renames"}
+		if oldHash == zeroHash {
+			args = append(args, newHash, "--not", "--branches")
+		} else {
+			args = append(args, oldHash+".."+newHash)
+		}
+		out, err := exec.Command("git", args...).Output()
+		if err != nil {
+			fmt.Fprintf(stderr, "gitraf: failed to list changed files of %s: %v\n", ref, err)
+			return 1
+		}
+
+		reported := make(map[string]bool)
+		for _, path := range strings.Split(string(out), "\n") {
+			lock, locked := theirs[path]
+			if !locked || reported[path] {
+				continue
+			}
+			reported[path] = true
+			rejected = true
+			fmt.Fprintf(stderr, "gitraf: %s: %s is locked by %s (lock %s)\n", ref, path, lock.Owner.Name, lock.ID)
+		}
+	}
+
+	if rejected {
+		fmt.Fprintf(stderr, "gitraf: push rejected, ask the lock owner to unlock the files (pushing as %s)\n", pusher)
+		return 1
+	}
+	return 0
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -23,8 +24,30 @@ func main() {
 	tailnetURL := flag.String("tailnet-url", "", "Tailnet URL for SSH clone")
 	templatesPath := flag.String("templates", "", "Path to templates directory (defaults to ./templates)")
 	pagesBaseURL := flag.String("pages-base-url", "", "Base URL for gitraf-pages (e.g., example.com for {repo}.example.com)")
+	hook := flag.String("hook", "", "Run as a git hook instead of serving (pre-receive)")
+	lfsMigrate := flag.String("lfs-migrate", "", "Copy a repository's LFS objects between storages instead of serving")
+	lfsMigrateFrom := flag.String("lfs-migrate-from", "server", "Storage to migrate LFS objects from: server, repo or an LFS config file")
+	lfsMigrateTo := flag.String("lfs-migrate-to", "repo", "Storage to migrate LFS objects to: server, repo or an LFS config file")
+	lfsMigrateDelete := flag.Bool("lfs-migrate-delete", false, "Delete migrated LFS objects from the source storage")
+	backupList := flag.Bool("backup-list", false, "List the snapshots in the backup bucket and exit")
+	backupVerify := flag.Bool("backup-verify", false, "Verify every snapshot in the backup bucket and exit")
+	restore := flag.String("restore", "", "Restore from a snapshot ID, or latest, instead of serving")
+	restoreRepo := flag.String("restore-repo", "", "Repository to restore, every repository and the server configs if empty")
+	restoreAs := flag.String("restore-as", "", "Name to restore the repository as")
+	restoreOverwrite := flag.Bool("restore-overwrite", false, "Replace repositories and configs that exist")
+	masterKeyPath := flag.String("master-key-file", "", "Path to the master key encrypting stored secrets (defaults to master.key next to the repos directory)")
+	trashDays := flag.Int("trash-days", defaultTrashDays, "Days deleted repositories are kept in the trash before they're purged")
+	rotateMasterKey := flag.Bool("rotate-master-key", false, "Generate a new master key, re-encrypt stored secrets with it and exit")
 	flag.Parse()
 
+	// Git hooks installed by the server call back into the binary
+	if *hook != "" {
+		if *hook != "pre-receive" {
+			log.Fatalf("Error: unknown hook: %s", *hook)
+		}
+		os.Exit(runPreReceiveHook(os.Stdin, os.Stderr))
+	}
+
 	// Check environment variables as fallbacks
 	if *reposPath == "" {
 		*reposPath = os.Getenv("GITRAF_REPOS_PATH")
@@ -41,6 +64,12 @@ func main() {
 	if *pagesBaseURL == "" {
 		*pagesBaseURL = os.Getenv("GITRAF_PAGES_BASE_URL")
 	}
+	if *masterKeyPath == "" {
+		*masterKeyPath = os.Getenv("GITRAF_MASTER_KEY_FILE")
+	}
+	if os.Getenv("GITRAF_TRASH_DAYS") != "" {
+		fmt.Sscanf(os.Getenv("GITRAF_TRASH_DAYS"), "%d", trashDays)
+	}
 
 	// Validate required parameters
 	if *reposPath == "" {
@@ -52,6 +81,47 @@ func main() {
 		log.Fatalf("Error: repos directory does not exist: %s", *reposPath)
 	}
 
+	// Secrets in config files are encrypted with the master key
+	dataDir := filepath.Dir(*reposPath)
+	if *masterKeyPath == "" {
+		*masterKeyPath = filepath.Join(dataDir, masterKeyFile)
+	}
+	var err error
+	if secretStore, err = NewSecretStore(*masterKeyPath); err != nil {
+		log.Fatalf("Error: loading master key: %v", err)
+	}
+
+	// Admin commands run against the repos directory and exit
+	if *rotateMasterKey {
+		if err := secretStore.Rotate(*reposPath); err != nil {
+			log.Fatalf("Error: rotating master key: %v", err)
+		}
+		fmt.Printf("Secrets are now encrypted with master key %s\n", secretStore.KeyID())
+		os.Exit(0)
+	}
+	if *lfsMigrate != "" {
+		os.Exit(runLFSMigrate(*reposPath, *lfsMigrate, *lfsMigrateFrom, *lfsMigrateTo, *lfsMigrateDelete, os.Stdout))
+	}
+	if *backupList {
+		os.Exit(runBackupList(*reposPath, os.Stdout))
+	}
+	if *backupVerify {
+		os.Exit(runBackupVerify(*reposPath, os.Stdout))
+	}
+	if *restore != "" {
+		os.Exit(runRestore(*reposPath, RestoreRequest{
+			Snapshot:  *restore,
+			Repo:      *restoreRepo,
+			As:        *restoreAs,
+			Overwrite: *restoreOverwrite,
+		}, os.Stdout))
+	}
+
+	// Encrypt secrets saved in plain text or with a previous master key
+	if err := secretStore.SealConfigs(*reposPath); err != nil {
+		log.Printf("Warning: could not encrypt stored secrets: %v", err)
+	}
+
 	// Determine templates path
 	if *templatesPath == "" {
 		// Try to find templates relative to executable
@@ -75,7 +145,7 @@ func main() {
 	}
 
 	// Create server
-	server, err := NewServer(*reposPath, *publicURL, *tailnetURL, *templatesPath, *pagesBaseURL)
+	server, err := NewServer(*reposPath, *publicURL, *tailnetURL, *templatesPath, *pagesBaseURL, time.Duration(*trashDays)*24*time.Hour)
 	if err != nil {
 		log.Fatalf("Error creating server: %v", err)
 	}
@@ -86,7 +156,10 @@ func main() {
 	// Middleware
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	r.Use(PeerAddrMiddleware)
 	r.Use(middleware.RealIP)
+	r.Use(server.redirectRenamedRepos)
+	r.Use(server.routeNamespaces)
 
 	// Static files
 	staticPath := filepath.Join(filepath.Dir(*templatesPath), "static")
@@ -100,28 +173,98 @@ func main() {
 	r.Get("/", server.handleIndex)
 	r.Get("/docs", server.handleDocs)
 	r.Get("/docs/{section}", server.handleDocs)
+	r.Get("/search", server.handleSearch)
+	r.Get("/search/commits", server.handleCommitSearch)
 	r.Get("/new", server.handleNewRepo)
 	r.Post("/new", server.handleNewRepoPost)
+	r.Get("/-/groups/{group}", server.handleGroup)
+	r.Get("/-/groups/{group}/settings", server.handleGroupSettings)
+	r.Post("/-/groups/{group}/settings", server.handleGroupSettingsPost)
 	r.Get("/{repo}", server.handleRepo)
-	r.Get("/{repo}/tree/{ref}/*", server.handleTree)
-	r.Get("/{repo}/blob/{ref}/*", server.handleBlob)
-	r.Get("/{repo}/submodule/{ref}/*", server.handleSubmodule)
-	r.Get("/{repo}/commits/{ref}", server.handleCommits)
+	r.Get("/{repo}/tree/*", server.handleTree)
+	r.Get("/{repo}/blob/*", server.handleBlob)
+	r.Get("/{repo}/submodule/*", server.handleSubmodule)
+	r.Get("/{repo}/commits/*", server.handleCommits)
 	r.Get("/{repo}/commit/{hash}", server.handleCommit)
+	r.Get("/{repo}/branches", server.handleBranches)
+	r.Post("/{repo}/branches", server.handleBranchCreate)
+	r.Post("/{repo}/branches/delete", server.handleBranchDelete)
+	r.Post("/{repo}/branches/default", server.handleBranchDefault)
+	r.Get("/{repo}/locks", server.handleLocks)
+	r.Post("/{repo}/locks/{id}/release", server.handleLockRelease)
+	r.Get("/{repo}/search", server.handleRepoSearch)
 	r.Get("/{repo}/settings", server.handleRepoSettings)
 	r.Post("/{repo}/settings", server.handleRepoSettingsPost)
+	r.Post("/{repo}/mirror/sync", server.handleMirrorSyncPost)
+	r.Post("/{repo}/import", server.handleImportRetryPost)
+	r.Post("/{repo}/rename", server.handleRepoRenamePost)
+	r.Post("/{repo}/archive", server.handleRepoArchivePost)
+	r.Post("/{repo}/delete", server.handleRepoDeletePost)
+
+	// JSON API
+	r.Get("/api/search/commits", server.handleAPICommitSearch)
+	r.Get("/api/cache", server.handleAPICacheStats)
+	r.Get("/api/repos", server.handleAPIRepos)
+	r.Post("/api/repos/{repo}/refs-changed", server.handleRefsChanged)
+	r.Get("/api/lfs/usage", server.handleAPILFSUsage)
+	r.Post("/api/repos/{repo}/lfs/gc", server.handleAPILFSGC)
+	r.Post("/api/repos/{repo}/mirror/sync", server.handleAPIMirrorSync)
+	r.Get("/api/repos/{repo}/import", server.handleAPIImportStatus)
+	r.Get("/api/backups", server.handleAPIBackups)
 
 	// Admin routes (tailnet only)
 	r.Get("/admin/settings", server.handleAdminSettings)
 	r.Post("/admin/generate-ssh-key", server.handleGenerateSSHKey)
 	r.Post("/admin/update-server", server.handleUpdateServer)
 	r.Post("/admin/lfs-config", server.handleLFSConfigPost)
+	r.Post("/admin/lfs-gc", server.handleLFSGCPost)
 	r.Post("/admin/backup-config", server.handleBackupConfigPost)
+	r.Post("/admin/backup-run", server.handleBackupRunPost)
+	r.Post("/admin/backup-restore", server.handleBackupRestorePost)
+	r.Post("/admin/backup-verify", server.handleBackupVerifyPost)
+	r.Post("/admin/storage-test", server.handleStorageTest)
+	r.Post("/admin/trash/{id}/restore", server.handleTrashRestorePost)
+	r.Post("/admin/trash/{id}/purge", server.handleTrashPurgePost)
 
 	// Git LFS routes
 	r.Post("/{repo}.git/info/lfs/objects/batch", server.handleLFSBatch)
-	r.Post("/{repo}.git/info/lfs/locks/verify", server.handleLFSLocksVerify)
+	r.Get("/{repo}.git/info/lfs/objects/{oid}", server.handleLFSObjectDownload)
+	r.Put("/{repo}.git/info/lfs/objects/{oid}", server.handleLFSObjectUpload)
+	r.Post("/{repo}.git/info/lfs/verify", server.handleLFSVerify)
+	r.Head("/{repo}.git/info/lfs/uploads/{oid}", server.handleLFSTusOffset)
+	r.Patch("/{repo}.git/info/lfs/uploads/{oid}", server.handleLFSTusPatch)
+	r.Post("/{repo}.git/info/lfs/multipart/{oid}/commit", server.handleLFSMultipartCommit)
+	r.Post("/{repo}.git/info/lfs/multipart/{oid}/abort", server.handleLFSMultipartAbort)
+	r.Post("/{repo}.git/info/lfs/locks", server.handleLFSLockCreate)
 	r.Get("/{repo}.git/info/lfs/locks", server.handleLFSLocks)
+	r.Post("/{repo}.git/info/lfs/locks/verify", server.handleLFSLocksVerify)
+	r.Post("/{repo}.git/info/lfs/locks/{id}/unlock", server.handleLFSUnlock)
+
+	// Drop cached repository data when refs change
+	go repoCache.Watch(*reposPath)
+
+	// Reload storage configs when they change
+	go storageConfigs.Watch(filepath.Dir(*reposPath))
+
+	// Keep the search indexes up to date
+	go server.search.Run(searchIndexInterval)
+	go server.commits.Run(searchIndexInterval)
+
+	// Count LFS usage and collect unreferenced objects
+	go server.lfsGC.Run(lfsGCInterval)
+
+	// Back up repositories on the configured schedule
+	go server.backups.Run(backupCheckInterval)
+
+	// Push mirrors after pushes and on their schedules
+	repoCache.OnInvalidate(server.mirrors.Notify)
+	go server.mirrors.Run(mirrorCheckInterval)
+
+	// Imports that were running when the server stopped have to be retried
+	server.imports.Recover()
+
+	// Purge deleted repositories once they've been in the trash long enough
+	go server.trash.Run(trashCheckInterval)
 
 	// Start server
 	addr := fmt.Sprintf(":%d", *port)
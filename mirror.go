@@ -0,0 +1,937 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// mirrorConfigFile configures the mirror targets of a repository
+	mirrorConfigFile = "git-mirror.json"
+
+	// mirrorStatusFile keeps the outcome of a repository's mirror syncs across restarts
+	mirrorStatusFile = "git-mirror-status.json"
+
+	// mirrorCredentialsFile holds the named mirror credentials, next to the repos directory
+	mirrorCredentialsFile = "mirror-credentials.json"
+
+	// mirrorCheckInterval is how often mirror schedules are checked
+	mirrorCheckInterval = time.Minute
+
+	// defaultMirrorSchedule is when mirrors are synced besides after pushes
+	defaultMirrorSchedule = "hourly"
+
+	// mirrorPushDelay is how long refs have to stay unchanged before a push is mirrored, so a
+	// push updating many refs is mirrored once
+	mirrorPushDelay = 5 * time.Second
+
+	// mirrorTimeout bounds the sync of a target
+	mirrorTimeout = 10 * time.Minute
+)
+
+var (
+	// ErrMirrorRunning is returned when a repository's mirrors are already being synced
+	ErrMirrorRunning = errors.New("mirror sync already running")
+
+	// errPullMirror rejects changes to a pull mirror other than fetching from its upstream
+	errPullMirror = errors.New("repository is a pull mirror, push to its upstream instead")
+
+	// mirrorTargetName is what target names may look like
+	mirrorTargetName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+)
+
+// MirrorProvider holds what differs between the hosts mirrors live on
+type MirrorProvider struct {
+	Name        string // Key stored in targets
+	Label       string
+	Placeholder string // Example remote URL
+	TokenUser   string // HTTP user access tokens are sent as, unless credentials name one
+	KeysURL     string // Where to add the server's SSH key, empty if it depends on the host
+}
+
+// mirrorProviders are the provider presets, the last one is the fallback
+var mirrorProviders = []MirrorProvider{
+	{Name: "github", Label: "GitHub", Placeholder: "git@github.com:owner/repo.git", TokenUser: "x-access-token", KeysURL: "https://github.com/settings/keys"},
+	{Name: "gitlab", Label: "GitLab", Placeholder: "git@gitlab.com:group/repo.git", TokenUser: "oauth2", KeysURL: "https://gitlab.com/-/user_settings/ssh_keys"},
+	{Name: "gitea", Label: "Gitea", Placeholder: "git@gitea.example.com:owner/repo.git", TokenUser: "git"},
+	{Name: "generic", Label: "Other", Placeholder: "https://git.example.com/repo.git", TokenUser: "git"},
+}
+
+// mirrorProvider returns the provider preset with a name, or the generic one
+func mirrorProvider(name string) MirrorProvider {
+	for _, p := range mirrorProviders {
+		if p.Name == name {
+			return p
+		}
+	}
+	return mirrorProviders[len(mirrorProviders)-1]
+}
+
+// detectMirrorProvider guesses the provider of a remote URL from its host
+func detectMirrorProvider(remote string) string {
+	switch {
+	case strings.Contains(remote, "github.com"):
+		return "github"
+	case strings.Contains(remote, "gitlab.com"):
+		return "gitlab"
+	default:
+		return "generic"
+	}
+}
+
+// MirrorTarget is a remote a repository is pushed to or fetched from
+type MirrorTarget struct {
+	Name        string   `json:"name"`
+	Enabled     bool     `json:"enabled"`
+	Direction   string   `json:"direction"`             // "push" or "pull"
+	Provider    string   `json:"provider,omitempty"`    // Name of a mirrorProviders preset
+	URL         string   `json:"url"`                   // Any URL git accepts
+	Refs        []string `json:"refs,omitempty"`        // See refPattern, every branch and tag if empty
+	Credentials string   `json:"credentials,omitempty"` // Name in mirror-credentials.json
+	Token       string   `json:"token,omitempty"`       // Own access token, encrypted with the master key
+	Schedule    string   `json:"schedule,omitempty"`    // See ParseSchedule, defaultMirrorSchedule if empty
+}
+
+// active reports whether the target is enabled and has a remote
+func (t *MirrorTarget) active() bool {
+	return t.Enabled && t.URL != ""
+}
+
+// pull reports whether the repository is fetched from the target instead of pushed to it
+func (t *MirrorTarget) pull() bool {
+	return t.Direction == "pull"
+}
+
+// schedule returns when the target is synced besides after pushes
+func (t *MirrorTarget) schedule() string {
+	if t.Schedule == "" {
+		return defaultMirrorSchedule
+	}
+	return t.Schedule
+}
+
+// matches reports whether the target mirrors a ref
+func (t *MirrorTarget) matches(ref string) bool {
+	if len(t.Refs) == 0 {
+		return strings.HasPrefix(ref, "refs/heads/") || strings.HasPrefix(ref, "refs/tags/")
+	}
+	for _, filter := range t.Refs {
+		if matchRefPattern(refPattern(filter), ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// refPattern expands a ref filter: "branches" or "tags" for all of them, a branch name or
+// pattern, or a full ref pattern starting with refs/
+func refPattern(filter string) string {
+	switch {
+	case filter == "branches":
+		return "refs/heads/*"
+	case filter == "tags":
+		return "refs/tags/*"
+	case strings.HasPrefix(filter, "refs/"):
+		return filter
+	default:
+		return "refs/heads/" + filter
+	}
+}
+
+// matchRefPattern matches a ref against a pattern in which a trailing * also matches
+// slashes, so refs/heads/* matches refs/heads/feature/x
+func matchRefPattern(pattern, ref string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && !strings.ContainsAny(prefix, "*?[") {
+		return strings.HasPrefix(ref, prefix)
+	}
+	ok, _ := path.Match(pattern, ref)
+	return ok
+}
+
+// MirrorConfig is the mirror configuration of a repository
+type MirrorConfig struct {
+	Targets []*MirrorTarget `json:"targets"`
+
+	// The single mirror configured before targets, migrated into one when loaded
+	Enabled   bool   `json:"enabled,omitempty"`
+	Direction string `json:"direction,omitempty"`
+	GitHubURL string `json:"github_url,omitempty"`
+	Token     string `json:"token,omitempty"`
+	Schedule  string `json:"schedule,omitempty"`
+}
+
+// migrate turns the single mirror configured before targets into a target and reports
+// whether there was one
+func (c *MirrorConfig) migrate() bool {
+	if c.GitHubURL == "" && c.Direction == "" && c.Token == "" && c.Schedule == "" && !c.Enabled {
+		return false
+	}
+	if c.GitHubURL != "" {
+		target := &MirrorTarget{
+			Name:      "mirror",
+			Enabled:   c.Enabled,
+			Direction: "push",
+			Provider:  detectMirrorProvider(c.GitHubURL),
+			URL:       c.GitHubURL,
+			Token:     c.Token,
+			Schedule:  c.Schedule,
+		}
+		if c.Direction == "pull" {
+			target.Name, target.Direction = "upstream", "pull"
+		} else if target.Provider != "generic" {
+			target.Name = target.Provider
+		}
+		c.Targets = append([]*MirrorTarget{target}, c.Targets...)
+	}
+	c.Enabled, c.Direction, c.GitHubURL, c.Token, c.Schedule = false, "", "", "", ""
+	return true
+}
+
+// target returns the target with a name, or nil
+func (c *MirrorConfig) target(name string) *MirrorTarget {
+	for _, t := range c.Targets {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// pullTarget returns the active target the repository is fetched from, or nil
+func (c *MirrorConfig) pullTarget() *MirrorTarget {
+	for _, t := range c.Targets {
+		if t.active() && t.pull() {
+			return t
+		}
+	}
+	return nil
+}
+
+// MirrorStatus is the outcome of the syncs of a mirror target
+type MirrorStatus struct {
+	Target      string    `json:"target"`
+	Remote      string    `json:"remote"`
+	Trigger     string    `json:"trigger"` // "push", "schedule" or "manual"
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"` // Why the last attempt failed, empty if it succeeded
+	Duration    int64     `json:"duration_ms"`          // Of the last attempt
+	Updated     int       `json:"updated"`              // Refs created, updated or deleted by the last success
+}
+
+// MirrorCredentials authenticate with mirror remotes. They're named in mirror-credentials.json
+// next to the repos directory, which is edited by hand, so targets can share them.
+type MirrorCredentials struct {
+	Username string `json:"username,omitempty"` // HTTP user, the provider's token user if empty
+	Token    string `json:"token,omitempty"`    // Access token for HTTPS remotes, encrypted with the master key
+	SSHKey   string `json:"ssh_key,omitempty"`  // Private key for SSH remotes instead of the server's
+}
+
+// loadMirrorConfig reads the mirror configuration of a repository, the error wraps
+// os.ErrNotExist if it has none
+func loadMirrorConfig(repoPath string) (*MirrorConfig, error) {
+	data, err := os.ReadFile(filepath.Join(repoPath, mirrorConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	cfg := &MirrorConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", mirrorConfigFile, err)
+	}
+	cfg.migrate()
+	return cfg, nil
+}
+
+// saveMirrorConfig writes the mirror configuration of a repository
+func saveMirrorConfig(repoPath string, cfg *MirrorConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(repoPath, mirrorConfigFile), data, 0644)
+}
+
+// migrateMirrorConfigs rewrites the mirror configs written before targets
+func migrateMirrorConfigs(reposPath string) {
+	for _, repoPath := range repoPaths(reposPath) {
+		path := filepath.Join(repoPath, mirrorConfigFile)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		cfg := &MirrorConfig{}
+		if json.Unmarshal(data, cfg) != nil || !cfg.migrate() {
+			continue
+		}
+		statuses := loadMirrorStatuses(repoPath, cfg)
+		if err := saveMirrorConfig(repoPath, cfg); err != nil {
+			log.Printf("Mirror: migrating %s: %v", path, err)
+			continue
+		}
+		saveMirrorStatuses(repoPath, statuses)
+		log.Printf("Mirror: migrated %s to mirror targets", path)
+	}
+}
+
+// loadMirrorCredentials reads the named mirror credentials, none if the file doesn't exist
+func loadMirrorCredentials(reposPath string) (map[string]*MirrorCredentials, error) {
+	var file struct {
+		Credentials map[string]*MirrorCredentials `json:"credentials"`
+	}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(reposPath), mirrorCredentialsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", mirrorCredentialsFile, err)
+	}
+	return file.Credentials, nil
+}
+
+// mirrorAuth returns the credentials a target authenticates with, decrypted
+func mirrorAuth(reposPath string, t *MirrorTarget) (*MirrorCredentials, error) {
+	creds := &MirrorCredentials{Token: t.Token}
+	if t.Credentials != "" {
+		all, err := loadMirrorCredentials(reposPath)
+		if err != nil {
+			return nil, err
+		}
+		named, ok := all[t.Credentials]
+		if !ok {
+			return nil, fmt.Errorf("unknown mirror credentials: %s", t.Credentials)
+		}
+		c := *named
+		creds = &c
+	}
+	if err := decryptSecrets(&creds.Token); err != nil {
+		return nil, fmt.Errorf("mirror token: %w", err)
+	}
+	if creds.Username == "" {
+		creds.Username = mirrorProvider(t.Provider).TokenUser
+	}
+	return creds, nil
+}
+
+// pullMirrorURL returns the upstream of a repository that is an active pull mirror, without
+// credentials, or ""
+func pullMirrorURL(repoPath string) string {
+	cfg, err := loadMirrorConfig(repoPath)
+	if err != nil {
+		return ""
+	}
+	target := cfg.pullTarget()
+	if target == nil {
+		return ""
+	}
+	if u, err := url.Parse(target.URL); err == nil && u.User != nil {
+		u.User = nil
+		return u.String()
+	}
+	return target.URL
+}
+
+// loadMirrorStatuses reads the outcome of the last syncs of a repository's targets by name.
+// The status of the single mirror configured before targets goes to the target with its remote.
+func loadMirrorStatuses(repoPath string, cfg *MirrorConfig) map[string]*MirrorStatus {
+	var file struct {
+		Targets map[string]*MirrorStatus `json:"targets"`
+		MirrorStatus
+	}
+	data, err := os.ReadFile(filepath.Join(repoPath, mirrorStatusFile))
+	if err != nil || json.Unmarshal(data, &file) != nil {
+		return make(map[string]*MirrorStatus)
+	}
+	if file.Targets == nil {
+		file.Targets = make(map[string]*MirrorStatus)
+		for _, t := range cfg.Targets {
+			if file.Remote != "" && t.URL == file.Remote {
+				status := file.MirrorStatus
+				status.Target = t.Name
+				file.Targets[t.Name] = &status
+				break
+			}
+		}
+	}
+	return file.Targets
+}
+
+// saveMirrorStatuses writes the outcome of the last syncs of a repository's targets
+func saveMirrorStatuses(repoPath string, statuses map[string]*MirrorStatus) error {
+	data, err := json.MarshalIndent(map[string]interface{}{"targets": statuses}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(repoPath, mirrorStatusFile), data, 0644)
+}
+
+// mirrorJob identifies the schedule of a repository's target
+type mirrorJob struct {
+	repo, target string
+}
+
+// Mirrors syncs repositories with their mirror targets after pushes and on schedule
+type Mirrors struct {
+	reposPath string
+
+	mu      sync.Mutex
+	running map[string]bool
+	pending map[string]*time.Timer // Syncs waiting for refs to settle after a push
+	jobs    map[mirrorJob]*scheduledJob
+}
+
+// NewMirrors creates the mirrors of the repositories in reposPath
+func NewMirrors(reposPath string) *Mirrors {
+	return &Mirrors{
+		reposPath: reposPath,
+		running:   make(map[string]bool),
+		pending:   make(map[string]*time.Timer),
+		jobs:      make(map[mirrorJob]*scheduledJob),
+	}
+}
+
+// Run migrates the mirror configs written before targets, then syncs the targets whose
+// schedules are due, it never returns. Changes to the configs are picked up within interval.
+func (m *Mirrors) Run(interval time.Duration) {
+	migrateMirrorConfigs(m.reposPath)
+	for {
+		m.tick(time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// tick runs the syncs that are due, one target after the other
+func (m *Mirrors) tick(now time.Time) {
+	repos, err := ListRepos(m.reposPath, true)
+	if err != nil {
+		log.Printf("Mirror: listing repositories: %v", err)
+		return
+	}
+
+	var due []mirrorJob
+	m.mu.Lock()
+	configured := make(map[mirrorJob]bool)
+	for _, repo := range repos {
+		cfg, err := loadMirrorConfig(filepath.Join(m.reposPath, repo.Name+".git"))
+		if err != nil {
+			continue
+		}
+		for _, t := range cfg.Targets {
+			if !t.active() || (repo.IsArchived && t.pull()) {
+				continue
+			}
+			key := mirrorJob{repo.Name, t.Name}
+			configured[key] = true
+			job, ok := m.jobs[key]
+			if !ok {
+				job = &scheduledJob{}
+				m.jobs[key] = job
+			}
+			ok, err = job.due(t.schedule(), now)
+			if err != nil {
+				log.Printf("Mirror %s of %s: %v", t.Name, repo.Name, err)
+			}
+			if ok {
+				due = append(due, key)
+			}
+		}
+	}
+	for key := range m.jobs {
+		if !configured[key] {
+			delete(m.jobs, key)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, job := range due {
+		if _, err := m.Sync(context.Background(), job.repo, job.target, "schedule"); err != nil && !errors.Is(err, ErrMirrorRunning) {
+			log.Printf("Mirror of %s failed: %v", job.repo, err)
+		}
+	}
+}
+
+// Next returns when a repository's target is synced next on schedule, or the zero time
+func (m *Mirrors) Next(repoName, target string) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if job, ok := m.jobs[mirrorJob{repoName, target}]; ok {
+		return job.next
+	}
+	return time.Time{}
+}
+
+// Running reports whether a repository's mirrors are being synced
+func (m *Mirrors) Running(repoName string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.running[repoName]
+}
+
+// Notify pushes the repository at repoPath to its push targets once its refs stop changing,
+// it's called whenever they change
+func (m *Mirrors) Notify(repoPath string) {
+	rel, err := filepath.Rel(m.reposPath, repoPath)
+	if err != nil || !strings.HasSuffix(rel, ".git") {
+		return
+	}
+	repoName := strings.TrimSuffix(filepath.ToSlash(rel), ".git")
+	cfg, err := loadMirrorConfig(repoPath)
+	if err != nil || !slices.ContainsFunc(cfg.Targets, func(t *MirrorTarget) bool { return t.active() && !t.pull() }) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if timer, ok := m.pending[repoName]; ok {
+		timer.Reset(mirrorPushDelay)
+		return
+	}
+	m.pending[repoName] = time.AfterFunc(mirrorPushDelay, func() {
+		m.mu.Lock()
+		delete(m.pending, repoName)
+		m.mu.Unlock()
+
+		_, err := m.sync(context.Background(), repoName, "push", func(t *MirrorTarget) bool { return !t.pull() })
+		if errors.Is(err, ErrMirrorRunning) {
+			// The running sync may have missed the push
+			m.Notify(repoPath)
+		} else if err != nil {
+			log.Printf("Mirror of %s failed: %v", repoName, err)
+		}
+	})
+}
+
+// Sync syncs a repository with one of its active targets, or every one if target is empty,
+// and returns their outcomes
+func (m *Mirrors) Sync(ctx context.Context, repoName, target, trigger string) ([]*MirrorStatus, error) {
+	return m.sync(ctx, repoName, trigger, func(t *MirrorTarget) bool {
+		return target == "" || t.Name == target
+	})
+}
+
+// sync syncs a repository with the active targets selected, pull targets first so push
+// targets get what was fetched. Every branch and tag a target mirrors is pushed to it or
+// fetched from it, and those the other side doesn't have anymore are deleted.
+func (m *Mirrors) sync(ctx context.Context, repoName, trigger string, selected func(t *MirrorTarget) bool) ([]*MirrorStatus, error) {
+	m.mu.Lock()
+	if m.running[repoName] {
+		m.mu.Unlock()
+		return nil, ErrMirrorRunning
+	}
+	m.running[repoName] = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.running, repoName)
+		m.mu.Unlock()
+	}()
+
+	repoPath := filepath.Join(m.reposPath, repoName+".git")
+	cfg, err := loadMirrorConfig(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	// Archived repositories still push to their targets but don't fetch anymore
+	archived := IsArchivedRepo(repoPath)
+	var targets []*MirrorTarget
+	for _, t := range cfg.Targets {
+		if t.active() && selected(t) && !(archived && t.pull()) {
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) == 0 && archived {
+		return nil, errArchived
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no mirror target to sync")
+	}
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].pull() && !targets[j].pull() })
+
+	statuses := loadMirrorStatuses(repoPath, cfg)
+	var results []*MirrorStatus
+	var errs []error
+	for _, t := range targets {
+		status := statuses[t.Name]
+		if status == nil || status.Remote != t.URL {
+			status = &MirrorStatus{Target: t.Name, Remote: t.URL}
+			statuses[t.Name] = status
+		}
+		status.Trigger = trigger
+		status.LastAttempt = time.Now()
+
+		updated, err := syncMirrorTarget(ctx, m.reposPath, repoPath, t)
+		status.Duration = time.Since(status.LastAttempt).Milliseconds()
+		if err != nil {
+			status.LastError = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+		} else {
+			status.LastSuccess, status.LastError, status.Updated = status.LastAttempt, "", updated
+		}
+		results = append(results, status)
+	}
+
+	// Drop the outcomes of removed targets
+	for name := range statuses {
+		if cfg.target(name) == nil {
+			delete(statuses, name)
+		}
+	}
+	if err := saveMirrorStatuses(repoPath, statuses); err != nil {
+		log.Printf("Mirror of %s: saving status: %v", repoName, err)
+	}
+	return results, errors.Join(errs...)
+}
+
+// syncMirrorTarget pushes a repository to a target or fetches it from a pull target, and
+// returns the number of refs changed
+func syncMirrorTarget(ctx context.Context, reposPath, repoPath string, t *MirrorTarget) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, mirrorTimeout)
+	defer cancel()
+
+	// Targets saved before URLs were checked could point at the server's own disk
+	if _, _, err := parseRemoteURL(t.URL, false); err != nil {
+		return 0, err
+	}
+	creds, err := mirrorAuth(reposPath, t)
+	if err != nil {
+		return 0, err
+	}
+	env := mirrorGitEnv(creds)
+
+	local, err := listRefs(ctx, repoPath)
+	if err != nil {
+		return 0, fmt.Errorf("listing refs: %w", err)
+	}
+	remote, head, err := lsRemote(ctx, repoPath, t.URL, env)
+	if err != nil {
+		return 0, err
+	}
+	if t.pull() {
+		return fetchMirror(ctx, repoPath, t, env, local, remote, head)
+	}
+	return pushMirror(ctx, repoPath, t, env, local, remote)
+}
+
+// lsRemote lists the refs of a remote and the branch its HEAD points at, if it says
+func lsRemote(ctx context.Context, repoPath, remote string, env []string) (map[string]string, string, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "ls-remote", "--symref", "--", remote)
+	cmd.Env = env
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, "", fmt.Errorf("git ls-remote: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	refs := make(map[string]string)
+	var head string
+	for _, line := range strings.Split(string(out), "\n") {
+		oid, name, ok := strings.Cut(line, "\t")
+		if !ok || strings.HasSuffix(name, "^{}") {
+			continue
+		}
+		if target, ok := strings.CutPrefix(oid, "ref: "); ok {
+			if name == "HEAD" {
+				head = target
+			}
+			continue
+		}
+		refs[name] = oid
+	}
+	return refs, head, nil
+}
+
+// pushMirror force-pushes the refs a target mirrors that it doesn't have, and deletes those
+// it mirrors that the repository doesn't have
+func pushMirror(ctx context.Context, repoPath string, t *MirrorTarget, env []string, local, remote map[string]string) (int, error) {
+	var specs []string
+	for ref, oid := range local {
+		if t.matches(ref) && remote[ref] != oid {
+			specs = append(specs, "+"+ref+":"+ref)
+		}
+	}
+	for ref := range remote {
+		if _, ok := local[ref]; !ok && t.matches(ref) {
+			specs = append(specs, ":"+ref)
+		}
+	}
+	if len(specs) == 0 {
+		return 0, nil
+	}
+	sort.Strings(specs)
+
+	args := append([]string{"-C", repoPath, "push", "--porcelain", "--", t.URL}, specs...)
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = env
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("git push: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return len(specs), nil
+}
+
+// fetchMirror makes the refs a pull target mirrors those of the remote, and points HEAD at
+// the remote's default branch if it's mirrored
+func fetchMirror(ctx context.Context, repoPath string, t *MirrorTarget, env []string, local, remote map[string]string, head string) (int, error) {
+	var specs []string
+	for ref, oid := range remote {
+		if t.matches(ref) && local[ref] != oid {
+			specs = append(specs, "+"+ref+":"+ref)
+		}
+	}
+	if len(specs) > 0 {
+		sort.Strings(specs)
+		args := append([]string{"-C", repoPath, "fetch", "--quiet", "--no-tags", "--", t.URL}, specs...)
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		os.Remove(filepath.Join(repoPath, "FETCH_HEAD"))
+		if err != nil {
+			return 0, fmt.Errorf("git fetch: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	var deletes strings.Builder
+	deleted := 0
+	for ref := range local {
+		if _, ok := remote[ref]; !ok && t.matches(ref) {
+			fmt.Fprintf(&deletes, "delete %s\n", ref)
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "update-ref", "--stdin")
+		cmd.Stdin = strings.NewReader(deletes.String())
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return 0, fmt.Errorf("git update-ref: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	// Follow the upstream's default branch, remotes that don't advertise it keep ours
+	if _, ok := remote[head]; ok && t.matches(head) {
+		current, _ := exec.CommandContext(ctx, "git", "-C", repoPath, "symbolic-ref", "HEAD").Output()
+		if strings.TrimSpace(string(current)) != head {
+			if out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "symbolic-ref", "HEAD", head).CombinedOutput(); err != nil {
+				return 0, fmt.Errorf("git symbolic-ref: %v: %s", err, strings.TrimSpace(string(out)))
+			}
+		}
+	}
+	return len(specs) + deleted, nil
+}
+
+// mirrorGitEnv is the environment of git commands talking to mirror remotes: never prompting,
+// authenticating over SSH with the credentials' key or the server's, and over HTTPS with the
+// credentials' token if set
+func mirrorGitEnv(creds *MirrorCredentials) []string {
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	key := creds.SSHKey
+	if key == "" && sshKeyExists() {
+		key = getSSHKeyPath()
+	}
+	if key != "" {
+		quoted := "'" + strings.ReplaceAll(key, "'", `'\''`) + "'"
+		env = append(env, "GIT_SSH_COMMAND=ssh -i "+quoted+" -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=accept-new")
+	}
+	if creds.Token != "" {
+		// Passed in the environment rather than the command line, which other users can see
+		auth := base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Token))
+		env = append(env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader", "GIT_CONFIG_VALUE_0=Authorization: Basic "+auth)
+	}
+	return env
+}
+
+// parseMirrorForm reads the mirror targets from the repository settings form, existing if
+// it has none. Each target's fields are suffixed with its index, mirror_count of them. Tokens left empty are kept from
+// existing, a target named mirror_orig before being renamed keeps its token too.
+func parseMirrorForm(r *http.Request, existing *MirrorConfig, credentials map[string]*MirrorCredentials) (*MirrorConfig, error) {
+	if r.FormValue("mirror_count") == "" {
+		return existing, nil
+	}
+	cfg := &MirrorConfig{}
+	count, _ := strconv.Atoi(r.FormValue("mirror_count"))
+	pulls := 0
+	for i := 0; i < count; i++ {
+		field := func(name string) string {
+			return strings.TrimSpace(r.FormValue(fmt.Sprintf("mirror_%s_%d", name, i)))
+		}
+		if field("remove") == "on" || field("url") == "" {
+			continue
+		}
+
+		t := &MirrorTarget{
+			Name:        field("name"),
+			Enabled:     field("enabled") == "on",
+			Direction:   "push",
+			Provider:    mirrorProvider(field("provider")).Name,
+			URL:         field("url"),
+			Credentials: field("credentials"),
+			Token:       field("token"),
+			Schedule:    field("schedule"),
+		}
+		if field("direction") == "pull" {
+			t.Direction = "pull"
+		}
+		for _, filter := range strings.FieldsFunc(field("refs"), func(r rune) bool { return r == ',' || r == ' ' }) {
+			if _, err := path.Match(refPattern(filter), ""); err != nil {
+				return nil, fmt.Errorf("invalid ref filter %q", filter)
+			}
+			t.Refs = append(t.Refs, filter)
+		}
+
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("mirror-%d", i+1)
+		}
+		if !mirrorTargetName.MatchString(t.Name) {
+			return nil, fmt.Errorf("invalid mirror name %q, use letters, digits, '.', '_' and '-'", t.Name)
+		}
+		remote, password, err := parseRemoteURL(t.URL, false)
+		if err != nil {
+			return nil, fmt.Errorf("mirror %s: %w", t.Name, err)
+		}
+		t.URL = remote
+		if password != "" && t.Token == "" {
+			t.Token = password
+		}
+		if cfg.target(t.Name) != nil {
+			return nil, fmt.Errorf("two mirrors are named %s", t.Name)
+		}
+		if t.Schedule != "" {
+			if _, err := ParseSchedule(t.Schedule); err != nil {
+				return nil, fmt.Errorf("mirror %s: invalid schedule: %w", t.Name, err)
+			}
+		}
+		if t.Credentials != "" {
+			if _, ok := credentials[t.Credentials]; !ok {
+				return nil, fmt.Errorf("mirror %s: unknown credentials %s", t.Name, t.Credentials)
+			}
+		}
+		if t.active() && t.pull() {
+			if pulls++; pulls > 1 {
+				return nil, errors.New("only one mirror can be pulled from")
+			}
+		}
+
+		if t.Token == "" {
+			if old := existing.target(field("orig")); old != nil {
+				t.Token = old.Token
+			}
+		} else {
+			var err error
+			if t.Token, err = secretStore.Encrypt(t.Token); err != nil {
+				return nil, fmt.Errorf("encrypting the mirror token: %w", err)
+			}
+		}
+		cfg.Targets = append(cfg.Targets, t)
+	}
+	return cfg, nil
+}
+
+// mirrorTargetViews returns the targets of a repository with their outcomes and next
+// scheduled syncs, then a blank one, for the settings page
+func (m *Mirrors) mirrorTargetViews(repoName string, cfg *MirrorConfig) []map[string]interface{} {
+	statuses := loadMirrorStatuses(filepath.Join(m.reposPath, repoName+".git"), cfg)
+	var views []map[string]interface{}
+	for _, t := range cfg.Targets {
+		views = append(views, map[string]interface{}{
+			"Target":   t,
+			"Active":   t.active(),
+			"Pull":     t.pull(),
+			"Refs":     strings.Join(t.Refs, ", "),
+			"HasToken": t.Token != "",
+			"Provider": mirrorProvider(t.Provider),
+			"Status":   statuses[t.Name],
+			"Next":     m.Next(repoName, t.Name),
+		})
+	}
+
+	// A blank target to add one
+	blank := &MirrorTarget{Enabled: true, Direction: "push", Provider: "github"}
+	return append(views, map[string]interface{}{
+		"Target":   blank,
+		"New":      true,
+		"Provider": mirrorProvider(blank.Provider),
+	})
+}
+
+// handleMirrorSyncPost syncs a repository with one of its targets, or every one, in the
+// background (tailnet only)
+func (s *Server) handleMirrorSyncPost(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied - Tailnet required", http.StatusForbidden)
+		return
+	}
+
+	repoName := repoParam(r)
+	if !RepoExists(s.reposPath, repoName) {
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+	target := r.FormValue("target")
+	cfg, err := loadMirrorConfig(filepath.Join(s.reposPath, repoName+".git"))
+	if err != nil || (target != "" && cfg.target(target) == nil) {
+		http.Error(w, "Mirror not found", http.StatusNotFound)
+		return
+	}
+	if s.mirrors.Running(repoName) {
+		http.Error(w, ErrMirrorRunning.Error(), http.StatusConflict)
+		return
+	}
+
+	go func() {
+		if _, err := s.mirrors.Sync(context.Background(), repoName, target, "manual"); err != nil {
+			log.Printf("Mirror of %s failed: %v", repoName, err)
+		}
+	}()
+
+	// Redirect back to referrer
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		referer = "/" + repoName + "/settings"
+	}
+	http.Redirect(w, r, referer, http.StatusFound)
+}
+
+// handleAPIMirrorSync syncs a repository with the target named by ?target=, or every one,
+// and returns the outcomes (tailnet only)
+func (s *Server) handleAPIMirrorSync(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "Access denied - Tailnet required"})
+		return
+	}
+
+	repoName := repoParam(r)
+	if !RepoExists(s.reposPath, repoName) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Repository not found"})
+		return
+	}
+
+	statuses, err := s.mirrors.Sync(r.Context(), repoName, r.URL.Query().Get("target"), "manual")
+	switch {
+	case errors.Is(err, ErrMirrorRunning):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case statuses == nil:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusBadGateway, statuses)
+	default:
+		writeJSON(w, http.StatusOK, statuses)
+	}
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+const (
+	// repoTemplateFile marks a repository new ones can be created from, like
+	// git-daemon-export-ok marks public ones
+	repoTemplateFile = "git-template"
+
+	// defaultInitialBranch is the branch the initial commit of a new repository goes to
+	defaultInitialBranch = "main"
+)
+
+// RepoFileTemplate is a .gitignore or license a new repository can start with
+type RepoFileTemplate struct {
+	Name  string
+	Label string
+	Text  string // Licenses hold [year] and [fullname] placeholders
+}
+
+// gitignoreTemplates are the .gitignore files offered for new repositories
+var gitignoreTemplates = []RepoFileTemplate{
+	{Name: "go", Label: "Go", Text: `# Binaries
+*.exe
+*.exe~
+*.dll
+*.so
+*.dylib
+
+# Test binaries and coverage
+*.test
+*.out
+coverage.*
+
+# Dependency directories
+vendor/
+
+# Workspace files
+go.work
+go.work.sum
+`},
+	{Name: "node", Label: "Node", Text: `# Dependencies
+node_modules/
+
+# Logs
+logs/
+*.log
+npm-debug.log*
+yarn-debug.log*
+yarn-error.log*
+
+# Build output
+dist/
+build/
+coverage/
+
+# Environment
+.env
+.env.local
+`},
+	{Name: "python", Label: "Python", Text: `# Byte-compiled files
+__pycache__/
+*.py[cod]
+
+# Distribution and packaging
+build/
+dist/
+*.egg-info/
+
+# Virtual environments
+.venv/
+venv/
+env/
+
+# Test and coverage reports
+.pytest_cache/
+.coverage
+htmlcov/
+
+# Environment
+.env
+`},
+	{Name: "rust", Label: "Rust", Text: `# Build output
+target/
+
+# Backup files from rustfmt
+**/*.rs.bk
+
+# Debugging information
+*.pdb
+`},
+	{Name: "java", Label: "Java", Text: `# Compiled classes and archives
+*.class
+*.jar
+*.war
+*.ear
+
+# Build output
+target/
+build/
+.gradle/
+
+# Logs
+*.log
+
+# IDE files
+.idea/
+*.iml
+`},
+	{Name: "c", Label: "C / C++", Text: `# Object files
+*.o
+*.obj
+
+# Libraries
+*.a
+*.lib
+*.so
+*.dylib
+*.dll
+
+# Executables
+*.exe
+*.out
+a.out
+
+# Build directories
+build/
+`},
+}
+
+// repoLicenses are the licenses offered for new repositories
+var repoLicenses = []RepoFileTemplate{
+	{Name: "mit", Label: "MIT License", Text: `MIT License
+
+Copyright (c) [year] [fullname]
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+`},
+	{Name: "bsd-2-clause", Label: "BSD 2-Clause License", Text: `BSD 2-Clause License
+
+Copyright (c) [year], [fullname]
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+`},
+	{Name: "bsd-3-clause", Label: "BSD 3-Clause License", Text: `BSD 3-Clause License
+
+Copyright (c) [year], [fullname]
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its
+   contributors may be used to endorse or promote products derived from
+   this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+`},
+	{Name: "isc", Label: "ISC License", Text: `ISC License
+
+Copyright (c) [year], [fullname]
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted, provided that the above
+copyright notice and this permission notice appear in all copies.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+`},
+	{Name: "unlicense", Label: "The Unlicense", Text: `This is free and unencumbered software released into the public domain.
+
+Anyone is free to copy, modify, publish, use, compile, sell, or
+distribute this software, either in source code form or as a compiled
+binary, for any purpose, commercial or non-commercial, and by any
+means.
+
+In jurisdictions that recognize copyright laws, the author or authors
+of this software dedicate any and all copyright interest in the
+software to the public domain. We make this dedication for the benefit
+of the public at large and to the detriment of our heirs and
+successors. We intend this dedication to be an overt act of
+relinquishment in perpetuity of all present and future rights to this
+software under copyright law.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+OTHER DEALINGS IN THE SOFTWARE.
+
+For more information, please refer to <https://unlicense.org>
+`},
+}
+
+// fileTemplate returns the template with a name, or nil
+func fileTemplate(templates []RepoFileTemplate, name string) *RepoFileTemplate {
+	for i := range templates {
+		if templates[i].Name == name {
+			return &templates[i]
+		}
+	}
+	return nil
+}
+
+// IsTemplateRepo checks if a repository is marked as a template
+func IsTemplateRepo(repoPath string) bool {
+	_, err := os.Stat(filepath.Join(repoPath, repoTemplateFile))
+	return err == nil
+}
+
+// setTemplateRepo marks a repository as a template or unmarks it
+func setTemplateRepo(repoPath string, template bool) error {
+	path := filepath.Join(repoPath, repoTemplateFile)
+	if template {
+		return os.WriteFile(path, []byte{}, 0644)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListTemplateRepos returns the names of the repositories marked as templates
+func ListTemplateRepos(reposPath string) []string {
+	repos, err := ListRepos(reposPath, true)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, repo := range repos {
+		if repo.IsTemplate {
+			names = append(names, repo.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RepoInit describes the initial commit of a new repository
+type RepoInit struct {
+	Template  string // Repository whose files the commit starts with
+	Readme    bool
+	Gitignore *RepoFileTemplate
+	License   *RepoFileTemplate
+	Branch    string
+	Author    object.Signature
+}
+
+// parseRepoInit reads the initial commit from the new repository form, nil if the repository
+// starts empty
+func parseRepoInit(r *http.Request, reposPath string) (*RepoInit, error) {
+	initial := &RepoInit{
+		Template: strings.TrimSpace(r.FormValue("template")),
+		Readme:   r.FormValue("init_readme") == "on",
+		Branch:   defaultInitialBranch,
+		Author:   commitAuthor(r),
+	}
+	if name := r.FormValue("init_gitignore"); name != "" {
+		if initial.Gitignore = fileTemplate(gitignoreTemplates, name); initial.Gitignore == nil {
+			return nil, fmt.Errorf("unknown .gitignore template %q", name)
+		}
+	}
+	if name := r.FormValue("init_license"); name != "" {
+		if initial.License = fileTemplate(repoLicenses, name); initial.License == nil {
+			return nil, fmt.Errorf("unknown license %q", name)
+		}
+	}
+	if initial.Template != "" {
+		if !RepoExists(reposPath, initial.Template) || !IsTemplateRepo(filepath.Join(reposPath, initial.Template+".git")) {
+			return nil, fmt.Errorf("%s is not a template repository", initial.Template)
+		}
+	}
+	if initial.Template == "" && !initial.Readme && initial.Gitignore == nil && initial.License == nil {
+		return nil, nil
+	}
+	return initial, nil
+}
+
+// commitAuthor returns who commits made from the web are authored by. Tailscale Serve passes
+// the user's name and login, otherwise the identity of lockOwner is used.
+func commitAuthor(r *http.Request) object.Signature {
+	owner := lockOwner(r)
+	name := owner
+	if tailscaleUserLogin(r) != "" && r.Header.Get("Tailscale-User-Name") != "" {
+		name = r.Header.Get("Tailscale-User-Name")
+	}
+	email := owner
+	if !strings.Contains(email, "@") {
+		email = owner + "@gitraf"
+	}
+	return object.Signature{Name: name, Email: email, When: time.Now()}
+}
+
+// initRepo writes the initial commit of a new repository directly into its object storage
+// and points the initial branch and HEAD at it. The commit starts with the files of the
+// template's default branch, the README, .gitignore and license are added unless the
+// template has them. LFS objects the template's files point to are copied too.
+func initRepo(ctx context.Context, reposPath, repoName, description string, initial *RepoInit) error {
+	repo, err := git.PlainOpen(filepath.Join(reposPath, repoName+".git"))
+	if err != nil {
+		return err
+	}
+
+	var entries []object.TreeEntry
+	message := "Initial commit"
+	if initial.Template != "" {
+		if entries, err = copyTemplateTree(ctx, reposPath, initial.Template, repoName, repo.Storer); err != nil {
+			return fmt.Errorf("copying template %s: %w", initial.Template, err)
+		}
+		message = "Initial commit from template " + initial.Template
+	}
+
+	var files []object.TreeEntry
+	add := func(name, content string) error {
+		for _, entry := range entries {
+			if entry.Name == name {
+				return nil
+			}
+		}
+		hash, err := storeBlob(repo.Storer, []byte(content))
+		if err != nil {
+			return err
+		}
+		files = append(files, object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: hash})
+		return nil
+	}
+	if initial.Readme {
+		readme := "# " + repoName + "\n"
+		if description != "" {
+			readme += "\n" + description + "\n"
+		}
+		if err := add("README.md", readme); err != nil {
+			return err
+		}
+	}
+	if initial.Gitignore != nil {
+		if err := add(".gitignore", initial.Gitignore.Text); err != nil {
+			return err
+		}
+	}
+	if initial.License != nil {
+		license := strings.NewReplacer("[year]", strconv.Itoa(initial.Author.When.Year()), "[fullname]", initial.Author.Name).Replace(initial.License.Text)
+		if err := add("LICENSE", license); err != nil {
+			return err
+		}
+	}
+	entries = append(entries, files...)
+
+	tree, err := storeTree(repo.Storer, entries)
+	if err != nil {
+		return err
+	}
+	commit := &object.Commit{
+		Author:    initial.Author,
+		Committer: initial.Author,
+		Message:   message + "\n",
+		TreeHash:  tree,
+	}
+	obj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return err
+	}
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+
+	branch := plumbing.NewBranchReferenceName(initial.Branch)
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, hash)); err != nil {
+		return err
+	}
+	return repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch))
+}
+
+// storeBlob writes a blob into an object storage
+func storeBlob(s storer.EncodedObjectStorer, content []byte) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := w.Write(content); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+// storeTree writes a tree into an object storage, its entries sorted the way git does
+func storeTree(s storer.EncodedObjectStorer, entries []object.TreeEntry) (plumbing.Hash, error) {
+	sortKey := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool { return sortKey(entries[i]) < sortKey(entries[j]) })
+
+	obj := s.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+// copyTemplateTree copies the files of a template's default branch into an object storage and
+// returns the entries of its root tree, which is left to be written with the files added to
+// it. Submodules are kept as they are, pointing to commits
+// of other repositories.
+func copyTemplateTree(ctx context.Context, reposPath, template, repoName string, dst storer.EncodedObjectStorer) ([]object.TreeEntry, error) {
+	src, err := git.PlainOpen(filepath.Join(reposPath, template+".git"))
+	if err != nil {
+		return nil, err
+	}
+	head, err := src.Head()
+	if err != nil {
+		return nil, errors.New("template repository is empty")
+	}
+	commit, err := src.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	var copyTree func(hash plumbing.Hash) error
+	copyTree = func(hash plumbing.Hash) error {
+		tree, err := src.TreeObject(hash)
+		if err != nil {
+			return err
+		}
+		for _, entry := range tree.Entries {
+			if entry.Mode == filemode.Submodule || seen[entry.Hash] {
+				continue
+			}
+			seen[entry.Hash] = true
+			if entry.Mode == filemode.Dir {
+				if err := copyTree(entry.Hash); err != nil {
+					return err
+				}
+			}
+			if err := copyObject(src.Storer, dst, entry.Hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := copyTree(commit.TreeHash); err != nil {
+		return nil, err
+	}
+
+	pointers := make(map[string]int64)
+	if err := collectTreePointers(src, commit.TreeHash, make(map[plumbing.Hash]bool), pointers); err != nil {
+		return nil, err
+	}
+	if len(pointers) > 0 {
+		copyTemplateLFS(ctx, reposPath, template, repoName, pointers)
+	}
+
+	tree, err := src.TreeObject(commit.TreeHash)
+	if err != nil {
+		return nil, err
+	}
+	return append([]object.TreeEntry(nil), tree.Entries...), nil
+}
+
+// copyObject copies an object between object storages
+func copyObject(src, dst storer.EncodedObjectStorer, hash plumbing.Hash) error {
+	obj, err := src.EncodedObject(plumbing.AnyObject, hash)
+	if err != nil {
+		return err
+	}
+	r, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	copied := dst.NewEncodedObject()
+	copied.SetType(obj.Type())
+	w, err := copied.Writer()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	_, err = dst.SetEncodedObject(copied)
+	return err
+}
+
+// copyTemplateLFS copies the LFS objects a template's files point to into the storage of a
+// new repository. Objects that can't be copied are logged, the files still are.
+func copyTemplateLFS(ctx context.Context, reposPath, template, repoName string, pointers map[string]int64) {
+	src, _, err := openRepoLFSStorage(ctx, reposPath, template)
+	if err != nil {
+		log.Printf("Template %s: LFS objects not copied to %s: %v", template, repoName, err)
+		return
+	}
+	dst, _, err := openRepoLFSStorage(ctx, reposPath, repoName)
+	if err != nil {
+		log.Printf("Template %s: LFS objects not copied to %s: %v", template, repoName, err)
+		return
+	}
+	for oid, size := range pointers {
+		if err := copyLFSObject(ctx, src, lfsObjectKey(template, oid), dst, lfsObjectKey(repoName, oid), size); err != nil {
+			log.Printf("Template %s: LFS object %s not copied to %s: %v", template, oid, repoName, err)
+		}
+	}
+}
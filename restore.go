@@ -0,0 +1,635 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// errRestoreExists means a repository or config being restored already exists
+var errRestoreExists = errors.New("already exists, restore with overwrite to replace it")
+
+// RestoreRequest says what to restore from a snapshot
+type RestoreRequest struct {
+	Snapshot  string // Snapshot ID, or "latest"
+	Repo      string // Repository to restore, empty for every repository and the server configs
+	As        string // Name to restore Repo as, empty for its own
+	Overwrite bool   // Replace repositories and configs that exist
+}
+
+// RestoreReport describes a restore
+type RestoreReport struct {
+	Snapshot   string    `json:"snapshot"`
+	Repo       string    `json:"repo,omitempty"` // Empty for the whole server
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Restored   []string  `json:"restored"`
+	Skipped    []string  `json:"skipped,omitempty"` // Exist and weren't overwritten
+	Files      []string  `json:"files,omitempty"`   // Server configs
+	LFSObjects int       `json:"lfs_objects"`
+	Errors     []string  `json:"errors,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// BackupVerification is the result of restoring a snapshot into a temporary directory and
+// checking every repository with git fsck
+type BackupVerification struct {
+	Snapshot   string    `json:"snapshot"`
+	Verified   time.Time `json:"verified"`
+	Repos      int       `json:"repos"`
+	LFSObjects int       `json:"lfs_objects"`
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+// resolveSnapshot returns the manifest of a snapshot, "latest" being the newest complete one
+func resolveSnapshot(ctx context.Context, storage LFSStorage, id string) (*BackupManifest, error) {
+	if id == "latest" {
+		snapshots, err := listBackupSnapshots(ctx, storage)
+		if err != nil {
+			return nil, err
+		}
+		i := slices.IndexFunc(snapshots, func(s BackupSnapshot) bool { return s.Complete })
+		if i < 0 {
+			return nil, errors.New("no complete snapshot in the backup bucket")
+		}
+		id = snapshots[i].ID
+	}
+	if _, err := time.Parse(backupIDFormat, id); err != nil {
+		return nil, fmt.Errorf("invalid snapshot ID: %s", id)
+	}
+	manifest, err := loadBackupManifest(ctx, storage, id)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("snapshot %s not found or incomplete", id)
+	}
+	return manifest, err
+}
+
+// Restore restores a repository, under its own name or another, or every repository and the
+// server configs from a snapshot. Existing ones are only replaced with req.Overwrite.
+func (b *Backups) Restore(ctx context.Context, req RestoreRequest) (*RestoreReport, error) {
+	if err := b.start("restore"); err != nil {
+		return nil, err
+	}
+	defer b.finish()
+
+	report := &RestoreReport{Snapshot: req.Snapshot, Repo: req.Repo, Started: time.Now(), Restored: []string{}}
+	err := b.restoreSnapshot(ctx, req, report)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.Finished = time.Now()
+
+	b.mu.Lock()
+	b.restore = report
+	b.mu.Unlock()
+	b.saveStatus()
+
+	if err == nil {
+		log.Printf("Restore from snapshot %s: %d repositories, %d LFS objects, %d skipped, %d errors",
+			report.Snapshot, len(report.Restored), report.LFSObjects, len(report.Skipped), len(report.Errors))
+	}
+	return report, err
+}
+
+// restoreSnapshot fills in a restore report
+func (b *Backups) restoreSnapshot(ctx context.Context, req RestoreRequest, report *RestoreReport) error {
+	storage, err := b.storage(ctx)
+	if err != nil {
+		return err
+	}
+	manifest, err := resolveSnapshot(ctx, storage, req.Snapshot)
+	if err != nil {
+		return err
+	}
+	report.Snapshot = manifest.ID
+	storage = snapshotStorage(storage, manifest)
+
+	// One repository, possibly under another name
+	if req.Repo != "" {
+		i := slices.IndexFunc(manifest.Repos, func(r BackupRepo) bool { return r.Name == req.Repo })
+		if i < 0 {
+			return fmt.Errorf("snapshot %s has no repository %s", manifest.ID, req.Repo)
+		}
+		target := req.Repo
+		if req.As != "" {
+			target = req.As
+		}
+		if !validRepoPath(target) {
+			return fmt.Errorf("invalid repository name: %s", target)
+		}
+		lfsObjects, err := b.restoreRepo(ctx, storage, manifest.ID, manifest.Repos[i], target, req.Overwrite)
+		if err != nil {
+			return fmt.Errorf("%s: %w", target, err)
+		}
+		report.Restored = append(report.Restored, target)
+		report.LFSObjects += lfsObjects
+		return nil
+	}
+
+	// The whole server: configs first, the LFS storage of repositories depends on them
+	dataDir := filepath.Dir(b.reposPath)
+	for _, name := range manifest.Files {
+		if !validBackupServerFile(name) {
+			report.Errors = append(report.Errors, "invalid server file: "+name)
+			continue
+		}
+		path := filepath.Join(dataDir, name)
+		if group, ok := strings.CutPrefix(name, backupGroupsPrefix); ok {
+			path = filepath.Join(b.reposPath, filepath.FromSlash(group))
+		}
+		if _, err := os.Stat(path); err == nil && !req.Overwrite {
+			report.Skipped = append(report.Skipped, name)
+			continue
+		}
+		// Group settings go in their group, which may not exist yet
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := getBackupFile(ctx, storage, backupSnapshotPrefix+manifest.ID+"/server/"+name, path, 0600); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		storageConfigs.Invalidate(path)
+		report.Files = append(report.Files, name)
+	}
+
+	for _, repo := range manifest.Repos {
+		if !validRepoPath(repo.Name) {
+			report.Errors = append(report.Errors, "invalid repository name: "+repo.Name)
+			continue
+		}
+		lfsObjects, err := b.restoreRepo(ctx, storage, manifest.ID, repo, repo.Name, req.Overwrite)
+		switch {
+		case errors.Is(err, errRestoreExists):
+			report.Skipped = append(report.Skipped, repo.Name)
+		case err != nil:
+			log.Printf("Restore: %s: %v", repo.Name, err)
+			report.Errors = append(report.Errors, repo.Name+": "+err.Error())
+		default:
+			report.Restored = append(report.Restored, repo.Name)
+			report.LFSObjects += lfsObjects
+		}
+	}
+	return nil
+}
+
+// validBackupServerFile reports whether a server file listed in a manifest is one backups
+// save, so a tampered manifest can't write anywhere else in the data directory
+func validBackupServerFile(name string) bool {
+	if group, ok := strings.CutPrefix(name, backupGroupsPrefix); ok {
+		dir, file := path.Split(group)
+		return file == groupConfigFile && validRepoPath(strings.TrimSuffix(dir, "/"))
+	}
+	return slices.Contains(backupServerFiles, name)
+}
+
+// restoreRepo restores a repository from snapshot id as target, then its LFS objects into
+// the storage target is configured with, and returns how many LFS objects were copied.
+// The repository is restored next to the others and only renamed into place once complete.
+func (b *Backups) restoreRepo(ctx context.Context, storage LFSStorage, id string, repo BackupRepo, target string, overwrite bool) (int, error) {
+	targetPath := filepath.Join(b.reposPath, target+".git")
+	exists := RepoExists(b.reposPath, target)
+	if exists && !overwrite {
+		return 0, errRestoreExists
+	}
+	if GroupExists(b.reposPath, target) {
+		return 0, fmt.Errorf("a group named %s exists", target)
+	}
+	if err := createRepoGroups(b.reposPath, target); err != nil {
+		return 0, err
+	}
+
+	// Not ending in .git keeps the directory out of the repository list
+	tmp, err := os.MkdirTemp(b.reposPath, ".restore-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+	restorePath := filepath.Join(tmp, "repo.git")
+	if err := restoreRepoTo(ctx, storage, id, repo, restorePath); err != nil {
+		return 0, err
+	}
+
+	if exists {
+		if err := os.Rename(targetPath, filepath.Join(tmp, "replaced.git")); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.Rename(restorePath, targetPath); err != nil {
+		if exists {
+			os.Rename(filepath.Join(tmp, "replaced.git"), targetPath)
+		}
+		return 0, err
+	}
+	repoCache.Invalidate(targetPath)
+
+	// Hooks aren't backed up, the lock hook comes back with the locks
+	if slices.Contains(repo.Files, lfsLocksFile) {
+		if err := installLockHook(targetPath); err != nil {
+			log.Printf("Restore: %s: %v", target, err)
+		}
+	}
+
+	return restoreLFSObjects(ctx, storage, b.reposPath, repo, target)
+}
+
+// fetchBundle fetches every ref of a bundle into the repository in dir, which has the
+// objects the bundle requires
+func fetchBundle(ctx context.Context, storage LFSStorage, key, dir string) error {
+	bundle, err := os.CreateTemp("", "gitraf-restore-*.bundle")
+	if err != nil {
+		return err
+	}
+	bundle.Close()
+	defer os.Remove(bundle.Name())
+	if err := getBackupFile(ctx, storage, key, bundle.Name(), 0600); err != nil {
+		return fmt.Errorf("downloading: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "-C", dir, "fetch", "--quiet", bundle.Name(), "+refs/*:refs/*")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git fetch: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.Remove(filepath.Join(dir, "FETCH_HEAD"))
+}
+
+// setRefs makes the refs of the repository in dir exactly refs
+func setRefs(ctx context.Context, dir string, refs map[string]string) error {
+	current, err := listRefs(ctx, dir)
+	if err != nil {
+		return err
+	}
+	var updates strings.Builder
+	for name := range current {
+		if _, ok := refs[name]; !ok {
+			fmt.Fprintf(&updates, "delete %s\n", name)
+		}
+	}
+	for name, oid := range refs {
+		if current[name] != oid {
+			fmt.Fprintf(&updates, "update %s %s\n", name, oid)
+		}
+	}
+	if updates.Len() == 0 {
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "-C", dir, "update-ref", "--stdin")
+	cmd.Stdin = strings.NewReader(updates.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git update-ref: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// restoreRepoTo recreates a repository from snapshot id in dir
+func restoreRepoTo(ctx context.Context, storage LFSStorage, id string, repo BackupRepo, dir string) error {
+	if err := CreateBareRepo(dir); err != nil {
+		return err
+	}
+
+	for _, key := range repo.Bundles {
+		if err := fetchBundle(ctx, storage, key, dir); err != nil {
+			return fmt.Errorf("%s: %w", path.Base(key), err)
+		}
+	}
+	// Bundles don't record deleted refs, nor refs moved to commits of earlier bundles
+	if repo.Refs != nil {
+		if err := setRefs(ctx, dir, repo.Refs); err != nil {
+			return err
+		}
+	}
+
+	// The saved HEAD and config replace the ones git created
+	prefix := backupRepoPrefix(id, repo.Name)
+	for _, name := range repo.Files {
+		if !slices.Contains(backupRepoFiles, name) {
+			return fmt.Errorf("invalid repository file: %s", name)
+		}
+		if err := getBackupFile(ctx, storage, prefix+"files/"+name, filepath.Join(dir, name), 0644); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// restoreLFSObjects copies the LFS objects of a repository in a snapshot to the storage of
+// target, skipping those it already has
+func restoreLFSObjects(ctx context.Context, storage LFSStorage, reposPath string, repo BackupRepo, target string) (int, error) {
+	if len(repo.LFSObjects) == 0 {
+		return 0, nil
+	}
+	lfs, _, err := openRepoLFSStorage(ctx, reposPath, target)
+	if err != nil {
+		return 0, fmt.Errorf("restoring %d LFS objects: %w", len(repo.LFSObjects), err)
+	}
+
+	copied := 0
+	for _, oid := range repo.LFSObjects {
+		src := backupLFSPrefix + lfsObjectKey(repo.Name, oid)
+		size, err := storage.Size(ctx, src)
+		if err != nil {
+			return copied, fmt.Errorf("LFS object %s: %w", oid, err)
+		}
+		dst := lfsObjectKey(target, oid)
+		if existing, err := lfs.Size(ctx, dst); err == nil && existing == size {
+			continue
+		}
+		if err := copyLFSObject(ctx, storage, src, lfs, dst, size); err != nil {
+			return copied, fmt.Errorf("LFS object %s: %w", oid, err)
+		}
+		copied++
+	}
+	return copied, nil
+}
+
+// getBackupFile downloads an object from the backup bucket to a file
+func getBackupFile(ctx context.Context, storage LFSStorage, key, filePath string, perm os.FileMode) error {
+	body, err := storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	tmp := filePath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filePath)
+}
+
+// VerifyAll verifies every complete snapshot in the bucket
+func (b *Backups) VerifyAll(ctx context.Context) error {
+	if err := b.start("verify"); err != nil {
+		return err
+	}
+	defer b.finish()
+
+	storage, err := b.storage(ctx)
+	if err != nil {
+		return err
+	}
+	snapshots, err := listBackupSnapshots(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		if !snapshot.Complete {
+			continue
+		}
+		verification := verifySnapshot(ctx, storage, snapshot.ID)
+		if len(verification.Errors) > 0 {
+			log.Printf("Backup verification of %s: %s", snapshot.ID, strings.Join(verification.Errors, "; "))
+		}
+		b.mu.Lock()
+		b.verified[snapshot.ID] = verification
+		b.mu.Unlock()
+	}
+	b.saveStatus()
+	return b.RefreshSnapshots(ctx)
+}
+
+// verifySnapshot restores every repository of a snapshot into a temporary directory, runs
+// git fsck on it and checks its LFS objects are in the bucket
+func verifySnapshot(ctx context.Context, storage LFSStorage, id string) *BackupVerification {
+	verification := &BackupVerification{Snapshot: id, Verified: time.Now()}
+	fail := func(format string, args ...any) {
+		verification.Errors = append(verification.Errors, fmt.Sprintf(format, args...))
+	}
+
+	manifest, err := loadBackupManifest(ctx, storage, id)
+	if err != nil {
+		fail("%v", err)
+		return verification
+	}
+	storage = snapshotStorage(storage, manifest)
+	tmp, err := os.MkdirTemp("", "gitraf-verify-")
+	if err != nil {
+		fail("%v", err)
+		return verification
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, repo := range manifest.Repos {
+		if !validRepoPath(repo.Name) {
+			fail("invalid repository name: %s", repo.Name)
+			continue
+		}
+		dir := filepath.Join(tmp, repo.Name+".git")
+		if err := restoreRepoTo(ctx, storage, id, repo, dir); err != nil {
+			fail("%s: %v", repo.Name, err)
+			continue
+		}
+		cmd := exec.CommandContext(ctx, "git", "-C", dir, "fsck", "--full", "--no-dangling", "--no-progress")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			fail("%s: git fsck: %v: %s", repo.Name, err, strings.TrimSpace(string(out)))
+			os.RemoveAll(dir)
+			continue
+		}
+		os.RemoveAll(dir)
+
+		missing := 0
+		for _, oid := range repo.LFSObjects {
+			if _, err := storage.Size(ctx, backupLFSPrefix+lfsObjectKey(repo.Name, oid)); err != nil {
+				missing++
+				continue
+			}
+			verification.LFSObjects++
+		}
+		if missing > 0 {
+			fail("%s: %d LFS objects missing", repo.Name, missing)
+			continue
+		}
+		verification.Repos++
+	}
+	return verification
+}
+
+// runBackupList prints the snapshots in the backup bucket, for the -backup-list command,
+// and returns the exit code
+func runBackupList(reposPath string, out io.Writer) int {
+	ctx := context.Background()
+	backups := NewBackups(reposPath)
+	storage, err := backups.storage(ctx)
+	if err != nil {
+		fmt.Fprintf(out, "opening backup storage: %v\n", err)
+		return 1
+	}
+	snapshots, err := listBackupSnapshots(ctx, storage)
+	if err != nil {
+		fmt.Fprintf(out, "listing snapshots: %v\n", err)
+		return 1
+	}
+
+	for _, snapshot := range snapshots {
+		state := fmt.Sprintf("%d repositories", len(snapshot.Repos))
+		if !snapshot.Complete {
+			state = "incomplete"
+		}
+		if v, ok := backups.verified[snapshot.ID]; ok {
+			if len(v.Errors) > 0 {
+				state += fmt.Sprintf(", verification failed %s", v.Verified.Format(time.DateTime))
+			} else {
+				state += fmt.Sprintf(", verified %s", v.Verified.Format(time.DateTime))
+			}
+		}
+		fmt.Fprintf(out, "%s  %s  %10d bytes  %s\n", snapshot.ID, snapshot.Started.Local().Format(time.DateTime), snapshot.Bytes, state)
+	}
+	return 0
+}
+
+// runRestore restores from a snapshot, for the -restore command, and returns the exit code
+func runRestore(reposPath string, req RestoreRequest, out io.Writer) int {
+	report, err := NewBackups(reposPath).Restore(context.Background(), req)
+	if err != nil {
+		fmt.Fprintf(out, "restore failed: %v\n", err)
+		return 1
+	}
+	for _, name := range report.Files {
+		fmt.Fprintf(out, "restored %s\n", name)
+	}
+	for _, name := range report.Restored {
+		fmt.Fprintf(out, "restored %s\n", name)
+	}
+	for _, name := range report.Skipped {
+		fmt.Fprintf(out, "skipped %s, it exists\n", name)
+	}
+	for _, e := range report.Errors {
+		fmt.Fprintf(out, "error: %s\n", e)
+	}
+	fmt.Fprintf(out, "snapshot %s: restored %d repositories and %d LFS objects\n", report.Snapshot, len(report.Restored), report.LFSObjects)
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runBackupVerify verifies every snapshot, for the -backup-verify command, and returns the
+// exit code
+func runBackupVerify(reposPath string, out io.Writer) int {
+	backups := NewBackups(reposPath)
+	if err := backups.VerifyAll(context.Background()); err != nil {
+		fmt.Fprintf(out, "verification failed: %v\n", err)
+		return 1
+	}
+
+	code := 0
+	for _, snapshot := range backups.Status().Snapshots {
+		v, ok := backups.verified[snapshot.ID]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(out, "%s: %d repositories and %d LFS objects verified\n", snapshot.ID, v.Repos, v.LFSObjects)
+		for _, e := range v.Errors {
+			fmt.Fprintf(out, "  error: %s\n", e)
+			code = 1
+		}
+	}
+	return code
+}
+
+// handleBackupRestorePost starts a restore from a snapshot in the background (tailnet only)
+func (s *Server) handleBackupRestorePost(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied - Tailnet required", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	req := RestoreRequest{
+		Snapshot:  r.FormValue("snapshot"),
+		Repo:      strings.TrimSpace(r.FormValue("repo")),
+		As:        strings.TrimSpace(r.FormValue("as")),
+		Overwrite: r.FormValue("overwrite") == "on",
+	}
+	if req.Snapshot == "" {
+		http.Error(w, "Snapshot is required", http.StatusBadRequest)
+		return
+	}
+	if req.As != "" && (req.Repo == "" || !validRepoPath(req.As)) {
+		http.Error(w, "Restoring under another name needs a repository and a valid name", http.StatusBadRequest)
+		return
+	}
+	if s.backups.Running() {
+		http.Error(w, ErrBackupRunning.Error(), http.StatusConflict)
+		return
+	}
+
+	go func() {
+		if _, err := s.backups.Restore(context.Background(), req); err != nil {
+			log.Printf("Restore failed: %v", err)
+		}
+	}()
+
+	// Redirect back to referrer
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		referer = "/admin/settings"
+	}
+	http.Redirect(w, r, referer, http.StatusFound)
+}
+
+// handleBackupVerifyPost starts a verification of every snapshot in the background (tailnet only)
+func (s *Server) handleBackupVerifyPost(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied - Tailnet required", http.StatusForbidden)
+		return
+	}
+	if s.backups.Running() {
+		http.Error(w, ErrBackupRunning.Error(), http.StatusConflict)
+		return
+	}
+
+	go func() {
+		if err := s.backups.VerifyAll(context.Background()); err != nil {
+			log.Printf("Backup verification failed: %v", err)
+		}
+	}()
+
+	// Redirect back to referrer
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		referer = "/admin/settings"
+	}
+	http.Redirect(w, r, referer, http.StatusFound)
+}
+
+// handleAPIBackups returns the snapshots in the backup bucket and the backup status (tailnet only)
+func (s *Server) handleAPIBackups(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "Access denied - Tailnet required"})
+		return
+	}
+
+	if r.URL.Query().Get("refresh") == "true" {
+		if err := s.backups.RefreshSnapshots(r.Context()); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, s.backups.Status())
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ErrRefNotFound is returned when a revision does not resolve to a commit
+var ErrRefNotFound = errors.New("reference not found")
+
+// minHashPrefix is the shortest abbreviated hash accepted, same as git
+const minHashPrefix = 4
+
+// AmbiguousRefError is returned when an abbreviated hash matches more than one commit
+type AmbiguousRefError struct {
+	Ref        string
+	Candidates []string
+}
+
+func (e *AmbiguousRefError) Error() string {
+	return fmt.Sprintf("short hash %s is ambiguous: %s", e.Ref, strings.Join(e.Candidates, ", "))
+}
+
+// revisionStep is a single suffix of a revision expression like ~3, ^2, ^{} or @{date}
+type revisionStep struct {
+	op  byte // '~', '^', '{' (peel) or '@'
+	n   int
+	arg string
+}
+
+// resolveRef resolves a revision expression to a commit hash.
+//
+// Supported forms are branch, tag and remote names (including slashes, e.g. feature/x),
+// full names starting with refs/, full and abbreviated commit hashes, HEAD and @,
+// followed by any number of ~N, ^N, ^{} / ^{commit} and @{date} suffixes.
+func resolveRef(r *git.Repository, rev string) (plumbing.Hash, error) {
+	name, steps, err := parseRevision(rev)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	hash, err := resolveRefName(r, name)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	commit, err := peelToCommit(r, hash)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("%w: %s", ErrRefNotFound, rev)
+	}
+
+	for _, step := range steps {
+		switch step.op {
+		case '~':
+			for i := 0; i < step.n; i++ {
+				commit, err = commit.Parent(0)
+				if err != nil {
+					return plumbing.ZeroHash, fmt.Errorf("%w: %s", ErrRefNotFound, rev)
+				}
+			}
+		case '^':
+			if step.n == 0 {
+				continue
+			}
+			commit, err = commit.Parent(step.n - 1)
+			if err != nil {
+				return plumbing.ZeroHash, fmt.Errorf("%w: %s", ErrRefNotFound, rev)
+			}
+		case '{':
+			if step.arg != "" && step.arg != "commit" {
+				return plumbing.ZeroHash, fmt.Errorf("%w: %s (only ^{commit} is supported)", ErrRefNotFound, rev)
+			}
+		case '@':
+			date, err := parseRevisionDate(step.arg, time.Now())
+			if err != nil {
+				return plumbing.ZeroHash, fmt.Errorf("%w: %s (%v)", ErrRefNotFound, rev, err)
+			}
+			commit, err = commitAtDate(commit, date)
+			if err != nil {
+				return plumbing.ZeroHash, fmt.Errorf("%w: %s", ErrRefNotFound, rev)
+			}
+		}
+	}
+
+	return commit.Hash, nil
+}
+
+// parseRevision splits a revision expression into the ref name and its suffixes
+func parseRevision(rev string) (string, []revisionStep, error) {
+	invalid := fmt.Errorf("%w: %s", ErrRefNotFound, rev)
+
+	end := len(rev)
+	for i := 0; i < len(rev); i++ {
+		if rev[i] == '~' || rev[i] == '^' || strings.HasPrefix(rev[i:], "@{") {
+			end = i
+			break
+		}
+	}
+
+	name := rev[:end]
+	if name == "" || name == "@" {
+		name = "HEAD"
+	}
+
+	var steps []revisionStep
+	rest := rev[end:]
+	for rest != "" {
+		switch {
+		case rest[0] == '~' || rest[0] == '^':
+			op := rest[0]
+			rest = rest[1:]
+			if op == '^' && strings.HasPrefix(rest, "{") {
+				closing := strings.IndexByte(rest, '}')
+				if closing == -1 {
+					return "", nil, invalid
+				}
+				steps = append(steps, revisionStep{op: '{', arg: rest[1:closing]})
+				rest = rest[closing+1:]
+				continue
+			}
+			digits := 0
+			for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+				digits++
+			}
+			n := 1
+			if digits > 0 {
+				var err error
+				if n, err = strconv.Atoi(rest[:digits]); err != nil {
+					return "", nil, invalid
+				}
+			}
+			steps = append(steps, revisionStep{op: op, n: n})
+			rest = rest[digits:]
+		case strings.HasPrefix(rest, "@{"):
+			closing := strings.IndexByte(rest, '}')
+			if closing == -1 {
+				return "", nil, invalid
+			}
+			steps = append(steps, revisionStep{op: '@', arg: rest[2:closing]})
+			rest = rest[closing+1:]
+		default:
+			return "", nil, invalid
+		}
+	}
+
+	return name, steps, nil
+}
+
+// resolveRefName resolves a plain ref name or (abbreviated) hash without suffixes
+func resolveRefName(r *git.Repository, name string) (plumbing.Hash, error) {
+	if name == "HEAD" {
+		head, err := r.Head()
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("%w: %s", ErrRefNotFound, name)
+		}
+		return head.Hash(), nil
+	}
+
+	// Branches are tried before tags since that is what the web UI links to
+	var candidates []plumbing.ReferenceName
+	if strings.HasPrefix(name, "refs/") {
+		candidates = append(candidates, plumbing.ReferenceName(name))
+	} else {
+		candidates = append(candidates,
+			plumbing.NewBranchReferenceName(name),
+			plumbing.NewTagReferenceName(name),
+			plumbing.ReferenceName("refs/remotes/"+name),
+		)
+	}
+	for _, candidate := range candidates {
+		if ref, err := r.Reference(candidate, true); err == nil {
+			return ref.Hash(), nil
+		}
+	}
+
+	if isHexString(name) && len(name) >= minHashPrefix && len(name) <= 40 {
+		return resolveHashPrefix(r, name)
+	}
+
+	return plumbing.ZeroHash, fmt.Errorf("%w: %s", ErrRefNotFound, name)
+}
+
+// resolveHashPrefix finds the single commit whose hash starts with the given prefix
+func resolveHashPrefix(r *git.Repository, prefix string) (plumbing.Hash, error) {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) == 40 {
+		hash := plumbing.NewHash(prefix)
+		if _, err := peelToCommit(r, hash); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("%w: %s", ErrRefNotFound, prefix)
+		}
+		return hash, nil
+	}
+
+	var hashes []plumbing.Hash
+	if prefixer, ok := r.Storer.(interface {
+		HashesWithPrefix(prefix []byte) ([]plumbing.Hash, error)
+	}); ok {
+		// hex.DecodeString only handles full bytes, the odd nibble is checked below
+		even, _ := hex.DecodeString(prefix[:len(prefix)&^1])
+		found, err := prefixer.HashesWithPrefix(even)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		hashes = found
+	} else {
+		iter, err := r.CommitObjects()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		iter.ForEach(func(c *object.Commit) error {
+			hashes = append(hashes, c.Hash)
+			return nil
+		})
+	}
+
+	// Only commit-ish objects are candidates, a blob sharing the prefix is not ambiguous
+	var matches []plumbing.Hash
+	for _, h := range hashes {
+		if !strings.HasPrefix(h.String(), prefix) {
+			continue
+		}
+		if _, err := peelToCommit(r, h); err == nil {
+			matches = append(matches, h)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return plumbing.ZeroHash, fmt.Errorf("%w: %s", ErrRefNotFound, prefix)
+	case 1:
+		return matches[0], nil
+	default:
+		ambiguous := &AmbiguousRefError{Ref: prefix}
+		for _, h := range matches {
+			ambiguous.Candidates = append(ambiguous.Candidates, h.String()[:min(len(prefix)+4, 40)])
+		}
+		return plumbing.ZeroHash, ambiguous
+	}
+}
+
+// peelToCommit returns the commit an object points to, following annotated tags
+func peelToCommit(r *git.Repository, hash plumbing.Hash) (*object.Commit, error) {
+	if commit, err := r.CommitObject(hash); err == nil {
+		return commit, nil
+	}
+	tag, err := r.TagObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	return tag.Commit()
+}
+
+// commitAtDate returns the first commit on the first-parent history that was committed
+// at or before the given date. Server-side bare repos usually keep no reflog, so this
+// approximates git's ref@{date} by walking the current history instead.
+func commitAtDate(commit *object.Commit, date time.Time) (*object.Commit, error) {
+	for {
+		if !commit.Committer.When.After(date) {
+			return commit, nil
+		}
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+		commit = parent
+	}
+}
+
+// parseRevisionDate parses the date inside @{...}. Absolute dates, "now", "yesterday"
+// and relative forms like "3.days.ago" or "2 weeks ago" are accepted.
+func parseRevisionDate(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, fmt.Errorf("empty date")
+	}
+	if _, err := strconv.Atoi(s); err == nil {
+		return time.Time{}, fmt.Errorf("reflog entries are not supported")
+	}
+
+	switch strings.ToLower(s) {
+	case "now":
+		return now, nil
+	case "yesterday":
+		return now.AddDate(0, 0, -1), nil
+	}
+
+	fields := strings.Fields(strings.ReplaceAll(strings.ToLower(s), ".", " "))
+	if len(fields) == 3 && fields[2] == "ago" {
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid relative date: %s", s)
+		}
+		switch strings.TrimSuffix(fields[1], "s") {
+		case "second":
+			return now.Add(-time.Duration(n) * time.Second), nil
+		case "minute":
+			return now.Add(-time.Duration(n) * time.Minute), nil
+		case "hour":
+			return now.Add(-time.Duration(n) * time.Hour), nil
+		case "day":
+			return now.AddDate(0, 0, -n), nil
+		case "week":
+			return now.AddDate(0, 0, -7*n), nil
+		case "month":
+			return now.AddDate(0, -n, 0), nil
+		case "year":
+			return now.AddDate(-n, 0, 0), nil
+		}
+		return time.Time{}, fmt.Errorf("invalid relative date: %s", s)
+	}
+
+	layouts := []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04",
+		"2006-01-02",
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date: %s", s)
+}
+
+// isHexString reports whether s consists only of hexadecimal digits
+func isHexString(s string) bool {
+	for _, c := range s {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isRefError reports whether err means a revision could not be resolved
+func isRefError(err error) bool {
+	var ambiguous *AmbiguousRefError
+	return errors.Is(err, ErrRefNotFound) || errors.As(err, &ambiguous)
+}
+
+// SplitRefPath splits the part of a URL after /tree/ or /blob/ into a revision and a
+// path. Since branch names may contain slashes, the longest prefix that resolves wins.
+func SplitRefPath(reposPath, repoName, refPath string) (string, string, error) {
+	repoPath := filepath.Join(reposPath, repoName+".git")
+	segments := strings.Split(strings.Trim(refPath, "/"), "/")
+
+	split, err := withCachedRepo(repoPath, func(r *git.Repository) (int, error) {
+		var lastErr error = fmt.Errorf("%w: %s", ErrRefNotFound, segments[0])
+		for i := len(segments); i > 0; i-- {
+			_, err := resolveRef(r, strings.Join(segments[:i], "/"))
+			if err == nil {
+				return i, nil
+			}
+			// An ambiguous short hash is more useful to report than "not found"
+			var ambiguous *AmbiguousRefError
+			if errors.As(err, &ambiguous) {
+				lastErr = err
+			}
+		}
+		return 0, lastErr
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return strings.Join(segments[:split], "/"), strings.Join(segments[split:], "/"), nil
+}
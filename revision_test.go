@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// newRevisionTestRepo creates repo.git in a repos directory with this history, main being
+// the merge m and HEAD pointing at it, and returns the commits by name:
+//
+//	c1 - c2 - c3 - c4 - m    main
+//	  \    \           /
+//	   \    s1 -------'      feature/x
+//	    a1, a2               unreferenced, sharing the first 4 hex digits of their hashes
+//
+// Tags v1 and feature point at c1, a branch can't be named feature next to feature/x.
+// Commit cn is made on day n of January 2024, s1 in the middle of day 2.
+func newRevisionTestRepo(t *testing.T) (string, map[string]plumbing.Hash) {
+	t.Helper()
+	reposPath := t.TempDir()
+	r, err := git.PlainInit(filepath.Join(reposPath, "repo.git"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := r.Storer.NewEncodedObject()
+	if err := (&object.Tree{}).Encode(tree); err != nil {
+		t.Fatal(err)
+	}
+	treeHash, err := r.Storer.SetEncodedObject(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(message string, when time.Time, parents ...plumbing.Hash) plumbing.EncodedObject {
+		sig := object.Signature{Name: "Test", Email: "test@example.com", When: when}
+		obj := r.Storer.NewEncodedObject()
+		commit := &object.Commit{Author: sig, Committer: sig, Message: message, TreeHash: treeHash, ParentHashes: parents}
+		if err := commit.Encode(obj); err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+	store := func(obj plumbing.EncodedObject) plumbing.Hash {
+		hash, err := r.Storer.SetEncodedObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	day := func(d float64) time.Time {
+		return time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local).Add(time.Duration((d - 1) * 24 * float64(time.Hour)))
+	}
+
+	commits := make(map[string]plumbing.Hash)
+	commits["c1"] = store(encode("c1", day(1)))
+	commits["c2"] = store(encode("c2", day(2), commits["c1"]))
+	commits["s1"] = store(encode("s1", day(2.5), commits["c2"]))
+	commits["c3"] = store(encode("c3", day(3), commits["c2"]))
+	commits["c4"] = store(encode("c4", day(4), commits["c3"]))
+	commits["m"] = store(encode("m", day(5), commits["c4"], commits["s1"]))
+
+	// Commits are hashed until two share a prefix, about 300 tries
+	seen := make(map[string]plumbing.EncodedObject)
+	for i := 0; commits["a1"].IsZero(); i++ {
+		obj := encode(fmt.Sprintf("collision %d", i), day(1), commits["c1"])
+		prefix := obj.Hash().String()[:minHashPrefix]
+		if other, ok := seen[prefix]; ok {
+			commits["a1"], commits["a2"] = store(other), store(obj)
+		}
+		seen[prefix] = obj
+	}
+
+	for _, ref := range []*plumbing.Reference{
+		plumbing.NewHashReference(plumbing.NewBranchReferenceName("main"), commits["m"]),
+		plumbing.NewHashReference(plumbing.NewBranchReferenceName("feature/x"), commits["s1"]),
+		plumbing.NewHashReference(plumbing.NewTagReferenceName("v1"), commits["c1"]),
+		plumbing.NewHashReference(plumbing.NewTagReferenceName("feature"), commits["c1"]),
+		plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName("main")),
+	} {
+		if err := r.Storer.SetReference(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return reposPath, commits
+}
+
+func TestResolveRef(t *testing.T) {
+	reposPath, commits := newRevisionTestRepo(t)
+	r, err := git.PlainOpen(filepath.Join(reposPath, "repo.git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rev  string
+		want string // Commit name, empty for ErrRefNotFound
+	}{
+		{"HEAD", "m"},
+		{"@", "m"},
+		{"main", "m"},
+		{"refs/heads/main", "m"},
+		{"feature/x", "s1"},
+		{"feature", "c1"},
+		{"v1", "c1"},
+		{"HEAD~", "c4"},
+		{"HEAD~3", "c2"},
+		{"main~1~2", "c2"},
+		{"HEAD^", "c4"},
+		{"HEAD^1", "c4"},
+		{"HEAD^2", "s1"},
+		{"HEAD^2~1", "c2"},
+		{"HEAD^0", "m"},
+		{"HEAD^{commit}", "m"},
+		{"v1^{}", "c1"},
+		{"main@{2024-01-03 12:00}", "c3"},
+		{"main@{2024-01-10}", "m"},
+		{commits["c3"].String(), "c3"},
+		{commits["c3"].String()[:12] + "~1", "c2"},
+		{"HEAD^3", ""},
+		{"HEAD~10", ""},
+		{"HEAD^{tree}", ""},
+		{"main@{1}", ""},
+		{"main@{2023-12-01}", ""},
+		{"nope", ""},
+		{"nope~1", ""},
+		{"feature/y", ""},
+		{"main~x", ""},
+		{"0000000", ""},
+	}
+	for _, tt := range tests {
+		got, err := resolveRef(r, tt.rev)
+		if tt.want == "" {
+			if !errors.Is(err, ErrRefNotFound) {
+				t.Errorf("resolveRef(%q) = %s, %v, want ErrRefNotFound", tt.rev, got, err)
+			}
+			continue
+		}
+		if err != nil || got != commits[tt.want] {
+			t.Errorf("resolveRef(%q) = %s, %v, want %s (%s)", tt.rev, got, err, tt.want, commits[tt.want])
+		}
+	}
+
+	// A prefix shared by two commits names neither
+	prefix := commits["a1"].String()[:minHashPrefix]
+	_, err = resolveRef(r, prefix)
+	var ambiguous *AmbiguousRefError
+	if !errors.As(err, &ambiguous) || len(ambiguous.Candidates) != 2 {
+		t.Fatalf("resolveRef(%q) = %v, want an AmbiguousRefError with 2 candidates", prefix, err)
+	}
+	for _, name := range []string{"a1", "a2"} {
+		if got, err := resolveRef(r, commits[name].String()[:10]); err != nil || got != commits[name] {
+			t.Errorf("resolveRef of %s's longer prefix = %s, %v", name, got, err)
+		}
+	}
+}
+
+func TestSplitRefPath(t *testing.T) {
+	reposPath, commits := newRevisionTestRepo(t)
+	ambiguous := commits["a1"].String()[:minHashPrefix]
+
+	tests := []struct {
+		refPath  string
+		wantRef  string
+		wantPath string
+		wantErr  bool
+	}{
+		{"main", "main", "", false},
+		{"main/README.md", "main", "README.md", false},
+		{"feature/x", "feature/x", "", false},
+		{"feature/x/docs/README.md", "feature/x", "docs/README.md", false},
+		{"feature/y/README.md", "feature", "y/README.md", false},
+		{"HEAD~3/src/main.go", "HEAD~3", "src/main.go", false},
+		{"HEAD^2/src", "HEAD^2", "src", false},
+		{commits["c3"].String()[:7] + "/a/b", commits["c3"].String()[:7], "a/b", false},
+		{"nope/README.md", "", "", true},
+		{"nope", "", "", true},
+	}
+	for _, tt := range tests {
+		ref, path, err := SplitRefPath(reposPath, "repo", tt.refPath)
+		if tt.wantErr {
+			if !errors.Is(err, ErrRefNotFound) {
+				t.Errorf("SplitRefPath(%q) = %q, %q, %v, want ErrRefNotFound", tt.refPath, ref, path, err)
+			}
+			continue
+		}
+		if err != nil || ref != tt.wantRef || path != tt.wantPath {
+			t.Errorf("SplitRefPath(%q) = %q, %q, %v, want %q, %q", tt.refPath, ref, path, err, tt.wantRef, tt.wantPath)
+		}
+	}
+
+	var ambiguousErr *AmbiguousRefError
+	if _, _, err := SplitRefPath(reposPath, "repo", ambiguous+"/README.md"); !errors.As(err, &ambiguousErr) {
+		t.Errorf("SplitRefPath of an ambiguous prefix: %v, want an AmbiguousRefError", err)
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	// searchIndexInterval is how often repositories are checked for new commits
+	searchIndexInterval = time.Minute
+	// maxIndexedFileSize skips large files, they are rarely useful search results
+	maxIndexedFileSize = 512 * 1024
+	// maxSearchFiles limits the number of files in a result page
+	maxSearchFiles = 50
+	// maxSearchLinesPerFile limits the number of matched lines shown per file
+	maxSearchLinesPerFile = 5
+)
+
+// indexedFile is a file of the default branch together with its trigrams
+type indexedFile struct {
+	Path     string
+	Blob     string
+	Trigrams []uint32
+}
+
+// repoIndex is the trigram index of one repository's default branch
+type repoIndex struct {
+	Repo     string
+	Branch   string
+	Commit   string
+	Indexed  time.Time
+	Files    []indexedFile
+	postings map[uint32][]int // trigram -> indexes into Files, built on load
+}
+
+// SearchQuery describes a code search request
+type SearchQuery struct {
+	Query string
+	Regex bool
+	Path  string // Regular expression matched against the file path
+	Repos []string
+}
+
+// SearchLine is a single matching line, split around the first match for highlighting
+type SearchLine struct {
+	Number int
+	Before string
+	Match  string
+	After  string
+}
+
+// SearchResult is a file with matching lines
+type SearchResult struct {
+	Repo   string
+	Branch string
+	Commit string
+	Path   string
+	Lines  []SearchLine
+}
+
+// SearchIndex maintains on-disk trigram indexes for the default branch of every repository
+type SearchIndex struct {
+	reposPath string
+	dir       string
+
+	mu    sync.RWMutex
+	repos map[string]*repoIndex
+}
+
+// NewSearchIndex creates a search index stored in dir and loads existing index files
+func NewSearchIndex(reposPath, dir string) (*SearchIndex, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	idx := &SearchIndex{
+		reposPath: reposPath,
+		dir:       dir,
+		repos:     make(map[string]*repoIndex),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".idx") {
+			continue
+		}
+		ri, err := loadRepoIndex(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			log.Printf("Search index: ignoring %s: %v", entry.Name(), err)
+			continue
+		}
+		idx.repos[ri.Repo] = ri
+	}
+
+	return idx, nil
+}
+
+// Run updates the index periodically, it never returns
+func (idx *SearchIndex) Run(interval time.Duration) {
+	for {
+		if err := idx.Update(); err != nil {
+			log.Printf("Search index update failed: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Update re-indexes every repository whose default branch moved since it was last indexed
+func (idx *SearchIndex) Update() error {
+	repos, err := ListRepos(idx.reposPath, true)
+	if err != nil {
+		return err
+	}
+
+	present := make(map[string]bool)
+	for _, repo := range repos {
+		present[repo.Name] = true
+		if err := idx.UpdateRepo(repo.Name); err != nil {
+			log.Printf("Search index: failed to index %s: %v", repo.Name, err)
+		}
+	}
+
+	// Drop indexes of repositories that no longer exist
+	idx.mu.Lock()
+	for name := range idx.repos {
+		if !present[name] {
+			delete(idx.repos, name)
+			os.Remove(idx.indexPath(name))
+		}
+	}
+	idx.mu.Unlock()
+
+	return nil
+}
+
+// UpdateRepo indexes the default branch of a repository if its tip changed.
+// Files whose blob is unchanged reuse the trigrams of the previous index.
+func (idx *SearchIndex) UpdateRepo(repoName string) error {
+	repoPath := filepath.Join(idx.reposPath, repoName+".git")
+	r, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return err
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		// Empty repository, nothing to index
+		return nil
+	}
+
+	idx.mu.RLock()
+	previous := idx.repos[repoName]
+	idx.mu.RUnlock()
+	if previous != nil && previous.Commit == head.Hash().String() {
+		return nil
+	}
+
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+
+	reuse := make(map[string][]uint32)
+	if previous != nil {
+		for _, f := range previous.Files {
+			reuse[f.Blob] = f.Trigrams
+		}
+	}
+
+	files, err := commit.Files()
+	if err != nil {
+		return err
+	}
+
+	ri := &repoIndex{
+		Repo:    repoName,
+		Branch:  head.Name().Short(),
+		Commit:  head.Hash().String(),
+		Indexed: time.Now(),
+	}
+	err = files.ForEach(func(f *object.File) error {
+		if f.Size > maxIndexedFileSize {
+			return nil
+		}
+		blob := f.Hash.String()
+		trigrams, ok := reuse[blob]
+		if !ok {
+			if binary, err := f.IsBinary(); err != nil || binary {
+				return nil
+			}
+			content, err := f.Contents()
+			if err != nil {
+				return nil
+			}
+			trigrams = extractTrigrams([]byte(content))
+		}
+		ri.Files = append(ri.Files, indexedFile{Path: f.Name, Blob: blob, Trigrams: trigrams})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ri.buildPostings()
+
+	if err := saveRepoIndex(idx.indexPath(repoName), ri); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	idx.repos[repoName] = ri
+	idx.mu.Unlock()
+
+	log.Printf("Search index: indexed %s at %s (%d files)", repoName, ri.Commit[:8], len(ri.Files))
+	return nil
+}
+
+// Search runs a query against the indexed repositories
+func (idx *SearchIndex) Search(q SearchQuery) ([]SearchResult, error) {
+	var re *regexp.Regexp
+	var err error
+	if q.Regex {
+		re, err = regexp.Compile(q.Query)
+	} else {
+		re, err = regexp.Compile("(?i)" + regexp.QuoteMeta(q.Query))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+
+	var pathRe *regexp.Regexp
+	if q.Path != "" {
+		if pathRe, err = regexp.Compile(q.Path); err != nil {
+			return nil, fmt.Errorf("invalid path filter: %v", err)
+		}
+	}
+
+	var trigrams []uint32
+	if q.Regex {
+		for _, lit := range requiredLiterals(q.Query) {
+			trigrams = append(trigrams, extractTrigrams([]byte(lit))...)
+		}
+	} else {
+		trigrams = extractTrigrams([]byte(q.Query))
+	}
+
+	idx.mu.RLock()
+	var indexes []*repoIndex
+	for _, name := range q.Repos {
+		if ri, ok := idx.repos[name]; ok {
+			indexes = append(indexes, ri)
+		}
+	}
+	idx.mu.RUnlock()
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Repo < indexes[j].Repo })
+
+	var results []SearchResult
+	for _, ri := range indexes {
+		r, err := git.PlainOpen(filepath.Join(idx.reposPath, ri.Repo+".git"))
+		if err != nil {
+			continue
+		}
+		for _, fileIdx := range ri.candidates(trigrams) {
+			f := ri.Files[fileIdx]
+			if pathRe != nil && !pathRe.MatchString(f.Path) {
+				continue
+			}
+			lines := grepBlob(r, f.Blob, re)
+			if len(lines) == 0 {
+				continue
+			}
+			results = append(results, SearchResult{
+				Repo:   ri.Repo,
+				Branch: ri.Branch,
+				Commit: ri.Commit,
+				Path:   f.Path,
+				Lines:  lines,
+			})
+			if len(results) >= maxSearchFiles {
+				return results, nil
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// candidates returns the files containing all given trigrams, or every file if there are none
+func (ri *repoIndex) candidates(trigrams []uint32) []int {
+	if len(trigrams) == 0 {
+		all := make([]int, len(ri.Files))
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+
+	result := ri.postings[trigrams[0]]
+	for _, t := range trigrams[1:] {
+		if len(result) == 0 {
+			break
+		}
+		result = intersectSorted(result, ri.postings[t])
+	}
+	return result
+}
+
+// buildPostings builds the trigram to file posting lists
+func (ri *repoIndex) buildPostings() {
+	ri.postings = make(map[uint32][]int)
+	for i, f := range ri.Files {
+		for _, t := range f.Trigrams {
+			ri.postings[t] = append(ri.postings[t], i)
+		}
+	}
+}
+
+// indexPath returns the index file of a repository, the slashes of groups escaped
+func (idx *SearchIndex) indexPath(repoName string) string {
+	return filepath.Join(idx.dir, url.PathEscape(repoName)+".idx")
+}
+
+// loadRepoIndex reads a repository index from disk
+func loadRepoIndex(path string) (*repoIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ri repoIndex
+	if err := gob.NewDecoder(f).Decode(&ri); err != nil {
+		return nil, err
+	}
+	ri.buildPostings()
+	return &ri, nil
+}
+
+// saveRepoIndex writes a repository index to disk atomically
+func saveRepoIndex(path string, ri *repoIndex) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(ri); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// extractTrigrams returns the sorted, de-duplicated lower-case trigrams of content
+func extractTrigrams(content []byte) []uint32 {
+	content = bytes.ToLower(content)
+	seen := make(map[uint32]struct{})
+	for i := 0; i+3 <= len(content); i++ {
+		seen[uint32(content[i])<<16|uint32(content[i+1])<<8|uint32(content[i+2])] = struct{}{}
+	}
+	trigrams := make([]uint32, 0, len(seen))
+	for t := range seen {
+		trigrams = append(trigrams, t)
+	}
+	sort.Slice(trigrams, func(i, j int) bool { return trigrams[i] < trigrams[j] })
+	return trigrams
+}
+
+// requiredLiterals returns literal strings every match of the regular expression must contain
+func requiredLiterals(pattern string) []string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	return collectLiterals(re.Simplify())
+}
+
+func collectLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return collectLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return collectLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// Adjacent literals are joined so they can produce trigrams across the boundary
+		var literals []string
+		var run strings.Builder
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral {
+				run.WriteString(string(sub.Rune))
+				continue
+			}
+			if run.Len() > 0 {
+				literals = append(literals, run.String())
+				run.Reset()
+			}
+			literals = append(literals, collectLiterals(sub)...)
+		}
+		if run.Len() > 0 {
+			literals = append(literals, run.String())
+		}
+		return literals
+	}
+	return nil
+}
+
+// grepBlob returns the lines of a blob matching the regular expression
+func grepBlob(r *git.Repository, blobHash string, re *regexp.Regexp) []SearchLine {
+	blob, err := r.BlobObject(plumbing.NewHash(blobHash))
+	if err != nil {
+		return nil
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil
+	}
+
+	var lines []SearchLine
+	for i, line := range strings.Split(string(content), "\n") {
+		loc := re.FindStringIndex(line)
+		if loc == nil {
+			continue
+		}
+		lines = append(lines, SearchLine{
+			Number: i + 1,
+			Before: line[:loc[0]],
+			Match:  line[loc[0]:loc[1]],
+			After:  line[loc[1]:],
+		})
+		if len(lines) >= maxSearchLinesPerFile {
+			break
+		}
+	}
+	return lines
+}
+
+// intersectSorted returns the elements present in both sorted slices
+func intersectSorted(a, b []int) []int {
+	var result []int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// handleSearch searches code across all visible repositories
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	isTailnet := s.isTailnetRequest(r)
+
+	repos, err := ListRepos(s.reposPath, isTailnet)
+	if err != nil {
+		log.Printf("Error listing repos: %v", err)
+		http.Error(w, "Error listing repositories", http.StatusInternalServerError)
+		return
+	}
+
+	var names []string
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+	}
+
+	s.renderSearch(w, r, "", names)
+}
+
+// handleRepoSearch searches code within a single repository
+func (s *Server) handleRepoSearch(w http.ResponseWriter, r *http.Request) {
+	repoName := repoParam(r)
+
+	if !RepoExists(s.reposPath, repoName) {
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+
+	// Check access
+	repoPath := filepath.Join(s.reposPath, repoName+".git")
+	if !IsPublicRepo(s.reposPath, repoPath) && !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	s.renderSearch(w, r, repoName, []string{repoName})
+}
+
+// renderSearch runs the query from the request against the given repositories
+func (s *Server) renderSearch(w http.ResponseWriter, r *http.Request, repoName string, repos []string) {
+	q := SearchQuery{
+		Query: r.URL.Query().Get("q"),
+		Regex: r.URL.Query().Get("regex") == "on",
+		Path:  r.URL.Query().Get("path"),
+		Repos: repos,
+	}
+
+	var results []SearchResult
+	var searchErr string
+	if q.Query != "" {
+		var err error
+		results, err = s.search.Search(q)
+		if err != nil {
+			searchErr = err.Error()
+		}
+	}
+
+	title := "Search"
+	action := "/search"
+	if repoName != "" {
+		title = "Search - " + repoName
+		action = "/" + repoName + "/search"
+	}
+
+	data := map[string]interface{}{
+		"Title":      title,
+		"RepoName":   repoName,
+		"Action":     action,
+		"Query":      q.Query,
+		"Regex":      q.Regex,
+		"PathFilter": q.Path,
+		"Results":    results,
+		"Truncated":  len(results) >= maxSearchFiles,
+		"Error":      searchErr,
+		"IsTailnet":  s.isTailnetRequest(r),
+		"PublicURL":  s.publicURL,
+		"TailnetURL": s.tailnetURL,
+	}
+
+	s.renderTemplate(w, "search.html", data)
+}
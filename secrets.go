@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// secretPrefix marks an encrypted config value: enc:v1:{key id}:{base64 nonce and ciphertext}
+	secretPrefix = "enc:v1:"
+
+	// masterKeyFile holds the master keys in the data directory unless configured otherwise
+	masterKeyFile = "master.key"
+)
+
+// secretConfigFiles are the config files in the data directory holding secrets
+var secretConfigFiles = []string{"lfs-config.json", "backup-config.json", mirrorCredentialsFile}
+
+// secretConfigPaths returns the config files holding secrets: the server's, next to the repos
+// directory, and the mirror configs and import states of the repositories
+func secretConfigPaths(reposPath string) []string {
+	var paths []string
+	for _, name := range secretConfigFiles {
+		paths = append(paths, filepath.Join(filepath.Dir(reposPath), name))
+	}
+	for _, repoPath := range repoPaths(reposPath) {
+		for _, name := range []string{mirrorConfigFile, importStatusFile} {
+			if _, err := os.Stat(filepath.Join(repoPath, name)); err == nil {
+				paths = append(paths, filepath.Join(repoPath, name))
+			}
+		}
+	}
+	return paths
+}
+
+// secretStore encrypts the secrets in config files, it's set up by main before serving
+var secretStore *SecretStore
+
+// ErrUnknownSecretKey means a secret was encrypted with a master key that isn't configured
+var ErrUnknownSecretKey = errors.New("secret was encrypted with an unknown master key")
+
+// SecretStore encrypts config values with AES-256-GCM under a master key. Several keys can be
+// configured, the first encrypts and the others only decrypt secrets not yet rotated.
+type SecretStore struct {
+	mu      sync.Mutex
+	envKeys string // GITRAF_MASTER_KEY, comma separated base64 keys, takes precedence over keyFile
+	keyFile string // One base64 key per line
+	keys    [][]byte
+}
+
+// NewSecretStore loads the master keys from GITRAF_MASTER_KEY or keyFile, creating the file
+// with a new key if neither exists
+func NewSecretStore(keyFile string) (*SecretStore, error) {
+	s := &SecretStore{envKeys: os.Getenv("GITRAF_MASTER_KEY"), keyFile: keyFile}
+	if err := s.load(); err == nil || s.envKeys != "" || !os.IsNotExist(err) {
+		return s, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating a master key: %w", err)
+	}
+	if err := writeMasterKeys(keyFile, [][]byte{key}); err != nil {
+		return nil, err
+	}
+	log.Printf("Generated a new master key in %s", keyFile)
+	s.keys = [][]byte{key}
+	return s, nil
+}
+
+// Source describes where the master keys come from
+func (s *SecretStore) Source() string {
+	if s.envKeys != "" {
+		return "GITRAF_MASTER_KEY"
+	}
+	return s.keyFile
+}
+
+// KeyID returns the ID of the key new secrets are encrypted with
+func (s *SecretStore) KeyID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return masterKeyID(s.keys[0])
+}
+
+// load reads the master keys from their source
+func (s *SecretStore) load() error {
+	encoded := s.envKeys
+	if encoded == "" {
+		data, err := os.ReadFile(s.keyFile)
+		if err != nil {
+			return err
+		}
+		encoded = string(data)
+	}
+
+	var keys [][]byte
+	for _, line := range strings.Split(encoded, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, field := range strings.Split(line, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			key, err := base64.StdEncoding.DecodeString(field)
+			if err != nil || len(key) != 32 {
+				return fmt.Errorf("master key must be 32 bytes, base64 encoded")
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no master key in %s", s.Source())
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+// Encrypt encrypts a secret with the current master key, empty secrets stay empty
+func (s *SecretStore) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" || strings.HasPrefix(plaintext, secretPrefix) {
+		return plaintext, nil
+	}
+	s.mu.Lock()
+	key := s.keys[0]
+	s.mu.Unlock()
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return secretPrefix + masterKeyID(key) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a secret. Values that aren't encrypted are returned as they are, so
+// configs written before encryption keep working until they're sealed.
+func (s *SecretStore) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return value, nil
+	}
+	keyID, encoded, ok := strings.Cut(strings.TrimPrefix(value, secretPrefix), ":")
+	if !ok {
+		return "", errors.New("malformed secret")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("malformed secret")
+	}
+
+	key := s.key(keyID)
+	if key == nil {
+		// The keys may have been rotated by another process
+		if err := s.load(); err != nil {
+			return "", err
+		}
+		if key = s.key(keyID); key == nil {
+			return "", fmt.Errorf("%w (%s)", ErrUnknownSecretKey, keyID)
+		}
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("malformed secret")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("secret failed to decrypt")
+	}
+	return string(plaintext), nil
+}
+
+// current reports whether a value is encrypted with the current master key
+func (s *SecretStore) current(value string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.HasPrefix(value, secretPrefix+masterKeyID(s.keys[0])+":")
+}
+
+// key returns the master key with an ID, or nil
+func (s *SecretStore) key(id string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range s.keys {
+		if masterKeyID(key) == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// Rotate generates a new master key and re-encrypts every secret with it. Previous keys are
+// kept until all secrets are sealed with the new one. Keys from GITRAF_MASTER_KEY can't be
+// rotated here: put the new key first and call SealConfigs.
+func (s *SecretStore) Rotate(reposPath string) error {
+	if s.envKeys != "" {
+		return errors.New("the master key comes from GITRAF_MASTER_KEY, prepend the new key there instead")
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("generating a master key: %w", err)
+	}
+	s.mu.Lock()
+	keys := append([][]byte{key}, s.keys...)
+	s.mu.Unlock()
+	if err := writeMasterKeys(s.keyFile, keys); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+
+	if err := s.SealConfigs(reposPath); err != nil {
+		return fmt.Errorf("previous master keys were kept: %w", err)
+	}
+	if err := writeMasterKeys(s.keyFile, keys[:1]); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.keys = keys[:1]
+	s.mu.Unlock()
+	log.Printf("Rotated master key, secrets are now encrypted with key %s", masterKeyID(key))
+	return nil
+}
+
+// SealConfigs encrypts every secret in the config files that is stored in plain text or
+// with a previous master key
+func (s *SecretStore) SealConfigs(reposPath string) error {
+	for _, path := range secretConfigPaths(reposPath) {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var cfg map[string]interface{}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		sealed := 0
+		err = walkConfigSecrets(cfg, func(value string) (string, error) {
+			if value == "" || s.current(value) {
+				return value, nil
+			}
+			plaintext, err := s.Decrypt(value)
+			if err != nil {
+				return "", err
+			}
+			sealed++
+			return s.Encrypt(plaintext)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if sealed == 0 {
+			continue
+		}
+
+		data, err = json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return err
+		}
+		storageConfigs.Invalidate(path)
+		log.Printf("Encrypted %d secrets in %s", sealed, path)
+	}
+	return nil
+}
+
+// encryptConfigSecrets encrypts the secrets of a config before it's saved
+func encryptConfigSecrets(cfg map[string]interface{}) error {
+	return walkConfigSecrets(cfg, secretStore.Encrypt)
+}
+
+// walkConfigSecrets replaces the S3 and encryption keys and access tokens of a config,
+// including its named credentials and mirror targets
+func walkConfigSecrets(cfg map[string]interface{}, fn func(string) (string, error)) error {
+	configs := []map[string]interface{}{cfg}
+	if credentials, ok := cfg["credentials"].(map[string]interface{}); ok {
+		for _, creds := range credentials {
+			if creds, ok := creds.(map[string]interface{}); ok {
+				configs = append(configs, creds)
+			}
+		}
+	}
+	if targets, ok := cfg["targets"].([]interface{}); ok {
+		for _, target := range targets {
+			if target, ok := target.(map[string]interface{}); ok {
+				configs = append(configs, target)
+			}
+		}
+	}
+
+	for _, c := range configs {
+		for _, field := range []string{"access_key", "secret_key", "encryption_key", "token"} {
+			value, ok := c[field].(string)
+			if !ok {
+				continue
+			}
+			replaced, err := fn(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", field, err)
+			}
+			c[field] = replaced
+		}
+	}
+	return nil
+}
+
+// decryptSecrets decrypts the given config values in place
+func decryptSecrets(values ...*string) error {
+	for _, v := range values {
+		plaintext, err := secretStore.Decrypt(*v)
+		if err != nil {
+			return err
+		}
+		*v = plaintext
+	}
+	return nil
+}
+
+// keepSecret keeps the saved value of a write-only form field left empty
+func keepSecret(cfg, existing map[string]interface{}, field string) {
+	if cfg[field] == "" {
+		if v, ok := existing[field].(string); ok {
+			cfg[field] = v
+		}
+	}
+}
+
+// masterKeyID identifies a master key without revealing it
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// newGCM creates an AES-GCM cipher
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeMasterKeys saves master keys, the current one first, readable by the owner only
+func writeMasterKeys(path string, keys [][]byte) error {
+	var buf bytes.Buffer
+	buf.WriteString("# gitraf-server master keys, the first encrypts new secrets\n")
+	for _, key := range keys {
+		buf.WriteString(base64.StdEncoding.EncodeToString(key) + "\n")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
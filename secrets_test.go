@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestSecretStore creates a secret store with a new master key in dir
+func newTestSecretStore(t *testing.T, dir string) *SecretStore {
+	t.Helper()
+	t.Setenv("GITRAF_MASTER_KEY", "")
+	s, err := NewSecretStore(filepath.Join(dir, masterKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSecretStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSecretStore(t, dir)
+	if info, err := os.Stat(filepath.Join(dir, masterKeyFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("master key file: %v, %v", info, err)
+	}
+
+	sealed, err := s.Encrypt("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, secretPrefix+s.KeyID()+":") || strings.Contains(sealed, "s3cret") {
+		t.Fatalf("Encrypt = %q", sealed)
+	}
+	if again, _ := s.Encrypt("s3cret"); again == sealed {
+		t.Error("two encryptions of the same secret are equal, the nonce isn't random")
+	}
+	if got, err := s.Decrypt(sealed); err != nil || got != "s3cret" {
+		t.Errorf("Decrypt = %q, %v", got, err)
+	}
+
+	// Empty, plaintext and already encrypted values pass through
+	if got, err := s.Encrypt(""); err != nil || got != "" {
+		t.Errorf("Encrypt(\"\") = %q, %v", got, err)
+	}
+	for _, value := range []string{"", "plain"} {
+		if got, err := s.Decrypt(value); err != nil || got != value {
+			t.Errorf("Decrypt(%q) = %q, %v", value, got, err)
+		}
+	}
+	if got, _ := s.Encrypt(sealed); got != sealed {
+		t.Errorf("Encrypt of an encrypted value = %q, want it unchanged", got)
+	}
+
+	// A second store reads the same key file
+	t.Setenv("GITRAF_MASTER_KEY", "")
+	reopened, err := NewSecretStore(filepath.Join(dir, masterKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reopened.Decrypt(sealed); err != nil || got != "s3cret" {
+		t.Errorf("Decrypt with the reloaded key = %q, %v", got, err)
+	}
+}
+
+func TestSecretStoreRejectsTampering(t *testing.T) {
+	s := newTestSecretStore(t, t.TempDir())
+	sealed, err := s.Encrypt("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, encoded, _ := strings.Cut(strings.TrimPrefix(sealed, secretPrefix), ":")
+	raw, _ := base64.StdEncoding.DecodeString(encoded)
+	flipped := append([]byte(nil), raw...)
+	flipped[len(flipped)-1] ^= 1
+
+	for name, value := range map[string]string{
+		"truncated":      secretPrefix + keyID + ":" + base64.StdEncoding.EncodeToString(raw[:len(raw)-1]),
+		"nonce only":     secretPrefix + keyID + ":" + base64.StdEncoding.EncodeToString(raw[:12]),
+		"shorter":        secretPrefix + keyID + ":" + base64.StdEncoding.EncodeToString(raw[:4]),
+		"modified":       secretPrefix + keyID + ":" + base64.StdEncoding.EncodeToString(flipped),
+		"not base64":     secretPrefix + keyID + ":%%%",
+		"missing key ID": secretPrefix + encoded,
+	} {
+		if got, err := s.Decrypt(value); err == nil {
+			t.Errorf("%s secret decrypted to %q", name, got)
+		}
+	}
+}
+
+func TestSecretStoreWrongKey(t *testing.T) {
+	s := newTestSecretStore(t, t.TempDir())
+	sealed, err := s.Encrypt("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newTestSecretStore(t, t.TempDir())
+	if got, err := other.Decrypt(sealed); !errors.Is(err, ErrUnknownSecretKey) {
+		t.Errorf("Decrypt with another master key = %q, %v, want ErrUnknownSecretKey", got, err)
+	}
+
+	// A key claiming the right ID still has to open the secret
+	forged := &SecretStore{keyFile: filepath.Join(t.TempDir(), masterKeyFile), keys: [][]byte{make([]byte, 32)}}
+	keyID, encoded, _ := strings.Cut(strings.TrimPrefix(sealed, secretPrefix), ":")
+	forgedSecret := secretPrefix + masterKeyID(forged.keys[0]) + ":" + encoded
+	if got, err := forged.Decrypt(forgedSecret); err == nil {
+		t.Errorf("secret of key %s decrypted with another key to %q", keyID, got)
+	}
+}
+
+func TestSecretStoreRotate(t *testing.T) {
+	dataDir := t.TempDir()
+	reposPath := filepath.Join(dataDir, "repos")
+	if err := os.Mkdir(reposPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSecretStore(t, dataDir)
+	oldID := s.KeyID()
+	sealed, err := s.Encrypt("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dataDir, "lfs-config.json")
+	data, _ := json.Marshal(map[string]interface{}{
+		"bucket":     "lfs",
+		"access_key": "plain-key",
+		"secret_key": sealed,
+		"credentials": map[string]interface{}{
+			"team": map[string]interface{}{"secret_key": sealed},
+		},
+	})
+	if err := os.WriteFile(configPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Rotate(reposPath); err != nil {
+		t.Fatal(err)
+	}
+	if s.KeyID() == oldID {
+		t.Fatal("the master key didn't change")
+	}
+	if len(s.keys) != 1 {
+		t.Errorf("%d master keys kept after rotating, want 1", len(s.keys))
+	}
+
+	var cfg map[string]interface{}
+	data, _ = os.ReadFile(configPath)
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	team := cfg["credentials"].(map[string]interface{})["team"].(map[string]interface{})
+	for field, want := range map[string]struct {
+		value interface{}
+		plain string
+	}{
+		"access_key": {cfg["access_key"], "plain-key"},
+		"secret_key": {cfg["secret_key"], "s3cret"},
+		"team":       {team["secret_key"], "s3cret"},
+	} {
+		value, _ := want.value.(string)
+		if !s.current(value) {
+			t.Errorf("%s = %q, not sealed with the new key", field, value)
+		}
+		if got, err := s.Decrypt(value); err != nil || got != want.plain {
+			t.Errorf("%s decrypts to %q, %v, want %q", field, got, err, want.plain)
+		}
+	}
+	if cfg["bucket"] != "lfs" {
+		t.Errorf("bucket = %v, settings other than secrets changed", cfg["bucket"])
+	}
+
+	// The old key is gone from the key file
+	t.Setenv("GITRAF_MASTER_KEY", "")
+	reopened, err := NewSecretStore(filepath.Join(dataDir, masterKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Decrypt(sealed); !errors.Is(err, ErrUnknownSecretKey) {
+		t.Errorf("secret of the rotated key: %v, want ErrUnknownSecretKey", err)
+	}
+
+	// Keys from the environment can't be rotated by the server
+	t.Setenv("GITRAF_MASTER_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	env, err := NewSecretStore(filepath.Join(t.TempDir(), masterKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Rotate(reposPath); err == nil {
+		t.Error("rotated a master key from GITRAF_MASTER_KEY")
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/fsnotify/fsnotify"
+)
+
+// storageTestTimeout bounds a storage connection test
+const storageTestTimeout = 30 * time.Second
+
+// storageConfigs caches the storage configs in the data directory and the S3 clients made from them
+var storageConfigs = NewStorageConfigs()
+
+// StorageConfigs loads config files once and keeps them until they change on disk. Files are
+// only cached while the data directory is watched, so edits by hand are never missed.
+type StorageConfigs struct {
+	mu         sync.Mutex
+	dir        string // Watched data directory, empty until Watch runs
+	generation int    // Bumped by every invalidation, so loads racing one aren't cached
+	files      map[string]cachedConfig
+	clients    map[s3ClientConfig]*s3.Client
+	tests      map[string]*StorageTestResult
+}
+
+// cachedConfig is a parsed config file, or the error reading it
+type cachedConfig struct {
+	value any
+	err   error
+}
+
+// s3ClientConfig is everything an S3 client is made from
+type s3ClientConfig struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// StorageTestResult is the outcome of a storage connection test
+type StorageTestResult struct {
+	Target   string    `json:"target"` // "lfs" or "backup"
+	OK       bool      `json:"ok"`
+	Error    string    `json:"error,omitempty"`
+	Tested   time.Time `json:"tested"`
+	Duration int64     `json:"duration_ms"`
+}
+
+// NewStorageConfigs creates an empty config cache
+func NewStorageConfigs() *StorageConfigs {
+	return &StorageConfigs{
+		files:   make(map[string]cachedConfig),
+		clients: make(map[s3ClientConfig]*s3.Client),
+		tests:   make(map[string]*StorageTestResult),
+	}
+}
+
+// loadCachedConfig returns a copy of the parsed JSON config file at path, reading it only if
+// it isn't cached. Errors, including a missing file, are cached too.
+func loadCachedConfig[T any](c *StorageConfigs, path string) (*T, error) {
+	path = filepath.Clean(path)
+	c.mu.Lock()
+	cached, ok := c.files[path]
+	generation := c.generation
+	c.mu.Unlock()
+
+	if !ok {
+		value := new(T)
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, value)
+		}
+		cached = cachedConfig{value: value, err: err}
+
+		c.mu.Lock()
+		if c.dir != "" && filepath.Dir(path) == c.dir && c.generation == generation {
+			c.files[path] = cached
+		}
+		c.mu.Unlock()
+	}
+
+	if cached.err != nil {
+		return nil, cached.err
+	}
+	value := *cached.value.(*T)
+	return &value, nil
+}
+
+// Invalidate drops a cached config file, and the clients made from it, after it changed
+func (c *StorageConfigs) Invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if _, ok := c.files[filepath.Clean(path)]; ok {
+		delete(c.files, filepath.Clean(path))
+		// Clients are cheap to recreate, dropping them all keeps credentials from piling up
+		clear(c.clients)
+	}
+}
+
+// Watch reloads config files in the data directory when they change, it never returns
+func (c *StorageConfigs) Watch(dataDir string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Storage configs: file watching unavailable, reading configs on every use: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(dataDir); err != nil {
+		log.Printf("Storage configs: failed to watch %s: %v", dataDir, err)
+		return
+	}
+	c.mu.Lock()
+	c.dir = filepath.Clean(dataDir)
+	c.mu.Unlock()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			c.Invalidate(event.Name)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Storage configs: watch error: %v", err)
+		}
+	}
+}
+
+// S3Client returns a client for an S3-compatible service, creating it on first use
+func (c *StorageConfigs) S3Client(ctx context.Context, cfg s3ClientConfig) (*s3.Client, error) {
+	c.mu.Lock()
+	client, ok := c.clients[cfg]
+	c.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	client, err := newS3Client(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.clients[cfg] = client
+	c.mu.Unlock()
+	return client, nil
+}
+
+// newS3Client creates an S3 client with static credentials and path-style addressing
+func newS3Client(ctx context.Context, c s3ClientConfig) (*s3.Client, error) {
+	region := c.Region
+	if region == "" {
+		region = "auto"
+	}
+
+	// Create custom endpoint resolver for S3-compatible services
+	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		return aws.Endpoint{
+			URL:               c.Endpoint,
+			SigningRegion:     region,
+			HostnameImmutable: true,
+		}, nil
+	})
+
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(region),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			c.AccessKey,
+			c.SecretKey,
+			"",
+		)),
+		config.WithEndpointResolverWithOptions(customResolver),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = true // Required for some S3-compatible services
+	})
+
+	return client, nil
+}
+
+// Test records the result of a connection test of a storage
+func (c *StorageConfigs) Test(ctx context.Context, target string, storage LFSStorage) *StorageTestResult {
+	started := time.Now()
+	err := testStorageRoundTrip(ctx, storage)
+	result := &StorageTestResult{
+		Target:   target,
+		OK:       err == nil,
+		Tested:   started,
+		Duration: time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+		log.Printf("Storage connection test of %s failed: %v", target, err)
+	}
+
+	c.mu.Lock()
+	c.tests[target] = result
+	c.mu.Unlock()
+	return result
+}
+
+// LastTest returns the result of the last connection test of a storage, or nil
+func (c *StorageConfigs) LastTest(target string) *StorageTestResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tests[target]
+}
+
+// testStorageRoundTrip stores a small object, checks its size and deletes it again
+func testStorageRoundTrip(ctx context.Context, storage LFSStorage) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTestTimeout)
+	defer cancel()
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	key := ".gitraf-test/" + hex.EncodeToString(id)
+	body := "gitraf-server connection test\n"
+
+	if err := storage.Put(ctx, key, strings.NewReader(body), int64(len(body))); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	size, err := storage.Size(ctx, key)
+	if err != nil {
+		storage.Delete(ctx, key)
+		return fmt.Errorf("head: %w", err)
+	}
+	if size != int64(len(body)) {
+		storage.Delete(ctx, key)
+		return fmt.Errorf("head: size is %d bytes, expected %d", size, len(body))
+	}
+	if err := storage.Delete(ctx, key); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	if _, err := storage.Size(ctx, key); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("delete: object still exists (%v)", err)
+	}
+	return nil
+}
+
+// decodeConfig converts a config as it's saved to its typed form
+func decodeConfig[T any](m map[string]interface{}) (*T, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	value := new(T)
+	return value, json.Unmarshal(data, value)
+}
+
+// handleStorageTest tests the LFS or backup storage described by the submitted form without
+// saving it, and returns the result as JSON (tailnet only)
+func (s *Server) handleStorageTest(w http.ResponseWriter, r *http.Request) {
+	if !s.isTailnetRequest(r) {
+		http.Error(w, "Access denied - Tailnet required", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	var storage LFSStorage
+	var err error
+	target := r.FormValue("target")
+	dataDir := filepath.Dir(s.reposPath)
+	switch target {
+	case "lfs":
+		var form map[string]interface{}
+		var lfsCfg *LFSConfig
+		if form, err = parseLFSConfigForm(r, filepath.Join(dataDir, "lfs-config.json")); err == nil {
+			if lfsCfg, err = decodeConfig[LFSConfig](form); err == nil {
+				if err = lfsCfg.decryptSecrets(); err == nil {
+					storage, err = openLFSStorage(r.Context(), lfsCfg, dataDir)
+				}
+			}
+		}
+	case "backup":
+		var backupCfg *BackupConfig
+		if backupCfg, err = decodeConfig[BackupConfig](parseBackupConfigForm(r, filepath.Join(dataDir, "backup-config.json"))); err == nil {
+			if err = backupCfg.decryptSecrets(); err == nil {
+				storage, err = openBackupStorage(r.Context(), backupCfg)
+			}
+		}
+	default:
+		http.Error(w, "Unknown storage", http.StatusBadRequest)
+		return
+	}
+
+	result := &StorageTestResult{Target: target, Tested: time.Now(), Error: fmt.Sprint(err)}
+	if err == nil {
+		result = storageConfigs.Test(r.Context(), target, storage)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
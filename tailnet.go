@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"net"
+	"net/http"
 	"strings"
 )
 
@@ -28,6 +30,12 @@ func IsTailnetIP(ipStr string) bool {
 	return ip4[0] == 100 && ip4[1] >= 64 && ip4[1] <= 127
 }
 
+// IsLoopbackIP checks if the given IP address is a loopback address, e.g. a git hook on this host
+func IsLoopbackIP(ipStr string) bool {
+	ip := net.ParseIP(cleanIPString(ipStr))
+	return ip != nil && ip.IsLoopback()
+}
+
 // cleanIPString extracts the IP address from various formats
 func cleanIPString(ipStr string) string {
 	// Remove port if present (handle both IPv4 "ip:port" and IPv6 "[ip]:port")
@@ -71,3 +79,22 @@ func GetClientIP(remoteAddr string, xForwardedFor string, xRealIP string) string
 	// Fall back to RemoteAddr
 	return cleanIPString(remoteAddr)
 }
+
+// peerAddrKey is the request context key of the address of the connecting peer
+type peerAddrKey struct{}
+
+// PeerAddrMiddleware remembers the address of the connecting peer, before middleware.RealIP
+// replaces RemoteAddr with the client address proxies pass along
+func PeerAddrMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerAddrKey{}, r.RemoteAddr)))
+	})
+}
+
+// peerAddr returns the address of the connecting peer, which clients can't spoof
+func peerAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(peerAddrKey{}).(string); ok {
+		return addr
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+)
+
+const (
+	// topicConfigSection holds the topics of a repository in its git config, one topic option
+	// each
+	topicConfigSection = "gitraf"
+
+	// maxRepoTopics is how many topics a repository can have
+	maxRepoTopics = 20
+)
+
+// repoTopic is what topics may look like: lowercase letters, digits and inner hyphens
+var repoTopic = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,34}$`)
+
+// ReadRepoTopics returns the topics of a repository, none if its config can't be read
+func ReadRepoTopics(repoPath string) []string {
+	f, err := os.Open(filepath.Join(repoPath, "config"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	cfg, err := config.ReadConfig(f)
+	if err != nil {
+		return nil
+	}
+	return cfg.Raw.Section(topicConfigSection).Options.GetAll("topic")
+}
+
+// setRepoTopics replaces the topics of a repository in its git config
+func setRepoTopics(repoPath string, topics []string) error {
+	r, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return err
+	}
+	cfg, err := r.Config()
+	if err != nil {
+		return err
+	}
+	section := cfg.Raw.Section(topicConfigSection)
+	section.RemoveOption("topic")
+	for _, topic := range topics {
+		section.AddOption("topic", topic)
+	}
+	if len(section.Options) == 0 && len(section.Subsections) == 0 {
+		cfg.Raw.RemoveSection(topicConfigSection)
+	}
+	return r.Storer.SetConfig(cfg)
+}
+
+// parseRepoTopics parses a comma or whitespace separated list of topics, lowercased
+func parseRepoTopics(s string) ([]string, error) {
+	var topics []string
+	for _, topic := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if !repoTopic.MatchString(topic) {
+			return nil, fmt.Errorf("invalid topic %q, use up to 35 lowercase letters, digits and hyphens", topic)
+		}
+		if !slices.Contains(topics, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	if len(topics) > maxRepoTopics {
+		return nil, fmt.Errorf("a repository can have at most %d topics", maxRepoTopics)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// filterReposByTopic returns the repositories with a topic, all of them without one
+func filterReposByTopic(repos []Repo, topic string) []Repo {
+	if topic == "" {
+		return repos
+	}
+	var filtered []Repo
+	for _, repo := range repos {
+		if slices.Contains(repo.Topics, topic) {
+			filtered = append(filtered, repo)
+		}
+	}
+	return filtered
+}
+
+// repoTopicCounts returns the topics of repositories, most used first
+func repoTopicCounts(repos []Repo) []map[string]interface{} {
+	counts := make(map[string]int)
+	for _, repo := range repos {
+		for _, topic := range repo.Topics {
+			counts[topic]++
+		}
+	}
+	var topics []map[string]interface{}
+	for topic, count := range counts {
+		topics = append(topics, map[string]interface{}{"Name": topic, "Count": count})
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		a, b := topics[i]["Count"].(int), topics[j]["Count"].(int)
+		if a != b {
+			return a > b
+		}
+		return topics[i]["Name"].(string) < topics[j]["Name"].(string)
+	})
+	return topics
+}
+
+// APIRepo is a repository as listed by the API
+type APIRepo struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Public      bool      `json:"public"`
+	Topics      []string  `json:"topics"`
+	Template    bool      `json:"template"`
+	Archived    bool      `json:"archived"`
+	MirrorURL   string    `json:"mirror_url,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+// handleAPIRepos lists the repositories the request can see, optionally only those with a
+// topic. Archived repositories are left out unless ?archived=1.
+func (s *Server) handleAPIRepos(w http.ResponseWriter, r *http.Request) {
+	repos, err := ListRepos(s.reposPath, s.isTailnetRequest(r))
+	if err != nil {
+		log.Printf("Error listing repos: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Error listing repositories"})
+		return
+	}
+
+	list := []APIRepo{}
+	repos = filterArchivedRepos(repos, showArchived(r))
+	for _, repo := range filterReposByTopic(repos, strings.ToLower(r.URL.Query().Get("topic"))) {
+		topics := repo.Topics
+		if topics == nil {
+			topics = []string{}
+		}
+		list = append(list, APIRepo{
+			Name:        repo.Name,
+			Description: repo.Description,
+			Public:      repo.IsPublic,
+			Topics:      topics,
+			Template:    repo.IsTemplate,
+			Archived:    repo.IsArchived,
+			MirrorURL:   repo.MirrorURL,
+			Updated:     repo.LastCommit,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"repos": list,
+		"count": len(list),
+	})
+}